@@ -0,0 +1,80 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+    "sort"
+    "strings"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+// Logged in stratum sessions of one mining software and protocol dialect
+type clientCount struct {
+    Agent          string   `json:"agent"`
+    Dialect        string   `json:"dialect"`
+    Sessions       int64    `json:"sessions"`
+}
+
+// Sessions of all stratum nodes by mining software and protocol dialect, HTTP getwork miners are not counted
+type clientStats struct {
+    Total          int64            `json:"total"`
+    Agents         map[string]int64 `json:"agents"`
+    Dialects       map[string]int64 `json:"dialects"`
+    // Most used first
+    Clients        []clientCount    `json:"clients"`
+}
+
+func (s *ApiServer) collectClientStats(nodes []map[string]interface{}) *clientStats {
+    ids := make([]string, 0, len(nodes))
+    for _, node := range nodes {
+        if name, ok := node["name"].(string); ok {
+            ids = append(ids, name)
+        }
+    }
+    counts, err := s.replica.GetClientStats(ids)
+    if err != nil {
+        log.Errorf("Failed to get client stats from backend: %v", err)
+        return nil
+    }
+    result := &clientStats{Agents: make(map[string]int64), Dialects: make(map[string]int64)}
+    for field, n := range counts {
+        parts := strings.SplitN(field, ":", 2)
+        if len(parts) != 2 || n <= 0 {
+            continue
+        }
+        result.Clients = append(result.Clients, clientCount{Agent: parts[1], Dialect: parts[0], Sessions: n})
+        result.Agents[parts[1]] += n
+        result.Dialects[parts[0]] += n
+        result.Total += n
+    }
+    sort.Slice(result.Clients, func(i, j int) bool {
+        a, b := result.Clients[i], result.Clients[j]
+        if a.Sessions != b.Sessions {
+            return a.Sessions > b.Sessions
+        }
+        if a.Agent != b.Agent {
+            return a.Agent < b.Agent
+        }
+        return a.Dialect < b.Dialect
+    })
+    return result
+}
+
+func (s *ApiServer) ClientsIndex(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.WriteHeader(http.StatusOK)
+
+    reply := make(map[string]interface{})
+    stats := s.getStats()
+    if stats != nil {
+        reply["now"] = util.MakeTimestamp()
+        reply["clients"] = stats["clients"]
+    }
+
+    err := json.NewEncoder(w).Encode(reply)
+    if err != nil {
+        log.Error("Error serializing API response: ", err)
+    }
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "time"
+
+    "github.com/gorilla/mux"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+type ClosuresConfig struct {
+    Enabled        bool     `json:"enabled"`
+    // Account data is deleted this long after final payout
+    Retention      string   `json:"retention"`
+}
+
+// Message is signed with the key of login address
+type ClosureRequest struct {
+    Timestamp      int64    `json:"timestamp"`
+    Signature      string   `json:"signature"`
+}
+
+func closureMessage(login string, ts int64) string {
+    return fmt.Sprintf("%s close account at %d", login, ts)
+}
+
+func (s *ApiServer) startClosures() {
+    cfg := &s.config.Closures
+    s.closuresRetention = util.MustParseDuration(cfg.Retention)
+    log.Infof("Account closures enabled, data retention after final payout: %v", s.closuresRetention)
+}
+
+func (s *ApiServer) AccountClosureIndex(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+    w.Header().Set("Cache-Control", "no-cache")
+
+    login := mux.Vars(r)["login"]
+    if r.Method == "POST" {
+        s.requestClosure(w, r, login)
+        return
+    }
+    c, err := s.replica.GetClosure(login)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to fetch account closure from backend: %v", err)
+        return
+    }
+    if c == nil {
+        w.WriteHeader(http.StatusNotFound)
+        return
+    }
+    reply := map[string]interface{}{"closure": c}
+    if c.State == "paid" {
+        reply["deleteAt"] = c.PaidAt + int64(s.closuresRetention/time.Second)
+    }
+    w.WriteHeader(http.StatusOK)
+    err = json.NewEncoder(w).Encode(reply)
+    if err != nil {
+        log.Error("Error serializing API response: ", err)
+    }
+}
+
+func (s *ApiServer) requestClosure(w http.ResponseWriter, r *http.Request, login string) {
+    var req ClosureRequest
+    if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+        s.writeError(w, http.StatusBadRequest, "Malformed request")
+        return
+    }
+    exist, err := s.backend.IsMinerExists(login)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to fetch stats from backend: %v", err)
+        return
+    }
+    if !exist {
+        w.WriteHeader(http.StatusNotFound)
+        return
+    }
+
+    if !s.verifySignedRequest(w, login, closureMessage(login, req.Timestamp), req.Timestamp, req.Signature) {
+        return
+    }
+
+    ok, err := s.backend.RequestClosure(login, req.Timestamp)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to write account closure to backend: %v", err)
+        return
+    }
+    if !ok {
+        s.writeError(w, http.StatusConflict, "Account closure is already in progress or request was used before")
+        return
+    }
+    log.Infof("Account closure requested by %v", login)
+
+    w.WriteHeader(http.StatusOK)
+    err = json.NewEncoder(w).Encode(map[string]interface{}{"state": "pending"})
+    if err != nil {
+        log.Error("Error serializing API response: ", err)
+    }
+}
+
+// Deletes data of accounts paid out longer than retention ago
+func (s *ApiServer) purgeClosedAccounts() {
+    closures, err := s.backend.GetClosures("paid")
+    if err != nil {
+        log.Error("Failed to fetch account closures from backend:", err)
+        return
+    }
+    now := util.MakeTimestamp() / 1000
+    retention := int64(s.closuresRetention / time.Second)
+    for _, c := range closures {
+        if c.PaidAt+retention > now {
+            continue
+        }
+        // Credits and shares of ledger kept in Postgres are not watched by deletion
+        balance, locked, err := s.ledger.GetClosingBalance(c.Login)
+        if err != nil {
+            log.Errorf("Failed to get closing balance of %v: %v", c.Login, err)
+            continue
+        }
+        unpaid, err := s.ledger.HasRoundShares(c.Login)
+        if err != nil {
+            log.Errorf("Failed to check round shares of %v: %v", c.Login, err)
+            continue
+        }
+        if balance <= c.Dust && locked == 0 && !unpaid {
+            err = s.backend.DeleteMinerData(c, now)
+        } else {
+            err = storage.ErrClosureUnsettled
+        }
+        if err == storage.ErrClosureUnsettled {
+            log.Warnf("Closed account %v got shares or credits since final payout, waiting for payout again", c.Login)
+            if err := s.backend.ReopenClosure(c); err != nil {
+                log.Errorf("Failed to reopen closure of %v: %v", c.Login, err)
+            }
+            continue
+        }
+        if err != nil {
+            log.Errorf("Failed to delete data of closed account %v: %v", c.Login, err)
+            continue
+        }
+        s.minersMu.Lock()
+        delete(s.miners, c.Login)
+        s.minersMu.Unlock()
+        log.Infof("Deleted data of closed account %v", c.Login)
+    }
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+
+    "github.com/gorilla/mux"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+type HistoryConfig struct {
+    Enabled          bool     `json:"enabled"`
+    // Hashrate is sampled this often, also the finest resolution served
+    Interval         string   `json:"interval"`
+    // Raw samples are kept this long, then averaged into hourly rollups
+    Retention        string   `json:"retention"`
+    RollupRetention  string   `json:"rollupRetention"`
+    // Upper bound of buckets in one reply
+    MaxPoints        int64    `json:"maxPoints"`
+}
+
+func (s *ApiServer) startHistory() {
+    cfg := &s.config.History
+    s.historyIntv = util.MustParseDuration(cfg.Interval)
+    s.historyRetention = util.MustParseDuration(cfg.Retention)
+    s.historyRollupRetention = util.MustParseDuration(cfg.RollupRetention)
+    if s.historyRetention < time.Hour || s.historyRollupRetention < s.historyRetention {
+        log.Fatalf("History retention must be at least 1h and not longer than rollupRetention")
+    }
+    if cfg.MaxPoints <= 0 {
+        cfg.MaxPoints = 1000
+    }
+    log.Infof("Hashrate history enabled, sampling every %v, raw kept for %v, rollups for %v",
+        s.historyIntv, s.historyRetention, s.historyRollupRetention)
+}
+
+// Writes samples from freshly collected stats once per history interval
+func (s *ApiServer) sampleHistory(stats map[string]interface{}) {
+    now := util.MakeTimestamp() / 1000
+    intv := int64(s.historyIntv / time.Second)
+    ts := now / intv * intv
+    if ts <= s.lastSample {
+        return
+    }
+    err := s.backend.WriteHashrateSamples(ts, stats["hashrate"].(int64), stats["miners"].(map[string]storage.Miner))
+    if err != nil {
+        log.Errorf("Failed to write hashrate samples to backend: %v", err)
+        return
+    }
+    s.lastSample = ts
+}
+
+func (s *ApiServer) compactHistory() {
+    start := time.Now()
+    total, err := s.backend.CompactHashrateHistory(s.historyRetention, s.historyRollupRetention)
+    if err != nil {
+        log.Error("Failed to compact hashrate history in backend:", err)
+    } else {
+        log.Infof("Compacted hashrate history, %v samples rolled up, elapsed time %v", total, time.Since(start))
+    }
+}
+
+func (s *ApiServer) HistoryIndex(w http.ResponseWriter, r *http.Request) {
+    s.writeHistory(w, r, "")
+}
+
+func (s *ApiServer) AccountHistoryIndex(w http.ResponseWriter, r *http.Request) {
+    s.writeHistory(w, r, mux.Vars(r)["login"])
+}
+
+// Serves ?window=24h&resolution=10m as bucket averages, empty buckets are omitted
+func (s *ApiServer) writeHistory(w http.ResponseWriter, r *http.Request, login string) {
+    w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+    w.Header().Set("Cache-Control", "no-cache")
+
+    window, err := time.ParseDuration(r.URL.Query().Get("window"))
+    if err != nil || window <= 0 || window > s.historyRollupRetention {
+        s.writeError(w, http.StatusBadRequest, "Window must be within retention")
+        return
+    }
+    resolution, err := time.ParseDuration(r.URL.Query().Get("resolution"))
+    if err != nil || resolution < s.historyIntv {
+        s.writeError(w, http.StatusBadRequest, "Resolution must not be finer than "+s.historyIntv.String())
+        return
+    }
+    if int64(window/resolution) > s.config.History.MaxPoints {
+        s.writeError(w, http.StatusBadRequest, "Too many points requested")
+        return
+    }
+
+    res := int64(resolution / time.Second)
+    from := (util.MakeTimestamp()/1000 - int64(window/time.Second)) / res * res
+    samples, err := s.replica.GetHashrateSamples(login, from)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to fetch hashrate history from backend: %v", err)
+        return
+    }
+
+    buckets := []storage.HashrateSample{}
+    var sum, count int64
+    for i, sample := range samples {
+        sum += sample.Hashrate
+        count++
+        bucket := sample.Timestamp / res * res
+        if i == len(samples)-1 || samples[i+1].Timestamp/res*res != bucket {
+            buckets = append(buckets, storage.HashrateSample{Timestamp: bucket, Hashrate: sum / count})
+            sum, count = 0, 0
+        }
+    }
+
+    w.WriteHeader(http.StatusOK)
+    err = json.NewEncoder(w).Encode(map[string]interface{}{
+        "window":     window.String(),
+        "resolution": resolution.String(),
+        "samples":    buckets,
+    })
+    if err != nil {
+        log.Error("Error serializing API response: ", err)
+    }
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+
+    "github.com/gorilla/mux"
+)
+
+type HoldRequest struct {
+    Reason         string   `json:"reason"`
+}
+
+func (s *ApiServer) HoldsIndex(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+    holds, err := s.ledger.GetHolds("")
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to fetch holds from backend: %v", err)
+        return
+    }
+
+    w.WriteHeader(http.StatusOK)
+    err = json.NewEncoder(w).Encode(map[string]interface{}{"holds": holds})
+    if err != nil {
+        log.Error("Error serializing API response: ", err)
+    }
+}
+
+func (s *ApiServer) HoldIndex(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+    height, _ := strconv.ParseInt(mux.Vars(r)["height"], 10, 64)
+    hash := mux.Vars(r)["hash"]
+
+    var ok bool
+    var err error
+    if r.Method == "DELETE" {
+        ok, err = s.ledger.ReleaseHold(height, hash)
+    } else {
+        var req HoldRequest
+        json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req)
+        ok, err = s.ledger.HoldBlock(height, hash, req.Reason)
+    }
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to update hold of block %v:%v: %v", height, hash, err)
+        return
+    }
+    if !ok {
+        // Not matured, outside of dispute window or already in requested state
+        w.WriteHeader(http.StatusConflict)
+        return
+    }
+    if r.Method == "DELETE" {
+        log.Infof("Released hold of block %v:%v", height, hash)
+    } else {
+        log.Infof("Held block %v:%v", height, hash)
+    }
+
+    // Affected accounts must show new state at once
+    s.minersMu.Lock()
+    s.miners = make(map[string]*Entry)
+    s.minersMu.Unlock()
+
+    w.WriteHeader(http.StatusOK)
+    err = json.NewEncoder(w).Encode(map[string]interface{}{"height": height, "hash": hash, "held": r.Method != "DELETE"})
+    if err != nil {
+        log.Error("Error serializing API response: ", err)
+    }
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+    "compress/gzip"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+)
+
+type CorsConfig struct {
+    // Allowed origins, "*" or empty allows any
+    Origins        []string `json:"origins"`
+    // Request headers allowed in preflight, Content-Type and Authorization when empty
+    Headers        []string `json:"headers"`
+    // Seconds browsers may cache preflight response
+    MaxAge         int      `json:"maxAge"`
+}
+
+// Sets CORS headers on every response and answers preflight requests
+func (s *ApiServer) withCors(next http.Handler) http.Handler {
+    cfg := s.config.Cors
+    anyOrigin := len(cfg.Origins) == 0
+    origins := make(map[string]bool)
+    for _, origin := range cfg.Origins {
+        if origin == "*" {
+            anyOrigin = true
+        }
+        origins[origin] = true
+    }
+    headers := "Content-Type, Authorization"
+    if len(cfg.Headers) > 0 {
+        headers = strings.Join(cfg.Headers, ", ")
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        origin := r.Header.Get("Origin")
+        if anyOrigin {
+            w.Header().Set("Access-Control-Allow-Origin", "*")
+        } else {
+            w.Header().Add("Vary", "Origin")
+            if origins[origin] {
+                w.Header().Set("Access-Control-Allow-Origin", origin)
+            }
+        }
+        if r.Method == "OPTIONS" && len(r.Header.Get("Access-Control-Request-Method")) > 0 {
+            w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+            w.Header().Set("Access-Control-Allow-Headers", headers)
+            if cfg.MaxAge > 0 {
+                w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cfg.MaxAge))
+            }
+            w.WriteHeader(http.StatusNoContent)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// Compresses responses for clients accepting gzip, share dumps are gzipped already
+func withGzip(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Add("Vary", "Accept-Encoding")
+        if !acceptsGzip(r) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        gw := &gzipResponseWriter{ResponseWriter: w}
+        defer gw.Close()
+        next.ServeHTTP(gw, r)
+    })
+}
+
+func acceptsGzip(r *http.Request) bool {
+    for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+        enc = strings.TrimSpace(enc)
+        if enc == "gzip" || strings.HasPrefix(enc, "gzip;") && !strings.HasSuffix(enc, "q=0") {
+            return true
+        }
+    }
+    return false
+}
+
+// Decides on compression when headers are written
+type gzipResponseWriter struct {
+    http.ResponseWriter
+    gz             *gzip.Writer
+    wroteHeader    bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+    if w.wroteHeader {
+        return
+    }
+    w.wroteHeader = true
+    h := w.Header()
+    if status != http.StatusNoContent && status != http.StatusNotModified &&
+        h.Get("Content-Encoding") == "" && h.Get("Content-Type") != "application/gzip" {
+        h.Del("Content-Length")
+        h.Set("Content-Encoding", "gzip")
+        w.gz = gzip.NewWriter(w.ResponseWriter)
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+    if !w.wroteHeader {
+        w.WriteHeader(http.StatusOK)
+    }
+    if w.gz != nil {
+        return w.gz.Write(b)
+    }
+    return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipResponseWriter) Close() {
+    if w.gz != nil {
+        w.gz.Close()
+    }
+}
+
+// Limit and offset query parameters, limit is capped by maxPageSize which is also the default.
+// Without maxPageSize whole lists are returned unless limit is set.
+func (s *ApiServer) page(r *http.Request) (offset, limit int) {
+    offset, _ = strconv.Atoi(r.URL.Query().Get("offset"))
+    if offset < 0 {
+        offset = 0
+    }
+    limit, _ = strconv.Atoi(r.URL.Query().Get("limit"))
+    max := s.config.MaxPageSize
+    if limit <= 0 || max > 0 && limit > max {
+        limit = max
+    }
+    return
+}
+
+// Bounds of page within list of n items, limit 0 is unlimited
+func pageBounds(n, offset, limit int) (int, int) {
+    if offset > n {
+        offset = n
+    }
+    end := n
+    if limit > 0 && offset+limit < n {
+        end = offset + limit
+    }
+    return offset, end
+}
+
+// Miners ordered by hashrate, then by login, so pages are stable between requests
+func pageMiners(miners map[string]storage.Miner, offset, limit int) map[string]storage.Miner {
+    if offset == 0 && limit == 0 {
+        return miners
+    }
+    logins := make([]string, 0, len(miners))
+    for login := range miners {
+        logins = append(logins, login)
+    }
+    sort.Slice(logins, func(i, j int) bool {
+        a, b := miners[logins[i]], miners[logins[j]]
+        if a.HR != b.HR {
+            return a.HR > b.HR
+        }
+        return logins[i] < logins[j]
+    })
+    start, end := pageBounds(len(logins), offset, limit)
+    result := make(map[string]storage.Miner, end-start)
+    for _, login := range logins[start:end] {
+        result[login] = miners[login]
+    }
+    return result
+}
+
+func pageBlocks(blocks []*storage.BlockData, offset, limit int) []*storage.BlockData {
+    start, end := pageBounds(len(blocks), offset, limit)
+    return blocks[start:end]
+}
+
+func pagePayments(payments []map[string]interface{}, offset, limit int) []map[string]interface{} {
+    start, end := pageBounds(len(payments), offset, limit)
+    return payments[start:end]
+}
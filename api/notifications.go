@@ -0,0 +1,102 @@
+package api
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+
+    "github.com/gorilla/mux"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/notify"
+)
+
+type NotificationsConfig struct {
+    Enabled        bool     `json:"enabled"`
+}
+
+// Message is signed with the key of login address, empty targets unsubscribe
+type NotificationsRequest struct {
+    Targets        map[string]string    `json:"targets"`
+    Timestamp      int64                `json:"timestamp"`
+    Signature      string               `json:"signature"`
+}
+
+// Every kind is listed in fixed order so signature covers all targets
+func notificationsMessage(login string, targets map[string]string, ts int64) string {
+    msg := login + " notifications"
+    for _, kind := range notify.Kinds {
+        msg += fmt.Sprintf(" %s:%s", kind, targets[kind])
+    }
+    return fmt.Sprintf("%s at %d", msg, ts)
+}
+
+func (s *ApiServer) startNotifications() {
+    log.Infof("Offline notifications opt-in enabled")
+}
+
+func (s *ApiServer) AccountNotificationsIndex(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+    w.Header().Set("Cache-Control", "no-cache")
+
+    login := mux.Vars(r)["login"]
+    if r.Method == "POST" {
+        s.setNotifications(w, r, login)
+        return
+    }
+    targets, err := s.replica.GetNotifications(login)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to fetch notification settings from backend: %v", err)
+        return
+    }
+    // Targets are private, only show which kinds are on
+    enabled := make(map[string]bool)
+    for _, kind := range notify.Kinds {
+        enabled[kind] = len(targets[kind]) > 0
+    }
+    w.WriteHeader(http.StatusOK)
+    err = json.NewEncoder(w).Encode(map[string]interface{}{"notifications": enabled})
+    if err != nil {
+        log.Error("Error serializing API response: ", err)
+    }
+}
+
+func (s *ApiServer) setNotifications(w http.ResponseWriter, r *http.Request, login string) {
+    var req NotificationsRequest
+    if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+        s.writeError(w, http.StatusBadRequest, "Malformed request")
+        return
+    }
+    targets := make(map[string]string)
+    for kind, target := range req.Targets {
+        if len(target) == 0 {
+            continue
+        }
+        if err := notify.ValidTarget(kind, target); err != nil {
+            s.writeError(w, http.StatusBadRequest, err.Error())
+            return
+        }
+        targets[kind] = target
+    }
+    if !s.verifySignedRequest(w, login, notificationsMessage(login, targets, req.Timestamp), req.Timestamp, req.Signature) {
+        return
+    }
+
+    ok, err := s.backend.SetNotifications(login, targets, req.Timestamp)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to write notification settings to backend: %v", err)
+        return
+    }
+    if !ok {
+        s.writeError(w, http.StatusConflict, "Newer settings are already stored")
+        return
+    }
+    log.Infof("Notification settings of %v updated, %v targets", login, len(targets))
+
+    w.WriteHeader(http.StatusOK)
+    err = json.NewEncoder(w).Encode(map[string]interface{}{"targets": len(targets)})
+    if err != nil {
+        log.Error("Error serializing API response: ", err)
+    }
+}
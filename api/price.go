@@ -0,0 +1,146 @@
+package api
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/payouts"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+const coingeckoUrl = "https://api.coingecko.com/api/v3/simple/price?ids=%s&vs_currencies=%s"
+
+type PriceConfig struct {
+    Enabled        bool     `json:"enabled"`
+    // Must return {"<coin>": {"<currency>": price}}, CoinGecko simple price when empty
+    Url            string   `json:"url"`
+    // CoinGecko coin id
+    Coin           string   `json:"coin"`
+    Currencies     []string `json:"currencies"`
+    Interval       string   `json:"interval"`
+    Timeout        string   `json:"timeout"`
+}
+
+// Last successfully fetched rates
+type priceQuote struct {
+    Rates          map[string]float64 `json:"rates"`
+    UpdatedAt      int64              `json:"updatedAt"`
+}
+
+type priceFetcher struct {
+    url            string
+    coin           string
+    client         *http.Client
+    quote          atomic.Value
+}
+
+func (s *ApiServer) startPrice() {
+    cfg := &s.config.Price
+    if len(cfg.Coin) == 0 || len(cfg.Currencies) == 0 {
+        log.Fatal("Price requires coin and currencies")
+    }
+    url := cfg.Url
+    if len(url) == 0 {
+        url = fmt.Sprintf(coingeckoUrl, cfg.Coin, strings.Join(cfg.Currencies, ","))
+    }
+    timeout := 10 * time.Second
+    if len(cfg.Timeout) > 0 {
+        timeout = util.MustParseDuration(cfg.Timeout)
+    }
+    s.price = &priceFetcher{url: url, coin: cfg.Coin, client: &http.Client{Timeout: timeout}}
+    intv := util.MustParseDuration(cfg.Interval)
+    timer := time.NewTimer(intv)
+    log.Infof("Fetching %v price every %v from %v", cfg.Coin, intv, url)
+    s.price.refresh()
+
+    go func() {
+        for {
+            select {
+            case <-timer.C:
+                s.price.refresh()
+                timer.Reset(intv)
+            }
+        }
+    }()
+}
+
+// Keeps previous quote on failure, its updatedAt tells how old it is
+func (p *priceFetcher) refresh() {
+    resp, err := p.client.Get(p.url)
+    if err != nil {
+        log.Errorf("Failed to fetch price: %v", err)
+        return
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        log.Errorf("Failed to fetch price: %v", resp.Status)
+        return
+    }
+    var reply map[string]map[string]float64
+    err = json.NewDecoder(resp.Body).Decode(&reply)
+    if err != nil {
+        log.Errorf("Failed to parse price: %v", err)
+        return
+    }
+    rates, ok := reply[p.coin]
+    if !ok || len(rates) == 0 {
+        log.Errorf("No %v price in reply", p.coin)
+        return
+    }
+    p.quote.Store(&priceQuote{Rates: rates, UpdatedAt: util.MakeTimestamp()})
+}
+
+func (p *priceFetcher) current() *priceQuote {
+    if p == nil {
+        return nil
+    }
+    q := p.quote.Load()
+    if q == nil {
+        return nil
+    }
+    return q.(*priceQuote)
+}
+
+// Estimated earnings in Satoshi and in every quoted currency
+type earnings struct {
+    // Satoshi
+    Amount         int64              `json:"amount"`
+    Fiat           map[string]float64 `json:"fiat,omitempty"`
+}
+
+// Expected daily reward for hashrate at current network difficulty, static reward of
+// unlocker rewardSchedule and poolFee. Transaction fees and luck are not included.
+func (s *ApiServer) estimateDaily(hashrate int64, network map[string]int64) *earnings {
+    if network == nil || network["difficulty"] <= 0 {
+        return nil
+    }
+    reward := payouts.StaticReward(s.config.RewardSchedule, uint64(network["height"]))
+    // Blocks found per day at this hashrate
+    blocks := float64(hashrate) * 86400 / float64(network["difficulty"])
+    coins := blocks * float64(reward) * (1 - s.config.PoolFee/100)
+
+    result := &earnings{Amount: int64(coins)}
+    if q := s.price.current(); q != nil {
+        result.Fiat = make(map[string]float64, len(q.Rates))
+        for currency, rate := range q.Rates {
+            result.Fiat[currency] = coins / 1e8 * rate
+        }
+    }
+    return result
+}
+
+// Height and difficulty of the best stratum node
+func bestNetwork(nodes []map[string]interface{}) map[string]int64 {
+    var best map[string]int64
+    for _, node := range nodes {
+        height := parseNodeInt(node["height"])
+        if best == nil || height > best["height"] {
+            best = map[string]int64{"height": height, "difficulty": parseNodeInt(node["difficulty"])}
+        }
+    }
+    return best
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+    "crypto/ed25519"
+    "encoding/hex"
+    "encoding/json"
+    "net/http"
+    "time"
+
+    "github.com/gorilla/mux"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+type ProofsConfig struct {
+    Enabled        bool     `json:"enabled"`
+    Pool           string   `json:"pool"`
+    Interval       string   `json:"interval"`
+    // Number of snapshots kept per account
+    Keep           int64    `json:"keep"`
+    // Hex encoded ed25519 seed
+    PrivateKey     string   `json:"privateKey"`
+}
+
+// Statement of work delivered by a login to the pool within [From, To]
+type HashrateProof struct {
+    Pool           string   `json:"pool"`
+    Login          string   `json:"login"`
+    From           int64    `json:"from"`
+    To             int64    `json:"to"`
+    Hashrate       int64    `json:"hashrate"`
+    Shares         int64    `json:"shares"`
+    Difficulty     int64    `json:"difficulty"`
+}
+
+// Signature covers the exact bytes of Proof
+type SignedProof struct {
+    Proof          json.RawMessage   `json:"proof"`
+    Algorithm      string            `json:"algorithm"`
+    PublicKey      string            `json:"publicKey"`
+    Signature      string            `json:"signature"`
+}
+
+type proofSigner struct {
+    key            ed25519.PrivateKey
+    publicKey      string
+    interval       time.Duration
+}
+
+func newProofSigner(cfg *ProofsConfig) *proofSigner {
+    seed, err := hex.DecodeString(cfg.PrivateKey)
+    if err != nil || len(seed) != ed25519.SeedSize {
+        log.Fatalf("Invalid proofs privateKey, must be %v hex encoded bytes", ed25519.SeedSize)
+    }
+    if cfg.Keep <= 0 {
+        log.Fatalf("Proofs keep must be > 0, your value is %v", cfg.Keep)
+    }
+    key := ed25519.NewKeyFromSeed(seed)
+    publicKey := key.Public().(ed25519.PublicKey)
+    return &proofSigner{
+        key:       key,
+        publicKey: hex.EncodeToString(publicKey),
+        interval:  util.MustParseDuration(cfg.Interval),
+    }
+}
+
+func (p *proofSigner) sign(proof *HashrateProof) (*SignedProof, error) {
+    data, err := json.Marshal(proof)
+    if err != nil {
+        return nil, err
+    }
+    signature := ed25519.Sign(p.key, data)
+    return &SignedProof{
+        Proof:     data,
+        Algorithm: "ed25519",
+        PublicKey: p.publicKey,
+        Signature: hex.EncodeToString(signature),
+    }, nil
+}
+
+func (s *ApiServer) startProofs() {
+    s.proofs = newProofSigner(&s.config.Proofs)
+    timer := time.NewTimer(s.proofs.interval)
+    log.Infof("Set hashrate proofs interval to %v", s.proofs.interval)
+
+    go func() {
+        for {
+            select {
+            case <-timer.C:
+                s.writeProofs()
+                timer.Reset(s.proofs.interval)
+            }
+        }
+    }()
+}
+
+func (s *ApiServer) writeProofs() {
+    stats := s.getStats()
+    if stats == nil {
+        return
+    }
+    miners, ok := stats["miners"].(map[string]storage.Miner)
+    if !ok {
+        return
+    }
+    start := time.Now()
+    to := util.MakeTimestamp() / 1000
+    from := to - int64(s.proofs.interval/time.Second)
+    expire := s.proofs.interval * time.Duration(s.config.Proofs.Keep)
+    total := 0
+
+    for login, _ := range miners {
+        shares, diff, err := s.backend.GetMinerShares(login, from, to)
+        if err != nil {
+            log.Errorf("Failed to fetch shares of %v from backend: %v", login, err)
+            return
+        }
+        if shares == 0 {
+            continue
+        }
+        proof := &HashrateProof{
+            Pool:       s.config.Proofs.Pool,
+            Login:      login,
+            From:       from,
+            To:         to,
+            Hashrate:   diff / (to - from),
+            Shares:     shares,
+            Difficulty: diff,
+        }
+        signed, err := s.proofs.sign(proof)
+        if err != nil {
+            log.Errorf("Failed to sign hashrate proof for %v: %v", login, err)
+            continue
+        }
+        data, _ := json.Marshal(signed)
+        err = s.backend.WriteHashrateProof(login, to, string(data), s.config.Proofs.Keep, expire)
+        if err != nil {
+            log.Errorf("Failed to write hashrate proof to backend: %v", err)
+            return
+        }
+        total++
+    }
+    log.Infof("Signed %v hashrate proofs in %s", total, time.Since(start))
+}
+
+func (s *ApiServer) ProofsIndex(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.WriteHeader(http.StatusOK)
+
+    reply := map[string]interface{}{
+        "pool":      s.config.Proofs.Pool,
+        "algorithm": "ed25519",
+        "publicKey": s.proofs.publicKey,
+        "interval":  int64(s.proofs.interval / time.Second),
+    }
+    err := json.NewEncoder(w).Encode(reply)
+    if err != nil {
+        log.Error("Error serializing API response: ", err)
+    }
+}
+
+func (s *ApiServer) AccountProofsIndex(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+    w.Header().Set("Cache-Control", "no-cache")
+
+    login := mux.Vars(r)["login"]
+    rows, err := s.replica.GetHashrateProofs(login, s.config.Proofs.Keep)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to fetch hashrate proofs from backend: %v", err)
+        return
+    }
+    proofs := make([]json.RawMessage, len(rows))
+    for i, row := range rows {
+        proofs[i] = json.RawMessage(row)
+    }
+
+    w.WriteHeader(http.StatusOK)
+    err = json.NewEncoder(w).Encode(map[string]interface{}{"proofs": proofs})
+    if err != nil {
+        log.Error("Error serializing API response: ", err)
+    }
+}
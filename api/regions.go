@@ -0,0 +1,47 @@
+package api
+
+import (
+    "strconv"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+// Connections and hashrate of live stratum nodes by region, nodes outside cluster mode count as "default"
+func (s *ApiServer) regionStats(nodes []map[string]interface{}) map[string]map[string]int64 {
+    timeout := 5 * time.Minute
+    if len(s.config.NodeTimeout) > 0 {
+        timeout = util.MustParseDuration(s.config.NodeTimeout)
+    }
+    now := util.MakeTimestamp() / 1000
+    regions := make(map[string]map[string]int64)
+    for _, node := range nodes {
+        lastBeat := parseNodeInt(node["lastBeat"])
+        if now-lastBeat > int64(timeout/time.Second) {
+            continue
+        }
+        name, _ := node["region"].(string)
+        if len(name) == 0 {
+            name = "default"
+        }
+        region, ok := regions[name]
+        if !ok {
+            region = map[string]int64{"nodes": 0, "miners": 0, "hashrate": 0}
+            regions[name] = region
+        }
+        region["nodes"]++
+        region["hashrate"] += parseNodeInt(node["hashrate"])
+        stratums, _ := node["stratums"].([]map[string]interface{})
+        for _, st := range stratums {
+            region["miners"] += parseNodeInt(st["minerCount"])
+        }
+    }
+    return regions
+}
+
+// Node states are read from Redis hashes as strings
+func parseNodeInt(v interface{}) int64 {
+    str, _ := v.(string)
+    n, _ := strconv.ParseInt(str, 10, 64)
+    return n
+}
@@ -2,19 +2,25 @@ package api
 
 import (
     "encoding/json"
-    "log"
+    "fmt"
     "net/http"
     "sort"
+    "strconv"
     "sync"
     "sync/atomic"
     "time"
 
     "github.com/gorilla/mux"
 
+    "github.com/NotoriousPyro/open-metaverse-pool/logging"
+    "github.com/NotoriousPyro/open-metaverse-pool/payouts"
+    "github.com/NotoriousPyro/open-metaverse-pool/rpc"
     "github.com/NotoriousPyro/open-metaverse-pool/storage"
     "github.com/NotoriousPyro/open-metaverse-pool/util"
 )
 
+var log = logging.New("api")
+
 type ApiConfig struct {
     Enabled                bool     `json:"enabled"`
     Listen                 string   `json:"listen"`
@@ -26,17 +32,59 @@ type ApiConfig struct {
     Blocks                 int64    `json:"blocks"`
     PurgeOnly              bool     `json:"purgeOnly"`
     PurgeInterval          string   `json:"purgeInterval"`
+    // Optional read-only replica for stats queries
+    Replica                storage.Config   `json:"replica"`
+    Proofs                 ProofsConfig     `json:"proofs"`
+    // Link matured blocks to share dumps exported by unlocker
+    ShareDumps             bool     `json:"shareDumps"`
+    // Node and max age of requests signed by miners
+    SignedRequests         SignedRequestsConfig `json:"signedRequests"`
+    // Personal payout thresholds set by signed requests
+    Thresholds             ThresholdsConfig `json:"thresholds"`
+    // Enables admin endpoints, sent as bearer token
+    AdminToken             string   `json:"adminToken"`
+    // Hashrate time series for charts
+    History                HistoryConfig    `json:"history"`
+    // Account closures requested by signed requests
+    Closures               ClosuresConfig   `json:"closures"`
+    // Offline notification targets set by signed requests
+    Notifications          NotificationsConfig  `json:"notifications"`
+    // Stratum nodes silent for longer are left out of regions breakdown, 5m when empty
+    NodeTimeout            string   `json:"nodeTimeout"`
+    // Cross-origin access for public frontends
+    Cors                   CorsConfig       `json:"cors"`
+    // Compress responses for clients accepting gzip
+    Gzip                   bool     `json:"gzip"`
+    // Largest page of miners, blocks and payments, unlimited when 0
+    MaxPageSize            int      `json:"maxPageSize"`
+    // Exchange rates for fiat value of estimated earnings
+    Price                  PriceConfig      `json:"price"`
+    // Copied from unlocker config, estimated earnings follow its reward math
+    PoolFee                float64              `json:"-"`
+    RewardSchedule         []payouts.RewardEra  `json:"-"`
 }
 
 type ApiServer struct {
     config                 *ApiConfig
     backend                *storage.RedisClient
+    replica                *storage.RedisClient
+    ledger                 storage.Ledger
+    ledgerReplica          storage.Ledger
     hashrateWindow         time.Duration
     hashrateLargeWindow    time.Duration
     stats                  atomic.Value
     miners                 map[string]*Entry
     minersMu               sync.RWMutex
     statsIntv              time.Duration
+    proofs                 *proofSigner
+    signedRpc              *rpc.RPCClient
+    signedMaxAge           time.Duration
+    historyIntv            time.Duration
+    historyRetention       time.Duration
+    historyRollupRetention time.Duration
+    lastSample             int64
+    closuresRetention      time.Duration
+    price                  *priceFetcher
 }
 
 type Entry struct {
@@ -44,12 +92,25 @@ type Entry struct {
     updatedAt     int64
 }
 
-func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
+func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient, ledger storage.Ledger) *ApiServer {
     hashrateWindow := util.MustParseDuration(cfg.HashrateWindow)
     hashrateLargeWindow := util.MustParseDuration(cfg.HashrateLargeWindow)
+    replica := backend
+    if len(cfg.Replica.Endpoint) > 0 {
+        replica = backend.NewReplicaClient(&cfg.Replica)
+        log.Infof("Using read replica %v for API queries", cfg.Replica.Endpoint)
+    }
+    // Replica serves ledger reads only if ledger is kept in Redis
+    ledgerReplica := ledger
+    if ledger == storage.Ledger(backend) {
+        ledgerReplica = replica
+    }
     return &ApiServer{
         config:              cfg,
         backend:             backend,
+        replica:             replica,
+        ledger:              ledger,
+        ledgerReplica:       ledgerReplica,
         hashrateWindow:      hashrateWindow,
         hashrateLargeWindow: hashrateLargeWindow,
         miners:              make(map[string]*Entry),
@@ -58,21 +119,34 @@ func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
 
 func (s *ApiServer) Start() {
     if s.config.PurgeOnly {
-        log.Printf("Starting API in purge-only mode")
+        log.Infof("Starting API in purge-only mode")
     } else {
-        log.Printf("Starting API on %v", s.config.Listen)
+        log.Infof("Starting API on %v", s.config.Listen)
     }
 
     s.statsIntv = util.MustParseDuration(s.config.StatsCollectInterval)
     statsTimer := time.NewTimer(s.statsIntv)
-    log.Printf("Set stats collect interval to %v", s.statsIntv)
+    log.Infof("Set stats collect interval to %v", s.statsIntv)
 
     purgeIntv := util.MustParseDuration(s.config.PurgeInterval)
     purgeTimer := time.NewTimer(purgeIntv)
-    log.Printf("Set purge interval to %v", purgeIntv)
+    log.Infof("Set purge interval to %v", purgeIntv)
 
     sort.Ints(s.config.LuckWindow)
 
+    if s.config.History.Enabled {
+        s.startHistory()
+    }
+    if s.config.UsesSignedRequests() {
+        s.startSignedRequests()
+    }
+    if s.config.Closures.Enabled {
+        s.startClosures()
+    }
+    if s.config.Notifications.Enabled {
+        s.startNotifications()
+    }
+
     if s.config.PurgeOnly {
         s.purgeStale()
     } else {
@@ -96,6 +170,15 @@ func (s *ApiServer) Start() {
     }()
 
     if !s.config.PurgeOnly {
+        if s.config.Proofs.Enabled {
+            s.startProofs()
+        }
+        if s.config.Thresholds.Enabled {
+            s.startThresholds()
+        }
+        if s.config.Price.Enabled {
+            s.startPrice()
+        }
         s.listen()
     }
 }
@@ -105,10 +188,40 @@ func (s *ApiServer) listen() {
     r.HandleFunc("/api/stats", s.StatsIndex)
     r.HandleFunc("/api/miners", s.MinersIndex)
     r.HandleFunc("/api/blocks", s.BlocksIndex)
+    if s.config.ShareDumps {
+        r.HandleFunc("/api/blocks/{height:[0-9]+}/{hash:[0-9a-zA-Z]+}/shares", s.ShareDumpIndex)
+    }
     r.HandleFunc("/api/payments", s.PaymentsIndex)
+    r.HandleFunc("/api/clients", s.ClientsIndex)
     r.HandleFunc("/api/accounts/{login:M[A-Z0-9]{1}[0-9a-zA-Z]{32}$}", s.AccountIndex)
+    if s.config.History.Enabled {
+        r.HandleFunc("/api/history", s.HistoryIndex)
+        r.HandleFunc("/api/accounts/{login:M[A-Z0-9]{1}[0-9a-zA-Z]{32}}/history", s.AccountHistoryIndex)
+    }
+    if s.config.Proofs.Enabled {
+        r.HandleFunc("/api/proofs", s.ProofsIndex)
+        r.HandleFunc("/api/proofs/{login:M[A-Z0-9]{1}[0-9a-zA-Z]{32}$}", s.AccountProofsIndex)
+    }
+    if s.config.Thresholds.Enabled {
+        r.HandleFunc("/api/accounts/{login:M[A-Z0-9]{1}[0-9a-zA-Z]{32}}/threshold", s.AccountThresholdIndex).Methods("POST")
+    }
+    if s.config.Closures.Enabled {
+        r.HandleFunc("/api/accounts/{login:M[A-Z0-9]{1}[0-9a-zA-Z]{32}}/close", s.AccountClosureIndex).Methods("GET", "POST")
+    }
+    if s.config.Notifications.Enabled {
+        r.HandleFunc("/api/accounts/{login:M[A-Z0-9]{1}[0-9a-zA-Z]{32}}/notifications", s.AccountNotificationsIndex).Methods("GET", "POST")
+    }
+    // Admin requests must carry "Authorization: Bearer <adminToken>"
+    if len(s.config.AdminToken) > 0 {
+        r.Handle("/api/admin/holds", util.BearerAuth(s.config.AdminToken, http.HandlerFunc(s.HoldsIndex))).Methods("GET")
+        r.Handle("/api/admin/holds/{height:[0-9]+}/{hash:[0-9a-zA-Z]+}", util.BearerAuth(s.config.AdminToken, http.HandlerFunc(s.HoldIndex))).Methods("POST", "DELETE")
+    }
     r.NotFoundHandler = http.HandlerFunc(notFound)
-    err := http.ListenAndServe(s.config.Listen, r)
+    handler := s.withCors(r)
+    if s.config.Gzip {
+        handler = withGzip(handler)
+    }
+    err := http.ListenAndServe(s.config.Listen, handler)
     if err != nil {
         log.Fatalf("Failed to start API: %v", err)
     }
@@ -116,7 +229,6 @@ func (s *ApiServer) listen() {
 
 func notFound(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-    w.Header().Set("Access-Control-Allow-Origin", "*")
     w.Header().Set("Cache-Control", "no-cache")
     w.WriteHeader(http.StatusNotFound)
 }
@@ -125,50 +237,79 @@ func (s *ApiServer) purgeStale() {
     start := time.Now()
     total, err := s.backend.FlushStaleStats(s.hashrateWindow, s.hashrateLargeWindow)
     if err != nil {
-        log.Println("Failed to purge stale data from backend:", err)
+        log.Error("Failed to purge stale data from backend:", err)
     } else {
-        log.Printf("Purged stale stats from backend, %v shares affected, elapsed time %v", total, time.Since(start))
+        log.Infof("Purged stale stats from backend, %v shares affected, elapsed time %v", total, time.Since(start))
+    }
+    if s.config.History.Enabled {
+        s.compactHistory()
+    }
+    if s.config.Closures.Enabled {
+        s.purgeClosedAccounts()
     }
 }
 
 func (s *ApiServer) collectStats() {
     start := time.Now()
-    stats, err := s.backend.CollectStats(s.hashrateWindow, s.config.Blocks, s.config.Payments)
+    stats, err := s.replica.CollectStats(s.hashrateWindow)
     if err != nil {
-        log.Printf("Failed to fetch stats from backend: %v", err)
+        log.Errorf("Failed to fetch stats from backend: %v", err)
         return
     }
+    ledgerStats, err := s.ledgerReplica.GetLedgerStats(s.config.Blocks, s.config.Payments)
+    if err != nil {
+        log.Errorf("Failed to fetch blocks and payments from ledger: %v", err)
+        return
+    }
+    for key, value := range ledgerStats {
+        stats[key] = value
+    }
+    if s.config.ShareDumps {
+        for _, block := range stats["matured"].([]*storage.BlockData) {
+            if !block.Orphan {
+                block.ShareDump = fmt.Sprintf("/api/blocks/%d/%s/shares", block.Height, block.Hash)
+            }
+        }
+    }
+    nodes, err := s.replica.GetNodeStates()
+    if err != nil {
+        log.Errorf("Failed to get nodes stats from backend: %v", err)
+    }
+    stats["network"] = bestNetwork(nodes)
+    stats["clients"] = s.collectClientStats(nodes)
     if len(s.config.LuckWindow) > 0 {
-        stats["luck"], err = s.backend.CollectLuckStats(s.config.LuckWindow)
+        stats["luck"], err = s.ledgerReplica.CollectLuckStats(s.config.LuckWindow)
         if err != nil {
-            log.Printf("Failed to fetch luck stats from backend: %v", err)
+            log.Errorf("Failed to fetch luck stats from backend: %v", err)
             return
         }
     }
     s.stats.Store(stats)
-    log.Printf("Stats collection finished %s", time.Since(start))
+    if s.config.History.Enabled {
+        s.sampleHistory(stats)
+    }
+    log.Infof("Stats collection finished %s", time.Since(start))
 }
 
 func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-    w.Header().Set("Access-Control-Allow-Origin", "*")
     w.Header().Set("Cache-Control", "no-cache")
     w.WriteHeader(http.StatusOK)
 
     reply := make(map[string]interface{})
     
-    nodeStats, err := s.backend.GetNodeStates()
+    nodeStats, err := s.replica.GetNodeStates()
     if err != nil {
-        log.Printf("Failed to get nodes stats from backend: %v", err)
+        log.Errorf("Failed to get nodes stats from backend: %v", err)
     }
     //reply["nodes"] = nodes
     
     nodes := make([]map[string]interface{}, len(nodeStats))
     for id, node := range nodeStats {
         nodeName := node["name"].(string)
-        stratum, err := s.backend.GetStratumStates(nodeName)
+        stratum, err := s.replica.GetStratumStates(nodeName)
         if err != nil {
-            log.Printf("Failed to get stratum stats from backend: %v", err)
+            log.Errorf("Failed to get stratum stats from backend: %v", err)
         }
         if stratum != nil {
             nodes[id] = map[string]interface{}{
@@ -176,6 +317,8 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
                 "height": node["height"],
                 "difficulty": node["difficulty"],
                 "lastBeat": node["lastBeat"],
+                "region": node["region"],
+                "hashrate": node["hashrate"],
                 "stratums": stratum,
             }
         } else {
@@ -183,6 +326,14 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
         }
     }
     reply["nodes"] = nodes
+    reply["regions"] = s.regionStats(nodes)
+
+    // Share acceptance stopped by admin, by stratum name or "*" for all
+    pauses, err := s.replica.GetPauses()
+    if err != nil {
+        log.Errorf("Failed to get share acceptance pauses from backend: %v", err)
+    }
+    reply["pauses"] = pauses
 
     stats := s.getStats()
     if stats != nil {
@@ -193,81 +344,111 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
         reply["maturedTotal"] = stats["maturedTotal"]
         reply["immatureTotal"] = stats["immatureTotal"]
         reply["candidatesTotal"] = stats["candidatesTotal"]
+        reply["network"] = stats["network"]
+        reply["estimatedDailyPerMH"] = s.estimateDaily(1000000, stats["network"].(map[string]int64))
+    }
+    if q := s.price.current(); q != nil {
+        reply["price"] = q
     }
 
     err = json.NewEncoder(w).Encode(reply)
     if err != nil {
-        log.Println("Error serializing API response: ", err)
+        log.Error("Error serializing API response: ", err)
     }
 }
 
 func (s *ApiServer) MinersIndex(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-    w.Header().Set("Access-Control-Allow-Origin", "*")
     w.Header().Set("Cache-Control", "no-cache")
     w.WriteHeader(http.StatusOK)
 
     reply := make(map[string]interface{})
     stats := s.getStats()
     if stats != nil {
+        offset, limit := s.page(r)
+        miners, _ := stats["miners"].(map[string]storage.Miner)
         reply["now"] = util.MakeTimestamp()
-        reply["miners"] = stats["miners"]
+        reply["miners"] = pageMiners(miners, offset, limit)
         reply["hashrate"] = stats["hashrate"]
         reply["minersTotal"] = stats["minersTotal"]
     }
 
     err := json.NewEncoder(w).Encode(reply)
     if err != nil {
-        log.Println("Error serializing API response: ", err)
+        log.Error("Error serializing API response: ", err)
     }
 }
 
 func (s *ApiServer) BlocksIndex(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-    w.Header().Set("Access-Control-Allow-Origin", "*")
     w.Header().Set("Cache-Control", "no-cache")
     w.WriteHeader(http.StatusOK)
 
     reply := make(map[string]interface{})
     stats := s.getStats()
     if stats != nil {
-        reply["matured"] = stats["matured"]
+        offset, limit := s.page(r)
+        matured, _ := stats["matured"].([]*storage.BlockData)
+        immature, _ := stats["immature"].([]*storage.BlockData)
+        candidates, _ := stats["candidates"].([]*storage.BlockData)
+        reply["matured"] = pageBlocks(matured, offset, limit)
         reply["maturedTotal"] = stats["maturedTotal"]
-        reply["immature"] = stats["immature"]
+        reply["immature"] = pageBlocks(immature, offset, limit)
         reply["immatureTotal"] = stats["immatureTotal"]
-        reply["candidates"] = stats["candidates"]
+        reply["candidates"] = pageBlocks(candidates, offset, limit)
         reply["candidatesTotal"] = stats["candidatesTotal"]
         reply["luck"] = stats["luck"]
     }
 
     err := json.NewEncoder(w).Encode(reply)
     if err != nil {
-        log.Println("Error serializing API response: ", err)
+        log.Error("Error serializing API response: ", err)
     }
 }
 
 func (s *ApiServer) PaymentsIndex(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-    w.Header().Set("Access-Control-Allow-Origin", "*")
     w.Header().Set("Cache-Control", "no-cache")
     w.WriteHeader(http.StatusOK)
 
     reply := make(map[string]interface{})
     stats := s.getStats()
     if stats != nil {
-        reply["payments"] = stats["payments"]
+        offset, limit := s.page(r)
+        payments, _ := stats["payments"].([]map[string]interface{})
+        reply["payments"] = pagePayments(payments, offset, limit)
         reply["paymentsTotal"] = stats["paymentsTotal"]
     }
 
     err := json.NewEncoder(w).Encode(reply)
     if err != nil {
-        log.Println("Error serializing API response: ", err)
+        log.Error("Error serializing API response: ", err)
+    }
+}
+
+func (s *ApiServer) ShareDumpIndex(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    height, _ := strconv.ParseInt(vars["height"], 10, 64)
+    hash := vars["hash"]
+
+    data, err := s.replica.GetShareDump(height, hash)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to fetch share dump from backend: %v", err)
+        return
+    }
+    if data == nil {
+        w.WriteHeader(http.StatusNotFound)
+        return
     }
+    w.Header().Set("Content-Type", "application/gzip")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"shares-%d-%s.json.gz\"", height, hash))
+    w.WriteHeader(http.StatusOK)
+    w.Write(data)
 }
 
 func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-    w.Header().Set("Access-Control-Allow-Origin", "*")
     w.Header().Set("Cache-Control", "no-cache")
 
     login := mux.Vars(r)["login"]
@@ -279,33 +460,53 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
     cacheIntv := int64(s.statsIntv / time.Millisecond)
     // Refresh stats if stale
     if !ok || reply.updatedAt < now-cacheIntv {
-        exist, err := s.backend.IsMinerExists(login)
+        exist, err := s.replica.IsMinerExists(login)
         if !exist {
             w.WriteHeader(http.StatusNotFound)
             return
         }
         if err != nil {
             w.WriteHeader(http.StatusInternalServerError)
-            log.Printf("Failed to fetch stats from backend: %v", err)
+            log.Errorf("Failed to fetch stats from backend: %v", err)
             return
         }
 
-        stats, err := s.backend.GetMinerStats(login, s.config.Payments)
+        stats, err := s.replica.GetMinerStats(login)
         if err != nil {
             w.WriteHeader(http.StatusInternalServerError)
-            log.Printf("Failed to fetch stats from backend: %v", err)
+            log.Errorf("Failed to fetch stats from backend: %v", err)
             return
         }
-        workers, err := s.backend.CollectWorkersStats(s.hashrateWindow, s.hashrateLargeWindow, login)
+        ledgerStats, err := s.ledgerReplica.GetMinerLedgerStats(login, s.config.Payments)
         if err != nil {
             w.WriteHeader(http.StatusInternalServerError)
-            log.Printf("Failed to fetch stats from backend: %v", err)
+            log.Errorf("Failed to fetch balances and payments from ledger: %v", err)
+            return
+        }
+        minerStats := stats["stats"].(map[string]interface{})
+        for field, value := range ledgerStats["balances"].(map[string]int64) {
+            minerStats[field] = value
+        }
+        delete(ledgerStats, "balances")
+        for key, value := range ledgerStats {
+            stats[key] = value
+        }
+        workers, err := s.replica.CollectWorkersStats(s.hashrateWindow, s.hashrateLargeWindow, login)
+        if err != nil {
+            w.WriteHeader(http.StatusInternalServerError)
+            log.Errorf("Failed to fetch stats from backend: %v", err)
             return
         }
         for key, value := range workers {
             stats[key] = value
         }
         stats["pageSize"] = s.config.Payments
+        if global := s.getStats(); global != nil {
+            stats["estimatedDaily"] = s.estimateDaily(workers["hashrate"].(int64), global["network"].(map[string]int64))
+        }
+        if q := s.price.current(); q != nil {
+            stats["price"] = q
+        }
         reply = &Entry{stats: stats, updatedAt: now}
         s.miners[login] = reply
     }
@@ -313,7 +514,7 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
     w.WriteHeader(http.StatusOK)
     err := json.NewEncoder(w).Encode(reply.stats)
     if err != nil {
-        log.Println("Error serializing API response: ", err)
+        log.Error("Error serializing API response: ", err)
     }
 }
 
@@ -0,0 +1,50 @@
+package api
+
+import (
+    "net/http"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/rpc"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+// Requests signed with the key of miner address: thresholds, closures and notifications
+type SignedRequestsConfig struct {
+    // Node used to verify signed messages
+    Daemon         string   `json:"daemon"`
+    Timeout        string   `json:"timeout"`
+    // Max age of signed request
+    MaxAge         string   `json:"maxAge"`
+}
+
+func (c *ApiConfig) UsesSignedRequests() bool {
+    return c.Thresholds.Enabled || c.Closures.Enabled || c.Notifications.Enabled
+}
+
+func (s *ApiServer) startSignedRequests() {
+    cfg := &s.config.SignedRequests
+    s.signedMaxAge = util.MustParseDuration(cfg.MaxAge)
+    s.signedRpc = rpc.NewRPCClient("ApiServer", cfg.Daemon, "", "", cfg.Timeout)
+}
+
+// Checks that ts is within maxAge of server time and sig is signature of msg by login,
+// otherwise writes error reply and returns false
+func (s *ApiServer) verifySignedRequest(w http.ResponseWriter, login, msg string, ts int64, sig string) bool {
+    now := util.MakeTimestamp() / 1000
+    maxAge := int64(s.signedMaxAge / time.Second)
+    if ts < now-maxAge || ts > now+maxAge {
+        s.writeError(w, http.StatusBadRequest, "Request expired")
+        return false
+    }
+    valid, err := s.signedRpc.VerifyMessage(login, sig, msg)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to verify signature of %v: %v", login, err)
+        return false
+    }
+    if !valid {
+        s.writeError(w, http.StatusForbidden, "Invalid signature")
+        return false
+    }
+    return true
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+
+    "github.com/gorilla/mux"
+)
+
+type ThresholdsConfig struct {
+    Enabled        bool     `json:"enabled"`
+    // Bounds of personal threshold in Satoshi
+    Min            int64    `json:"min"`
+    Max            int64    `json:"max"`
+}
+
+// Message is signed with the key of login address
+type ThresholdRequest struct {
+    Threshold      int64    `json:"threshold"`
+    Timestamp      int64    `json:"timestamp"`
+    Signature      string   `json:"signature"`
+}
+
+func thresholdMessage(login string, threshold, ts int64) string {
+    return fmt.Sprintf("%s payout threshold %d at %d", login, threshold, ts)
+}
+
+func (s *ApiServer) startThresholds() {
+    cfg := &s.config.Thresholds
+    if cfg.Min <= 0 || cfg.Max < cfg.Min {
+        log.Fatalf("Invalid thresholds bounds, min: %v, max: %v", cfg.Min, cfg.Max)
+    }
+    log.Infof("Personal payout thresholds enabled, min: %v, max: %v", cfg.Min, cfg.Max)
+}
+
+func (s *ApiServer) AccountThresholdIndex(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+    w.Header().Set("Cache-Control", "no-cache")
+
+    login := mux.Vars(r)["login"]
+    var req ThresholdRequest
+    if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+        s.writeError(w, http.StatusBadRequest, "Malformed request")
+        return
+    }
+    cfg := &s.config.Thresholds
+    if req.Threshold < cfg.Min || req.Threshold > cfg.Max {
+        s.writeError(w, http.StatusBadRequest, fmt.Sprintf("Threshold must be within %v and %v", cfg.Min, cfg.Max))
+        return
+    }
+    exist, err := s.backend.IsMinerExists(login)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to fetch stats from backend: %v", err)
+        return
+    }
+    if !exist {
+        w.WriteHeader(http.StatusNotFound)
+        return
+    }
+
+    if !s.verifySignedRequest(w, login, thresholdMessage(login, req.Threshold, req.Timestamp), req.Timestamp, req.Signature) {
+        return
+    }
+
+    ok, err := s.backend.SetMinerThreshold(login, req.Threshold, req.Timestamp)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to write payout threshold to backend: %v", err)
+        return
+    }
+    if !ok {
+        s.writeError(w, http.StatusConflict, "Newer threshold is already set")
+        return
+    }
+    log.Infof("Payout threshold of %v set to %v", login, req.Threshold)
+
+    // Drop cached account stats so the new value shows up at once
+    s.minersMu.Lock()
+    delete(s.miners, login)
+    s.minersMu.Unlock()
+
+    w.WriteHeader(http.StatusOK)
+    err = json.NewEncoder(w).Encode(map[string]interface{}{"threshold": req.Threshold})
+    if err != nil {
+        log.Error("Error serializing API response: ", err)
+    }
+}
+
+func (s *ApiServer) writeError(w http.ResponseWriter, status int, message string) {
+    w.WriteHeader(status)
+    err := json.NewEncoder(w).Encode(map[string]interface{}{"error": message})
+    if err != nil {
+        log.Error("Error serializing API response: ", err)
+    }
+}
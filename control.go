@@ -0,0 +1,84 @@
+package main
+
+import (
+    "encoding/json"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/proxy"
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+)
+
+type ControlMessage struct {
+    Action         string   `json:"action"`
+    Message        string   `json:"message"`
+}
+
+// Runs actions published to control channel by external tools
+func startControl(cfg *proxy.ControlConfig, db int64, backend *storage.RedisClient) {
+    keys := make(map[string]string)
+    channels := []string{}
+    if len(cfg.Channel) > 0 {
+        channels = append(channels, cfg.Channel)
+    }
+    for key, action := range cfg.Keys {
+        channel := backend.KeyspaceChannel(db, key)
+        keys[channel] = action
+        channels = append(channels, channel)
+    }
+    if len(channels) == 0 {
+        log.Info("Control is enabled but no channel or keys are set")
+        return
+    }
+
+    for {
+        pubsub, err := backend.Subscribe(channels...)
+        if err != nil {
+            log.Errorf("Failed to subscribe to control channels: %v", err)
+            time.Sleep(5 * time.Second)
+            continue
+        }
+        log.Infof("Listening for control actions on %v", channels)
+        for {
+            msg, err := pubsub.ReceiveMessage()
+            if err != nil {
+                log.Errorf("Control subscription error: %v", err)
+                break
+            }
+            if action, ok := keys[msg.Channel]; ok {
+                runControlAction(&ControlMessage{Action: action})
+                continue
+            }
+            var m ControlMessage
+            if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
+                log.Warnf("Malformed control message: %v", msg.Payload)
+                continue
+            }
+            runControlAction(&m)
+        }
+        pubsub.Close()
+        time.Sleep(5 * time.Second)
+    }
+}
+
+// Actions for modules not running in this process are ignored
+func runControlAction(m *ControlMessage) {
+    switch m.Action {
+    case "refreshTemplate":
+        if proxyServer != nil {
+            log.Info("Control: refreshing block template")
+            proxyServer.RefreshBlockTemplate()
+        }
+    case "runUnlocker":
+        if blockUnlocker != nil {
+            log.Info("Control: running unlocker")
+            blockUnlocker.Trigger()
+        }
+    case "broadcast":
+        if proxyServer != nil && len(m.Message) > 0 {
+            log.Infof("Control: broadcasting message: %v", m.Message)
+            proxyServer.BroadcastMessage(m.Message)
+        }
+    default:
+        log.Warnf("Unknown control action: %v", m.Action)
+    }
+}
@@ -0,0 +1,168 @@
+package events
+
+import (
+    "encoding/json"
+    "fmt"
+    "sync/atomic"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/logging"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+var log = logging.New("events")
+
+type Config struct {
+    Enabled        bool     `json:"enabled"`
+    // kafka or nats
+    Driver         string   `json:"driver"`
+    // Kafka brokers or NATS server URLs
+    Servers        []string `json:"servers"`
+    // Events go to <topic>.shares, <topic>.blocks and <topic>.payments
+    Topic          string   `json:"topic"`
+    // Events waiting to be sent, newer ones are dropped when full so miners are never slowed down
+    Buffer         int      `json:"buffer"`
+}
+
+type ShareEvent struct {
+    Login          string   `json:"login"`
+    Worker         string   `json:"worker"`
+    Ip             string   `json:"ip"`
+    Port           string   `json:"port"`
+    Height         uint64   `json:"height,omitempty"`
+    Difficulty     int64    `json:"difficulty"`
+    Accepted       bool     `json:"accepted"`
+    // Set for rejected shares: paused, malformed, stale, duplicate or invalid
+    Reason         string   `json:"reason,omitempty"`
+    Timestamp      int64    `json:"timestamp"`
+}
+
+type BlockEvent struct {
+    Login          string   `json:"login"`
+    Worker         string   `json:"worker"`
+    Port           string   `json:"port"`
+    Height         uint64   `json:"height"`
+    Nonce          string   `json:"nonce"`
+    Header         string   `json:"header"`
+    Difficulty     int64    `json:"difficulty"`
+    ShareDiff      int64    `json:"shareDifficulty"`
+    Solo           bool     `json:"solo"`
+    Timestamp      int64    `json:"timestamp"`
+}
+
+type PaymentEvent struct {
+    Login          string   `json:"login"`
+    Amount         int64    `json:"amount"`
+    Tx             string   `json:"tx"`
+    Timestamp      int64    `json:"timestamp"`
+}
+
+type message struct {
+    topic          string
+    // Events of one login keep their order
+    key            string
+    value          []byte
+}
+
+type sink interface {
+    publish(msgs []*message) error
+}
+
+// Methods are no-ops on nil publisher, so callers need no checks when disabled
+type Publisher struct {
+    config         *Config
+    sink           sink
+    queue          chan *message
+    dropped        int64
+}
+
+const maxBatch = 500
+
+func NewPublisher(cfg *Config) (*Publisher, error) {
+    var s sink
+    var err error
+    switch cfg.Driver {
+    case "kafka":
+        s, err = newKafkaSink(cfg)
+    case "nats":
+        s, err = newNatsSink(cfg)
+    default:
+        return nil, fmt.Errorf("Unknown events driver %v", cfg.Driver)
+    }
+    if err != nil {
+        return nil, err
+    }
+    size := cfg.Buffer
+    if size <= 0 {
+        size = 10000
+    }
+    p := &Publisher{config: cfg, sink: s, queue: make(chan *message, size)}
+    go p.run()
+    log.Infof("Publishing pool events to %v topic %v", cfg.Driver, cfg.Topic)
+    return p, nil
+}
+
+func (p *Publisher) Share(e *ShareEvent) {
+    if p == nil {
+        return
+    }
+    e.Timestamp = util.MakeTimestamp()
+    p.enqueue("shares", e.Login, e)
+}
+
+func (p *Publisher) Block(e *BlockEvent) {
+    if p == nil {
+        return
+    }
+    e.Timestamp = util.MakeTimestamp()
+    p.enqueue("blocks", e.Login, e)
+}
+
+func (p *Publisher) Payment(e *PaymentEvent) {
+    if p == nil {
+        return
+    }
+    e.Timestamp = util.MakeTimestamp()
+    p.enqueue("payments", e.Login, e)
+}
+
+func (p *Publisher) enqueue(kind, key string, e interface{}) {
+    value, err := json.Marshal(e)
+    if err != nil {
+        log.Errorf("Failed to serialize %v event: %v", kind, err)
+        return
+    }
+    select {
+    case p.queue <- &message{topic: p.config.Topic + "." + kind, key: key, value: value}:
+    default:
+        atomic.AddInt64(&p.dropped, 1)
+    }
+}
+
+func (p *Publisher) run() {
+    timer := time.NewTimer(time.Minute)
+    for {
+        select {
+        case m := <-p.queue:
+            batch := []*message{m}
+        Batch:
+            for len(batch) < maxBatch {
+                select {
+                case m := <-p.queue:
+                    batch = append(batch, m)
+                default:
+                    break Batch
+                }
+            }
+            if err := p.sink.publish(batch); err != nil {
+                atomic.AddInt64(&p.dropped, int64(len(batch)))
+                log.Errorf("Failed to publish %v events: %v", len(batch), err)
+            }
+        case <-timer.C:
+            if n := atomic.SwapInt64(&p.dropped, 0); n > 0 {
+                log.Warnf("Dropped %v events in the last minute", n)
+            }
+            timer.Reset(time.Minute)
+        }
+    }
+}
@@ -0,0 +1,58 @@
+package events
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/nats-io/nats.go"
+    "github.com/segmentio/kafka-go"
+)
+
+type kafkaSink struct {
+    writer         *kafka.Writer
+}
+
+func newKafkaSink(cfg *Config) (*kafkaSink, error) {
+    if len(cfg.Servers) == 0 {
+        return nil, fmt.Errorf("No Kafka brokers configured")
+    }
+    // Topic is set per message, hashing by login keeps events of a miner in one partition
+    w := &kafka.Writer{
+        Addr:         kafka.TCP(cfg.Servers...),
+        Balancer:     &kafka.Hash{},
+        BatchTimeout: 50 * time.Millisecond,
+        WriteTimeout: 10 * time.Second,
+    }
+    return &kafkaSink{writer: w}, nil
+}
+
+func (s *kafkaSink) publish(msgs []*message) error {
+    batch := make([]kafka.Message, len(msgs))
+    for i, m := range msgs {
+        batch[i] = kafka.Message{Topic: m.topic, Key: []byte(m.key), Value: m.value}
+    }
+    return s.writer.WriteMessages(context.Background(), batch...)
+}
+
+type natsSink struct {
+    conn           *nats.Conn
+}
+
+func newNatsSink(cfg *Config) (*natsSink, error) {
+    conn, err := nats.Connect(strings.Join(cfg.Servers, ","), nats.Name("open-metaverse-pool"), nats.MaxReconnects(-1))
+    if err != nil {
+        return nil, err
+    }
+    return &natsSink{conn: conn}, nil
+}
+
+func (s *natsSink) publish(msgs []*message) error {
+    for _, m := range msgs {
+        if err := s.conn.Publish(m.topic, m.value); err != nil {
+            return err
+        }
+    }
+    return nil
+}
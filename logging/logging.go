@@ -0,0 +1,231 @@
+package logging
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    stdlog "log"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+type Config struct {
+    // debug, info, warn or error
+    Level          string              `json:"level"`
+    // console or json
+    Format         string              `json:"format"`
+    // Written to stderr when empty
+    File           string              `json:"file"`
+    // File is rotated when it grows over this many megabytes, 0 disables rotation
+    MaxSize        int                 `json:"maxSize"`
+    // Rotated files to keep
+    MaxFiles       int                 `json:"maxFiles"`
+    // Level per component overriding default, e.g. {"proxy": "warn"}
+    Components     map[string]string   `json:"components"`
+}
+
+type Level int
+
+const (
+    Debug Level = iota
+    Info
+    Warn
+    Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+    return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+    if len(s) == 0 {
+        return Info, nil
+    }
+    for i, name := range levelNames {
+        if strings.EqualFold(s, name) {
+            return Level(i), nil
+        }
+    }
+    return Info, fmt.Errorf("Unknown log level %v", s)
+}
+
+type levelSet struct {
+    def            Level
+    components     map[string]Level
+}
+
+var (
+    outMu          sync.Mutex
+    out            io.Writer = os.Stderr
+    jsonFormat     bool
+    levels         atomic.Value
+)
+
+func init() {
+    levels.Store(&levelSet{def: Info})
+}
+
+// Applies config to all loggers, stdlib log output is routed through it too
+func Setup(cfg *Config) error {
+    if err := Reload(cfg); err != nil {
+        return err
+    }
+    switch cfg.Format {
+    case "", "console":
+    case "json":
+    default:
+        return fmt.Errorf("Unknown log format %v", cfg.Format)
+    }
+    var w io.Writer = os.Stderr
+    if len(cfg.File) > 0 {
+        f, err := openRotating(cfg.File, int64(cfg.MaxSize)*1024*1024, cfg.MaxFiles)
+        if err != nil {
+            return err
+        }
+        w = f
+    }
+    outMu.Lock()
+    out = w
+    jsonFormat = cfg.Format == "json"
+    outMu.Unlock()
+
+    stdlog.SetFlags(0)
+    stdlog.SetOutput(stdWriter{New("std")})
+    return nil
+}
+
+// Levels can be changed at runtime, output only on restart
+func Reload(cfg *Config) error {
+    set := &levelSet{components: make(map[string]Level)}
+    var err error
+    if set.def, err = ParseLevel(cfg.Level); err != nil {
+        return err
+    }
+    for component, s := range cfg.Components {
+        if set.components[component], err = ParseLevel(s); err != nil {
+            return err
+        }
+    }
+    levels.Store(set)
+    return nil
+}
+
+type Logger struct {
+    component      string
+    // Key value pairs added to every record
+    fields         []interface{}
+}
+
+func New(component string) *Logger {
+    return &Logger{component: component}
+}
+
+// Returns logger adding key value pairs to every record
+func (l *Logger) With(kv ...interface{}) *Logger {
+    fields := make([]interface{}, 0, len(l.fields)+len(kv))
+    fields = append(fields, l.fields...)
+    fields = append(fields, kv...)
+    return &Logger{component: l.component, fields: fields}
+}
+
+func (l *Logger) Enabled(level Level) bool {
+    set := levels.Load().(*levelSet)
+    if min, ok := set.components[l.component]; ok {
+        return level >= min
+    }
+    return level >= set.def
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.logf(Debug, format, args...) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.logf(Info, format, args...) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.logf(Warn, format, args...) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.logf(Error, format, args...) }
+
+func (l *Logger) Debug(args ...interface{}) { l.log(Debug, args...) }
+func (l *Logger) Info(args ...interface{})  { l.log(Info, args...) }
+func (l *Logger) Warn(args ...interface{})  { l.log(Warn, args...) }
+func (l *Logger) Error(args ...interface{}) { l.log(Error, args...) }
+
+// Fatal records are always written, then process exits
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+    l.write(Error, fmt.Sprintf(format, args...))
+    os.Exit(1)
+}
+
+func (l *Logger) Fatal(args ...interface{}) {
+    l.write(Error, sprintln(args...))
+    os.Exit(1)
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+    if l.Enabled(level) {
+        l.write(level, fmt.Sprintf(format, args...))
+    }
+}
+
+func (l *Logger) log(level Level, args ...interface{}) {
+    if l.Enabled(level) {
+        l.write(level, sprintln(args...))
+    }
+}
+
+func sprintln(args ...interface{}) string {
+    return strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+}
+
+func (l *Logger) write(level Level, msg string) {
+    now := time.Now()
+    var buf bytes.Buffer
+
+    outMu.Lock()
+    defer outMu.Unlock()
+
+    if jsonFormat {
+        buf.WriteString(`{"time":`)
+        writeJSON(&buf, now.Format(time.RFC3339Nano))
+        buf.WriteString(`,"level":`)
+        writeJSON(&buf, level.String())
+        buf.WriteString(`,"component":`)
+        writeJSON(&buf, l.component)
+        buf.WriteString(`,"msg":`)
+        writeJSON(&buf, msg)
+        for i := 0; i+1 < len(l.fields); i += 2 {
+            buf.WriteByte(',')
+            writeJSON(&buf, fmt.Sprint(l.fields[i]))
+            buf.WriteByte(':')
+            writeJSON(&buf, l.fields[i+1])
+        }
+        buf.WriteString("}\n")
+    } else {
+        fmt.Fprintf(&buf, "%s %-5s %s: %s", now.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), l.component, msg)
+        for i := 0; i+1 < len(l.fields); i += 2 {
+            fmt.Fprintf(&buf, " %v=%v", l.fields[i], l.fields[i+1])
+        }
+        buf.WriteByte('\n')
+    }
+    out.Write(buf.Bytes())
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+    b, err := json.Marshal(v)
+    if err != nil {
+        b, _ = json.Marshal(fmt.Sprint(v))
+    }
+    buf.Write(b)
+}
+
+// Records written by packages still using stdlib log
+type stdWriter struct {
+    logger         *Logger
+}
+
+func (w stdWriter) Write(p []byte) (int, error) {
+    w.logger.log(Info, strings.TrimSuffix(string(p), "\n"))
+    return len(p), nil
+}
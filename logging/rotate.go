@@ -0,0 +1,82 @@
+package logging
+
+import (
+    "fmt"
+    "os"
+    "time"
+)
+
+// Log file which can't be reopened after rotation is retried this often, logs go to stderr meanwhile
+const reopenInterval = time.Minute
+
+// Log file renamed to file.1, file.2 ... once it grows over maxSize
+type rotatingFile struct {
+    path           string
+    maxSize        int64
+    maxFiles       int
+    file           *os.File
+    size           int64
+    // Set while writing to stderr
+    retryAt        time.Time
+}
+
+func openRotating(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+    if maxFiles <= 0 {
+        maxFiles = 1
+    }
+    r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+    if err := r.open(); err != nil {
+        return nil, err
+    }
+    return r, nil
+}
+
+func (r *rotatingFile) open() error {
+    f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    info, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return err
+    }
+    r.file = f
+    r.size = info.Size()
+    return nil
+}
+
+// Called with output lock held
+func (r *rotatingFile) Write(p []byte) (int, error) {
+    if r.file == os.Stderr {
+        if time.Now().After(r.retryAt) {
+            if err := r.open(); err != nil {
+                r.retryAt = time.Now().Add(reopenInterval)
+            } else {
+                fmt.Fprintf(os.Stderr, "Log file %v reopened\n", r.path)
+            }
+        }
+    } else if r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize && r.size > 0 {
+        if err := r.rotate(); err != nil {
+            fmt.Fprintf(os.Stderr, "Failed to rotate log file %v, logging to stderr: %v\n", r.path, err)
+        }
+    }
+    n, err := r.file.Write(p)
+    r.size += int64(n)
+    return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+    r.file.Close()
+    for i := r.maxFiles - 1; i > 0; i-- {
+        os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+    }
+    // Keeps writing to the same file if rename fails
+    os.Rename(r.path, r.path+".1")
+    if err := r.open(); err != nil {
+        r.file, r.size = os.Stderr, 0
+        r.retryAt = time.Now().Add(reopenInterval)
+        return err
+    }
+    return nil
+}
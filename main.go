@@ -2,42 +2,59 @@ package main
 
 import (
     "encoding/json"
-    "log"
     "math/rand"
     "os"
+    "os/signal"
     "path/filepath"
     "runtime"
+    "syscall"
     "time"
 
     "github.com/yvasiyarov/gorelic"
 
     "github.com/NotoriousPyro/open-metaverse-pool/api"
+    "github.com/NotoriousPyro/open-metaverse-pool/events"
+    "github.com/NotoriousPyro/open-metaverse-pool/logging"
+    "github.com/NotoriousPyro/open-metaverse-pool/notify"
     "github.com/NotoriousPyro/open-metaverse-pool/payouts"
     "github.com/NotoriousPyro/open-metaverse-pool/proxy"
     "github.com/NotoriousPyro/open-metaverse-pool/storage"
 )
 
+var log = logging.New("main")
+
 var cfg proxy.Config
 var backend *storage.RedisClient
+var ledger storage.Ledger
+var publisher *events.Publisher
+
+var proxyServer *proxy.ProxyServer
+var blockUnlocker *payouts.BlockUnlocker
+var payoutsProcessor *payouts.PayoutsProcessor
 
 func startProxy() {
-    s := proxy.NewProxy(&cfg, backend)
-    s.Start()
+    proxyServer = proxy.NewProxy(&cfg, backend, ledger, publisher)
+    go proxyServer.Start()
 }
 
 func startApi() {
-    s := api.NewApiServer(&cfg.Api, backend)
+    s := api.NewApiServer(&cfg.Api, backend, ledger)
     s.Start()
 }
 
 func startBlockUnlocker() {
-    u := payouts.NewBlockUnlocker(&cfg.BlockUnlocker, backend)
-    u.Start()
+    blockUnlocker = payouts.NewBlockUnlocker(&cfg.BlockUnlocker, backend, ledger)
+    go blockUnlocker.Start()
 }
 
 func startPayoutsProcessor() {
-    u := payouts.NewPayoutsProcessor(&cfg.Payouts, backend)
-    u.Start()
+    payoutsProcessor = payouts.NewPayoutsProcessor(&cfg.Payouts, backend, ledger, publisher)
+    go payoutsProcessor.Start()
+}
+
+func startNotifier() {
+    n := notify.NewNotifier(&cfg.Notifier, backend)
+    go n.Start()
 }
 
 func startNewrelic() {
@@ -50,27 +67,78 @@ func startNewrelic() {
     }
 }
 
-func readConfig(cfg *proxy.Config) {
+func configFileName() string {
     configFileName := "config.json"
     if len(os.Args) > 1 {
         configFileName = os.Args[1]
     }
     configFileName, _ = filepath.Abs(configFileName)
-    log.Printf("Loading config: %v", configFileName)
+    return configFileName
+}
 
-    configFile, err := os.Open(configFileName)
+func loadConfig(cfg *proxy.Config) error {
+    configFile, err := os.Open(configFileName())
     if err != nil {
-        log.Fatal("File error: ", err.Error())
+        return err
     }
     defer configFile.Close()
     jsonParser := json.NewDecoder(configFile)
     if err := jsonParser.Decode(&cfg); err != nil {
-        log.Fatal("Config error: ", err.Error())
+        return err
+    }
+    // Keeps wallet password out of config files
+    if password := os.Getenv("ACCOUNT_PASSWORD"); len(password) > 0 {
+        cfg.Password = password
     }
     cfg.Payouts.Account = cfg.Account
     cfg.Payouts.Password = cfg.Password
     cfg.BlockUnlocker.Account = cfg.Account
     cfg.BlockUnlocker.Password = cfg.Password
+    cfg.Api.PoolFee = cfg.BlockUnlocker.PoolFee
+    cfg.Api.RewardSchedule = cfg.BlockUnlocker.RewardSchedule
+    return nil
+}
+
+func readConfig(cfg *proxy.Config) {
+    log.Infof("Loading config: %v", configFileName())
+    if err := loadConfig(cfg); err != nil {
+        log.Fatal("Config error: ", err.Error())
+    }
+    if err := logging.Setup(&cfg.Log); err != nil {
+        log.Fatal("Log config error: ", err.Error())
+    }
+}
+
+// Re-reads config file and applies settings which can be changed at runtime
+func reloadConfig() {
+    log.Infof("Reloading config: %v", configFileName())
+    var newCfg proxy.Config
+    if err := loadConfig(&newCfg); err != nil {
+        log.Errorf("Config reload failed, keeping current settings: %v", err)
+        return
+    }
+    // Modules are validated only if enabled, running ones must stay enabled
+    if (proxyServer != nil && !newCfg.Proxy.Enabled) || (blockUnlocker != nil && !newCfg.BlockUnlocker.Enabled) || (payoutsProcessor != nil && !newCfg.Payouts.Enabled) {
+        log.Error("Config reload failed, keeping current settings: running modules can't be disabled without restart")
+        return
+    }
+    if err := validateConfig(&newCfg); err != nil {
+        log.Errorf("Config reload failed, keeping current settings: %v", err)
+        return
+    }
+    if err := logging.Reload(&newCfg.Log); err != nil {
+        log.Warnf("Log levels not reloaded: %v", err)
+    }
+    if proxyServer != nil {
+        proxyServer.Reload(&newCfg)
+    }
+    if blockUnlocker != nil {
+        blockUnlocker.Reload(&newCfg.BlockUnlocker)
+    }
+    if payoutsProcessor != nil {
+        payoutsProcessor.Reload(&newCfg.Payouts)
+    }
+    log.Info("Config reload complete")
 }
 
 func main() {
@@ -79,31 +147,69 @@ func main() {
 
     if cfg.Threads > 0 {
         runtime.GOMAXPROCS(cfg.Threads)
-        log.Printf("Running with %v threads", cfg.Threads)
+        log.Infof("Running with %v threads", cfg.Threads)
     }
 
     startNewrelic()
 
     backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin)
-    pong, err := backend.Check()
+    var err error
+    ledger, err = storage.NewLedger(&cfg.Ledger, backend)
     if err != nil {
-        log.Printf("Can't establish connection to backend: %v", err)
+        log.Fatalf("Failed to initialize ledger: %v", err)
+    }
+    if cfg.SkipPreflight {
+        pong, err := backend.Check()
+        if err != nil {
+            log.Errorf("Can't establish connection to backend: %v", err)
+        } else {
+            log.Infof("Backend check reply: %v", pong)
+        }
     } else {
-        log.Printf("Backend check reply: %v", pong)
+        report := runPreflight(&cfg, backend, ledger)
+        report.print()
+        if n := report.failures(); n > 0 {
+            log.Fatalf("Preflight failed with %v errors, refusing to start", n)
+        }
+    }
+
+    if cfg.Events.Enabled {
+        publisher, err = events.NewPublisher(&cfg.Events)
+        if err != nil {
+            log.Fatalf("Failed to start events publisher: %v", err)
+        }
     }
 
     if cfg.Proxy.Enabled {
-        go startProxy()
+        startProxy()
     }
     if cfg.Api.Enabled {
         go startApi()
     }
     if cfg.BlockUnlocker.Enabled {
-        go startBlockUnlocker()
+        startBlockUnlocker()
     }
     if cfg.Payouts.Enabled {
-        go startPayoutsProcessor()
+        startPayoutsProcessor()
+    }
+    if cfg.Notifier.Enabled {
+        startNotifier()
+    }
+    if cfg.Control.Enabled {
+        go startControl(&cfg.Control, cfg.Redis.Database, backend)
+    }
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+    for sig := range signals {
+        if sig == syscall.SIGHUP {
+            reloadConfig()
+            continue
+        }
+        log.Infof("Received %v, shutting down", sig)
+        if proxyServer != nil {
+            proxyServer.Shutdown()
+        }
+        return
     }
-    quit := make(chan bool)
-    <-quit
 }
@@ -0,0 +1,147 @@
+package notify
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/logging"
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+var log = logging.New("notifier")
+
+type NotifierConfig struct {
+    Enabled        bool            `json:"enabled"`
+    Interval       string          `json:"interval"`
+    // Worker without shares for this long is reported offline
+    OfflineAfter   string          `json:"offlineAfter"`
+    Timeout        string          `json:"timeout"`
+    Smtp           SmtpConfig      `json:"smtp"`
+    Telegram       TelegramConfig  `json:"telegram"`
+}
+
+// Sent to every sink the miner opted in
+type Event struct {
+    Login          string   `json:"login"`
+    Worker         string   `json:"worker"`
+    // offline or online
+    Event          string   `json:"event"`
+    LastShare      int64    `json:"lastShare"`
+    Timestamp      int64    `json:"timestamp"`
+}
+
+func (e *Event) text() string {
+    if e.Event == "offline" {
+        return fmt.Sprintf("Worker %s of %s is offline, last share at %v",
+            e.Worker, e.Login, time.Unix(e.LastShare, 0).UTC().Format(time.RFC1123))
+    }
+    return fmt.Sprintf("Worker %s of %s is back online", e.Worker, e.Login)
+}
+
+type Notifier struct {
+    config         *NotifierConfig
+    backend        *storage.RedisClient
+    offlineAfter   int64
+    sinks          map[string]sink
+}
+
+func NewNotifier(cfg *NotifierConfig, backend *storage.RedisClient) *Notifier {
+    n := &Notifier{config: cfg, backend: backend}
+    n.offlineAfter = int64(util.MustParseDuration(cfg.OfflineAfter) / time.Second)
+    n.sinks = newSinks(cfg, util.MustParseDuration(cfg.Timeout))
+    return n
+}
+
+func (n *Notifier) Start() {
+    log.Infof("Starting notifier, workers are reported offline after %vs without shares", n.offlineAfter)
+    intv := util.MustParseDuration(n.config.Interval)
+    timer := time.NewTimer(intv)
+    log.Infof("Set notifier interval to %v", intv)
+
+    n.check()
+    timer.Reset(intv)
+
+    go func() {
+        for {
+            select {
+            case <-timer.C:
+                n.check()
+                timer.Reset(intv)
+            }
+        }
+    }()
+}
+
+func (n *Notifier) check() {
+    logins, err := n.backend.GetNotifyLogins()
+    if err != nil {
+        log.Errorf("Failed to get notification subscribers from backend: %v", err)
+        return
+    }
+    for _, login := range logins {
+        n.checkLogin(login)
+    }
+}
+
+// Compares last share of every worker with its last reported state
+func (n *Notifier) checkLogin(login string) {
+    lastShares, err := n.backend.GetWorkersLastShare(login)
+    if err != nil {
+        log.Errorf("Failed to get workers of %v from backend: %v", login, err)
+        return
+    }
+    states, err := n.backend.GetWorkerStates(login)
+    if err != nil {
+        log.Errorf("Failed to get worker states of %v from backend: %v", login, err)
+        return
+    }
+    now := util.MakeTimestamp() / 1000
+
+    // Workers missing in hashrate stats expired long ago
+    for worker, state := range states {
+        if _, ok := lastShares[worker]; !ok && state.State == "online" {
+            lastShares[worker] = state.LastShare
+        }
+    }
+    for worker, lastShare := range lastShares {
+        event := "online"
+        if now-lastShare >= n.offlineAfter {
+            event = "offline"
+        }
+        // State is written on change only, so stored last share may lag behind
+        state, known := states[worker]
+        if known && state.State == event {
+            continue
+        }
+        err := n.backend.SetWorkerState(login, worker, event, lastShare)
+        if err != nil {
+            log.Errorf("Failed to write state of worker %v of %v to backend: %v", worker, login, err)
+            continue
+        }
+        // First sighting of worker is not worth a message
+        if !known && event == "online" {
+            continue
+        }
+        n.notify(&Event{Login: login, Worker: worker, Event: event, LastShare: lastShare, Timestamp: now})
+    }
+}
+
+func (n *Notifier) notify(e *Event) {
+    settings, err := n.backend.GetNotifications(e.Login)
+    if err != nil {
+        log.Errorf("Failed to get notification settings of %v from backend: %v", e.Login, err)
+        return
+    }
+    for kind, target := range settings {
+        s, ok := n.sinks[kind]
+        if !ok || len(target) == 0 {
+            continue
+        }
+        if err := s.send(target, e); err != nil {
+            log.Errorf("Failed to send %v notification to %v: %v", kind, e.Login, err)
+        } else {
+            log.Infof("Sent %v notification to %v: worker %v is %v", kind, e.Login, e.Worker, e.Event)
+        }
+    }
+}
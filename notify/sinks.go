@@ -0,0 +1,189 @@
+package notify
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "net/mail"
+    "net/smtp"
+    "net/url"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+)
+
+var Kinds = []string{"email", "telegram", "discord", "webhook"}
+
+type SmtpConfig struct {
+    Enabled        bool     `json:"enabled"`
+    Host           string   `json:"host"`
+    Port           int      `json:"port"`
+    Username       string   `json:"username"`
+    Password       string   `json:"password"`
+    From           string   `json:"from"`
+}
+
+type TelegramConfig struct {
+    Enabled        bool     `json:"enabled"`
+    // Bot token, miners opt in with their chat id
+    Token          string   `json:"token"`
+}
+
+// Delivers event to target set by miner: address, chat id or URL
+type sink interface {
+    send(target string, e *Event) error
+}
+
+// Webhook sinks are always available, mail and Telegram need pool credentials
+func newSinks(cfg *NotifierConfig, timeout time.Duration) map[string]sink {
+    client := newPublicClient(timeout)
+    sinks := map[string]sink{
+        "webhook": &webhookSink{client: client},
+        "discord": &discordSink{client: client},
+    }
+    if cfg.Smtp.Enabled {
+        sinks["email"] = &smtpSink{cfg: &cfg.Smtp}
+    }
+    if cfg.Telegram.Enabled {
+        sinks["telegram"] = &telegramSink{client: client, token: cfg.Telegram.Token}
+    }
+    return sinks
+}
+
+// Targets are set by miners, URLs must be https to keep requests off plain internal services
+func ValidTarget(kind, target string) error {
+    switch kind {
+    case "email":
+        addr, err := mail.ParseAddress(target)
+        if err != nil || addr.Address != target {
+            return fmt.Errorf("Invalid email address")
+        }
+    case "telegram":
+        if _, err := strconv.ParseInt(target, 10, 64); err != nil {
+            return fmt.Errorf("Invalid Telegram chat id")
+        }
+    case "discord":
+        u, err := url.Parse(target)
+        if err != nil || u.Scheme != "https" || (u.Host != "discord.com" && u.Host != "discordapp.com") ||
+            !strings.HasPrefix(u.Path, "/api/webhooks/") {
+            return fmt.Errorf("Invalid Discord webhook URL")
+        }
+    case "webhook":
+        u, err := url.Parse(target)
+        if err != nil || u.Scheme != "https" || len(u.Hostname()) == 0 {
+            return fmt.Errorf("Webhook URL must be https")
+        }
+        ips, err := net.LookupIP(u.Hostname())
+        if err != nil {
+            return fmt.Errorf("Unable to resolve webhook host")
+        }
+        for _, ip := range ips {
+            if !publicIP(ip) {
+                return fmt.Errorf("Webhook host must have a public address")
+            }
+        }
+    default:
+        return fmt.Errorf("Unknown notification kind %v", kind)
+    }
+    return nil
+}
+
+// Only public addresses, so miner set URL can't reach pool internals
+func publicIP(ip net.IP) bool {
+    return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+        ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// Address is checked after resolution on every connection, redirects and DNS rebinding included.
+// Environment proxy is not used, it would hide the real destination.
+func newPublicClient(timeout time.Duration) *http.Client {
+    dialer := &net.Dialer{
+        Timeout: timeout,
+        Control: func(network, address string, c syscall.RawConn) error {
+            host, _, err := net.SplitHostPort(address)
+            if err != nil {
+                return err
+            }
+            ip := net.ParseIP(host)
+            if ip == nil || !publicIP(ip) {
+                return fmt.Errorf("Refusing to connect to non-public address %v", host)
+            }
+            return nil
+        },
+    }
+    transport := &http.Transport{
+        DialContext:         dialer.DialContext,
+        TLSHandshakeTimeout: timeout,
+    }
+    return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+type smtpSink struct {
+    cfg            *SmtpConfig
+}
+
+func (s *smtpSink) send(target string, e *Event) error {
+    var auth smtp.Auth
+    if len(s.cfg.Username) > 0 {
+        auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)
+    }
+    subject := fmt.Sprintf("Worker %s is %s", e.Worker, e.Event)
+    msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", s.cfg.From, target, subject, e.text())
+    addr := fmt.Sprintf("%s:%d", s.cfg.Host, s.cfg.Port)
+    return smtp.SendMail(addr, auth, s.cfg.From, []string{target}, []byte(msg))
+}
+
+type telegramSink struct {
+    client         *http.Client
+    token          string
+}
+
+func (s *telegramSink) send(target string, e *Event) error {
+    form := url.Values{"chat_id": {target}, "text": {e.text()}}
+    resp, err := s.client.PostForm("https://api.telegram.org/bot"+s.token+"/sendMessage", form)
+    if err != nil {
+        // Error contains request URL with bot token
+        return fmt.Errorf("Telegram request failed: %v", strings.Replace(err.Error(), s.token, "<token>", -1))
+    }
+    return checkResponse(resp)
+}
+
+type discordSink struct {
+    client         *http.Client
+}
+
+func (s *discordSink) send(target string, e *Event) error {
+    return postJSON(s.client, target, map[string]string{"content": e.text()})
+}
+
+// Posts event as JSON
+type webhookSink struct {
+    client         *http.Client
+}
+
+func (s *webhookSink) send(target string, e *Event) error {
+    return postJSON(s.client, target, e)
+}
+
+func postJSON(client *http.Client, target string, v interface{}) error {
+    body, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    resp, err := client.Post(target, "application/json", bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    return checkResponse(resp)
+}
+
+func checkResponse(resp *http.Response) error {
+    resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return fmt.Errorf("Unexpected response status %v", resp.Status)
+    }
+    return nil
+}
@@ -0,0 +1,148 @@
+package payouts
+
+import (
+    "fmt"
+    "math/big"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/events"
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+)
+
+const (
+    defaultMaxRecipients = 100
+    batchTxChecks = 60
+)
+
+type batchPayment struct {
+    login   string
+    amount  int64
+}
+
+// Pays payees with one sendmore transaction per maxRecipients of them.
+// Balances are moved to pending before sending, so a failed run shows up as pending payments.
+func (u *PayoutsProcessor) payBatches(payments []*batchPayment) (int, *big.Int) {
+    size := u.config.MaxRecipients
+    if size <= 0 {
+        size = defaultMaxRecipients
+    }
+    paid := 0
+    total := big.NewInt(0)
+    for i := 0; i < len(payments) && !u.halt; i += size {
+        end := i + size
+        if end > len(payments) {
+            end = len(payments)
+        }
+        if !u.checkPeers() {
+            payoutsLog.Warn("Insufficient peers for payment... Will delay until next run.")
+            break
+        }
+        amount, err := u.payBatch(payments[i:end])
+        if err != nil {
+            u.halt = true
+            u.lastFail = err
+            break
+        }
+        paid += end - i
+        total.Add(total, big.NewInt(amount))
+    }
+    return paid, total
+}
+
+func (u *PayoutsProcessor) payBatch(batch []*batchPayment) (int64, error) {
+    recipients := make([]string, len(batch))
+    amounts := make([]int64, len(batch))
+    var total int64
+    for i, p := range batch {
+        recipients[i] = p.login
+        amounts[i] = p.amount
+        total += p.amount
+    }
+
+    getBalance, err := u.rpc.GetBalance(u.config.Address)
+    if err != nil {
+        return 0, err
+    }
+    if getBalance.Unspent < total {
+        return 0, fmt.Errorf("Not enough balance for batch payment, need %v Satoshi, pool has %v Satoshi", total, getBalance.Unspent)
+    }
+
+    err = u.ledger.LockPayouts("batch", total)
+    if err != nil {
+        payoutsLog.Errorf("Failed to lock batch payment of %v Satoshi: %v", total, err)
+        return 0, err
+    }
+    for i, p := range batch {
+        err = u.ledger.UpdateBalance(p.login, p.amount)
+        if err != nil {
+            payoutsLog.Errorf("Failed to update balance for Miner: %s, Satoshi: %v [%v]", p.login, p.amount, err)
+            u.rollbackBatch(batch[:i])
+            return 0, err
+        }
+    }
+    payoutsLog.Infof("Locked batch payment to %v miners, %v Satoshi", len(batch), total)
+
+    err = u.ledger.SetPayoutsTx("")
+    if err != nil {
+        payoutsLog.Errorf("Failed to mark batch payment as sending: %v", err)
+        u.rollbackBatch(batch)
+        return 0, err
+    }
+    txHash, err := u.sender.SendMore(recipients, amounts, u.config.Address)
+    if err != nil || txHash == "" {
+        // Node may have broadcast tx before the error, e.g. on timeout, so balances stay pending
+        // and payouts locked as in single mode until resolved manually
+        payoutsLog.Errorf("Failed to send batch payment of %v Satoshi: %v. Check outgoing tx in block explorer and docs/PAYOUTS.md", total, err)
+        if err == nil {
+            err = fmt.Errorf("Empty tx hash for batch payment")
+        }
+        return 0, err
+    }
+    u.recordTx(txHash)
+
+    if !u.waitForTx(txHash) {
+        // Balances stay pending, tx may still be mined
+        return 0, fmt.Errorf("Batch payment tx %v not confirmed in time, resolve it manually", txHash)
+    }
+    payments := make([]*storage.PendingPayment, len(batch))
+    for i, p := range batch {
+        payments[i] = &storage.PendingPayment{Address: p.login, Amount: p.amount}
+    }
+    err = u.ledger.WriteBatchPayments(txHash, payments)
+    if err != nil {
+        payoutsLog.Errorf("Failed to log TxReceipt for batch payment of %v Satoshi, Tx: %s [%v]", total, txHash, err)
+        return 0, err
+    }
+    for _, p := range batch {
+        u.publisher.Payment(&events.PaymentEvent{Login: p.login, Amount: p.amount, Tx: txHash})
+        payoutsLog.Infof("Paid %v ETP to %v, Tx: %v", p.amount, p.login, txHash)
+    }
+    return total, nil
+}
+
+// Only for failures before tx is marked as sending, it can't have been broadcast then,
+// so balances are credited back and lock released
+func (u *PayoutsProcessor) rollbackBatch(batch []*batchPayment) {
+    for _, p := range batch {
+        if err := u.ledger.RollbackBalance(p.login, p.amount); err != nil {
+            payoutsLog.Errorf("Failed to credit %v Satoshi back to %s, error is: %v", p.amount, p.login, err)
+            return
+        }
+    }
+    if err := u.ledger.UnlockPayouts(); err != nil {
+        payoutsLog.Error("Failed to unlock payouts:", err)
+    }
+}
+
+func (u *PayoutsProcessor) waitForTx(txHash string) bool {
+    for i := 0; i < batchTxChecks; i++ {
+        payoutsLog.Infof("Waiting for TxReceipt: %v", txHash)
+        time.Sleep(txCheckInterval)
+        receipt, _ := u.rpc.GetTransaction(txHash)
+        if receipt != nil && receipt.Confirmed() && txHash == receipt.Hash {
+            payoutsLog.Infof("TxReceipt confirmed: %v", txHash)
+            return true
+        }
+    }
+    return false
+}
@@ -2,21 +2,24 @@ package payouts
 
 import (
     "fmt"
-    "log"
     "math/big"
     "os"
     "strconv"
     "time"
 
+    "github.com/NotoriousPyro/open-metaverse-pool/events"
+    "github.com/NotoriousPyro/open-metaverse-pool/logging"
     "github.com/NotoriousPyro/open-metaverse-pool/rpc"
     "github.com/NotoriousPyro/open-metaverse-pool/storage"
     "github.com/NotoriousPyro/open-metaverse-pool/util"
 )
 
-const (
-    txCheckInterval = 5 * time.Second
-    failedTxReceiptRestartDelay = 10 * time.Minute
-)
+var payoutsLog = logging.New("payouts")
+
+const failedTxReceiptRestartDelay = 10 * time.Minute
+
+// Shortened by tests
+var txCheckInterval = 5 * time.Second
 
 type PayoutsConfig struct {
     Enabled         bool     `json:"enabled"`
@@ -27,59 +30,83 @@ type PayoutsConfig struct {
     // In Shannon
     Threshold       int64    `json:"threshold"`
     BgSave          bool     `json:"bgsave"`
+    // Closing accounts are paid out above this amount regardless of threshold
+    ClosureDust     int64    `json:"closureDust"`
     Account         string
     Password        string
     Address         string   `json:"address"`
+    // "single" sends one tx per payee, "batch" pays up to maxRecipients payees per sendmore tx
+    Mode            string   `json:"mode"`
+    MaxRecipients   int      `json:"maxRecipients"`
+    // Signs payouts with key of address instead of wallet account on node
+    Signer          SignerConfig `json:"signer"`
 }
 
 type PayoutsProcessor struct {
     config      *PayoutsConfig
     backend     *storage.RedisClient
+    ledger      storage.Ledger
+    publisher   *events.Publisher
     rpc         *rpc.RPCClient
+    sender      paymentSender
     halt        bool
     lastFail    error
+    reload      chan *PayoutsConfig
+}
+
+func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient, ledger storage.Ledger, publisher *events.Publisher) *PayoutsProcessor {
+    u := &PayoutsProcessor{config: cfg, backend: backend, ledger: ledger, publisher: publisher, reload: make(chan *PayoutsConfig, 1)}
+    if err := ValidatePayoutsConfig(cfg); err != nil {
+        payoutsLog.Fatal(err)
+    }
+    u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Account, cfg.Password, cfg.Timeout)
+    u.sender = u.rpc
+    if cfg.Signer.Enabled {
+        signer, err := newTxSigner(cfg, u.rpc)
+        if err != nil {
+            payoutsLog.Fatalf("Failed to load payouts signing key: %v", err)
+        }
+        u.sender = signer
+        payoutsLog.Infof("Signing payouts locally with key of %v", cfg.Address)
+    }
+    return u
 }
 
-func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) *PayoutsProcessor {
-    u := &PayoutsProcessor{config: cfg, backend: backend}
+func ValidatePayoutsConfig(cfg *PayoutsConfig) error {
     if len(cfg.Address) != 0 && !util.IsValidHexAddress(cfg.Address) {
-        log.Fatalln("Invalid Payouts Address", cfg.Address)
+        return fmt.Errorf("Invalid Payouts Address %v", cfg.Address)
     }
     if len(cfg.Address) < 1 {
-        log.Fatalln("Address not set in config", cfg.Address)
+        return fmt.Errorf("Address not set in config")
     }
-    u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Account, cfg.Password, cfg.Timeout)
-    return u
+    if cfg.Mode != "" && cfg.Mode != "single" && cfg.Mode != "batch" {
+        return fmt.Errorf("Invalid payouts mode %v, must be single or batch", cfg.Mode)
+    }
+    if cfg.MaxRecipients < 0 {
+        return fmt.Errorf("Invalid payouts maxRecipients %v", cfg.MaxRecipients)
+    }
+    if cfg.Signer.Fee < 0 {
+        return fmt.Errorf("Invalid payouts signer fee %v", cfg.Signer.Fee)
+    }
+    return nil
 }
 
 func (u *PayoutsProcessor) Start() {
-    log.Println("Starting payouts")
+    payoutsLog.Info("Starting payouts")
 
     if u.mustResolvePayout() {
-        log.Println("Running with env RESOLVE_PAYOUT=1, now trying to resolve locked payouts")
+        payoutsLog.Info("Running with env RESOLVE_PAYOUT=1, now trying to resolve locked payouts")
         u.resolvePayouts()
-        log.Println("Now you have to restart payouts module with RESOLVE_PAYOUT=0 for normal run")
+        payoutsLog.Info("Now you have to restart payouts module with RESOLVE_PAYOUT=0 for normal run")
         return
     }
 
     intv := util.MustParseDuration(u.config.Interval)
     timer := time.NewTimer(intv)
-    log.Printf("Set payouts interval to %v", intv)
+    payoutsLog.Infof("Set payouts interval to %v", intv)
 
-    payments := u.backend.GetPendingPayments()
-    if len(payments) > 0 {
-        log.Printf("Previous payout failed, you have to resolve it. List of failed payments:\n %v",
-            formatPendingPayments(payments))
-        return
-    }
-
-    locked, err := u.backend.IsPayoutsLocked()
-    if err != nil {
-        log.Println("Unable to start payouts:", err)
-        return
-    }
-    if locked {
-        log.Println("Unable to start payouts because they are locked")
+    if !u.reconcilePayouts() {
+        payoutsLog.Warn("Unable to start payouts because they are locked")
         return
     }
 
@@ -93,6 +120,8 @@ func (u *PayoutsProcessor) Start() {
             case <-timer.C:
                 u.process()
                 timer.Reset(intv)
+            case cfg := <-u.reload:
+                u.applyConfig(cfg)
             }
         }
     }()
@@ -100,37 +129,55 @@ func (u *PayoutsProcessor) Start() {
 
 func (u *PayoutsProcessor) process() {
     if u.halt {
-        log.Println("Payments suspended due to last critical error:", u.lastFail)
+        payoutsLog.Error("Payments suspended due to last critical error:", u.lastFail)
         return
     }
-    err := u.backend.UnlockPayouts()
+    err := u.ledger.UnlockPayouts()
     if err != nil {
-        log.Println("Failed to unlock payouts:", err)
+        payoutsLog.Error("Failed to unlock payouts:", err)
         return
     }
     mustPay := 0
     minersPaid := 0
     totalAmount := big.NewInt(0)
-    payees, err := u.backend.GetPayees()
+    payees, err := u.ledger.GetPayees()
+    if err != nil {
+        payoutsLog.Error("Error while retrieving payees from backend:", err)
+        return
+    }
+    closures, err := u.backend.GetClosures("pending")
     if err != nil {
-        log.Println("Error while retrieving payees from backend:", err)
+        payoutsLog.Error("Error while retrieving account closures from backend:", err)
         return
     }
+    closing := make(map[string]bool)
+    for _, c := range closures {
+        closing[c.Login] = true
+    }
+    var batch []*batchPayment
     
-    u.rpc.SetAddress(u.config.Address)
+    // Locally signed payouts need no wallet account on node
+    if !u.config.Signer.Enabled {
+        u.rpc.SetAddress(u.config.Address)
+    }
     
     Payments:
         for _, login := range payees {
-            amount, _ := u.backend.GetBalance(login)
+            amount, _ := u.ledger.GetBalance(login)
             amountInShannon := big.NewInt(amount)
-            if !u.reachedThreshold(amountInShannon) {
+            if !u.reachedThreshold(login, amountInShannon, closing[login]) {
                 continue
             }
             mustPay++
 
+            if u.config.Mode == "batch" {
+                batch = append(batch, &batchPayment{login: login, amount: amount})
+                continue
+            }
+
             // Require active peers before processing
             if !u.checkPeers() {
-                log.Println("Insufficient peers for payment... Will delay until next run.")
+                payoutsLog.Warn("Insufficient peers for payment... Will delay until next run.")
                 break
             }
 
@@ -152,60 +199,69 @@ func (u *PayoutsProcessor) process() {
             }
             
             // Lock payments for current payout
-            err = u.backend.LockPayouts(login, amount)
+            err = u.ledger.LockPayouts(login, amount)
             if err != nil {
-                log.Printf("Failed to lock payment for %s: %v", login, err)
+                payoutsLog.Errorf("Failed to lock payment for %s: %v", login, err)
                 u.halt = true
                 u.lastFail = err
                 break
             }
-            log.Printf("Locked payment for %s, %v Satoshi", login, amount)
+            payoutsLog.Infof("Locked payment for %s, %v Satoshi", login, amount)
 
-            txHash, err := u.rpc.SendTransaction(u.config.Address, login, strconv.FormatInt(amount, 10))
+            err = u.ledger.SetPayoutsTx("")
+            if err != nil {
+                payoutsLog.Errorf("Failed to mark payment for %s as sending: %v", login, err)
+                u.halt = true
+                u.lastFail = err
+                break
+            }
+            txHash, err := u.sender.SendTransaction(u.config.Address, login, strconv.FormatInt(amount, 10))
             if err != nil || txHash == "" {
-                log.Printf("Failed to send payment to %s, %v Satoshi: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
+                payoutsLog.Errorf("Failed to send payment to %s, %v Satoshi: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
                     login, amount, err, login)
                 u.halt = true
                 u.lastFail = err
                 break
             }
+            u.recordTx(txHash)
             
             maxTxChecks := 59
             txChecks := 0
             // Wait for TX confirmation before further payouts
             Transaction:
                 for {
-                    log.Printf("Waiting for TxReceipt: %v", txHash)
+                    payoutsLog.Infof("Waiting for TxReceipt: %v", txHash)
                     time.Sleep(txCheckInterval)
                     receipt, err := u.rpc.GetTransaction(txHash)
                     
                     if receipt != nil && receipt.Confirmed() && txHash == receipt.Hash {
-                        log.Printf("TxReceipt confirmed for Miner %s: Satoshi: %v, Tx: %s", login, amount, txHash)
+                        payoutsLog.Infof("TxReceipt confirmed for Miner %s: Satoshi: %v, Tx: %s", login, amount, txHash)
                         
                         // Debit miner's balance and update stats
-                        err = u.backend.UpdateBalance(login, amount)
+                        err = u.ledger.UpdateBalance(login, amount)
                         if err != nil {
-                            log.Printf("Failed to update balance for Miner: %s, Satoshi: %v [%v]", login, amount, err)
+                            payoutsLog.Errorf("Failed to update balance for Miner: %s, Satoshi: %v [%v]", login, amount, err)
                             u.halt = true
                             u.lastFail = err
                             break Payments
                         }
-                        log.Printf("Balance updated for Miner: %s, Satoshi: %v", login, amount)
+                        payoutsLog.Infof("Balance updated for Miner: %s, Satoshi: %v", login, amount)
                         
                         // Log transaction hash
-                        err = u.backend.WritePayment(login, txHash, amount)
+                        err = u.ledger.WritePayment(login, txHash, amount)
                         if err != nil {
-                            log.Printf("Failed to log TxReceipt for Miner: %s, Satoshi: %v, Tx: %s [%v]", login, amount, txHash, err)
+                            payoutsLog.Errorf("Failed to log TxReceipt for Miner: %s, Satoshi: %v, Tx: %s [%v]", login, amount, txHash, err)
                             u.halt = true
                             u.lastFail = err
                             break Payments
                         }
-                        log.Printf("TxReceipt logged for Miner: %s, Satoshi: %v, Tx: %s", login, amount, txHash)
+                        payoutsLog.Infof("TxReceipt logged for Miner: %s, Satoshi: %v, Tx: %s", login, amount, txHash)
+                        u.publisher.Payment(&events.PaymentEvent{Login: login, Amount: amount, Tx: txHash})
                         break Transaction
                     }
                     
                     if err != nil && txChecks > maxTxChecks {
-                        log.Printf("Restarting payouts in 10 minutes to reattempt payment. Failed to get TxReceipt %s: %s", login, txHash)
+                        payoutsLog.Errorf("Restarting payouts in 10 minutes to reattempt payment. Failed to get TxReceipt %s: %s", login, txHash)
                         time.Sleep(failedTxReceiptRestartDelay)
                         u.process()
                     }
@@ -214,13 +270,23 @@ func (u *PayoutsProcessor) process() {
             
             minersPaid++
             totalAmount.Add(totalAmount, big.NewInt(amount))
-            log.Printf("Paid %v ETP to %v, Tx: %v", amount, login, txHash)
+            payoutsLog.Infof("Paid %v ETP to %v, Tx: %v", amount, login, txHash)
         }
 
+    if len(batch) > 0 {
+        paid, amount := u.payBatches(batch)
+        minersPaid += paid
+        totalAmount.Add(totalAmount, amount)
+    }
+
     if mustPay > 0 {
-        log.Printf("Paid total %v ETP to %v of %v payees", totalAmount, minersPaid, mustPay)
+        payoutsLog.Infof("Paid total %v ETP to %v of %v payees", totalAmount, minersPaid, mustPay)
     } else {
-        log.Println("No payees that have reached payout threshold")
+        payoutsLog.Info("No payees that have reached payout threshold")
+    }
+
+    if !u.halt {
+        u.settleClosures(closures)
     }
 
     // Save redis state to disk
@@ -229,21 +295,87 @@ func (u *PayoutsProcessor) process() {
     }
 }
 
+// Closing accounts left with dust only and no credits to come are ready for deletion
+func (u *PayoutsProcessor) settleClosures(closures []*storage.Closure) {
+    for _, c := range closures {
+        balance, locked, err := u.ledger.GetClosingBalance(c.Login)
+        if err != nil {
+            payoutsLog.Errorf("Failed to get closing balance of %v: %v", c.Login, err)
+            continue
+        }
+        if balance > u.config.ClosureDust || locked > 0 {
+            continue
+        }
+        // Shares of open rounds are credited later
+        unpaid, err := u.ledger.HasRoundShares(c.Login)
+        if err != nil {
+            payoutsLog.Errorf("Failed to check round shares of %v: %v", c.Login, err)
+            continue
+        }
+        if unpaid {
+            continue
+        }
+        err = u.backend.MarkClosurePaid(c, balance, util.MakeTimestamp()/1000)
+        if err != nil {
+            payoutsLog.Errorf("Failed to mark closure of %v as paid: %v", c.Login, err)
+            continue
+        }
+        payoutsLog.Infof("Account %v closed, %v Satoshi dust left, data scheduled for deletion", c.Login, balance)
+    }
+}
+
+// Schedules new threshold and peers requirement to be applied between payout runs
+func (u *PayoutsProcessor) Reload(cfg *PayoutsConfig) {
+    select {
+    case u.reload <- cfg:
+    default:
+        payoutsLog.Info("Payouts config reload is already pending")
+    }
+}
+
+func (u *PayoutsProcessor) applyConfig(cfg *PayoutsConfig) {
+    u.config.Threshold = cfg.Threshold
+    u.config.RequirePeers = cfg.RequirePeers
+    u.config.BgSave = cfg.BgSave
+    u.config.ClosureDust = cfg.ClosureDust
+    u.config.MaxRecipients = cfg.MaxRecipients
+    payoutsLog.Infof("Payouts config reloaded, threshold: %v, required peers: %v", cfg.Threshold, cfg.RequirePeers)
+}
+
 func (self PayoutsProcessor) checkPeers() bool {
     peers, err := self.rpc.GetPeerCount()
     if err != nil {
-        log.Println("Unable to start payouts, failed to retrieve number of peers from node:", err)
+        payoutsLog.Error("Unable to start payouts, failed to retrieve number of peers from node:", err)
         return false
     }
     if peers < self.config.RequirePeers {
-        log.Println("Unable to start payouts, number of peers on a node is less than required", self.config.RequirePeers)
+        payoutsLog.Error("Unable to start payouts, number of peers on a node is less than required", self.config.RequirePeers)
         return false
     }
     return true
 }
 
-func (self PayoutsProcessor) reachedThreshold(amount *big.Int) bool {
-    return big.NewInt(self.config.Threshold).Cmp(amount) < 0
+// Personal threshold set by miner through API takes precedence over global one,
+// closing accounts are paid out down to dust
+func (self PayoutsProcessor) reachedThreshold(login string, amount *big.Int, closing bool) bool {
+    if closing {
+        return big.NewInt(self.config.ClosureDust).Cmp(amount) < 0
+    }
+    threshold, err := self.backend.GetMinerThreshold(login)
+    if err != nil {
+        payoutsLog.Errorf("Failed to get payout threshold of %v, using default: %v", login, err)
+    }
+    if threshold <= 0 {
+        threshold = self.config.Threshold
+    }
+    return big.NewInt(threshold).Cmp(amount) < 0
+}
+
+// Tx hash lets crash recovery settle the payout, failing to store it only costs manual resolution
+func (u *PayoutsProcessor) recordTx(txHash string) {
+    if err := u.ledger.SetPayoutsTx(txHash); err != nil {
+        payoutsLog.Errorf("Failed to record payout tx %v: %v", txHash, err)
+    }
 }
 
 func formatPendingPayments(list []*storage.PendingPayment) string {
@@ -257,39 +389,39 @@ func formatPendingPayments(list []*storage.PendingPayment) string {
 func (self PayoutsProcessor) bgSave() {
     result, err := self.backend.BgSave()
     if err != nil {
-        log.Println("Failed to perform BGSAVE on backend:", err)
+        payoutsLog.Error("Failed to perform BGSAVE on backend:", err)
         return
     }
-    log.Println("Saving backend state to disk:", result)
+    payoutsLog.Info("Saving backend state to disk:", result)
 }
 
 func (self PayoutsProcessor) resolvePayouts() {
-    payments := self.backend.GetPendingPayments()
+    payments := self.ledger.GetPendingPayments()
 
     if len(payments) > 0 {
-        log.Printf("Will credit back following balances:\n%s", formatPendingPayments(payments))
+        payoutsLog.Infof("Will credit back following balances:\n%s", formatPendingPayments(payments))
 
         for _, v := range payments {
-            err := self.backend.RollbackBalance(v.Address, v.Amount)
+            err := self.ledger.RollbackBalance(v.Address, v.Amount)
             if err != nil {
-                log.Printf("Failed to credit %v Satoshi back to %s, error is: %v", v.Amount, v.Address, err)
+                payoutsLog.Errorf("Failed to credit %v Satoshi back to %s, error is: %v", v.Amount, v.Address, err)
                 return
             }
-            log.Printf("Credited %v Satoshi back to %s", v.Amount, v.Address)
+            payoutsLog.Infof("Credited %v Satoshi back to %s", v.Amount, v.Address)
         }
-        err := self.backend.UnlockPayouts()
+        err := self.ledger.UnlockPayouts()
         if err != nil {
-            log.Println("Failed to unlock payouts:", err)
+            payoutsLog.Error("Failed to unlock payouts:", err)
             return
         }
     } else {
-        log.Println("No pending payments to resolve")
+        payoutsLog.Info("No pending payments to resolve")
     }
 
     if self.config.BgSave {
         self.bgSave()
     }
-    log.Println("Payouts unlocked")
+    payoutsLog.Info("Payouts unlocked")
 }
 
 func (self PayoutsProcessor) mustResolvePayout() bool {
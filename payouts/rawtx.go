@@ -0,0 +1,231 @@
+package payouts
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/binary"
+    "fmt"
+
+    "github.com/btcsuite/btcd/btcec"
+)
+
+// Only SIGHASH_ALL is used, every input commits to all outputs
+const sigHashAll = 1
+
+// Attachment carried by every Metaverse output, only plain ETP ones are paid out
+const (
+    attachEtp         = 0
+    attachEtpAward    = 1
+    attachMessage     = 3
+    // Attachment version which adds from and to DIDs
+    attachDidVersion  = 207
+)
+
+type txInput struct {
+    prevout        []byte
+    script         []byte
+    sequence       []byte
+}
+
+type txOutput struct {
+    value          int64
+    script         []byte
+    attachType     uint32
+}
+
+// Transaction built by node, outputs are kept as sent for serialization
+// since signature hash only needs them serialized
+type rawTx struct {
+    version        []byte
+    inputs         []*txInput
+    outputs        []*txOutput
+    outputsRaw     []byte
+    locktime       []byte
+}
+
+func parseRawTx(data []byte) (*rawTx, error) {
+    r := &txReader{data: data}
+    tx := &rawTx{version: r.next(4)}
+    n := r.varint()
+    for i := uint64(0); i < n && r.err == nil; i++ {
+        in := &txInput{prevout: r.next(36)}
+        in.script = r.next(int(r.varint()))
+        in.sequence = r.next(4)
+        tx.inputs = append(tx.inputs, in)
+    }
+    start := r.pos
+    n = r.varint()
+    for i := uint64(0); i < n && r.err == nil; i++ {
+        out, err := r.output()
+        if err != nil {
+            return nil, err
+        }
+        tx.outputs = append(tx.outputs, out)
+    }
+    if r.err != nil || len(data)-r.pos != 4 {
+        return nil, fmt.Errorf("Malformed raw transaction")
+    }
+    tx.outputsRaw = data[start:r.pos]
+    tx.locktime = data[r.pos:]
+    return tx, nil
+}
+
+// Value, script and attachment of output, attachments of assets and identities are not supported
+func (r *txReader) output() (*txOutput, error) {
+    out := &txOutput{}
+    if v := r.next(8); v != nil {
+        out.value = int64(binary.LittleEndian.Uint64(v))
+    }
+    out.script = r.next(int(r.varint()))
+    var version uint32
+    if v := r.next(4); v != nil {
+        version = binary.LittleEndian.Uint32(v)
+    }
+    if v := r.next(4); v != nil {
+        out.attachType = binary.LittleEndian.Uint32(v)
+    }
+    if version == attachDidVersion {
+        r.next(int(r.varint()))
+        r.next(int(r.varint()))
+    }
+    switch out.attachType {
+    case attachEtp, attachEtpAward:
+        r.next(8)
+    case attachMessage:
+        r.next(int(r.varint()))
+    default:
+        if r.err == nil {
+            return nil, fmt.Errorf("Unsupported output attachment type %v", out.attachType)
+        }
+    }
+    return out, nil
+}
+
+func (tx *rawTx) serialize(script func(i int) []byte) []byte {
+    var b bytes.Buffer
+    b.Write(tx.version)
+    writeVarint(&b, uint64(len(tx.inputs)))
+    for i, in := range tx.inputs {
+        s := script(i)
+        b.Write(in.prevout)
+        writeVarint(&b, uint64(len(s)))
+        b.Write(s)
+        b.Write(in.sequence)
+    }
+    b.Write(tx.outputsRaw)
+    b.Write(tx.locktime)
+    return b.Bytes()
+}
+
+// Legacy signature hash: other inputs have empty scripts, signed one has script of spent output
+func (tx *rawTx) sigHash(index int, prevScript []byte) []byte {
+    data := tx.serialize(func(i int) []byte {
+        if i == index {
+            return prevScript
+        }
+        return nil
+    })
+    var hashType [4]byte
+    binary.LittleEndian.PutUint32(hashType[:], sigHashAll)
+    return doubleSha256(append(data, hashType[:]...))
+}
+
+// Signs every input as pay to public key hash of key, inputs must spend outputs of its address
+func (tx *rawTx) sign(key *btcec.PrivateKey, pubKey []byte) ([]byte, error) {
+    prevScript := payToPubKeyHash(hash160(pubKey))
+    scripts := make([][]byte, len(tx.inputs))
+    for i, in := range tx.inputs {
+        if len(in.script) > 0 && !bytes.Equal(in.script, prevScript) {
+            return nil, fmt.Errorf("Input %v doesn't spend output of signing key", i)
+        }
+        sig, err := key.Sign(tx.sigHash(i, prevScript))
+        if err != nil {
+            return nil, err
+        }
+        der := append(sig.Serialize(), sigHashAll)
+        var s bytes.Buffer
+        writePush(&s, der)
+        writePush(&s, pubKey)
+        scripts[i] = s.Bytes()
+    }
+    return tx.serialize(func(i int) []byte { return scripts[i] }), nil
+}
+
+// OP_DUP OP_HASH160 <hash> OP_EQUALVERIFY OP_CHECKSIG
+func payToPubKeyHash(hash []byte) []byte {
+    script := []byte{0x76, 0xa9, byte(len(hash))}
+    script = append(script, hash...)
+    return append(script, 0x88, 0xac)
+}
+
+func writePush(b *bytes.Buffer, data []byte) {
+    // Signatures and public keys fit direct push
+    b.WriteByte(byte(len(data)))
+    b.Write(data)
+}
+
+func writeVarint(b *bytes.Buffer, n uint64) {
+    var buf [9]byte
+    switch {
+    case n < 0xfd:
+        b.WriteByte(byte(n))
+    case n <= 0xffff:
+        buf[0] = 0xfd
+        binary.LittleEndian.PutUint16(buf[1:], uint16(n))
+        b.Write(buf[:3])
+    case n <= 0xffffffff:
+        buf[0] = 0xfe
+        binary.LittleEndian.PutUint32(buf[1:], uint32(n))
+        b.Write(buf[:5])
+    default:
+        buf[0] = 0xff
+        binary.LittleEndian.PutUint64(buf[1:], n)
+        b.Write(buf[:])
+    }
+}
+
+type txReader struct {
+    data           []byte
+    pos            int
+    err            error
+}
+
+func (r *txReader) next(n int) []byte {
+    if r.err != nil || n < 0 || r.pos+n > len(r.data) {
+        r.err = fmt.Errorf("Unexpected end of transaction")
+        return nil
+    }
+    b := r.data[r.pos : r.pos+n]
+    r.pos += n
+    return b
+}
+
+func (r *txReader) varint() uint64 {
+    b := r.next(1)
+    if b == nil {
+        return 0
+    }
+    switch b[0] {
+    case 0xfd:
+        if v := r.next(2); v != nil {
+            return uint64(binary.LittleEndian.Uint16(v))
+        }
+    case 0xfe:
+        if v := r.next(4); v != nil {
+            return uint64(binary.LittleEndian.Uint32(v))
+        }
+    case 0xff:
+        if v := r.next(8); v != nil {
+            return binary.LittleEndian.Uint64(v)
+        }
+    default:
+        return uint64(b[0])
+    }
+    return 0
+}
+
+func doubleSha256(data []byte) []byte {
+    h := sha256.Sum256(data)
+    h = sha256.Sum256(h[:])
+    return h[:]
+}
@@ -0,0 +1,133 @@
+package payouts
+
+import (
+    "bytes"
+    "encoding/hex"
+    "testing"
+
+    "github.com/btcsuite/btcd/btcec"
+)
+
+const (
+    testKey     = "7a28b5ba57c53603b0b07b56bba752f7784bf506fa95edc395f5cf6c7514fe9d"
+    testAddress = "MTjoVsx2tBwWEDkX2KP8Nz5by6pCogXiQb"
+    // Pays 1 ETP to recipient and 0.0001 ETP change to testAddress, outputs carry ETP attachments
+    testTx = "01000000" + "01" +
+        "3333333333333333333333333333333333333333333333333333333333333333" + "00000000" + "00" + "ffffffff" +
+        "02" +
+        "00e1f50500000000" + "1976a9140102030405060708090a0b0c0d0e0f101112131488ac" + "01000000" + "00000000" + "00e1f50500000000" +
+        "1027000000000000" + "1976a914d99d76e6417fe79aa50a88d8a2ad67f3c51c21da88ac" + "01000000" + "00000000" + "1027000000000000" +
+        "00000000"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+    b, err := hex.DecodeString(s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return b
+}
+
+func testSigningKey(t *testing.T) (*btcec.PrivateKey, []byte) {
+    key, pub := btcec.PrivKeyFromBytes(btcec.S256(), decodeHex(t, testKey))
+    return key, pub.SerializeCompressed()
+}
+
+func TestParseRawTx(t *testing.T) {
+    data := decodeHex(t, testTx)
+    tx, err := parseRawTx(data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(tx.inputs) != 1 || len(tx.outputs) != 2 {
+        t.Fatalf("got %v inputs and %v outputs, want 1 and 2", len(tx.inputs), len(tx.outputs))
+    }
+    if tx.outputs[0].value != 100000000 || tx.outputs[1].value != 10000 {
+        t.Errorf("output values %v and %v, want 100000000 and 10000", tx.outputs[0].value, tx.outputs[1].value)
+    }
+    if to, _ := scriptAddress(tx.outputs[1].script); to != testAddress {
+        t.Errorf("change goes to %v, want %v", to, testAddress)
+    }
+    if b := tx.serialize(func(i int) []byte { return tx.inputs[i].script }); !bytes.Equal(b, data) {
+        t.Errorf("serialized %x, want %x", b, data)
+    }
+
+    // Output with DID attachment version and message attachment
+    did := "01000000" + "00" + "02" +
+        "0a00000000000000" + "00" + "cf000000" + "00000000" + "0161" + "00" + "0a00000000000000" +
+        "0000000000000000" + "00" + "01000000" + "03000000" + "026869" +
+        "00000000"
+    tx, err = parseRawTx(decodeHex(t, did))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if tx.outputs[0].attachType != attachEtp || tx.outputs[1].attachType != attachMessage {
+        t.Errorf("attachment types %v and %v, want %v and %v", tx.outputs[0].attachType, tx.outputs[1].attachType, attachEtp, attachMessage)
+    }
+
+    bad := []string{
+        "",
+        testTx[:len(testTx)-2],
+        testTx + "00",
+        // Asset attachment
+        "01000000" + "00" + "01" + "0a00000000000000" + "00" + "01000000" + "02000000" + "00000000" + "00000000",
+    }
+    for _, s := range bad {
+        if _, err := parseRawTx(decodeHex(t, s)); err == nil {
+            t.Errorf("parsed malformed transaction %v", s)
+        }
+    }
+}
+
+// Known answers are computed with btcd txscript on a transaction without attachments,
+// signature hash doesn't look into outputs
+func legacyTx(t *testing.T) *rawTx {
+    data := decodeHex(t, "0100000002"+
+        "1111111111111111111111111111111111111111111111111111111111111111"+"00000000"+"00"+"ffffffff"+
+        "2222222222222222222222222222222222222222222222222222222222222222"+"01000000"+"00"+"ffffffff"+
+        "0200e1f505000000001976a9140102030405060708090a0b0c0d0e0f101112131488ac"+
+        "10270000000000001976a914d99d76e6417fe79aa50a88d8a2ad67f3c51c21da88ac"+
+        "00000000")
+    return &rawTx{
+        version:    data[:4],
+        inputs:     []*txInput{{prevout: data[5:41], sequence: data[42:46]}, {prevout: data[46:82], sequence: data[83:87]}},
+        outputsRaw: data[87 : len(data)-4],
+        locktime:   data[len(data)-4:],
+    }
+}
+
+func TestSigHash(t *testing.T) {
+    _, pubKey := testSigningKey(t)
+    script := payToPubKeyHash(hash160(pubKey))
+    tx := legacyTx(t)
+    want := []string{
+        "1ba38bf48fab1dfa5dd7be50aca466b5a7daac3878eb1c571192da9f3f7fd7a5",
+        "c067b10dbeac8ee3555e10de94dc1c481460a34d29447f40ed2774df8644463d",
+    }
+    for i, w := range want {
+        if h := tx.sigHash(i, script); hex.EncodeToString(h) != w {
+            t.Errorf("input %v: signature hash %x, want %v", i, h, w)
+        }
+    }
+}
+
+// Signatures are deterministic (RFC 6979), expected transaction passes btcd script engine
+func TestSign(t *testing.T) {
+    key, pubKey := testSigningKey(t)
+    tx := legacyTx(t)
+    signed, err := tx.sign(key, pubKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := "01000000021111111111111111111111111111111111111111111111111111111111111111000000006a473044022077ab648db04557aca783c4c30d346580e924fb7451024a17db45c80648707fa9022075edb5806981ae6dd85d189f96da43885dc82a4ed56b86442916646efa5ddb8f01210332d87c5cd4b31d81c5b010af42a2e413af253dc3a91bd3d53c6b2c45291c3de7ffffffff2222222222222222222222222222222222222222222222222222222222222222010000006a4730440220185dd694d338ff5f9ff44b02f0a06868dea9986c56ffd7c2636c681d233a110602202da4aadede9a3387dd7cb66c996d616e0b30ea6c3080c916386bf282ac26d75501210332d87c5cd4b31d81c5b010af42a2e413af253dc3a91bd3d53c6b2c45291c3de7ffffffff0200e1f505000000001976a9140102030405060708090a0b0c0d0e0f101112131488ac10270000000000001976a914d99d76e6417fe79aa50a88d8a2ad67f3c51c21da88ac00000000"
+    if hex.EncodeToString(signed) != want {
+        t.Errorf("signed %x, want %v", signed, want)
+    }
+
+    // Inputs already holding a script of another key are refused
+    tx = legacyTx(t)
+    tx.inputs[1].script = payToPubKeyHash(make([]byte, 20))
+    if _, err := tx.sign(key, pubKey); err == nil {
+        t.Errorf("signed input spending output of another key")
+    }
+}
@@ -0,0 +1,67 @@
+package payouts
+
+import (
+    "github.com/NotoriousPyro/open-metaverse-pool/events"
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+)
+
+// Settles payout interrupted by crash, returns false when it needs manual resolution.
+// Payout which never reached the node is credited back, payout whose tx confirmed is written,
+// anything in between is left locked.
+func (u *PayoutsProcessor) reconcilePayouts() bool {
+    lock, err := u.ledger.GetPayoutsLock()
+    if err != nil {
+        payoutsLog.Error("Unable to start payouts:", err)
+        return false
+    }
+    payments := u.ledger.GetPendingPayments()
+    if lock == nil {
+        if len(payments) > 0 {
+            payoutsLog.Errorf("Previous payout failed, you have to resolve it. List of failed payments:\n %v",
+                formatPendingPayments(payments))
+            return false
+        }
+        return true
+    }
+    payoutsLog.Warnf("Found interrupted payout of %v Satoshi for %v", lock.Amount, lock.Login)
+
+    if !lock.Sending {
+        payoutsLog.Info("Payout was not sent, crediting balances back")
+        u.resolvePayouts()
+        err = u.ledger.UnlockPayouts()
+        if err != nil {
+            payoutsLog.Error("Failed to unlock payouts:", err)
+            return false
+        }
+        return true
+    }
+    if len(lock.Tx) == 0 {
+        payoutsLog.Errorf("Payout may have been sent but tx hash is unknown, check outgoing tx in block explorer and resolve it manually. Pending payments:\n %v",
+            formatPendingPayments(payments))
+        return false
+    }
+    if !u.waitForTx(lock.Tx) {
+        payoutsLog.Errorf("Tx %v of interrupted payout is not confirmed, resolve it manually", lock.Tx)
+        return false
+    }
+
+    // Single payout debits balance only after confirmation
+    if len(payments) == 0 {
+        err = u.ledger.UpdateBalance(lock.Login, lock.Amount)
+        if err != nil {
+            payoutsLog.Errorf("Failed to update balance for Miner: %s, Satoshi: %v [%v]", lock.Login, lock.Amount, err)
+            return false
+        }
+        payments = []*storage.PendingPayment{{Address: lock.Login, Amount: lock.Amount}}
+    }
+    err = u.ledger.WriteBatchPayments(lock.Tx, payments)
+    if err != nil {
+        payoutsLog.Errorf("Failed to log TxReceipt for interrupted payout, Tx: %s [%v]", lock.Tx, err)
+        return false
+    }
+    for _, p := range payments {
+        u.publisher.Payment(&events.PaymentEvent{Login: p.Address, Amount: p.Amount, Tx: lock.Tx})
+        payoutsLog.Infof("Recovered payment of %v Satoshi to %v, Tx: %v", p.Amount, p.Address, lock.Tx)
+    }
+    return true
+}
@@ -0,0 +1,127 @@
+package payouts
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/rpc"
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+)
+
+const (
+    testMiner  = "MTi43eWRhDPgH1Khv4Vrm5pkrWxhw6sE8X"
+    testMiner2 = "MGqHvbaH9wzdr6oUDFz4S1HptjoKQcjRve"
+    testTxHash = "8a4ad1c6e1c8f0d0ac0a9f5d2c8e0f3b1e6b7e3a8d4c2b1a0f9e8d7c6b5a4939"
+)
+
+// Ledger recording calls made by payouts and unlocker, embedded nil Ledger panics on anything else
+type fakeLedger struct {
+    storage.Ledger
+    lock           *storage.PayoutsLock
+    pending        []*storage.PendingPayment
+    roundShares    map[string]int64
+    pplnsShares    map[string]int64
+    calls          []string
+}
+
+func (l *fakeLedger) GetPayoutsLock() (*storage.PayoutsLock, error) {
+    return l.lock, nil
+}
+
+func (l *fakeLedger) GetPendingPayments() []*storage.PendingPayment {
+    return l.pending
+}
+
+func (l *fakeLedger) UpdateBalance(login string, amount int64) error {
+    l.calls = append(l.calls, fmt.Sprintf("UpdateBalance %v %v", login, amount))
+    return nil
+}
+
+func (l *fakeLedger) RollbackBalance(login string, amount int64) error {
+    l.calls = append(l.calls, fmt.Sprintf("RollbackBalance %v %v", login, amount))
+    return nil
+}
+
+func (l *fakeLedger) UnlockPayouts() error {
+    l.calls = append(l.calls, "UnlockPayouts")
+    return nil
+}
+
+func (l *fakeLedger) WriteBatchPayments(txHash string, payments []*storage.PendingPayment) error {
+    list := make([]string, len(payments))
+    for i, p := range payments {
+        list[i] = fmt.Sprintf("%v:%v", p.Address, p.Amount)
+    }
+    l.calls = append(l.calls, fmt.Sprintf("WriteBatchPayments %v %v", txHash, strings.Join(list, ",")))
+    return nil
+}
+
+func (l *fakeLedger) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
+    return l.roundShares, nil
+}
+
+func (l *fakeLedger) GetPPLNSShares(nonce string) (map[string]int64, error) {
+    return l.pplnsShares, nil
+}
+
+// Node answering gettx, tx is confirmed when confirmed is set
+func testNode(t *testing.T, confirmed bool) *httptest.Server {
+    return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var req struct {
+            Method string   `json:"method"`
+            Params []string `json:"params"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Method != "gettx" {
+            t.Errorf("unexpected request %v %v", req.Method, err)
+        }
+        reply := map[string]string{}
+        if confirmed {
+            reply["hash"] = req.Params[len(req.Params)-1]
+        }
+        json.NewEncoder(w).Encode(map[string]interface{}{"id": 0, "jsonrpc": "2.0", "result": reply})
+    }))
+}
+
+func TestReconcilePayouts(t *testing.T) {
+    defer func(intv time.Duration) { txCheckInterval = intv }(txCheckInterval)
+    txCheckInterval = time.Millisecond
+
+    pending := []*storage.PendingPayment{{Address: testMiner, Amount: 100}, {Address: testMiner2, Amount: 200}}
+    tests := []struct {
+        name       string
+        lock       *storage.PayoutsLock
+        pending    []*storage.PendingPayment
+        confirmed  bool
+        ok         bool
+        calls      []string
+    }{
+        {"clean", nil, nil, false, true, nil},
+        {"pending without lock", nil, pending, false, false, nil},
+        {"not sending", &storage.PayoutsLock{Login: "batch", Amount: 300}, pending, false, true,
+            []string{"RollbackBalance " + testMiner + " 100", "RollbackBalance " + testMiner2 + " 200", "UnlockPayouts", "UnlockPayouts"}},
+        {"sending without hash", &storage.PayoutsLock{Login: "batch", Amount: 300, Sending: true}, pending, true, false, nil},
+        {"not confirmed", &storage.PayoutsLock{Login: "batch", Amount: 300, Sending: true, Tx: testTxHash}, pending, false, false, nil},
+        {"confirmed single", &storage.PayoutsLock{Login: testMiner, Amount: 100, Sending: true, Tx: testTxHash}, nil, true, true,
+            []string{"UpdateBalance " + testMiner + " 100", "WriteBatchPayments " + testTxHash + " " + testMiner + ":100"}},
+        {"confirmed batch", &storage.PayoutsLock{Login: "batch", Amount: 300, Sending: true, Tx: testTxHash}, pending, true, true,
+            []string{"WriteBatchPayments " + testTxHash + " " + testMiner + ":100," + testMiner2 + ":200"}},
+    }
+    for _, tt := range tests {
+        node := testNode(t, tt.confirmed)
+        ledger := &fakeLedger{lock: tt.lock, pending: tt.pending}
+        u := &PayoutsProcessor{config: &PayoutsConfig{}, ledger: ledger, rpc: rpc.NewRPCClient("test", node.URL, "", "", "1s")}
+        if ok := u.reconcilePayouts(); ok != tt.ok {
+            t.Errorf("%v: reconciled %v, want %v", tt.name, ok, tt.ok)
+        }
+        if !reflect.DeepEqual(ledger.calls, tt.calls) {
+            t.Errorf("%v: ledger calls %q, want %q", tt.name, ledger.calls, tt.calls)
+        }
+        node.Close()
+    }
+}
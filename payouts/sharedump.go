@@ -0,0 +1,61 @@
+package payouts
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/json"
+    "math/big"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+// Everything needed to recompute reward split of a block
+type ShareDump struct {
+    Height         int64              `json:"height"`
+    Hash           string             `json:"hash"`
+    RoundHeight    int64              `json:"roundHeight"`
+    Nonce          string             `json:"nonce"`
+    Reward         string             `json:"reward"`
+    PoolFee        float64            `json:"poolFee"`
+    PoolProfit     string             `json:"poolProfit"`
+    RewardMode     string             `json:"rewardMode"`
+    TotalShares    int64              `json:"totalShares"`
+    Shares         map[string]int64   `json:"shares"`
+    Rewards        map[string]int64   `json:"rewards"`
+}
+
+// Must be called before round shares are removed by WriteMaturedBlock
+func (u *BlockUnlocker) writeShareDump(block *storage.BlockData, revenue, poolProfit *big.Rat, rewards map[string]int64) error {
+    shares, totalShares, rewardMode, err := u.rewardShares(block)
+    if err != nil {
+        return err
+    }
+    poolFee, _ := u.blockFee(block, rewardMode)
+    dump := ShareDump{
+        Height:      block.Height,
+        Hash:        block.Hash,
+        RoundHeight: block.RoundHeight,
+        Nonce:       block.Nonce,
+        Reward:      util.FormatRatReward(revenue),
+        PoolFee:     poolFee,
+        PoolProfit:  util.FormatRatReward(poolProfit),
+        RewardMode:  rewardMode,
+        TotalShares: totalShares,
+        Shares:      shares,
+        Rewards:     rewards,
+    }
+
+    var buf bytes.Buffer
+    zw := gzip.NewWriter(&buf)
+    err = json.NewEncoder(zw).Encode(&dump)
+    if err != nil {
+        return err
+    }
+    err = zw.Close()
+    if err != nil {
+        return err
+    }
+
+    return u.backend.WriteShareDump(block.Height, block.Hash, buf.Bytes(), u.shareDumpsExpire)
+}
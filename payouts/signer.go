@@ -0,0 +1,395 @@
+package payouts
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "math/big"
+    "os"
+    "strings"
+
+    "github.com/btcsuite/btcd/btcec"
+    "golang.org/x/crypto/pbkdf2"
+    "golang.org/x/crypto/ripemd160"
+    "golang.org/x/crypto/scrypt"
+    "golang.org/x/crypto/sha3"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/rpc"
+)
+
+type SignerConfig struct {
+    Enabled         bool     `json:"enabled"`
+    // Web3 secret storage file of payouts address key, password is read from KEYSTORE_PASSWORD.
+    // Hex key in PAYOUT_PRIVATE_KEY is used instead if set
+    Keystore        string   `json:"keystore"`
+    // Fee of every payout tx in Satoshi, 0 leaves default of node
+    Fee             int64    `json:"fee"`
+}
+
+// Sends payments from pool address, by wallet account on node or signed locally
+type paymentSender interface {
+    SendTransaction(from, to, value string) (string, error)
+    SendMore(recipients []string, amounts []int64, change string) (string, error)
+}
+
+// Mainnet pay to public key hash and pay to script hash address versions
+const (
+    addressVersion       = 0x32
+    scriptAddressVersion = 0x05
+)
+
+// Node default fee, payouts with fee left to node refuse to pay more
+const defaultFeeLimit = 10000
+
+// Signs payout transactions with key held by payouts module, node only builds
+// unsigned transaction from UTXOs of address and broadcasts signed one
+type txSigner struct {
+    rpc            *rpc.RPCClient
+    key            *btcec.PrivateKey
+    pubKey         []byte
+    address        string
+    fee            int64
+}
+
+func newTxSigner(cfg *PayoutsConfig, client *rpc.RPCClient) (*txSigner, error) {
+    key, pubKey, err := LoadSigningKey(cfg)
+    if err != nil {
+        return nil, err
+    }
+    return &txSigner{rpc: client, key: key, pubKey: pubKey, address: cfg.Address, fee: cfg.Signer.Fee}, nil
+}
+
+// Loads key of payouts address, fails if key doesn't belong to it
+func LoadSigningKey(cfg *PayoutsConfig) (*btcec.PrivateKey, []byte, error) {
+    var raw []byte
+    var err error
+    if env := os.Getenv("PAYOUT_PRIVATE_KEY"); len(env) > 0 {
+        raw, err = hex.DecodeString(strings.TrimPrefix(env, "0x"))
+        if err != nil {
+            return nil, nil, fmt.Errorf("Invalid PAYOUT_PRIVATE_KEY: %v", err)
+        }
+    } else if len(cfg.Signer.Keystore) > 0 {
+        raw, err = decryptKeystore(cfg.Signer.Keystore, os.Getenv("KEYSTORE_PASSWORD"))
+        if err != nil {
+            return nil, nil, err
+        }
+    } else {
+        return nil, nil, fmt.Errorf("Signer requires keystore or PAYOUT_PRIVATE_KEY")
+    }
+    if len(raw) != 32 {
+        return nil, nil, fmt.Errorf("Private key must be 32 bytes, got %v", len(raw))
+    }
+    key, pub := btcec.PrivKeyFromBytes(btcec.S256(), raw)
+    // Wallets derive addresses from either form of public key
+    for _, pubKey := range [][]byte{pub.SerializeCompressed(), pub.SerializeUncompressed()} {
+        if pubKeyAddress(pubKey) == cfg.Address {
+            return key, pubKey, nil
+        }
+    }
+    return nil, nil, fmt.Errorf("Signing key is of address %v, not payouts address %v", pubKeyAddress(pub.SerializeCompressed()), cfg.Address)
+}
+
+func (s *txSigner) SendTransaction(from, to, value string) (string, error) {
+    amount, ok := new(big.Int).SetString(value, 10)
+    if !ok || !amount.IsInt64() {
+        return "", fmt.Errorf("Invalid amount %v", value)
+    }
+    return s.send([]string{to}, []int64{amount.Int64()}, from)
+}
+
+func (s *txSigner) SendMore(recipients []string, amounts []int64, change string) (string, error) {
+    return s.send(recipients, amounts, change)
+}
+
+// Node only builds transaction, it's checked to pay exactly what was asked before it's signed
+func (s *txSigner) send(recipients []string, amounts []int64, change string) (string, error) {
+    if change != s.address {
+        return "", fmt.Errorf("Change must go to payouts address %v, not %v", s.address, change)
+    }
+    unsigned, err := s.rpc.CreateRawTx(s.address, recipients, amounts, change, s.fee)
+    if err != nil {
+        return "", err
+    }
+    data, err := hex.DecodeString(unsigned)
+    if err != nil {
+        return "", fmt.Errorf("Malformed raw transaction from node: %v", err)
+    }
+    tx, err := parseRawTx(data)
+    if err != nil {
+        return "", err
+    }
+    paid, err := checkOutputs(tx, recipients, amounts, change)
+    if err != nil {
+        return "", fmt.Errorf("Refusing to sign transaction from node: %v", err)
+    }
+    spent, err := s.inputsValue(tx)
+    if err != nil {
+        return "", fmt.Errorf("Refusing to sign transaction from node: %v", err)
+    }
+    if err := checkFee(spent-paid, s.fee); err != nil {
+        return "", fmt.Errorf("Refusing to sign transaction from node: %v", err)
+    }
+    signed, err := tx.sign(s.key, s.pubKey)
+    if err != nil {
+        return "", err
+    }
+    return s.rpc.SendRawTx(hex.EncodeToString(signed))
+}
+
+// Sums outputs spent by tx, each is read from its transaction checked against outpoint
+func (s *txSigner) inputsValue(tx *rawTx) (int64, error) {
+    script := payToPubKeyHash(hash160(s.pubKey))
+    var total int64
+    for i, in := range tx.inputs {
+        prev, err := s.rpc.GetRawTx(outpointHash(in.prevout))
+        if err != nil {
+            return 0, err
+        }
+        data, err := hex.DecodeString(prev)
+        if err != nil {
+            return 0, fmt.Errorf("Malformed transaction spent by input %v: %v", i, err)
+        }
+        out, err := spentOutput(data, in.prevout)
+        if err != nil {
+            return 0, fmt.Errorf("Input %v: %v", i, err)
+        }
+        if !bytes.Equal(out.script, script) {
+            return 0, fmt.Errorf("Input %v doesn't spend output of payouts address", i)
+        }
+        total += out.value
+    }
+    return total, nil
+}
+
+// Every output must pay one of recipients its amount or return change to change address
+func checkOutputs(tx *rawTx, recipients []string, amounts []int64, change string) (int64, error) {
+    expected := make(map[string][]int64)
+    for i, to := range recipients {
+        expected[to] = append(expected[to], amounts[i])
+    }
+    var total int64
+    changed := false
+    for i, out := range tx.outputs {
+        if out.attachType != attachEtp {
+            return 0, fmt.Errorf("Output %v is not a plain ETP transfer", i)
+        }
+        if out.value <= 0 || total+out.value < total {
+            return 0, fmt.Errorf("Output %v has invalid value %v", i, out.value)
+        }
+        to, ok := scriptAddress(out.script)
+        if !ok {
+            return 0, fmt.Errorf("Output %v pays unknown script", i)
+        }
+        total += out.value
+        if takeAmount(expected, to, out.value) {
+            continue
+        }
+        if to == change && !changed {
+            changed = true
+            continue
+        }
+        return 0, fmt.Errorf("Output %v pays %v to %v which was not requested", i, out.value, to)
+    }
+    for to, left := range expected {
+        if len(left) > 0 {
+            return 0, fmt.Errorf("Transaction doesn't pay %v to %v", left[0], to)
+        }
+    }
+    return total, nil
+}
+
+func takeAmount(expected map[string][]int64, to string, value int64) bool {
+    for i, amount := range expected[to] {
+        if amount == value {
+            expected[to] = append(expected[to][:i], expected[to][i+1:]...)
+            return true
+        }
+    }
+    return false
+}
+
+// Fee must be the configured one, or within default of node when none is configured
+func checkFee(fee, configured int64) error {
+    if fee < 0 {
+        return fmt.Errorf("Outputs exceed spent value by %v", -fee)
+    }
+    if configured > 0 && fee != configured {
+        return fmt.Errorf("Fee %v differs from configured %v", fee, configured)
+    }
+    if configured <= 0 && fee > defaultFeeLimit {
+        return fmt.Errorf("Fee %v is over default of %v", fee, defaultFeeLimit)
+    }
+    return nil
+}
+
+// Output spent by outpoint, node can't misstate it since transaction must hash to outpoint
+func spentOutput(prev, prevout []byte) (*txOutput, error) {
+    if !bytes.Equal(doubleSha256(prev), prevout[:32]) {
+        return nil, fmt.Errorf("Spent transaction doesn't match outpoint %v", outpointHash(prevout))
+    }
+    tx, err := parseRawTx(prev)
+    if err != nil {
+        return nil, err
+    }
+    index := binary.LittleEndian.Uint32(prevout[32:])
+    if uint64(index) >= uint64(len(tx.outputs)) {
+        return nil, fmt.Errorf("Spent transaction has no output %v", index)
+    }
+    return tx.outputs[index], nil
+}
+
+// Transaction hashes are shown byte reversed
+func outpointHash(prevout []byte) string {
+    hash := make([]byte, 32)
+    for i := range hash {
+        hash[i] = prevout[31-i]
+    }
+    return hex.EncodeToString(hash)
+}
+
+func hash160(data []byte) []byte {
+    h := sha256.Sum256(data)
+    r := ripemd160.New()
+    r.Write(h[:])
+    return r.Sum(nil)
+}
+
+func pubKeyAddress(pubKey []byte) string {
+    return checkEncode(addressVersion, hash160(pubKey))
+}
+
+// Address paid by output script, pay to public key hash and pay to script hash only
+func scriptAddress(script []byte) (string, bool) {
+    switch {
+    case len(script) == 25 && script[0] == 0x76 && script[1] == 0xa9 && script[2] == 20 && script[23] == 0x88 && script[24] == 0xac:
+        return checkEncode(addressVersion, script[3:23]), true
+    case len(script) == 23 && script[0] == 0xa9 && script[1] == 20 && script[22] == 0x87:
+        return checkEncode(scriptAddressVersion, script[2:22]), true
+    }
+    return "", false
+}
+
+func checkEncode(version byte, hash []byte) string {
+    payload := append([]byte{version}, hash...)
+    return base58Encode(append(payload, doubleSha256(payload)[:4]...))
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58Encode(data []byte) string {
+    n := new(big.Int).SetBytes(data)
+    radix := big.NewInt(58)
+    mod := new(big.Int)
+    var out []byte
+    for n.Sign() > 0 {
+        n.DivMod(n, radix, mod)
+        out = append(out, base58Alphabet[mod.Int64()])
+    }
+    for _, b := range data {
+        if b != 0 {
+            break
+        }
+        out = append(out, base58Alphabet[0])
+    }
+    for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+        out[i], out[j] = out[j], out[i]
+    }
+    return string(out)
+}
+
+// Version 3 web3 secret storage, as written by geth and most wallets,
+// older tools spell the key Crypto which is matched as well
+type keystoreFile struct {
+    Crypto         keystoreCrypto   `json:"crypto"`
+}
+
+type keystoreCrypto struct {
+    Cipher         string           `json:"cipher"`
+    CipherText     string           `json:"ciphertext"`
+    CipherParams   struct {
+        IV         string           `json:"iv"`
+    }                               `json:"cipherparams"`
+    KDF            string           `json:"kdf"`
+    KDFParams      struct {
+        DKLen      int              `json:"dklen"`
+        Salt       string           `json:"salt"`
+        N          int              `json:"n"`
+        R          int              `json:"r"`
+        P          int              `json:"p"`
+        C          int              `json:"c"`
+        PRF        string           `json:"prf"`
+    }                               `json:"kdfparams"`
+    MAC            string           `json:"mac"`
+}
+
+func decryptKeystore(path, password string) ([]byte, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var file keystoreFile
+    if err := json.Unmarshal(data, &file); err != nil {
+        return nil, fmt.Errorf("Malformed keystore %v: %v", path, err)
+    }
+    c := &file.Crypto
+    if c.Cipher != "aes-128-ctr" {
+        return nil, fmt.Errorf("Unsupported keystore cipher %q", c.Cipher)
+    }
+    salt, err := hex.DecodeString(c.KDFParams.Salt)
+    if err != nil {
+        return nil, fmt.Errorf("Malformed keystore salt: %v", err)
+    }
+    var derived []byte
+    switch c.KDF {
+    case "scrypt":
+        derived, err = scrypt.Key([]byte(password), salt, c.KDFParams.N, c.KDFParams.R, c.KDFParams.P, c.KDFParams.DKLen)
+        if err != nil {
+            return nil, err
+        }
+    case "pbkdf2":
+        if c.KDFParams.PRF != "hmac-sha256" {
+            return nil, fmt.Errorf("Unsupported keystore prf %q", c.KDFParams.PRF)
+        }
+        derived = pbkdf2.Key([]byte(password), salt, c.KDFParams.C, c.KDFParams.DKLen, sha256.New)
+    default:
+        return nil, fmt.Errorf("Unsupported keystore kdf %q", c.KDF)
+    }
+    if len(derived) < 32 {
+        return nil, fmt.Errorf("Keystore derived key is too short")
+    }
+    cipherText, err := hex.DecodeString(c.CipherText)
+    if err != nil {
+        return nil, fmt.Errorf("Malformed keystore ciphertext: %v", err)
+    }
+    mac, err := hex.DecodeString(c.MAC)
+    if err != nil {
+        return nil, fmt.Errorf("Malformed keystore mac: %v", err)
+    }
+    h := sha3.NewLegacyKeccak256()
+    h.Write(derived[16:32])
+    h.Write(cipherText)
+    if !bytes.Equal(h.Sum(nil), mac) {
+        return nil, fmt.Errorf("Wrong keystore password")
+    }
+    iv, err := hex.DecodeString(c.CipherParams.IV)
+    if err != nil || len(iv) != aes.BlockSize {
+        return nil, fmt.Errorf("Malformed keystore iv")
+    }
+    block, err := aes.NewCipher(derived[:16])
+    if err != nil {
+        return nil, err
+    }
+    key := make([]byte, len(cipherText))
+    cipher.NewCTR(block, iv).XORKeyStream(key, cipherText)
+    // Some old tools stored keys without leading zero bytes
+    if len(key) < 32 {
+        key = append(make([]byte, 32-len(key)), key...)
+    }
+    return key, nil
+}
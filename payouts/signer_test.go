@@ -0,0 +1,165 @@
+package payouts
+
+import (
+    "encoding/binary"
+    "encoding/hex"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestAddress(t *testing.T) {
+    pubKey := decodeHex(t, "0250863ad64a87ae8a2fe83c1af1a8403cb53f53e486d8511dad8a04887e5b2352")
+    if h := hex.EncodeToString(hash160(pubKey)); h != "f54a5851e9372b87810a8e60cdd2e7cfd80b6e31" {
+        t.Errorf("hash160 %v", h)
+    }
+    // Bitcoin wiki example
+    if a := checkEncode(0, decodeHex(t, "010966776006953d5567439e5e39f86a0d273bee")); a != "16UwLL9Risc3QfPqBUvKofHmBQ7wMtjvM" {
+        t.Errorf("address %v", a)
+    }
+    _, key := testSigningKey(t)
+    if a := pubKeyAddress(key); a != testAddress {
+        t.Errorf("address of test key %v, want %v", a, testAddress)
+    }
+    if _, ok := scriptAddress(decodeHex(t, "6a0568656c6c6f")); ok {
+        t.Errorf("address of data script")
+    }
+}
+
+func TestCheckOutputs(t *testing.T) {
+    const recipient = "MTi43eWRhDPgH1Khv4Vrm5pkrWxhw6sE8X"
+    tx, err := parseRawTx(decodeHex(t, testTx))
+    if err != nil {
+        t.Fatal(err)
+    }
+    to, _ := scriptAddress(tx.outputs[0].script)
+    tests := []struct {
+        name       string
+        recipients []string
+        amounts    []int64
+        change     string
+        ok         bool
+    }{
+        {"exact", []string{to}, []int64{100000000}, testAddress, true},
+        {"other amount", []string{to}, []int64{90000000}, testAddress, false},
+        {"other recipient", []string{recipient}, []int64{100000000}, testAddress, false},
+        {"missing recipient", []string{to, recipient}, []int64{100000000, 5}, testAddress, false},
+        {"change elsewhere", []string{to}, []int64{100000000}, recipient, false},
+        // Change paid as the second recipient is fine
+        {"change as recipient", []string{to, testAddress}, []int64{100000000, 10000}, recipient, true},
+    }
+    for _, tt := range tests {
+        total, err := checkOutputs(tx, tt.recipients, tt.amounts, tt.change)
+        if tt.ok && (err != nil || total != 100010000) {
+            t.Errorf("%v: total %v, error %v", tt.name, total, err)
+        }
+        if !tt.ok && err == nil {
+            t.Errorf("%v: accepted", tt.name)
+        }
+    }
+
+    tx.outputs[1].attachType = attachEtpAward
+    if _, err := checkOutputs(tx, []string{to}, []int64{100000000}, testAddress); err == nil {
+        t.Errorf("accepted output with award attachment")
+    }
+}
+
+func TestCheckFee(t *testing.T) {
+    tests := []struct {
+        fee        int64
+        configured int64
+        ok         bool
+    }{
+        {10000, 0, true},
+        {defaultFeeLimit + 1, 0, false},
+        {-1, 0, false},
+        {20000, 20000, true},
+        {10000, 20000, false},
+        {30000, 20000, false},
+    }
+    for _, tt := range tests {
+        if err := checkFee(tt.fee, tt.configured); (err == nil) != tt.ok {
+            t.Errorf("fee %v with configured %v: %v", tt.fee, tt.configured, err)
+        }
+    }
+}
+
+func TestSpentOutput(t *testing.T) {
+    prev := decodeHex(t, testTx)
+    prevout := make([]byte, 36)
+    copy(prevout, doubleSha256(prev))
+    binary.LittleEndian.PutUint32(prevout[32:], 1)
+    out, err := spentOutput(prev, prevout)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if out.value != 10000 {
+        t.Errorf("spent value %v, want 10000", out.value)
+    }
+
+    binary.LittleEndian.PutUint32(prevout[32:], 2)
+    if _, err := spentOutput(prev, prevout); err == nil {
+        t.Errorf("spent missing output")
+    }
+    binary.LittleEndian.PutUint32(prevout[32:], 0)
+    prevout[0] ^= 1
+    if _, err := spentOutput(prev, prevout); err == nil {
+        t.Errorf("accepted transaction not matching outpoint")
+    }
+}
+
+// Vectors of web3 secret storage definition and go-ethereum
+func TestDecryptKeystore(t *testing.T) {
+    tests := []struct {
+        name       string
+        json       string
+        password   string
+        key        string
+    }{
+        {"pbkdf2", `{"crypto":{"cipher":"aes-128-ctr","cipherparams":{"iv":"6087dab2f9fdbbfaddc31a909735c1e6"},"ciphertext":"5318b4d5bcd28de64ee5559e671353e16f075ecae9f99c7a79a38af5f869aa46","kdf":"pbkdf2","kdfparams":{"c":262144,"dklen":32,"prf":"hmac-sha256","salt":"ae3cd4e7013836a3df6bd7241b12db061dbe2c6785853cce422d148a624ce0bd"},"mac":"517ead924a9d0dc3124507e3393d175ce3ff7c1e96529c6c555ce9e51205e9b2"},"version":3}`,
+            "testpassword", testKey},
+        {"scrypt 31 byte key", `{"crypto":{"cipher":"aes-128-ctr","cipherparams":{"iv":"e0c41130a323adc1446fc82f724bca2f"},"ciphertext":"9517cd5bdbe69076f9bf5057248c6c050141e970efa36ce53692d5d59a3984","kdf":"scrypt","kdfparams":{"dklen":32,"n":2,"r":8,"p":1,"salt":"711f816911c92d649fb4c84b047915679933555030b3552c1212609b38208c63"},"mac":"d5e116151c6aa71470e67a7d42c9620c75c4d23229847dcc127794f0732b0db5"},"version":3}`,
+            "foo", "00fa7b3db73dc7dfdf8c5fbdb796d741e4488628c41fc4febd9160a866ba0f35"},
+        {"scrypt 30 byte key", `{"crypto":{"cipher":"aes-128-ctr","cipherparams":{"iv":"3ca92af36ad7c2cd92454c59cea5ef00"},"ciphertext":"108b7d34f3442fc26ab1ab90ca91476ba6bfa8c00975a49ef9051dc675aa","kdf":"scrypt","kdfparams":{"dklen":32,"n":2,"r":8,"p":1,"salt":"d0769e608fb86cda848065642a9c6fa046845c928175662b8e356c77f914cd3b"},"mac":"75d0e6759f7b3cefa319c3be41680ab6beea7d8328653474bd06706d4cc67420"},"version":3}`,
+            "foo", "000081c29e8142bb6a81bef5a92bda7a8328a5c85bb2f9542e76f9b0f94fc018"},
+    }
+    dir, err := ioutil.TempDir("", "keystore")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    for i, tt := range tests {
+        path := filepath.Join(dir, tt.name)
+        if err := ioutil.WriteFile(path, []byte(tt.json), 0600); err != nil {
+            t.Fatal(err)
+        }
+        key, err := decryptKeystore(path, tt.password)
+        if err != nil {
+            t.Errorf("%v: %v", tt.name, err)
+            continue
+        }
+        if hex.EncodeToString(key) != tt.key {
+            t.Errorf("%v: key %x, want %v", tt.name, key, tt.key)
+        }
+        // pbkdf2 one is slow enough to check once
+        if i > 0 {
+            if _, err := decryptKeystore(path, "bar"); err == nil {
+                t.Errorf("%v: decrypted with wrong password", tt.name)
+            }
+        }
+    }
+}
+
+func TestLoadSigningKey(t *testing.T) {
+    defer os.Unsetenv("PAYOUT_PRIVATE_KEY")
+    os.Setenv("PAYOUT_PRIVATE_KEY", "0x"+testKey)
+    cfg := &PayoutsConfig{Address: testAddress, Signer: SignerConfig{Enabled: true}}
+    if _, _, err := LoadSigningKey(cfg); err != nil {
+        t.Errorf("key of payouts address: %v", err)
+    }
+    cfg.Address = "MTi43eWRhDPgH1Khv4Vrm5pkrWxhw6sE8X"
+    if _, _, err := LoadSigningKey(cfg); err == nil {
+        t.Errorf("loaded key of another address")
+    }
+}
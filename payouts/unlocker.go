@@ -2,18 +2,20 @@ package payouts
 
 import (
     "fmt"
-    "log"
     "math"
     "math/big"
     "strconv"
     "strings"
     "time"
 
+    "github.com/NotoriousPyro/open-metaverse-pool/logging"
     "github.com/NotoriousPyro/open-metaverse-pool/rpc"
     "github.com/NotoriousPyro/open-metaverse-pool/storage"
     "github.com/NotoriousPyro/open-metaverse-pool/util"
 )
 
+var unlockerLog = logging.New("unlocker")
+
 type UnlockerConfig struct {
     Enabled          bool     `json:"enabled"`
     PoolFee          float64  `json:"poolFee"`
@@ -28,45 +30,82 @@ type UnlockerConfig struct {
     Password         string
     Address          string   `json:"address"`
     PoolFeeAddress   string   `json:"poolFeeAddress"`
+    // Export shares and rewards of every matured block
+    ShareDumps       bool     `json:"shareDumps"`
+    ShareDumpsExpire string   `json:"shareDumpsExpire"`
+    // prop splits reward by shares of the round, pplns by last shares of proxy pplnsWindow
+    RewardMode       string   `json:"rewardMode"`
+    // Matured credits are not payable for this long so operator can hold disputed blocks
+    DisputeWindow    string   `json:"disputeWindow"`
+    // Static block reward by height, Metaverse mainnet schedule when empty
+    RewardSchedule   []RewardEra `json:"rewardSchedule"`
+    // Fee of blocks by stratum name they were found on, then by reward mode used
+    // (prop, pplns or solo), poolFee and poolFeeAddress otherwise
+    PortFees         map[string]FeeRule `json:"portFees"`
+    ModeFees         map[string]FeeRule `json:"modeFees"`
+}
+
+type FeeRule struct {
+    // Percent
+    Fee              float64  `json:"fee"`
+    // poolFeeAddress when empty
+    Address          string   `json:"address"`
 }
 
+// Static reward of blocks from Height until next era
+type RewardEra struct {
+    Height           uint64   `json:"height"`
+    // Satoshi
+    Reward           int64    `json:"reward"`
+    // Reward is multiplied by decay every decayInterval blocks since Height, 0 keeps it flat
+    Decay            float64  `json:"decay"`
+    DecayInterval    uint64   `json:"decayInterval"`
+}
+
+// 3 ETP, 5% less every 500000 blocks
+var defaultRewardSchedule = []RewardEra{{Height: 0, Reward: 300000000, Decay: 0.95, DecayInterval: 500000}}
+
 const minDepth = 16
 
 type BlockUnlocker struct {
-    config        *UnlockerConfig
-    backend       *storage.RedisClient
-    rpc           *rpc.RPCClient
-    halt          bool
-    lastFail      error
+    config           *UnlockerConfig
+    backend          *storage.RedisClient
+    ledger           storage.Ledger
+    rpc              *rpc.RPCClient
+    halt             bool
+    lastFail         error
+    reload           chan *UnlockerConfig
+    trigger          chan struct{}
+    disputeWindow    time.Duration
+    shareDumpsExpire time.Duration
 }
 
-func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockUnlocker {
-    if cfg.Depth < minDepth*2 {
-        log.Fatalf("Block maturity depth can't be < %v, your depth is %v", minDepth*2, cfg.Depth)
-    }
-    if cfg.ImmatureDepth < minDepth {
-        log.Fatalf("Immature depth can't be < %v, your depth is %v", minDepth, cfg.ImmatureDepth)
+func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient, ledger storage.Ledger) *BlockUnlocker {
+    if err := ValidateUnlockerConfig(cfg); err != nil {
+        unlockerLog.Fatal(err)
     }
-    u := &BlockUnlocker{config: cfg, backend: backend}
-    if len(cfg.PoolFeeAddress) != 0 && !util.IsValidHexAddress(cfg.PoolFeeAddress) {
-        log.Fatalln("Invalid poolFeeAddress", cfg.PoolFeeAddress)
+    u := &BlockUnlocker{config: cfg, backend: backend, ledger: ledger, reload: make(chan *UnlockerConfig, 1), trigger: make(chan struct{}, 1)}
+    u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, cfg.Account, cfg.Password, cfg.Timeout)
+    if len(cfg.DisputeWindow) > 0 {
+        u.disputeWindow = util.MustParseDuration(cfg.DisputeWindow)
+        unlockerLog.Infof("Matured credits are held back for dispute window of %v", u.disputeWindow)
     }
-    if len(cfg.PoolFeeAddress) < 1 {
-        log.Fatalln("poolFeeAddress not set in config", cfg.PoolFeeAddress)
+    if len(cfg.ShareDumpsExpire) > 0 {
+        u.shareDumpsExpire = util.MustParseDuration(cfg.ShareDumpsExpire)
     }
-    u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, cfg.Account, cfg.Password, cfg.Timeout)
     return u
 }
 
 func (u *BlockUnlocker) Start() {
-    log.Println("Starting block unlocker")
+    unlockerLog.Info("Starting block unlocker")
     intv := util.MustParseDuration(u.config.Interval)
     timer := time.NewTimer(intv)
-    log.Printf("Set block unlock interval to %v", intv)
+    unlockerLog.Infof("Set block unlock interval to %v", intv)
 
     // Immediately unlock after start
     u.unlockPendingBlocks()
     u.unlockAndCreditMiners()
+    u.releaseDisputableCredits()
     timer.Reset(intv)
 
     go func() {
@@ -75,12 +114,140 @@ func (u *BlockUnlocker) Start() {
             case <-timer.C:
                 u.unlockPendingBlocks()
                 u.unlockAndCreditMiners()
+                u.releaseDisputableCredits()
                 timer.Reset(intv)
+            case <-u.trigger:
+                unlockerLog.Info("Unlocker run triggered")
+                u.unlockPendingBlocks()
+                u.unlockAndCreditMiners()
+                u.releaseDisputableCredits()
+            case cfg := <-u.reload:
+                u.applyConfig(cfg)
             }
         }
     }()
 }
 
+func ValidateUnlockerConfig(cfg *UnlockerConfig) error {
+    if cfg.Depth < minDepth*2 {
+        return fmt.Errorf("Block maturity depth can't be < %v, your depth is %v", minDepth*2, cfg.Depth)
+    }
+    if cfg.ImmatureDepth < minDepth {
+        return fmt.Errorf("Immature depth can't be < %v, your depth is %v", minDepth, cfg.ImmatureDepth)
+    }
+    if len(cfg.PoolFeeAddress) != 0 && !util.IsValidHexAddress(cfg.PoolFeeAddress) {
+        return fmt.Errorf("Invalid poolFeeAddress %v", cfg.PoolFeeAddress)
+    }
+    if len(cfg.PoolFeeAddress) < 1 {
+        return fmt.Errorf("poolFeeAddress not set in config")
+    }
+    if len(cfg.ShareDumpsExpire) > 0 {
+        if _, err := time.ParseDuration(cfg.ShareDumpsExpire); err != nil {
+            return fmt.Errorf("Invalid shareDumpsExpire %q", cfg.ShareDumpsExpire)
+        }
+    }
+    switch cfg.RewardMode {
+    case "", "prop", "pplns":
+    default:
+        return fmt.Errorf("Invalid rewardMode %v, must be prop or pplns", cfg.RewardMode)
+    }
+    for i, era := range cfg.RewardSchedule {
+        if i > 0 && era.Height <= cfg.RewardSchedule[i-1].Height {
+            return fmt.Errorf("rewardSchedule heights must be ascending, %v follows %v", era.Height, cfg.RewardSchedule[i-1].Height)
+        }
+        if era.Reward <= 0 {
+            return fmt.Errorf("rewardSchedule reward at height %v must be > 0", era.Height)
+        }
+        if era.Decay < 0 || era.Decay > 1 || (era.Decay > 0 && era.DecayInterval == 0) {
+            return fmt.Errorf("rewardSchedule at height %v needs decay between 0 and 1 and decayInterval", era.Height)
+        }
+    }
+    if len(cfg.RewardSchedule) > 0 && cfg.RewardSchedule[0].Height > 0 {
+        return fmt.Errorf("rewardSchedule must start at height 0")
+    }
+    for name, rule := range cfg.PortFees {
+        if err := validateFeeRule(rule); err != nil {
+            return fmt.Errorf("portFees of %v: %v", name, err)
+        }
+    }
+    for mode, rule := range cfg.ModeFees {
+        switch mode {
+        case "prop", "pplns", "solo":
+        default:
+            return fmt.Errorf("Invalid modeFees mode %v, must be prop, pplns or solo", mode)
+        }
+        if err := validateFeeRule(rule); err != nil {
+            return fmt.Errorf("modeFees of %v: %v", mode, err)
+        }
+    }
+    return nil
+}
+
+func validateFeeRule(rule FeeRule) error {
+    if rule.Fee < 0 || rule.Fee > 100 {
+        return fmt.Errorf("fee %v must be between 0 and 100", rule.Fee)
+    }
+    if len(rule.Address) != 0 && !util.IsValidHexAddress(rule.Address) {
+        return fmt.Errorf("invalid address %v", rule.Address)
+    }
+    return nil
+}
+
+// Schedules new fee and depth settings to be applied between unlocker runs
+func (u *BlockUnlocker) Reload(cfg *UnlockerConfig) {
+    if err := ValidateUnlockerConfig(cfg); err != nil {
+        unlockerLog.Warnf("Unlocker config not reloaded: %v", err)
+        return
+    }
+    select {
+    case u.reload <- cfg:
+    default:
+        unlockerLog.Info("Unlocker config reload is already pending")
+    }
+}
+
+// Schedules unlocker run ahead of timer
+func (u *BlockUnlocker) Trigger() {
+    select {
+    case u.trigger <- struct{}{}:
+    default:
+        unlockerLog.Info("Unlocker run is already pending")
+    }
+}
+
+func (u *BlockUnlocker) applyConfig(cfg *UnlockerConfig) {
+    u.config.PoolFee = cfg.PoolFee
+    u.config.PoolFeeAddress = cfg.PoolFeeAddress
+    u.config.Donate = cfg.Donate
+    u.config.Depth = cfg.Depth
+    u.config.ImmatureDepth = cfg.ImmatureDepth
+    u.config.KeepTxFees = cfg.KeepTxFees
+    u.config.RewardMode = cfg.RewardMode
+    u.config.RewardSchedule = cfg.RewardSchedule
+    u.config.PortFees = cfg.PortFees
+    u.config.ModeFees = cfg.ModeFees
+    unlockerLog.Infof("Unlocker config reloaded, pool fee: %v, depth: %v, immature depth: %v", cfg.PoolFee, cfg.Depth, cfg.ImmatureDepth)
+}
+
+// Makes credits which passed dispute window payable unless block is held.
+// Runs with window disabled too, so released holds and leftovers are paid.
+func (u *BlockUnlocker) releaseDisputableCredits() {
+    if u.halt {
+        return
+    }
+    maxTs := (util.MakeTimestamp() - int64(u.disputeWindow/time.Millisecond)) / 1000
+    released, err := u.ledger.ReleaseDisputableCredits(maxTs)
+    if err != nil {
+        u.halt = true
+        u.lastFail = err
+        unlockerLog.Errorf("Failed to release disputable credits: %v", err)
+        return
+    }
+    if released > 0 {
+        unlockerLog.Infof("Released credits of %v blocks past dispute window", released)
+    }
+}
+
 type UnlockResult struct {
     maturedBlocks   []*storage.BlockData
     orphanedBlocks  []*storage.BlockData
@@ -97,7 +264,7 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
         height := candidate.Height
         block, err := u.rpc.GetBlockByHeight(height)
         if err != nil {
-            log.Printf("Error while retrieving block %v from node: %v", height, err)
+            unlockerLog.Errorf("Error while retrieving block %v from node: %v", height, err)
             return nil, err
         }
         if block == nil {
@@ -114,12 +281,12 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
                 return nil, err
             }
             result.maturedBlocks = append(result.maturedBlocks, candidate)
-            log.Printf("Mature block %v, hash: %v", candidate.Height, candidate.Hash)
+            unlockerLog.Infof("Mature block %v, hash: %v", candidate.Height, candidate.Hash)
         } else {
             result.orphans++
             candidate.Orphan = true
             result.orphanedBlocks = append(result.orphanedBlocks, candidate)
-            log.Printf("Orphaned block %v:%v", candidate.RoundHeight, candidate.Nonce)
+            unlockerLog.Infof("Orphaned block %v:%v", candidate.RoundHeight, candidate.Nonce)
         }
     }
     return result, nil
@@ -143,8 +310,11 @@ func (u *BlockUnlocker) matchCandidate(block *rpc.GetBlockReply, candidate *stor
 }
 
 func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage.BlockData) error {
-    reward := big.NewInt(int64(300000000 * math.Pow(0.95, math.Floor(float64(block.Number*1.0)/500000))))
-    extraTxReward, _ := u.getExtraRewardForTx(block.Number, reward)
+    reward := big.NewInt(StaticReward(u.config.RewardSchedule, block.Number))
+    extraTxReward, err := u.getExtraRewardForTx(block.Number, reward)
+    if err != nil {
+        return err
+    }
     
     if u.config.KeepTxFees {
         candidate.ExtraReward = extraTxReward
@@ -161,7 +331,7 @@ func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage
 
 func (u *BlockUnlocker) unlockPendingBlocks() {
     if u.halt {
-        log.Println("Unlocking suspended due to last critical error:", u.lastFail)
+        unlockerLog.Error("Unlocking suspended due to last critical error:", u.lastFail)
         return
     }
 
@@ -169,20 +339,20 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
     if err != nil {
         u.halt = true
         u.lastFail = err
-        log.Printf("Unable to get current blockchain height from node: %v", err)
+        unlockerLog.Errorf("Unable to get current blockchain height from node: %v", err)
         return
     }
 
-    candidates, err := u.backend.GetCandidates(int64(current.Number) - u.config.ImmatureDepth)
+    candidates, err := u.ledger.GetCandidates(int64(current.Number) - u.config.ImmatureDepth)
     if err != nil {
         u.halt = true
         u.lastFail = err
-        log.Printf("Failed to get block candidates from backend: %v", err)
+        unlockerLog.Errorf("Failed to get block candidates from backend: %v", err)
         return
     }
         
     if len(candidates) == 0 {
-        log.Println("No block candidates to unlock")
+        unlockerLog.Info("No block candidates to unlock")
         return
     }
     
@@ -190,19 +360,19 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
     if err != nil {
         u.halt = true
         u.lastFail = err
-        log.Printf("Failed to unlock blocks: %v", err)
+        unlockerLog.Errorf("Failed to unlock blocks: %v", err)
         return
     }
-    log.Printf("Immature %v blocks, %v uncles, %v orphans", result.blocks, result.uncles, result.orphans)
+    unlockerLog.Infof("Immature %v blocks, %v uncles, %v orphans", result.blocks, result.uncles, result.orphans)
 
-    err = u.backend.WritePendingOrphans(result.orphanedBlocks)
+    err = u.ledger.WritePendingOrphans(result.orphanedBlocks)
     if err != nil {
         u.halt = true
         u.lastFail = err
-        log.Printf("Failed to insert orphaned blocks into backend: %v", err)
+        unlockerLog.Errorf("Failed to insert orphaned blocks into backend: %v", err)
         return
     } else {
-        log.Printf("Inserted %v orphaned blocks to backend", result.orphans)
+        unlockerLog.Infof("Inserted %v orphaned blocks to backend", result.orphans)
     }
 
     totalRevenue := new(big.Rat)
@@ -214,14 +384,14 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
         if err != nil {
             u.halt = true
             u.lastFail = err
-            log.Printf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
+            unlockerLog.Errorf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
             return
         }
-        err = u.backend.WriteImmatureBlock(block, roundRewards)
+        err = u.ledger.WriteImmatureBlock(block, roundRewards)
         if err != nil {
             u.halt = true
             u.lastFail = err
-            log.Printf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
+            unlockerLog.Errorf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
             return
         }
         totalRevenue.Add(totalRevenue, revenue)
@@ -239,10 +409,10 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
         for login, reward := range roundRewards {
             entries = append(entries, fmt.Sprintf("\tREWARD %v: %v: %v Shannon", block.RoundKey(), login, reward))
         }
-        log.Println(strings.Join(entries, "\n"))
+        unlockerLog.Info(strings.Join(entries, "\n"))
     }
 
-    log.Printf(
+    unlockerLog.Infof(
         "IMMATURE SESSION: revenue %v, miners profit %v, pool profit: %v",
         util.FormatRatReward(totalRevenue),
         util.FormatRatReward(totalMinersProfit),
@@ -252,7 +422,7 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 
 func (u *BlockUnlocker) unlockAndCreditMiners() {
     if u.halt {
-        log.Println("Unlocking suspended due to last critical error:", u.lastFail)
+        unlockerLog.Error("Unlocking suspended due to last critical error:", u.lastFail)
         return
     }
     
@@ -260,20 +430,20 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
     if err != nil {
         u.halt = true
         u.lastFail = err
-        log.Printf("Unable to get current blockchain height from node: %v", err)
+        unlockerLog.Errorf("Unable to get current blockchain height from node: %v", err)
         return
     }
     
-    immature, err := u.backend.GetImmatureBlocks(int64(current.Number) - u.config.Depth)
+    immature, err := u.ledger.GetImmatureBlocks(int64(current.Number) - u.config.Depth)
     if err != nil {
         u.halt = true
         u.lastFail = err
-        log.Printf("Failed to get block candidates from backend: %v", err)
+        unlockerLog.Errorf("Failed to get block candidates from backend: %v", err)
         return
     }
 
     if len(immature) == 0 {
-        log.Println("No immature blocks to credit miners")
+        unlockerLog.Info("No immature blocks to credit miners")
         return
     }
 
@@ -281,21 +451,21 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
     if err != nil {
         u.halt = true
         u.lastFail = err
-        log.Printf("Failed to unlock blocks: %v", err)
+        unlockerLog.Errorf("Failed to unlock blocks: %v", err)
         return
     }
-    log.Printf("Unlocked %v blocks, %v uncles, %v orphans", result.blocks, result.uncles, result.orphans)
+    unlockerLog.Infof("Unlocked %v blocks, %v uncles, %v orphans", result.blocks, result.uncles, result.orphans)
 
     for _, block := range result.orphanedBlocks {
-        err = u.backend.WriteOrphan(block)
+        err = u.ledger.WriteOrphan(block)
         if err != nil {
             u.halt = true
             u.lastFail = err
-            log.Printf("Failed to insert orphaned block into backend: %v", err)
+            unlockerLog.Errorf("Failed to insert orphaned block into backend: %v", err)
             return
         }
     }
-    log.Printf("Inserted %v orphaned blocks to backend", result.orphans)
+    unlockerLog.Infof("Inserted %v orphaned blocks to backend", result.orphans)
 
     totalRevenue := new(big.Rat)
     totalMinersProfit := new(big.Rat)
@@ -306,14 +476,20 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
         if err != nil {
             u.halt = true
             u.lastFail = err
-            log.Printf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
+            unlockerLog.Errorf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
             return
         }
-        err = u.backend.WriteMaturedBlock(block, roundRewards)
+        if u.config.ShareDumps {
+            err = u.writeShareDump(block, revenue, poolProfit, roundRewards)
+            if err != nil {
+                unlockerLog.Errorf("Failed to export shares for round %v: %v", block.RoundKey(), err)
+            }
+        }
+        err = u.ledger.WriteMaturedBlock(block, roundRewards, u.disputeWindow > 0)
         if err != nil {
             u.halt = true
             u.lastFail = err
-            log.Printf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
+            unlockerLog.Errorf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
             return
         }
         totalRevenue.Add(totalRevenue, revenue)
@@ -331,10 +507,10 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
         for login, reward := range roundRewards {
             entries = append(entries, fmt.Sprintf("\tREWARD %v: %v: %v Shannon", block.RoundKey(), login, reward))
         }
-        log.Println(strings.Join(entries, "\n"))
+        unlockerLog.Info(strings.Join(entries, "\n"))
     }
 
-    log.Printf(
+    unlockerLog.Infof(
         "MATURE SESSION: revenue %v, miners profit %v, pool profit: %v",
         util.FormatRatReward(totalRevenue),
         util.FormatRatReward(totalMinersProfit),
@@ -343,15 +519,16 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 }
 
 func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *big.Rat, *big.Rat, map[string]int64, error) {
-    revenue := new(big.Rat).SetInt(block.Reward)
-    minersProfit, poolProfit := chargeFee(revenue, u.config.PoolFee)
-
-    shares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
+    shares, totalShares, mode, err := u.rewardShares(block)
     if err != nil {
         return nil, nil, nil, nil, err
     }
 
-    rewards := calculateRewardsForShares(shares, block.TotalShares, minersProfit)
+    revenue := new(big.Rat).SetInt(block.Reward)
+    poolFee, feeAddress := u.blockFee(block, mode)
+    minersProfit, poolProfit := chargeFee(revenue, poolFee)
+
+    rewards := calculateRewardsForShares(shares, totalShares, minersProfit)
 
     if block.ExtraReward != nil {
         extraReward := new(big.Rat).SetInt(block.ExtraReward)
@@ -359,15 +536,52 @@ func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *b
         revenue.Add(revenue, extraReward)
     }
 
-    if len(u.config.PoolFeeAddress) != 0 {
-        address := u.config.PoolFeeAddress
+    if len(feeAddress) != 0 {
         fee, _ := strconv.ParseInt(poolProfit.FloatString(0), 10, 64)
-        rewards[address] += fee
+        rewards[feeAddress] += fee
     }
 
     return revenue, minersProfit, poolProfit, rewards, nil
 }
 
+// Fee percent and address for block by port tag recorded when it was found and reward mode
+func (u *BlockUnlocker) blockFee(block *storage.BlockData, mode string) (float64, string) {
+    rule, ok := u.config.PortFees[block.Port]
+    if !ok || len(block.Port) == 0 {
+        rule, ok = u.config.ModeFees[mode]
+    }
+    if !ok {
+        return u.config.PoolFee, u.config.PoolFeeAddress
+    }
+    if len(rule.Address) == 0 {
+        return rule.Fee, u.config.PoolFeeAddress
+    }
+    return rule.Fee, rule.Address
+}
+
+// Returns shares reward is split by, their total and reward mode actually used
+func (u *BlockUnlocker) rewardShares(block *storage.BlockData) (map[string]int64, int64, string, error) {
+    if block.IsSolo() {
+        return map[string]int64{block.Finder: 1}, 1, "solo", nil
+    }
+    if u.config.RewardMode == "pplns" {
+        shares, err := u.ledger.GetPPLNSShares(block.Nonce)
+        if err != nil {
+            return nil, 0, "", err
+        }
+        if len(shares) > 0 {
+            total := int64(0)
+            for _, n := range shares {
+                total += n
+            }
+            return shares, total, "pplns", nil
+        }
+        unlockerLog.Warnf("No PPLNS window for round %v, using round shares", block.RoundKey())
+    }
+    shares, err := u.ledger.GetRoundShares(block.RoundHeight, block.Nonce)
+    return shares, block.TotalShares, "prop", err
+}
+
 func calculateRewardsForShares(shares map[string]int64, total int64, reward *big.Rat) map[string]int64 {
     rewards := make(map[string]int64)
 
@@ -392,14 +606,34 @@ func chargeFee(value *big.Rat, fee float64) (*big.Rat, *big.Rat) {
 func (u *BlockUnlocker) getExtraRewardForTx(height uint64, reward *big.Int) (*big.Int, error) {
     BlockTxs, err := u.rpc.GetBlockTxs(height)
     if err != nil {
-        log.Printf("Error retrieving BlockTxs for height %v", height)
+        unlockerLog.Errorf("Error retrieving BlockTxs for height %v", height)
         return nil, err
     }
     
+    if len(BlockTxs.Transactions) == 0 || len(BlockTxs.Transactions[0].Outputs) == 0 {
+        return nil, fmt.Errorf("Block %v has no coinbase output", height)
+    }
+    // Fees are what coinbase pays on top of static reward, nothing of them is burned on Metaverse
     blockValue := big.NewInt(BlockTxs.Transactions[0].Outputs[0].Value)
-    if err != nil {
-        return nil, err
+    if blockValue.Cmp(reward) < 0 {
+        return nil, fmt.Errorf("Coinbase of block %v pays %v, less than static reward %v, check rewardSchedule", height, blockValue, reward)
     }
-    
     return new(big.Int).Sub(blockValue, reward), nil
+}
+
+// Static block reward at height, Metaverse mainnet schedule when schedule is empty
+func StaticReward(schedule []RewardEra, height uint64) int64 {
+    if len(schedule) == 0 {
+        schedule = defaultRewardSchedule
+    }
+    era := schedule[0]
+    for _, e := range schedule {
+        if e.Height <= height {
+            era = e
+        }
+    }
+    if era.Decay == 0 {
+        return era.Reward
+    }
+    return int64(float64(era.Reward) * math.Pow(era.Decay, math.Floor(float64(height-era.Height)/float64(era.DecayInterval))))
 }
\ No newline at end of file
@@ -0,0 +1,103 @@
+package payouts
+
+import (
+    "math/big"
+    "reflect"
+    "testing"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+)
+
+func TestRewardShares(t *testing.T) {
+    round := map[string]int64{testMiner: 30, testMiner2: 10}
+    window := map[string]int64{testMiner: 5, testMiner2: 15}
+    tests := []struct {
+        name       string
+        mode       string
+        block      *storage.BlockData
+        pplns      map[string]int64
+        shares     map[string]int64
+        total      int64
+        used       string
+    }{
+        {"prop", "prop", &storage.BlockData{TotalShares: 40}, window, round, 40, "prop"},
+        {"pplns", "pplns", &storage.BlockData{TotalShares: 40}, window, window, 20, "pplns"},
+        {"pplns without window", "pplns", &storage.BlockData{TotalShares: 40}, nil, round, 40, "prop"},
+        {"solo", "pplns", &storage.BlockData{TotalShares: 40, Finder: testMiner2}, window, map[string]int64{testMiner2: 1}, 1, "solo"},
+    }
+    for _, tt := range tests {
+        u := &BlockUnlocker{config: &UnlockerConfig{RewardMode: tt.mode}, ledger: &fakeLedger{roundShares: round, pplnsShares: tt.pplns}}
+        shares, total, used, err := u.rewardShares(tt.block)
+        if err != nil {
+            t.Fatalf("%v: %v", tt.name, err)
+        }
+        if !reflect.DeepEqual(shares, tt.shares) || total != tt.total || used != tt.used {
+            t.Errorf("%v: shares %v of %v by %v, want %v of %v by %v", tt.name, shares, total, used, tt.shares, tt.total, tt.used)
+        }
+    }
+}
+
+func TestCalculateRewards(t *testing.T) {
+    const (
+        poolAddress = "MFeeAddressPoo11111111111111111111"
+        portAddress = "MFeeAddressPort1111111111111111111"
+        soloAddress = "MFeeAddressSo1o1111111111111111111"
+    )
+    cfg := &UnlockerConfig{
+        PoolFee:        1,
+        PoolFeeAddress: poolAddress,
+        PortFees:       map[string]FeeRule{"vip": {Fee: 0.5}, "partner": {Fee: 2, Address: portAddress}},
+        ModeFees:       map[string]FeeRule{"solo": {Fee: 3, Address: soloAddress}},
+    }
+    tests := []struct {
+        name       string
+        port       string
+        finder     string
+        rewards    map[string]int64
+    }{
+        {"pool fee", "", "", map[string]int64{testMiner: 74250000, testMiner2: 24750000, poolAddress: 1000000}},
+        {"unknown port", "main", "", map[string]int64{testMiner: 74250000, testMiner2: 24750000, poolAddress: 1000000}},
+        {"port fee to pool address", "vip", "", map[string]int64{testMiner: 74625000, testMiner2: 24875000, poolAddress: 500000}},
+        {"port fee to own address", "partner", "", map[string]int64{testMiner: 73500000, testMiner2: 24500000, portAddress: 2000000}},
+        {"mode fee", "", testMiner2, map[string]int64{testMiner2: 97000000, soloAddress: 3000000}},
+        // Port of the block takes precedence over its mode
+        {"port before mode", "partner", testMiner2, map[string]int64{testMiner2: 98000000, portAddress: 2000000}},
+    }
+    for _, tt := range tests {
+        u := &BlockUnlocker{config: cfg, ledger: &fakeLedger{roundShares: map[string]int64{testMiner: 30, testMiner2: 10}}}
+        block := &storage.BlockData{TotalShares: 40, Reward: big.NewInt(100000000), Port: tt.port, Finder: tt.finder}
+        _, _, _, rewards, err := u.calculateRewards(block)
+        if err != nil {
+            t.Fatalf("%v: %v", tt.name, err)
+        }
+        if !reflect.DeepEqual(rewards, tt.rewards) {
+            t.Errorf("%v: rewards %v, want %v", tt.name, rewards, tt.rewards)
+        }
+    }
+}
+
+func TestStaticReward(t *testing.T) {
+    schedule := []RewardEra{{Height: 0, Reward: 500}, {Height: 100, Reward: 400, Decay: 0.5, DecayInterval: 10}}
+    tests := []struct {
+        schedule   []RewardEra
+        height     uint64
+        reward     int64
+    }{
+        {nil, 0, 300000000},
+        {nil, 499999, 300000000},
+        {nil, 500000, 285000000},
+        {nil, 1000000, 270750000},
+        // Fraction is truncated
+        {nil, 1500000, 257212499},
+        {schedule, 99, 500},
+        {schedule, 100, 400},
+        {schedule, 109, 400},
+        {schedule, 110, 200},
+        {schedule, 135, 50},
+    }
+    for _, tt := range tests {
+        if reward := StaticReward(tt.schedule, tt.height); reward != tt.reward {
+            t.Errorf("reward at %v %v, want %v", tt.height, reward, tt.reward)
+        }
+    }
+}
@@ -0,0 +1,220 @@
+package policy
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "os/exec"
+    "strconv"
+    "strings"
+    "time"
+)
+
+type FirewallConfig struct {
+    // ipset, nftables, exec or webhook, empty disables unless legacy ipset name is set
+    Driver         string   `json:"driver"`
+    // ipset name or nftables "family table set", sets must support timeouts
+    Set            string   `json:"set"`
+    // Helper run as "command ban <ip> <seconds>" and "command unban <ip>"
+    Command        string   `json:"command"`
+    // Webhook receives JSON with action, ip and timeout in seconds
+    Url            string   `json:"url"`
+    // Sent as bearer token to webhook
+    Token          string   `json:"token"`
+    Timeout        string   `json:"timeout"`
+}
+
+// Drops banned peers before they reach stratum. Zero timeout is permanent,
+// expired bans are also unbanned explicitly for drivers which can't expire entries.
+type firewall interface {
+    ban(ip string, timeout time.Duration) error
+    unban(ip string) error
+}
+
+// Returns nil firewall when disabled
+func newFirewall(cfg *Banning) (firewall, error) {
+    fw := cfg.Firewall
+    if len(fw.Driver) == 0 && len(cfg.IPSet) > 0 {
+        fw.Driver, fw.Set = "ipset", cfg.IPSet
+    }
+    switch fw.Driver {
+    case "":
+        return nil, nil
+    case "ipset":
+        if len(fw.Set) == 0 {
+            return nil, fmt.Errorf("Firewall set name is required for ipset")
+        }
+        return &ipsetFirewall{set: fw.Set}, nil
+    case "nftables":
+        if len(strings.Fields(fw.Set)) != 3 {
+            return nil, fmt.Errorf("Firewall set must be \"family table set\" for nftables")
+        }
+        return &nftFirewall{set: fw.Set}, nil
+    case "exec":
+        if len(fw.Command) == 0 {
+            return nil, fmt.Errorf("Firewall command is required for exec")
+        }
+        return &execFirewall{command: fw.Command}, nil
+    case "webhook":
+        if len(fw.Url) == 0 {
+            return nil, fmt.Errorf("Firewall url is required for webhook")
+        }
+        timeout := 5 * time.Second
+        if len(fw.Timeout) > 0 {
+            d, err := time.ParseDuration(fw.Timeout)
+            if err != nil {
+                return nil, fmt.Errorf("Invalid firewall timeout %q", fw.Timeout)
+            }
+            timeout = d
+        }
+        return &webhookFirewall{client: &http.Client{Timeout: timeout}, url: fw.Url, token: fw.Token}, nil
+    }
+    return nil, fmt.Errorf("Unknown firewall driver %v, must be ipset, nftables, exec or webhook", fw.Driver)
+}
+
+func run(cmd string, args ...string) error {
+    out, err := exec.Command(cmd, args...).CombinedOutput()
+    if err != nil {
+        return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+    }
+    return nil
+}
+
+// Canonical form of ip, anything else is refused before it reaches a command line or webhook
+func hostIP(ip string) (string, error) {
+    parsed := net.ParseIP(ip)
+    if parsed == nil {
+        return "", fmt.Errorf("Refusing to firewall invalid IP %q", ip)
+    }
+    return parsed.String(), nil
+}
+
+func seconds(timeout time.Duration) string {
+    return strconv.FormatInt(int64(timeout/time.Second), 10)
+}
+
+type ipsetFirewall struct {
+    set            string
+}
+
+func (f *ipsetFirewall) ban(ip string, timeout time.Duration) error {
+    ip, err := hostIP(ip)
+    if err != nil {
+        return err
+    }
+    return run("sudo", "ipset", "add", f.set, ip, "timeout", seconds(timeout), "-!")
+}
+
+func (f *ipsetFirewall) unban(ip string) error {
+    ip, err := hostIP(ip)
+    if err != nil {
+        return err
+    }
+    return run("sudo", "ipset", "del", f.set, ip, "-!")
+}
+
+type nftFirewall struct {
+    set            string
+}
+
+func (f *nftFirewall) ban(ip string, timeout time.Duration) error {
+    ip, err := hostIP(ip)
+    if err != nil {
+        return err
+    }
+    args := append([]string{"nft", "add", "element"}, strings.Fields(f.set)...)
+    element := "{ " + ip + " }"
+    if timeout > 0 {
+        element = "{ " + ip + " timeout " + seconds(timeout) + "s }"
+    }
+    return run("sudo", append(args, element)...)
+}
+
+func (f *nftFirewall) unban(ip string) error {
+    ip, err := hostIP(ip)
+    if err != nil {
+        return err
+    }
+    args := append([]string{"nft", "delete", "element"}, strings.Fields(f.set)...)
+    err = run("sudo", append(args, "{ "+ip+" }")...)
+    // Element is gone already when nftables expired it
+    if err != nil && strings.Contains(err.Error(), "No such file or directory") {
+        return nil
+    }
+    return err
+}
+
+type execFirewall struct {
+    command        string
+}
+
+func (f *execFirewall) ban(ip string, timeout time.Duration) error {
+    ip, err := hostIP(ip)
+    if err != nil {
+        return err
+    }
+    return run(f.command, "ban", ip, seconds(timeout))
+}
+
+func (f *execFirewall) unban(ip string) error {
+    ip, err := hostIP(ip)
+    if err != nil {
+        return err
+    }
+    return run(f.command, "unban", ip)
+}
+
+type webhookFirewall struct {
+    client         *http.Client
+    url            string
+    token          string
+}
+
+type firewallAction struct {
+    Action         string   `json:"action"`
+    Ip             string   `json:"ip"`
+    // Seconds, 0 is permanent
+    Timeout        int64    `json:"timeout,omitempty"`
+}
+
+func (f *webhookFirewall) ban(ip string, timeout time.Duration) error {
+    ip, err := hostIP(ip)
+    if err != nil {
+        return err
+    }
+    return f.post(&firewallAction{Action: "ban", Ip: ip, Timeout: int64(timeout / time.Second)})
+}
+
+func (f *webhookFirewall) unban(ip string) error {
+    ip, err := hostIP(ip)
+    if err != nil {
+        return err
+    }
+    return f.post(&firewallAction{Action: "unban", Ip: ip})
+}
+
+func (f *webhookFirewall) post(action *firewallAction) error {
+    body, err := json.Marshal(action)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequest("POST", f.url, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if len(f.token) > 0 {
+        req.Header.Set("Authorization", "Bearer "+f.token)
+    }
+    resp, err := f.client.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return fmt.Errorf("Unexpected response status %v", resp.Status)
+    }
+    return nil
+}
@@ -0,0 +1,372 @@
+package policy
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+// Escalating penalties for logins and IPs sending too many invalid or stale shares
+type Penalty struct {
+    Enabled         bool        `json:"enabled"`
+    // Shares are counted over this sliding window
+    Window          string      `json:"window"`
+    // Ratios are judged once window holds this many shares
+    MinShares       int64       `json:"minShares"`
+    // Offense when ratio of window reaches percent, 0 disables
+    InvalidPercent  float64     `json:"invalidPercent"`
+    StalePercent    float64     `json:"stalePercent"`
+    // Offense when window holds this many forged shares whatever the ratio, 0 disables
+    ForgedShares    int64       `json:"forgedShares"`
+    // Action of every offense level: "warn" or ban duration, last one repeats
+    Steps           []string    `json:"steps"`
+    // Level starts over after this long without offense, empty keeps it
+    // until login or IP stops sending shares for window
+    Cooldown        string      `json:"cooldown"`
+}
+
+type ShareKind int
+
+const (
+    ShareValid ShareKind = iota
+    ShareInvalid
+    ShareStale
+    // Failed spot check, also counts as invalid
+    ShareForged
+)
+
+// Window is split into this many buckets
+const penaltyBuckets = 10
+
+// Penalty settings with parsed durations, 0 step is warning
+type penaltyRules struct {
+    Penalty
+    window         int64
+    cooldown       int64
+    steps          []time.Duration
+}
+
+func newPenaltyRules(cfg *Penalty) (*penaltyRules, error) {
+    r := &penaltyRules{Penalty: *cfg}
+    if !cfg.Enabled {
+        return r, nil
+    }
+    window, err := time.ParseDuration(cfg.Window)
+    if err != nil || window < penaltyBuckets*time.Millisecond {
+        return nil, fmt.Errorf("Invalid penalty window %q", cfg.Window)
+    }
+    r.window = int64(window / time.Millisecond)
+    if len(cfg.Cooldown) > 0 {
+        cooldown, err := time.ParseDuration(cfg.Cooldown)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid penalty cooldown %q", cfg.Cooldown)
+        }
+        r.cooldown = int64(cooldown / time.Millisecond)
+    }
+    if len(cfg.Steps) == 0 {
+        return nil, fmt.Errorf("Penalty requires at least one step")
+    }
+    for _, step := range cfg.Steps {
+        if step == "warn" {
+            r.steps = append(r.steps, 0)
+            continue
+        }
+        d, err := time.ParseDuration(step)
+        if err != nil || d <= 0 {
+            return nil, fmt.Errorf("Invalid penalty step %q, must be warn or ban duration", step)
+        }
+        r.steps = append(r.steps, d)
+    }
+    return r, nil
+}
+
+type penaltyKey struct {
+    kind           string
+    id             string
+}
+
+type shareBucket struct {
+    start          int64
+    valid          int64
+    invalid        int64
+    stale          int64
+    forged         int64
+}
+
+// Shares and offense level of one login or IP
+type offender struct {
+    buckets        [penaltyBuckets]shareBucket
+    level          int
+    lastOffense    int64
+    lastShare      int64
+    // Login bans only, IP bans are kept with other bans
+    bannedUntil    int64
+}
+
+// Adds share and returns counts of window
+func (o *offender) add(kind ShareKind, now, window int64) (int64, int64, int64, int64) {
+    span := window / penaltyBuckets
+    b := &o.buckets[(now/span)%penaltyBuckets]
+    if start := now - now%span; b.start != start {
+        *b = shareBucket{start: start}
+    }
+    switch kind {
+    case ShareValid:
+        b.valid++
+    case ShareInvalid:
+        b.invalid++
+    case ShareStale:
+        b.stale++
+    case ShareForged:
+        b.invalid++
+        b.forged++
+    }
+    o.lastShare = now
+    return o.counts(now, window)
+}
+
+func (o *offender) counts(now, window int64) (valid, invalid, stale, forged int64) {
+    for _, b := range o.buckets {
+        if now-b.start < window {
+            valid += b.valid
+            invalid += b.invalid
+            stale += b.stale
+            forged += b.forged
+        }
+    }
+    return
+}
+
+// Result of share counted towards penalty
+type penaltyVerdict struct {
+    banned         bool
+    offense        bool
+    level          int
+    step           time.Duration
+    invalid        float64
+    stale          float64
+    forged         int64
+    total          int64
+}
+
+type penaltyTracker struct {
+    sync.Mutex
+    rules          atomic.Value
+    offenders      map[penaltyKey]*offender
+}
+
+func newPenaltyTracker(rules *penaltyRules) *penaltyTracker {
+    t := &penaltyTracker{offenders: make(map[penaltyKey]*offender)}
+    t.rules.Store(rules)
+    return t
+}
+
+func (t *penaltyTracker) currentRules() *penaltyRules {
+    return t.rules.Load().(*penaltyRules)
+}
+
+func (t *penaltyTracker) record(r *penaltyRules, key penaltyKey, kind ShareKind) penaltyVerdict {
+    now := util.MakeTimestamp()
+    t.Lock()
+    defer t.Unlock()
+
+    o, ok := t.offenders[key]
+    if !ok {
+        o = &offender{}
+        t.offenders[key] = o
+    }
+    // Shares sent while banned don't count
+    if o.bannedUntil > now {
+        return penaltyVerdict{banned: true, level: o.level}
+    }
+    valid, invalid, stale, forged := o.add(kind, now, r.window)
+    total := valid + invalid + stale
+    // Forged shares are judged by count, a spot check catches only some of them
+    forgedOffense := r.ForgedShares > 0 && forged >= r.ForgedShares
+    if !forgedOffense && (total < r.MinShares || total == 0) {
+        return penaltyVerdict{}
+    }
+    v := penaltyVerdict{
+        invalid: float64(invalid) / float64(total) * 100,
+        stale:   float64(stale) / float64(total) * 100,
+        forged:  forged,
+        total:   total,
+    }
+    if !forgedOffense && (r.InvalidPercent <= 0 || v.invalid < r.InvalidPercent) && (r.StalePercent <= 0 || v.stale < r.StalePercent) {
+        return v
+    }
+    if r.cooldown > 0 && o.lastOffense > 0 && now-o.lastOffense > r.cooldown {
+        o.level = 0
+    }
+    o.level++
+    o.lastOffense = now
+    // Next offense needs a fresh window of shares
+    o.buckets = [penaltyBuckets]shareBucket{}
+    step := o.level - 1
+    if step >= len(r.steps) {
+        step = len(r.steps) - 1
+    }
+    v.offense, v.level, v.step = true, o.level, r.steps[step]
+    if v.step > 0 && key.kind == "login" {
+        o.bannedUntil = now + int64(v.step/time.Millisecond)
+    }
+    return v
+}
+
+func (t *penaltyTracker) loginBanned(login string) bool {
+    t.Lock()
+    defer t.Unlock()
+    o, ok := t.offenders[penaltyKey{"login", login}]
+    return ok && o.bannedUntil > util.MakeTimestamp()
+}
+
+// Drops offenders idle for window whose level has cooled down
+func (t *penaltyTracker) expire() int {
+    r := t.currentRules()
+    now := util.MakeTimestamp()
+    t.Lock()
+    defer t.Unlock()
+    n := 0
+    for key, o := range t.offenders {
+        if o.bannedUntil > now || now-o.lastShare < r.window {
+            continue
+        }
+        if o.level > 0 && r.cooldown > 0 && now-o.lastOffense <= r.cooldown {
+            continue
+        }
+        delete(t.offenders, key)
+        n++
+    }
+    return n
+}
+
+// Offense of login or IP, counts are shares of current window
+type OffenderInfo struct {
+    Kind           string   `json:"kind"`
+    Id             string   `json:"id"`
+    Level          int      `json:"level"`
+    Valid          int64    `json:"valid"`
+    Invalid        int64    `json:"invalid"`
+    Stale          int64    `json:"stale"`
+    Forged         int64    `json:"forged"`
+    LastOffense    int64    `json:"lastOffense"`
+    // Login bans only, IP bans are listed with other bans
+    BannedUntil    int64    `json:"bannedUntil"`
+}
+
+// Creates penalty tracker, exits if settings are invalid
+func (s *PolicyServer) startPenalty(cfg *Penalty) {
+    rules, err := newPenaltyRules(cfg)
+    if err != nil {
+        log.Fatal(err)
+    }
+    s.penalty = newPenaltyTracker(rules)
+    if cfg.Enabled {
+        log.Infof("Penalizing invalid shares over %v%%, stale shares over %v%% and %v forged shares within %v, steps %v", cfg.InvalidPercent, cfg.StalePercent, cfg.ForgedShares, cfg.Window, cfg.Steps)
+    }
+}
+
+func (s *PolicyServer) reloadPenalty(cfg *Penalty) {
+    rules, err := newPenaltyRules(cfg)
+    if err != nil {
+        log.Errorf("Penalty settings not reloaded: %v", err)
+        return
+    }
+    s.penalty.rules.Store(rules)
+}
+
+// Counts share of login and ip towards penalties, false when either is banned for its share ratio
+func (s *PolicyServer) ApplyPenaltyPolicy(login, ip string, kind ShareKind) bool {
+    r := s.penalty.currentRules()
+    if !r.Enabled {
+        return true
+    }
+    ok := true
+    if len(login) > 0 {
+        v := s.penalty.record(r, penaltyKey{"login", login}, kind)
+        ok = s.punish("login", login, &v) && ok
+    }
+    if !s.InWhiteList(ip) {
+        if s.IsBanned(ip) {
+            return false
+        }
+        v := s.penalty.record(r, penaltyKey{"ip", ip}, kind)
+        if v.offense && v.step > 0 {
+            x := s.Get(ip)
+            if atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
+                s.applyBan(x, ip, int32(v.level), v.step)
+            }
+        }
+        ok = s.punish("ip", ip, &v) && ok
+    }
+    return ok
+}
+
+func (s *PolicyServer) punish(kind, id string, v *penaltyVerdict) bool {
+    if v.banned {
+        return false
+    }
+    if !v.offense {
+        return true
+    }
+    if v.step == 0 {
+        log.Warnf("Penalty warning for %v %v, level %v: %.1f%% invalid, %.1f%% stale and %v forged of %v shares", kind, id, v.level, v.invalid, v.stale, v.forged, v.total)
+        return true
+    }
+    log.Warnf("Penalty ban of %v %v for %v, level %v: %.1f%% invalid, %.1f%% stale and %v forged of %v shares", kind, id, v.step, v.level, v.invalid, v.stale, v.forged, v.total)
+    return false
+}
+
+// Rejects logins serving a penalty ban
+func (s *PolicyServer) ApplyLoginPenaltyPolicy(login string) bool {
+    if !s.penalty.currentRules().Enabled {
+        return true
+    }
+    return !s.penalty.loginBanned(login)
+}
+
+// Logins and IPs with offenses, highest level first
+func (s *PolicyServer) Offenders() []OffenderInfo {
+    r := s.penalty.currentRules()
+    now := util.MakeTimestamp()
+    result := []OffenderInfo{}
+    s.penalty.Lock()
+    for key, o := range s.penalty.offenders {
+        if o.level == 0 {
+            continue
+        }
+        info := OffenderInfo{Kind: key.kind, Id: key.id, Level: o.level, LastOffense: o.lastOffense}
+        if o.bannedUntil > now {
+            info.BannedUntil = o.bannedUntil
+        }
+        if r.window > 0 {
+            info.Valid, info.Invalid, info.Stale, info.Forged = o.counts(now, r.window)
+        }
+        result = append(result, info)
+    }
+    s.penalty.Unlock()
+    sort.Slice(result, func(i, j int) bool {
+        if result[i].Level != result[j].Level {
+            return result[i].Level > result[j].Level
+        }
+        return result[i].LastOffense > result[j].LastOffense
+    })
+    return result
+}
+
+// Resets offense level of login or IP and lifts its penalty ban, IP ban is lifted as by admin unban
+func (s *PolicyServer) ForgiveOffender(kind, id string) bool {
+    key := penaltyKey{kind, id}
+    s.penalty.Lock()
+    _, ok := s.penalty.offenders[key]
+    delete(s.penalty.offenders, key)
+    s.penalty.Unlock()
+    if ok && kind == "ip" {
+        s.UnbanIP(id)
+    }
+    return ok
+}
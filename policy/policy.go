@@ -2,23 +2,28 @@ package policy
 
 import (
     "fmt"
-    "log"
-    "os/exec"
-    "strings"
+    "net"
     "sync"
     "sync/atomic"
     "time"
 
+    "github.com/NotoriousPyro/open-metaverse-pool/logging"
     "github.com/NotoriousPyro/open-metaverse-pool/storage"
     "github.com/NotoriousPyro/open-metaverse-pool/util"
 )
 
+var log = logging.New("policy")
+
 type Config struct {
     Workers           int           `json:"workers"`
     Banning           Banning       `json:"banning"`
     Limits            Limits        `json:"limits"`
+    // Escalating bans for high invalid or stale share ratio of a login or IP
+    Penalty           Penalty       `json:"penalty"`
     ResetInterval     string        `json:"resetInterval"`
     RefreshInterval   string        `json:"refreshInterval"`
+    // Only logins in backend login whitelist may mine, for private pools
+    WhitelistOnly     bool          `json:"whitelistOnly"`
 }
 
 type Limits struct {
@@ -30,11 +35,26 @@ type Limits struct {
 
 type Banning struct {
     Enabled            bool       `json:"enabled"`
+    // Legacy ipset name, same as firewall with ipset driver
     IPSet              string     `json:"ipset"`
+    Firewall           FirewallConfig `json:"firewall"`
     Timeout            int64      `json:"timeout"`
     InvalidPercent     float32    `json:"invalidPercent"`
     CheckThreshold     int32      `json:"checkThreshold"`
     MalformedLimit     int32      `json:"malformedLimit"`
+    DuplicateLimit     int32      `json:"duplicateLimit"`
+    // Ban durations by offense tier, last one is doubled for further tiers.
+    // If empty timeout is doubled with every tier.
+    Escalation         []string   `json:"escalation"`
+    // Ban is permanent from this tier on, 0 disables
+    PermanentAfter     int32      `json:"permanentAfter"`
+    // Offenses are counted in backend for this long, empty disables escalation
+    OffenseWindow      string     `json:"offenseWindow"`
+    // Offenses of IPs within subnet of this prefix length escalate each other
+    SubnetMask         int        `json:"subnetMask"`
+    // Malformed, duplicate and share counters are kept in backend for resetInterval,
+    // so all proxies ban by their sum. Costs a backend round trip per counted event.
+    SharedCounters     bool       `json:"sharedCounters"`
 }
 
 type Stats struct {
@@ -43,46 +63,81 @@ type Stats struct {
     // so moving it before the rest in order to avoid alignment issue
     LastBeat           int64
     BannedAt           int64
+    // 0 while banned means permanent ban
+    BanUntil           int64
     ValidShares        int32
     InvalidShares      int32
     Malformed          int32
+    Duplicates         int32
     ConnLimit          int32
     Banned             int32
+    Tier               int32
+}
+
+type BanInfo struct {
+    Ip                 string     `json:"ip"`
+    BannedAt           int64      `json:"bannedAt"`
+    // 0 for permanent ban
+    Until              int64      `json:"until"`
+    Tier               int32      `json:"tier"`
+}
+
+type banRequest struct {
+    ip                 string
+    timeout            time.Duration
+    unban              bool
 }
 
 type PolicyServer struct {
     sync.RWMutex
     statsMu            sync.Mutex
-    config             *Config
+    config             atomic.Value
     stats              map[string]*Stats
-    banChannel         chan string
+    banChannel         chan banRequest
     startedAt          int64
     grace              int64
     timeout            int64
     blacklist          []string
     whitelist          []string
+    loginWhitelist     []string
+    firewall           firewall
+    // Parsed ban durations of current config
+    bans               atomic.Value
+    penalty            *penaltyTracker
     storage            *storage.RedisClient
 }
 
 func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
-    s := &PolicyServer{config: cfg, startedAt: util.MakeTimestamp()}
+    s := &PolicyServer{startedAt: util.MakeTimestamp()}
+    s.config.Store(cfg)
     grace := util.MustParseDuration(cfg.Limits.Grace)
     s.grace = int64(grace / time.Millisecond)
-    s.banChannel = make(chan string, 64)
+    s.banChannel = make(chan banRequest, 64)
     s.stats = make(map[string]*Stats)
     s.storage = storage
+    fw, err := newFirewall(&cfg.Banning)
+    if err != nil {
+        log.Fatal(err)
+    }
+    s.firewall = fw
+    bans, err := newBanRules(&cfg.Banning)
+    if err != nil {
+        log.Fatal(err)
+    }
+    s.bans.Store(bans)
+    s.startPenalty(&cfg.Penalty)
     s.refreshState()
 
-    timeout := util.MustParseDuration(s.config.ResetInterval)
+    timeout := util.MustParseDuration(cfg.ResetInterval)
     s.timeout = int64(timeout / time.Millisecond)
 
-    resetIntv := util.MustParseDuration(s.config.ResetInterval)
+    resetIntv := util.MustParseDuration(cfg.ResetInterval)
     resetTimer := time.NewTimer(resetIntv)
-    log.Printf("Set policy stats reset every %v", resetIntv)
+    log.Infof("Set policy stats reset every %v", resetIntv)
 
-    refreshIntv := util.MustParseDuration(s.config.RefreshInterval)
+    refreshIntv := util.MustParseDuration(cfg.RefreshInterval)
     refreshTimer := time.NewTimer(refreshIntv)
-    log.Printf("Set policy state refresh every %v", refreshIntv)
+    log.Infof("Set policy state refresh every %v", refreshIntv)
 
     go func() {
         for {
@@ -91,76 +146,212 @@ func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
                 s.resetStats()
                 resetTimer.Reset(resetIntv)
             case <-refreshTimer.C:
+                s.expireBans()
                 s.refreshState()
                 refreshTimer.Reset(refreshIntv)
             }
         }
     }()
 
-    for i := 0; i < s.config.Workers; i++ {
+    for i := 0; i < cfg.Workers; i++ {
         s.startPolicyWorker()
     }
-    log.Printf("Running with %v policy workers", s.config.Workers)
+    log.Infof("Running with %v policy workers", cfg.Workers)
     return s
 }
 
+func (s *PolicyServer) cfg() *Config {
+    return s.config.Load().(*Config)
+}
+
+// Checks settings which Reload applies, so invalid config is rejected before anything changes
+func ValidateConfig(cfg *Config) error {
+    if _, err := newFirewall(&cfg.Banning); err != nil {
+        return err
+    }
+    if _, err := newBanRules(&cfg.Banning); err != nil {
+        return err
+    }
+    _, err := newPenaltyRules(&cfg.Penalty)
+    return err
+}
+
+// Applies new banning and limits thresholds, intervals and workers count are kept
+func (s *PolicyServer) Reload(cfg *Config) {
+    bans, err := newBanRules(&cfg.Banning)
+    if err != nil {
+        log.Errorf("Policy config not reloaded: %v", err)
+        return
+    }
+    fw, err := newFirewall(&cfg.Banning)
+    if err != nil {
+        log.Errorf("Policy firewall not reloaded: %v", err)
+    } else {
+        s.Lock()
+        s.firewall = fw
+        s.Unlock()
+    }
+    s.bans.Store(bans)
+    s.reloadPenalty(&cfg.Penalty)
+    s.config.Store(cfg)
+    log.Infof("Policy config reloaded, banning: %v, limits: %v, whitelist only: %v", cfg.Banning.Enabled, cfg.Limits.Enabled, cfg.WhitelistOnly)
+}
+
 func (s *PolicyServer) startPolicyWorker() {
     go func() {
         for {
             select {
-            case ip := <-s.banChannel:
-                s.doBan(ip)
+            case req := <-s.banChannel:
+                s.enforce(req)
             }
         }
     }()
 }
 
 func (s *PolicyServer) resetStats() {
+    total := s.expireBans()
     now := util.MakeTimestamp()
-    banningTimeout := s.config.Banning.Timeout * 1000
-    total := 0
     s.statsMu.Lock()
     defer s.statsMu.Unlock()
 
     for key, m := range s.stats {
         lastBeat := atomic.LoadInt64(&m.LastBeat)
-        bannedAt := atomic.LoadInt64(&m.BannedAt)
 
-        if now-bannedAt >= banningTimeout {
-            atomic.StoreInt64(&m.BannedAt, 0)
-            if atomic.CompareAndSwapInt32(&m.Banned, 1, 0) {
-                log.Printf("Ban dropped for %v", key)
-                delete(s.stats, key)
-                total++
-            }
+        // Banned peers are kept until ban expires, permanent bans are never dropped
+        if atomic.LoadInt32(&m.Banned) > 0 {
+            continue
         }
         if now-lastBeat >= s.timeout {
             delete(s.stats, key)
             total++
         }
     }
-    log.Printf("Flushed stats for %v IP addresses", total)
+    log.Debugf("Flushed stats for %v IP addresses, %v penalty offenders", total, s.penalty.expire())
+}
+
+// Drops expired bans and removes them from firewall, returns how many were dropped
+func (s *PolicyServer) expireBans() int {
+    now := util.MakeTimestamp()
+    var expired []string
+    s.statsMu.Lock()
+    for key, m := range s.stats {
+        until := atomic.LoadInt64(&m.BanUntil)
+        if until > 0 && now >= until && atomic.CompareAndSwapInt32(&m.Banned, 1, 0) {
+            atomic.StoreInt64(&m.BannedAt, 0)
+            delete(s.stats, key)
+            expired = append(expired, key)
+        }
+    }
+    s.statsMu.Unlock()
+
+    for _, ip := range expired {
+        log.Infof("Ban dropped for %v", ip)
+        s.unenforce(ip)
+    }
+    return len(expired)
 }
 
 func (s *PolicyServer) refreshState() {
     s.Lock()
-    defer s.Unlock()
     var err error
 
     s.blacklist, err = s.storage.GetBlacklist()
     if err != nil {
-        log.Printf("Failed to get blacklist from backend: %v", err)
+        log.Errorf("Failed to get blacklist from backend: %v", err)
     }
     s.whitelist, err = s.storage.GetWhitelist()
     if err != nil {
-        log.Printf("Failed to get whitelist from backend: %v", err)
+        log.Errorf("Failed to get whitelist from backend: %v", err)
+    }
+    s.loginWhitelist, err = s.storage.GetLoginWhitelist()
+    if err != nil {
+        log.Errorf("Failed to get login whitelist from backend: %v", err)
+    }
+    permanent, permErr := s.storage.GetPermanentBans()
+    if permErr != nil {
+        log.Errorf("Failed to get permanent bans from backend: %v", permErr)
+    }
+    for ip, tier := range permanent {
+        x := s.Get(ip)
+        if atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
+            atomic.StoreInt64(&x.BannedAt, util.MakeTimestamp())
+            atomic.StoreInt64(&x.BanUntil, 0)
+            atomic.StoreInt32(&x.Tier, int32(tier))
+        }
+    }
+    s.Unlock()
+
+    fetchedAt := util.MakeTimestamp()
+    bans, banErr := s.storage.GetBans()
+    if banErr != nil {
+        log.Errorf("Failed to get bans from backend: %v", banErr)
+    } else if permErr == nil {
+        s.syncBans(bans, permanent, fetchedAt)
+    }
+    log.Debug("Policy state refresh complete")
+}
+
+// Applies bans of other proxies and lifts local ones which are gone from backend,
+// bans made after fetchedAt may not be written yet and are kept
+func (s *PolicyServer) syncBans(bans map[string]storage.IPBan, permanent map[string]int64, fetchedAt int64) {
+    now := util.MakeTimestamp()
+    var requests []banRequest
+    for ip, ban := range bans {
+        if s.InWhiteList(ip) {
+            continue
+        }
+        x := s.Get(ip)
+        if !atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
+            continue
+        }
+        atomic.StoreInt64(&x.BannedAt, now)
+        atomic.StoreInt64(&x.BanUntil, ban.Until)
+        atomic.StoreInt32(&x.Tier, int32(ban.Tier))
+        timeout := time.Duration(ban.Until-now) * time.Millisecond
+        log.Infof("Banned peer %v for %v by another proxy, tier %v", ip, timeout, ban.Tier)
+        requests = append(requests, banRequest{ip: ip, timeout: timeout})
+    }
+
+    var lifted []string
+    s.statsMu.Lock()
+    for ip, x := range s.stats {
+        if atomic.LoadInt32(&x.Banned) == 0 || atomic.LoadInt64(&x.BannedAt) >= fetchedAt {
+            continue
+        }
+        // Expired bans are dropped by resetStats
+        if until := atomic.LoadInt64(&x.BanUntil); until > 0 && until <= now {
+            continue
+        }
+        if _, ok := bans[ip]; ok {
+            continue
+        }
+        if _, ok := permanent[ip]; ok {
+            continue
+        }
+        if atomic.CompareAndSwapInt32(&x.Banned, 1, 0) {
+            s.lift(x)
+            lifted = append(lifted, ip)
+        }
+    }
+    s.statsMu.Unlock()
+
+    for _, ip := range lifted {
+        log.Infof("Ban of %v was lifted on another proxy", ip)
+        requests = append(requests, banRequest{ip: ip, unban: true})
+    }
+    // Firewall may lag behind many bans of other proxies, refresh doesn't wait for it
+    if len(requests) > 0 {
+        go func() {
+            for _, req := range requests {
+                s.requestFirewall(req)
+            }
+        }()
     }
-    log.Println("Policy state refresh complete")
 }
 
 func (s *PolicyServer) NewStats() *Stats {
     x := &Stats{
-        ConnLimit: s.config.Limits.Limit,
+        ConnLimit: s.cfg().Limits.Limit,
     }
     x.heartbeat()
     return x
@@ -191,7 +382,7 @@ func (s *PolicyServer) IsBanned(ip string) bool {
 }
 
 func (s *PolicyServer) ApplyLimitPolicy(ip string) bool {
-    if !s.config.Limits.Enabled {
+    if !s.cfg().Limits.Enabled {
         return true
     }
     now := util.MakeTimestamp()
@@ -210,10 +401,35 @@ func (s *PolicyServer) ApplyLoginPolicy(addy, ip string) bool {
     return true
 }
 
+// Rejects logins missing in login whitelist if pool is whitelist only, never bans
+func (s *PolicyServer) ApplyWhitelistPolicy(addy string) bool {
+    if !s.WhitelistOnly() {
+        return true
+    }
+    s.RLock()
+    defer s.RUnlock()
+    return util.StringInSlice(addy, s.loginWhitelist)
+}
+
 func (s *PolicyServer) ApplyMalformedPolicy(ip string) bool {
     x := s.Get(ip)
-    n := x.incrMalformed()
-    if n >= s.config.Banning.MalformedLimit {
+    n := s.sharedCount(ip, "malformed", x.incrMalformed())
+    if n >= s.cfg().Banning.MalformedLimit {
+        s.forceBan(x, ip)
+        return false
+    }
+    return true
+}
+
+// Bans peers repeatedly submitting the same share, disabled with zero limit
+func (s *PolicyServer) ApplyDuplicatePolicy(ip string) bool {
+    limit := s.cfg().Banning.DuplicateLimit
+    if limit <= 0 {
+        return true
+    }
+    x := s.Get(ip)
+    n := s.sharedCount(ip, "duplicates", x.incrDuplicates())
+    if n >= limit {
         s.forceBan(x, ip)
         return false
     }
@@ -226,15 +442,15 @@ func (s *PolicyServer) ApplySharePolicy(ip string, validShare bool) bool {
 
     if validShare {
         x.ValidShares++
-        if s.config.Limits.Enabled {
-            x.incrLimit(s.config.Limits.LimitJump)
+        if s.cfg().Limits.Enabled {
+            x.incrLimit(s.cfg().Limits.LimitJump)
         }
     } else {
         x.InvalidShares++
     }
 
     totalShares := x.ValidShares + x.InvalidShares
-    if totalShares < s.config.Banning.CheckThreshold {
+    if totalShares < s.cfg().Banning.CheckThreshold {
         x.Unlock()
         return true
     }
@@ -243,33 +459,171 @@ func (s *PolicyServer) ApplySharePolicy(ip string, validShare bool) bool {
     x.resetShares()
     x.Unlock()
 
+    if s.cfg().Banning.SharedCounters {
+        counts := map[string]int64{"valid": int64(validShares), "invalid": int64(invalidShares)}
+        totals, err := s.storage.IncrPolicyCounters(ip, counts, s.counterWindow())
+        if err != nil {
+            log.Errorf("Failed to write share counters of %v to backend: %v", ip, err)
+        } else {
+            validShares = float32(totals["valid"])
+            invalidShares = float32(totals["invalid"])
+        }
+    }
+
     ratio := invalidShares / validShares
 
-    if ratio >= s.config.Banning.InvalidPercent/100.0 {
+    if ratio >= s.cfg().Banning.InvalidPercent/100.0 {
         s.forceBan(x, ip)
         return false
     }
     return true
 }
 
+// Adds one to counter of ip shared by all proxies and returns its total, local count if backend fails
+func (s *PolicyServer) sharedCount(ip, field string, local int32) int32 {
+    if !s.cfg().Banning.SharedCounters {
+        return local
+    }
+    totals, err := s.storage.IncrPolicyCounters(ip, map[string]int64{field: 1}, s.counterWindow())
+    if err != nil {
+        log.Errorf("Failed to write %v counter of %v to backend: %v", field, ip, err)
+        return local
+    }
+    return int32(totals[field])
+}
+
+func (s *PolicyServer) counterWindow() time.Duration {
+    return time.Duration(s.timeout) * time.Millisecond
+}
+
 func (x *Stats) resetShares() {
     x.ValidShares = 0
     x.InvalidShares = 0
 }
 
 func (s *PolicyServer) forceBan(x *Stats, ip string) {
-    if !s.config.Banning.Enabled || s.InWhiteList(ip) {
+    if !s.cfg().Banning.Enabled || s.InWhiteList(ip) {
         return
     }
-    atomic.StoreInt64(&x.BannedAt, util.MakeTimestamp())
+    s.ban(x, ip)
+}
 
-    if atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
-        if len(s.config.Banning.IPSet) > 0 {
-            s.banChannel <- ip
-        } else {
-            log.Println("Banned peer", ip)
+func (s *PolicyServer) ban(x *Stats, ip string) {
+    if !atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
+        return
+    }
+    tier, timeout := s.escalate(ip)
+    s.applyBan(x, ip, tier, timeout)
+}
+
+// Stores ban already marked on x, zero timeout is permanent
+func (s *PolicyServer) applyBan(x *Stats, ip string, tier int32, timeout time.Duration) {
+    now := util.MakeTimestamp()
+    until := int64(0)
+    if timeout > 0 {
+        until = now + int64(timeout/time.Millisecond)
+    }
+    atomic.StoreInt64(&x.BanUntil, until)
+    atomic.StoreInt32(&x.Tier, tier)
+    atomic.StoreInt64(&x.BannedAt, now)
+
+    if timeout == 0 {
+        err := s.storage.AddPermanentBan(ip, int64(tier))
+        if err != nil {
+            log.Errorf("Failed to write permanent ban of %v to backend: %v", ip, err)
+        }
+    } else {
+        err := s.storage.AddBan(ip, int64(tier), until)
+        if err != nil {
+            log.Errorf("Failed to write ban of %v to backend: %v", ip, err)
+        }
+    }
+    if timeout == 0 {
+        log.Warnf("Banned peer %v permanently, tier %v", ip, tier)
+    } else {
+        log.Warnf("Banned peer %v for %v, tier %v", ip, timeout, tier)
+    }
+    s.requestFirewall(banRequest{ip: ip, timeout: timeout})
+}
+
+// Ban settings with parsed durations
+type banRules struct {
+    Banning
+    offenseWindow  time.Duration
+    escalation     []time.Duration
+}
+
+func newBanRules(cfg *Banning) (*banRules, error) {
+    r := &banRules{Banning: *cfg}
+    if len(cfg.OffenseWindow) > 0 {
+        window, err := time.ParseDuration(cfg.OffenseWindow)
+        if err != nil || window <= 0 {
+            return nil, fmt.Errorf("Invalid banning offenseWindow %q", cfg.OffenseWindow)
+        }
+        r.offenseWindow = window
+    }
+    for _, step := range cfg.Escalation {
+        d, err := time.ParseDuration(step)
+        if err != nil || d <= 0 {
+            return nil, fmt.Errorf("Invalid banning escalation step %q", step)
+        }
+        r.escalation = append(r.escalation, d)
+    }
+    return r, nil
+}
+
+// Counts offense of ip and its subnet, returns tier and ban duration, 0 is permanent
+func (s *PolicyServer) escalate(ip string) (int32, time.Duration) {
+    r := s.bans.Load().(*banRules)
+    tier := int32(1)
+    if r.offenseWindow > 0 {
+        ipCount, subnetCount, err := s.storage.WriteOffense(ip, subnetOf(ip, r.SubnetMask), r.offenseWindow)
+        if err != nil {
+            log.Errorf("Failed to write offense of %v to backend: %v", ip, err)
+        }
+        if ipCount > int64(tier) {
+            tier = int32(ipCount)
+        }
+        if subnetCount > int64(tier) {
+            tier = int32(subnetCount)
+        }
+    }
+    if r.PermanentAfter > 0 && tier >= r.PermanentAfter {
+        return tier, 0
+    }
+    return tier, r.duration(tier)
+}
+
+func (r *banRules) duration(tier int32) time.Duration {
+    base := time.Duration(r.Timeout) * time.Second
+    step := int(tier - 1)
+    if len(r.escalation) > 0 {
+        if step < len(r.escalation) {
+            return r.escalation[step]
         }
+        base = r.escalation[len(r.escalation)-1]
+        step = step - len(r.escalation) + 1
     }
+    // Keep away from overflow, 2^20 of any sane timeout is forever anyway
+    if step > 20 {
+        step = 20
+    }
+    return base << uint(step)
+}
+
+// Subnet of ip with IPv4 prefix length mask, IPv6 always uses /64
+func subnetOf(ip string, mask int) string {
+    parsed := net.ParseIP(ip)
+    if parsed == nil {
+        return ip
+    }
+    if v4 := parsed.To4(); v4 != nil {
+        if mask <= 0 || mask > 32 {
+            mask = 24
+        }
+        return fmt.Sprintf("%v/%v", v4.Mask(net.CIDRMask(mask, 32)), mask)
+    }
+    return fmt.Sprintf("%v/64", parsed.Mask(net.CIDRMask(64, 128)))
 }
 
 func (x *Stats) incrLimit(n int32) {
@@ -280,6 +634,10 @@ func (x *Stats) incrMalformed() int32 {
     return atomic.AddInt32(&x.Malformed, 1)
 }
 
+func (x *Stats) incrDuplicates() int32 {
+    return atomic.AddInt32(&x.Duplicates, 1)
+}
+
 func (x *Stats) decrLimit() int32 {
     return atomic.AddInt32(&x.ConnLimit, -1)
 }
@@ -296,19 +654,145 @@ func (s *PolicyServer) InWhiteList(ip string) bool {
     return util.StringInSlice(ip, s.whitelist)
 }
 
-func (s *PolicyServer) doBan(ip string) {
-    set, timeout := s.config.Banning.IPSet, s.config.Banning.Timeout
-    cmd := fmt.Sprintf("sudo ipset add %s %s timeout %v -!", set, ip, timeout)
-    args := strings.Fields(cmd)
-    head := args[0]
-    args = args[1:]
+// Bans ip set by admin regardless of banning settings, counts as offense
+func (s *PolicyServer) BanIP(ip string) {
+    log.Infof("Banning peer %v by admin", ip)
+    s.ban(s.Get(ip), ip)
+}
+
+func (s *PolicyServer) UnbanIP(ip string) bool {
+    s.statsMu.Lock()
+    x, ok := s.stats[ip]
+    s.statsMu.Unlock()
+    if !ok || !atomic.CompareAndSwapInt32(&x.Banned, 1, 0) {
+        return false
+    }
+    s.lift(x)
+    // Forgiven peer starts from first tier again and loses its bans on all proxies, subnet history is kept
+    err := s.storage.ClearOffenses(ip)
+    if err != nil {
+        log.Errorf("Failed to clear offenses of %v in backend: %v", ip, err)
+    }
+    log.Infof("Unbanned peer %v by admin", ip)
+    s.unenforce(ip)
+    return true
+}
+
+// Resets stats of peer whose ban was just cleared
+func (s *PolicyServer) lift(x *Stats) {
+    atomic.StoreInt64(&x.BannedAt, 0)
+    atomic.StoreInt64(&x.BanUntil, 0)
+    atomic.StoreInt32(&x.Tier, 0)
+    x.Lock()
+    x.resetShares()
+    x.Unlock()
+    atomic.StoreInt32(&x.Malformed, 0)
+    atomic.StoreInt32(&x.Duplicates, 0)
+}
 
-    log.Printf("Banned %v with timeout %v on ipset %s", ip, timeout, set)
+func (s *PolicyServer) unenforce(ip string) {
+    s.requestFirewall(banRequest{ip: ip, unban: true})
+}
 
-    _, err := exec.Command(head, args...).Output()
+// Returns banned IPs with their tier, times are in milliseconds
+func (s *PolicyServer) BannedIPs() []BanInfo {
+    s.statsMu.Lock()
+    defer s.statsMu.Unlock()
+    result := []BanInfo{}
+    for ip, x := range s.stats {
+        if atomic.LoadInt32(&x.Banned) > 0 {
+            result = append(result, BanInfo{
+                Ip:       ip,
+                BannedAt: atomic.LoadInt64(&x.BannedAt),
+                Until:    atomic.LoadInt64(&x.BanUntil),
+                Tier:     atomic.LoadInt32(&x.Tier),
+            })
+        }
+    }
+    return result
+}
+
+func (s *PolicyServer) BanLogin(login string) error {
+    err := s.storage.AddToBlacklist(login)
+    if err != nil {
+        return err
+    }
+    s.refreshState()
+    return nil
+}
+
+func (s *PolicyServer) UnbanLogin(login string) error {
+    err := s.storage.RemoveFromBlacklist(login)
+    if err != nil {
+        return err
+    }
+    s.refreshState()
+    return nil
+}
+
+func (s *PolicyServer) BannedLogins() []string {
+    s.RLock()
+    defer s.RUnlock()
+    return append([]string{}, s.blacklist...)
+}
+
+func (s *PolicyServer) AllowLogin(login string) error {
+    err := s.storage.AddToLoginWhitelist(login)
+    if err != nil {
+        return err
+    }
+    s.refreshState()
+    return nil
+}
+
+func (s *PolicyServer) DisallowLogin(login string) error {
+    err := s.storage.RemoveFromLoginWhitelist(login)
     if err != nil {
-        log.Printf("CMD Error: %s", err)
+        return err
+    }
+    s.refreshState()
+    return nil
+}
+
+func (s *PolicyServer) WhitelistOnly() bool {
+    return s.cfg().WhitelistOnly
+}
+
+func (s *PolicyServer) AllowedLogins() []string {
+    s.RLock()
+    defer s.RUnlock()
+    return append([]string{}, s.loginWhitelist...)
+}
+
+func (s *PolicyServer) fw() firewall {
+    s.RLock()
+    defer s.RUnlock()
+    return s.firewall
+}
+
+// Firewall commands run on policy workers, so slow helpers never block stratum
+func (s *PolicyServer) requestFirewall(req banRequest) {
+    if s.fw() != nil {
+        s.banChannel <- req
+    }
+}
+
+func (s *PolicyServer) enforce(req banRequest) {
+    fw := s.fw()
+    if fw == nil {
+        return
+    }
+    if req.unban {
+        if err := fw.unban(req.ip); err != nil {
+            log.Errorf("Failed to unban %v on firewall: %v", req.ip, err)
+        }
+        return
+    }
+    if err := fw.ban(req.ip, req.timeout); err != nil {
+        log.Errorf("Failed to ban %v on firewall: %v", req.ip, err)
+        return
     }
+    log.Infof("Banned %v with timeout %v on firewall", req.ip, req.timeout)
 }
 
 func (x *Stats) heartbeat() {
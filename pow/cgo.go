@@ -0,0 +1,25 @@
+// +build cgo,!purego
+
+package pow
+
+import (
+    "github.com/ethereum/ethash"
+)
+
+// C implementation of libethash, needs C toolchain to build
+func init() {
+    register("cgo", func(params Params) Verifier {
+        if !params.Standard() {
+            return nil
+        }
+        return &cgoVerifier{ethash.New()}
+    })
+}
+
+type cgoVerifier struct {
+    hasher         *ethash.Ethash
+}
+
+func (v *cgoVerifier) Verify(block Block) bool {
+    return v.hasher.Verify(block)
+}
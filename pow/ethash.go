@@ -0,0 +1,261 @@
+package pow
+
+import (
+    "bytes"
+    "encoding/binary"
+    "hash"
+    "math/big"
+    "sync"
+
+    "golang.org/x/crypto/sha3"
+)
+
+const (
+    datasetInitBytes   = 1 << 30
+    datasetGrowthBytes = 1 << 23
+    cacheInitBytes     = 1 << 24
+    cacheGrowthBytes   = 1 << 17
+    mixBytes           = 128
+    hashBytes          = 64
+    hashWords          = 16
+    datasetParents     = 256
+    cacheRounds        = 3
+    loopAccesses       = 64
+    // Current, previous and next epoch around epoch switch
+    maxCaches          = 3
+)
+
+var maxUint256 = new(big.Int).Exp(big.NewInt(2), big.NewInt(256), big.NewInt(0))
+
+// Pure Go light verifier, works everywhere but costs more CPU per share
+func init() {
+    register("go", func(params Params) Verifier {
+        return NewEthash(params)
+    })
+}
+
+// Epoch numbers differ from seed epochs once epoch length changes, both identify a cache
+type cacheKey struct {
+    epoch          uint64
+    seedEpoch      uint64
+}
+
+type cache struct {
+    once           sync.Once
+    data           []uint32
+    datasetSize    uint64
+}
+
+type Ethash struct {
+    params         Params
+    mu             sync.Mutex
+    caches         map[cacheKey]*cache
+}
+
+func NewEthash(params Params) *Ethash {
+    return &Ethash{params: params, caches: make(map[cacheKey]*cache)}
+}
+
+func (e *Ethash) Verify(block Block) bool {
+    difficulty := block.Difficulty()
+    if difficulty == nil || difficulty.Sign() <= 0 {
+        return false
+    }
+    c := e.cache(e.params.epochs(block.NumberU64()))
+    digest, result := hashimotoLight(c.datasetSize, c.data, block.HashNoNonce().Bytes(), block.Nonce())
+    if string(digest) != string(block.MixDigest().Bytes()) {
+        return false
+    }
+    return meetsTarget(result, difficulty)
+}
+
+// Checks result derived from mix digest claimed by miner against difficulty of block.
+// Costs two hashes instead of hashimoto but proves nothing, a forged digest passes it.
+// Once Verify accepts the digest the outcome holds for any difficulty.
+func MeetsTarget(block Block) bool {
+    difficulty := block.Difficulty()
+    if difficulty == nil || difficulty.Sign() <= 0 {
+        return false
+    }
+    seed := make([]byte, 40)
+    copy(seed, block.HashNoNonce().Bytes())
+    binary.LittleEndian.PutUint64(seed[32:], block.Nonce())
+    seed = keccak(sha3.NewLegacyKeccak512(), seed)
+    result := keccak(sha3.NewLegacyKeccak256(), seed, block.MixDigest().Bytes())
+    return meetsTarget(result, difficulty)
+}
+
+func meetsTarget(result []byte, difficulty *big.Int) bool {
+    target := new(big.Int).Div(maxUint256, difficulty)
+    return new(big.Int).SetBytes(result).Cmp(target) <= 0
+}
+
+// Returns verification cache of epoch, generating it once, drops the oldest one if there are too many
+func (e *Ethash) cache(epoch, seedEpoch uint64) *cache {
+    key := cacheKey{epoch, seedEpoch}
+    e.mu.Lock()
+    c, ok := e.caches[key]
+    if !ok {
+        if len(e.caches) >= maxCaches {
+            var oldest cacheKey
+            first := true
+            for k, _ := range e.caches {
+                if first || k.seedEpoch < oldest.seedEpoch {
+                    oldest, first = k, false
+                }
+            }
+            delete(e.caches, oldest)
+        }
+        c = &cache{}
+        e.caches[key] = c
+    }
+    e.mu.Unlock()
+
+    c.once.Do(func() {
+        c.data = generateCache(cacheSize(epoch), seedHash(seedEpoch))
+        c.datasetSize = datasetSize(epoch)
+    })
+    return c
+}
+
+func cacheSize(epoch uint64) uint64 {
+    size := cacheInitBytes + cacheGrowthBytes*epoch - hashBytes
+    for !new(big.Int).SetUint64(size / hashBytes).ProbablyPrime(1) {
+        size -= 2 * hashBytes
+    }
+    return size
+}
+
+func datasetSize(epoch uint64) uint64 {
+    size := datasetInitBytes + datasetGrowthBytes*epoch - mixBytes
+    for !new(big.Int).SetUint64(size / mixBytes).ProbablyPrime(1) {
+        size -= 2 * mixBytes
+    }
+    return size
+}
+
+func seedHash(epoch uint64) []byte {
+    seed := make([]byte, 32)
+    h := sha3.NewLegacyKeccak256()
+    for i := uint64(0); i < epoch; i++ {
+        seed = keccak(h, seed)
+    }
+    return seed
+}
+
+func findSeedEpoch(seed []byte, maxEpoch uint64) (uint64, bool) {
+    s := make([]byte, 32)
+    h := sha3.NewLegacyKeccak256()
+    for epoch := uint64(0); epoch <= maxEpoch; epoch++ {
+        if bytes.Equal(s, seed) {
+            return epoch, true
+        }
+        s = keccak(h, s)
+    }
+    return 0, false
+}
+
+func keccak(h hash.Hash, data ...[]byte) []byte {
+    h.Reset()
+    for _, b := range data {
+        h.Write(b)
+    }
+    return h.Sum(nil)
+}
+
+func fnv(a, b uint32) uint32 {
+    return a*0x01000193 ^ b
+}
+
+func fnvHash(mix []uint32, data []uint32) {
+    for i := 0; i < len(mix); i++ {
+        mix[i] = mix[i]*0x01000193 ^ data[i]
+    }
+}
+
+func toWords(b []byte) []uint32 {
+    words := make([]uint32, len(b)/4)
+    for i := range words {
+        words[i] = binary.LittleEndian.Uint32(b[i*4:])
+    }
+    return words
+}
+
+// Sequential keccak512 chain mixed with RandMemoHash rounds
+func generateCache(size uint64, seed []byte) []uint32 {
+    rows := int(size / hashBytes)
+    buf := make([]byte, size)
+    h := sha3.NewLegacyKeccak512()
+
+    copy(buf, keccak(h, seed))
+    for off := hashBytes; off < len(buf); off += hashBytes {
+        copy(buf[off:], keccak(h, buf[off-hashBytes:off]))
+    }
+    temp := make([]byte, hashBytes)
+    for round := 0; round < cacheRounds; round++ {
+        for j := 0; j < rows; j++ {
+            src := ((j - 1 + rows) % rows) * hashBytes
+            dst := j * hashBytes
+            xor := int(binary.LittleEndian.Uint32(buf[dst:])%uint32(rows)) * hashBytes
+            for k := 0; k < hashBytes; k++ {
+                temp[k] = buf[src+k] ^ buf[xor+k]
+            }
+            copy(buf[dst:], keccak(h, temp))
+        }
+    }
+    return toWords(buf)
+}
+
+func generateDatasetItem(cache []uint32, index uint32, h hash.Hash) []uint32 {
+    rows := uint32(len(cache) / hashWords)
+    mix := make([]byte, hashBytes)
+    off := (index % rows) * hashWords
+    binary.LittleEndian.PutUint32(mix, cache[off]^index)
+    for i := uint32(1); i < hashWords; i++ {
+        binary.LittleEndian.PutUint32(mix[i*4:], cache[off+i])
+    }
+    intMix := toWords(keccak(h, mix))
+    for i := uint32(0); i < datasetParents; i++ {
+        parent := fnv(index^i, intMix[i%hashWords]) % rows
+        fnvHash(intMix, cache[parent*hashWords:])
+    }
+    for i, val := range intMix {
+        binary.LittleEndian.PutUint32(mix[i*4:], val)
+    }
+    return toWords(keccak(h, mix))
+}
+
+// Returns mix digest and result of hashimoto computed from cache only
+func hashimotoLight(size uint64, cache []uint32, headerHash []byte, nonce uint64) ([]byte, []byte) {
+    h := sha3.NewLegacyKeccak512()
+    rows := uint32(size / mixBytes)
+
+    seed := make([]byte, 40)
+    copy(seed, headerHash)
+    binary.LittleEndian.PutUint64(seed[32:], nonce)
+    seed = keccak(h, seed)
+    seedHead := binary.LittleEndian.Uint32(seed)
+
+    mix := make([]uint32, mixBytes/4)
+    for i := range mix {
+        mix[i] = binary.LittleEndian.Uint32(seed[i%hashWords*4:])
+    }
+    temp := make([]uint32, len(mix))
+    for i := 0; i < loopAccesses; i++ {
+        parent := fnv(uint32(i)^seedHead, mix[i%len(mix)]) % rows
+        for j := uint32(0); j < mixBytes/hashBytes; j++ {
+            copy(temp[j*hashWords:], generateDatasetItem(cache, 2*parent+j, h))
+        }
+        fnvHash(mix, temp)
+    }
+    for i := 0; i < len(mix); i += 4 {
+        mix[i/4] = fnv(fnv(fnv(mix[i], mix[i+1]), mix[i+2]), mix[i+3])
+    }
+    mix = mix[:len(mix)/4]
+
+    digest := make([]byte, 32)
+    for i, val := range mix {
+        binary.LittleEndian.PutUint32(digest[i*4:], val)
+    }
+    return digest, keccak(sha3.NewLegacyKeccak256(), seed, digest)
+}
@@ -0,0 +1,127 @@
+package pow
+
+import (
+    "fmt"
+    "math/big"
+    "sort"
+
+    "github.com/ethereum/go-ethereum/common"
+)
+
+// Share or block whose proof of work is checked
+type Block interface {
+    Difficulty() *big.Int
+    HashNoNonce() common.Hash
+    Nonce() uint64
+    MixDigest() common.Hash
+    NumberU64() uint64
+}
+
+type Verifier interface {
+    Verify(block Block) bool
+}
+
+// Epoch rules of an Ethash family chain
+type Params struct {
+    EpochLength    uint64
+    // Epoch length doubles from this height while seed hash keeps counting
+    // epochs of the original length (ECIP-1099), 0 never
+    DoubleEpochAt  uint64
+}
+
+const (
+    ethashEpochLength = 30000
+    // ETC mainnet ECIP-1099 activation
+    etchashBlock = 11700000
+)
+
+// Params of algo, epochLength and doubleEpochAt override its defaults when set
+func NewParams(algo string, epochLength, doubleEpochAt uint64) (Params, error) {
+    p := Params{EpochLength: ethashEpochLength}
+    switch algo {
+    case "", "ethash":
+    case "etchash":
+        p.DoubleEpochAt = etchashBlock
+    default:
+        return p, fmt.Errorf("Unknown algo %v, must be ethash or etchash", algo)
+    }
+    if epochLength > 0 {
+        p.EpochLength = epochLength
+    }
+    if doubleEpochAt > 0 {
+        p.DoubleEpochAt = doubleEpochAt
+    }
+    return p, nil
+}
+
+// Standard Ethash, the only rules libethash knows
+func (p Params) Standard() bool {
+    return p.EpochLength == ethashEpochLength && p.DoubleEpochAt == 0
+}
+
+// Returns epoch sizing cache and dataset at height and epoch its seed hash is derived from
+func (p Params) epochs(height uint64) (uint64, uint64) {
+    if p.DoubleEpochAt > 0 && height >= p.DoubleEpochAt {
+        epoch := height / (p.EpochLength * 2)
+        return epoch, epoch * 2
+    }
+    epoch := height / p.EpochLength
+    return epoch, epoch
+}
+
+// Seed hash of height, as node reports it in work package
+func SeedHash(p Params, height uint64) []byte {
+    _, seedEpoch := p.epochs(height)
+    return seedHash(seedEpoch)
+}
+
+// First height whose seed hash is seed, for work which comes without height.
+// Searches seed epochs up to maxEpoch.
+func SeedHeight(p Params, seed []byte, maxEpoch uint64) (uint64, bool) {
+    seedEpoch, ok := findSeedEpoch(seed, maxEpoch)
+    if !ok {
+        return 0, false
+    }
+    height := seedEpoch * p.EpochLength
+    if _, e := p.epochs(height); e != seedEpoch {
+        return 0, false
+    }
+    return height, true
+}
+
+// Backend returns nil for params it doesn't support
+var backends = make(map[string]func(params Params) Verifier)
+
+// Backends register themselves from init, optimized ones are built with cgo only
+func register(name string, f func(params Params) Verifier) {
+    backends[name] = f
+}
+
+// Names of backends compiled into this binary
+func Backends() []string {
+    names := make([]string, 0, len(backends))
+    for name, _ := range backends {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// Returns backend by name, empty name picks cgo if compiled in and params are standard, pure Go otherwise
+func New(name string, params Params) (Verifier, string, error) {
+    if len(name) == 0 {
+        name = "go"
+        if _, ok := backends["cgo"]; ok && params.Standard() {
+            name = "cgo"
+        }
+    }
+    f, ok := backends[name]
+    if !ok {
+        return nil, name, fmt.Errorf("Unknown hashing backend %v, available: %v", name, Backends())
+    }
+    v := f(params)
+    if v == nil {
+        return nil, name, fmt.Errorf("Hashing backend %v supports standard Ethash only", name)
+    }
+    return v, name, nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/payouts"
+    "github.com/NotoriousPyro/open-metaverse-pool/policy"
+    "github.com/NotoriousPyro/open-metaverse-pool/pow"
+    "github.com/NotoriousPyro/open-metaverse-pool/proxy"
+    "github.com/NotoriousPyro/open-metaverse-pool/rpc"
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+)
+
+type preflightCheck struct {
+    Name    string
+    Detail  string
+    Err     error
+    // Failed check which doesn't stop startup
+    Warn    bool
+}
+
+// Node whose last block is older than this is taken as still syncing
+const maxTipAge = time.Hour
+
+type preflightReport struct {
+    checks  []preflightCheck
+}
+
+func (r *preflightReport) add(name, detail string, err error) {
+    r.checks = append(r.checks, preflightCheck{Name: name, Detail: detail, Err: err})
+}
+
+func (r *preflightReport) warn(name, detail string, err error) {
+    r.checks = append(r.checks, preflightCheck{Name: name, Detail: detail, Err: err, Warn: true})
+}
+
+func (r *preflightReport) failures() int {
+    n := 0
+    for _, c := range r.checks {
+        if c.Err != nil && !c.Warn {
+            n++
+        }
+    }
+    return n
+}
+
+func (r *preflightReport) print() {
+    log.Infof("Preflight report, %v checks:", len(r.checks))
+    for _, c := range r.checks {
+        if c.Err != nil && c.Warn {
+            log.Warnf("  [WARN] %-32s %v", c.Name, c.Err)
+        } else if c.Err != nil {
+            log.Errorf("  [FAIL] %-32s %v", c.Name, c.Err)
+        } else {
+            log.Infof("  [ OK ] %-32s %v", c.Name, c.Detail)
+        }
+    }
+}
+
+// Checks everything enabled modules rely on before any of them is started
+func runPreflight(cfg *proxy.Config, backend *storage.RedisClient, ledger storage.Ledger) *preflightReport {
+    report := &preflightReport{}
+
+    checkConfig(report, cfg)
+    checkBackend(report, backend)
+    if ledger != storage.Ledger(backend) {
+        version, err := ledger.Check()
+        report.add("ledger reachable", version, err)
+    }
+
+    if cfg.Proxy.Enabled {
+        checkBindable(report, "proxy http", cfg.Proxy.Listen)
+        if cfg.Proxy.Admin.Enabled {
+            checkBindable(report, "proxy admin", cfg.Proxy.Admin.Listen)
+        }
+        for _, s := range cfg.Proxy.Stratum {
+            if s.Enabled {
+                for _, addr := range s.Listen {
+                    checkBindable(report, "stratum "+s.Name, addr)
+                }
+            }
+        }
+        if !cfg.Pool.Enabled {
+            // Backup nodes may be down, stratum fails over to them only while they are healthy
+            for i, v := range cfg.Upstream {
+                checkUpstream(report, "upstream "+v.Name, v.Url, v.Timeout, cfg, i > 0)
+            }
+        }
+    }
+    if cfg.Api.Enabled {
+        checkBindable(report, "api", cfg.Api.Listen)
+    }
+    if cfg.BlockUnlocker.Enabled {
+        checkUpstream(report, "unlocker daemon", cfg.BlockUnlocker.Daemon, cfg.BlockUnlocker.Timeout, cfg, false)
+    }
+    if cfg.Payouts.Enabled {
+        checkUpstream(report, "payouts daemon", cfg.Payouts.Daemon, cfg.Payouts.Timeout, cfg, false)
+        checkWallet(report, cfg)
+    }
+    return report
+}
+
+func checkConfig(report *preflightReport, cfg *proxy.Config) {
+    report.add("config", "consistent", validateConfig(cfg))
+}
+
+// Also run on reload, the whole new config is rejected if any setting is invalid
+func validateConfig(cfg *proxy.Config) (err error) {
+    if err = checkRedisConfig("redis", &cfg.Redis); err != nil {
+        return
+    }
+    if cfg.Api.Enabled && len(cfg.Api.Replica.Endpoint) > 0 {
+        if err = checkRedisConfig("api.replica", &cfg.Api.Replica); err != nil {
+            return
+        }
+    }
+
+    if cfg.Events.Enabled {
+        if cfg.Events.Driver != "kafka" && cfg.Events.Driver != "nats" {
+            err = fmt.Errorf("events.driver must be kafka or nats")
+            return
+        }
+        if len(cfg.Events.Servers) == 0 || len(cfg.Events.Topic) == 0 {
+            err = fmt.Errorf("events needs servers and topic")
+            return
+        }
+    }
+
+    durations := map[string]string{}
+    if cfg.Proxy.Enabled {
+        durations["upstreamCheckInterval"] = cfg.UpstreamCheckInterval
+        durations["proxy.blockRefreshInterval"] = cfg.Proxy.BlockRefreshInterval
+        durations["proxy.stateUpdateInterval"] = cfg.Proxy.StateUpdateInterval
+        durations["proxy.hashrateExpiration"] = cfg.Proxy.HashrateExpiration
+        if len(cfg.UpstreamMaxLatency) > 0 {
+            durations["upstreamMaxLatency"] = cfg.UpstreamMaxLatency
+        }
+        optional := map[string]string{
+            "proxy.staleGrace":             cfg.Proxy.StaleGrace,
+            "proxy.drainTimeout":           cfg.Proxy.DrainTimeout,
+            "proxy.cluster.hashrateWindow": cfg.Proxy.Cluster.HashrateWindow,
+            "pool.timeout":                 cfg.Pool.Timeout,
+            "pool.retryInterval":           cfg.Pool.RetryInterval,
+        }
+        for name, value := range optional {
+            if len(value) > 0 {
+                durations[name] = value
+            }
+        }
+        switch cfg.UpstreamStrategy {
+        case "", "failover", "roundRobin":
+        default:
+            err = fmt.Errorf("upstreamStrategy must be failover or roundRobin")
+            return
+        }
+        if cfg.Pool.Enabled {
+            if len(cfg.Pool.Upstreams) == 0 {
+                err = fmt.Errorf("pool mode is enabled but no upstream pools configured")
+                return
+            }
+            for _, v := range cfg.Pool.Upstreams {
+                if _, perr := pow.NewParams(v.Algo, v.EpochLength, v.Ecip1099Block); perr != nil {
+                    err = fmt.Errorf("upstream pool %v: %v", v.Name, perr)
+                    return
+                }
+            }
+        } else if len(cfg.Upstream) == 0 {
+            err = fmt.Errorf("proxy is enabled but no upstreams configured")
+            return
+        }
+        if err = policy.ValidateConfig(&cfg.Proxy.Policy); err != nil {
+            return
+        }
+        names := make(map[string]bool)
+        for _, s := range cfg.Proxy.Stratum {
+            if names[s.Name] {
+                err = fmt.Errorf("duplicate stratum name %v", s.Name)
+                return
+            }
+            names[s.Name] = true
+            if s.Enabled && s.Difficulty <= 0 {
+                err = fmt.Errorf("stratum %v difficulty must be > 0", s.Name)
+                return
+            }
+            if err = proxy.ValidateSchedule(&s); err != nil {
+                return
+            }
+            if s.Enabled {
+                durations["stratum "+s.Name+" timeout"] = s.Timeout
+                if s.FreshWork {
+                    durations["stratum "+s.Name+" freshWorkInterval"] = s.FreshWorkInterval
+                }
+            }
+        }
+        for _, v := range cfg.Upstream {
+            durations["upstream "+v.Name+" timeout"] = v.Timeout
+            params, perr := pow.NewParams(v.Algo, v.EpochLength, v.Ecip1099Block)
+            if perr != nil {
+                err = fmt.Errorf("upstream %v: %v", v.Name, perr)
+                return
+            }
+            if _, _, perr = pow.New(cfg.Proxy.Hasher, params); perr != nil {
+                err = fmt.Errorf("upstream %v: %v", v.Name, perr)
+                return
+            }
+        }
+    }
+    if cfg.Api.Enabled {
+        durations["api.statsCollectInterval"] = cfg.Api.StatsCollectInterval
+        durations["api.hashrateWindow"] = cfg.Api.HashrateWindow
+        durations["api.hashrateLargeWindow"] = cfg.Api.HashrateLargeWindow
+        durations["api.purgeInterval"] = cfg.Api.PurgeInterval
+        if cfg.Api.UsesSignedRequests() {
+            durations["api.signedRequests.timeout"] = cfg.Api.SignedRequests.Timeout
+            durations["api.signedRequests.maxAge"] = cfg.Api.SignedRequests.MaxAge
+        }
+        if cfg.Api.History.Enabled {
+            durations["api.history.interval"] = cfg.Api.History.Interval
+            durations["api.history.retention"] = cfg.Api.History.Retention
+            durations["api.history.rollupRetention"] = cfg.Api.History.RollupRetention
+        }
+        if cfg.Api.Closures.Enabled {
+            durations["api.closures.retention"] = cfg.Api.Closures.Retention
+        }
+    }
+    if cfg.BlockUnlocker.Enabled {
+        durations["unlocker.interval"] = cfg.BlockUnlocker.Interval
+        durations["unlocker.timeout"] = cfg.BlockUnlocker.Timeout
+        if len(cfg.BlockUnlocker.DisputeWindow) > 0 {
+            durations["unlocker.disputeWindow"] = cfg.BlockUnlocker.DisputeWindow
+        }
+        if err = payouts.ValidateUnlockerConfig(&cfg.BlockUnlocker); err != nil {
+            return
+        }
+    }
+    if cfg.Payouts.Enabled {
+        durations["payouts.interval"] = cfg.Payouts.Interval
+        durations["payouts.timeout"] = cfg.Payouts.Timeout
+        if err = payouts.ValidatePayoutsConfig(&cfg.Payouts); err != nil {
+            return
+        }
+    }
+    if cfg.Notifier.Enabled {
+        durations["notifier.interval"] = cfg.Notifier.Interval
+        durations["notifier.offlineAfter"] = cfg.Notifier.OfflineAfter
+        durations["notifier.timeout"] = cfg.Notifier.Timeout
+    }
+    for name, value := range durations {
+        if _, perr := time.ParseDuration(value); perr != nil {
+            err = fmt.Errorf("%v: %v", name, perr)
+            return
+        }
+    }
+    return
+}
+
+func checkRedisConfig(name string, cfg *storage.Config) error {
+    if cfg.Sentinel.Enabled && cfg.Cluster.Enabled {
+        return fmt.Errorf("%v sentinel and cluster can not be enabled together", name)
+    }
+    if cfg.Sentinel.Enabled && (len(cfg.Sentinel.MasterName) == 0 || len(cfg.Sentinel.Addrs) == 0) {
+        return fmt.Errorf("%v sentinel needs masterName and addrs", name)
+    }
+    if cfg.Cluster.Enabled {
+        if len(cfg.Cluster.Addrs) == 0 {
+            return fmt.Errorf("%v cluster needs addrs", name)
+        }
+        if cfg.Database != 0 {
+            return fmt.Errorf("%v cluster supports database 0 only", name)
+        }
+    }
+    if cfg.WriteBehind.Enabled && len(cfg.WriteBehind.FlushInterval) > 0 {
+        if _, err := time.ParseDuration(cfg.WriteBehind.FlushInterval); err != nil {
+            return fmt.Errorf("%v writeBehind flushInterval: %v", name, err)
+        }
+    }
+    return nil
+}
+
+func checkBackend(report *preflightReport, backend *storage.RedisClient) {
+    pong, err := backend.Check()
+    report.add("backend reachable", pong, err)
+    if err != nil {
+        return
+    }
+    report.add("backend writable", "ok", backend.CheckWritable())
+}
+
+func checkBindable(report *preflightReport, name, addr string) {
+    l, err := net.Listen("tcp", addr)
+    if err == nil {
+        l.Close()
+    }
+    report.add(name+" bind", addr, err)
+}
+
+func checkUpstream(report *preflightReport, name, url, timeout string, cfg *proxy.Config, backup bool) {
+    add := report.add
+    if backup {
+        add = report.warn
+    }
+    if _, err := time.ParseDuration(timeout); err != nil {
+        report.add(name, url, err)
+        return
+    }
+    client := rpc.NewRPCClient(name, url, cfg.Account, cfg.Password, timeout)
+    height, err := client.GetHeight()
+    if err != nil {
+        add(name, url, err)
+        return
+    }
+    peers, err := client.GetPeerCount()
+    if err == nil && peers == 0 {
+        err = fmt.Errorf("node has no peers, can't be synced")
+    }
+    if err != nil {
+        add(name, fmt.Sprintf("%v height %v, %v peers", url, height, peers), err)
+        return
+    }
+    // Node with peers may still be catching up, its tip is old then
+    tip, err := client.GetBlockByHeight(int64(height))
+    if err == nil && tip == nil {
+        err = fmt.Errorf("node returned no block at its height")
+    }
+    if err != nil {
+        add(name, fmt.Sprintf("%v height %v, %v peers", url, height, peers), err)
+        return
+    }
+    age := time.Since(time.Unix(int64(tip.TimeStamp), 0)).Truncate(time.Second)
+    if age > maxTipAge {
+        err = fmt.Errorf("last block is %v old, node is not synced", age)
+    }
+    add(name, fmt.Sprintf("%v height %v, %v peers, last block %v ago", url, height, peers, age), err)
+}
+
+func checkWallet(report *preflightReport, cfg *proxy.Config) {
+    if cfg.Payouts.Signer.Enabled {
+        _, _, err := payouts.LoadSigningKey(&cfg.Payouts)
+        report.add("payouts signer", cfg.Payouts.Address, err)
+        return
+    }
+    if _, err := time.ParseDuration(cfg.Payouts.Timeout); err != nil {
+        report.add("payouts wallet", cfg.Account, err)
+        return
+    }
+    client := rpc.NewRPCClient("PayoutsProcessor", cfg.Payouts.Daemon, cfg.Account, cfg.Password, cfg.Payouts.Timeout)
+    err := client.CheckAccount()
+    if err != nil {
+        err = fmt.Errorf("can't unlock account %v: %v", cfg.Account, err)
+    }
+    report.add("payouts wallet", cfg.Account, err)
+}
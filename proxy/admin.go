@@ -0,0 +1,324 @@
+package proxy
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/json"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "strconv"
+    "sync/atomic"
+
+    "github.com/gorilla/mux"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+type AdminConfig struct {
+    Enabled        bool     `json:"enabled"`
+    Listen         string   `json:"listen"`
+    // Sent as "Authorization: Bearer <token>", may be empty with mTLS
+    Token          string   `json:"token"`
+    CertFile       string   `json:"certFile"`
+    KeyFile        string   `json:"keyFile"`
+    // Clients must present certificate signed by this CA
+    ClientCAFile   string   `json:"clientCAFile"`
+}
+
+type AdminSession struct {
+    Id             uint64   `json:"id"`
+    Ip             string   `json:"ip"`
+    Login          string   `json:"login"`
+    Worker         string   `json:"worker"`
+    Difficulty     int64    `json:"difficulty"`
+    Override       bool     `json:"override"`
+    ConnectedAt    int64    `json:"connectedAt"`
+}
+
+func (s *ProxyServer) startAdmin() {
+    cfg := &s.config.Proxy.Admin
+    if len(cfg.Token) == 0 && len(cfg.ClientCAFile) == 0 {
+        log.Fatal("Admin API requires token or clientCAFile")
+    }
+    r := mux.NewRouter()
+    r.HandleFunc("/admin/sessions", s.adminSessions).Methods("GET")
+    r.HandleFunc("/admin/sessions/{id:[0-9]+}", s.adminKick).Methods("DELETE")
+    r.HandleFunc("/admin/sessions/{id:[0-9]+}/difficulty", s.adminDifficulty).Methods("PUT", "DELETE")
+    r.HandleFunc("/admin/bans", s.adminBans).Methods("GET")
+    r.HandleFunc("/admin/bans/ip/{ip}", s.adminBanIP).Methods("PUT", "DELETE")
+    r.HandleFunc("/admin/bans/login/{login}", s.adminBanLogin).Methods("PUT", "DELETE")
+    r.HandleFunc("/admin/offenders", s.adminOffenders).Methods("GET")
+    r.HandleFunc("/admin/offenders/{kind:login|ip}/{id}", s.adminForgive).Methods("DELETE")
+    r.HandleFunc("/admin/health", s.adminHealth).Methods("GET")
+    r.HandleFunc("/admin/pause", s.adminPauses).Methods("GET")
+    r.HandleFunc("/admin/pause", s.adminPause).Methods("PUT", "DELETE")
+    r.HandleFunc("/admin/pause/{name}", s.adminPause).Methods("PUT", "DELETE")
+    r.HandleFunc("/admin/whitelist", s.adminWhitelist).Methods("GET")
+    r.HandleFunc("/admin/whitelist/{login}", s.adminWhitelistLogin).Methods("PUT", "DELETE")
+    s.adminServer = &http.Server{Addr: cfg.Listen, Handler: util.BearerAuth(cfg.Token, adminHeaders(r))}
+
+    if len(cfg.ClientCAFile) > 0 {
+        if len(cfg.CertFile) == 0 {
+            log.Fatal("Admin API clientCAFile requires certFile and keyFile")
+        }
+        pem, err := ioutil.ReadFile(cfg.ClientCAFile)
+        if err != nil {
+            log.Fatalf("Failed to read admin clientCAFile: %v", err)
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            log.Fatalf("No certificates found in %v", cfg.ClientCAFile)
+        }
+        s.adminServer.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+    }
+
+    go func() {
+        var err error
+        if len(cfg.CertFile) > 0 {
+            log.Infof("Starting admin API on https://%v", cfg.Listen)
+            err = s.adminServer.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
+        } else {
+            log.Infof("Starting admin API on %v", cfg.Listen)
+            err = s.adminServer.ListenAndServe()
+        }
+        if err != nil && err != http.ErrServerClosed {
+            log.Fatalf("Failed to start admin API: %v", err)
+        }
+    }()
+}
+
+func adminHeaders(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+        next.ServeHTTP(w, r)
+    })
+}
+
+func writeAdminReply(w http.ResponseWriter, reply interface{}) {
+    w.WriteHeader(http.StatusOK)
+    err := json.NewEncoder(w).Encode(reply)
+    if err != nil {
+        log.Error("Error serializing admin API response: ", err)
+    }
+}
+
+// Sessions grouped by stratum name
+func (s *ProxyServer) adminSessions(w http.ResponseWriter, r *http.Request) {
+    t := s.currentBlockTemplate()
+    reply := make(map[string][]AdminSession)
+    for i, stratum := range s.stratum {
+        name := s.config.Proxy.Stratum[i].Name
+        sessions := []AdminSession{}
+        stratum.sessionsMu.RLock()
+        for cs, _ := range stratum.sessions {
+            difficulty, _ := s.sessionDifficulty(cs, t)
+            sessions = append(sessions, AdminSession{
+                Id:          cs.id,
+                Ip:          cs.ip,
+                Login:       cs.login,
+                Worker:      cs.worker,
+                Difficulty:  difficulty,
+                Override:    atomic.LoadInt64(&cs.difficulty) > 0,
+                ConnectedAt: cs.connectedAt,
+            })
+        }
+        stratum.sessionsMu.RUnlock()
+        reply[name] = sessions
+    }
+    writeAdminReply(w, reply)
+}
+
+func (s *ProxyServer) findSession(id uint64) *Session {
+    var found *Session
+    s.eachSession(func(cs *Session) {
+        if cs.id == id {
+            found = cs
+        }
+    })
+    return found
+}
+
+func (s *ProxyServer) adminKick(w http.ResponseWriter, r *http.Request) {
+    id, _ := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+    cs := s.findSession(id)
+    if cs == nil {
+        w.WriteHeader(http.StatusNotFound)
+        return
+    }
+    log.Infof("Admin disconnected session %v of %v@%v", cs.id, cs.login, cs.ip)
+    cs.conn.Close()
+    writeAdminReply(w, map[string]interface{}{"id": id})
+}
+
+func (s *ProxyServer) adminDifficulty(w http.ResponseWriter, r *http.Request) {
+    id, _ := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+    cs := s.findSession(id)
+    if cs == nil {
+        w.WriteHeader(http.StatusNotFound)
+        return
+    }
+    var difficulty int64
+    if r.Method == "PUT" {
+        var req struct {
+            Difficulty int64 `json:"difficulty"`
+        }
+        err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req)
+        if err != nil || req.Difficulty <= 0 {
+            w.WriteHeader(http.StatusBadRequest)
+            return
+        }
+        difficulty = req.Difficulty
+    }
+    atomic.StoreInt64(&cs.difficulty, difficulty)
+    log.Infof("Admin set difficulty of session %v of %v@%v to %v", cs.id, cs.login, cs.ip, difficulty)
+
+    // New target takes effect with the next job
+    t := s.currentBlockTemplate()
+    if t != nil && cs.conn != nil {
+        _, diff := s.sessionDifficulty(cs, t)
+        err := cs.pushNewJob([]string{t.Header, t.Seed, diff})
+        if err != nil {
+            log.Errorf("Job transmit error to %v@%v: %v", cs.login, cs.ip, err)
+        }
+    }
+    writeAdminReply(w, map[string]interface{}{"id": id, "difficulty": difficulty})
+}
+
+func (s *ProxyServer) adminHealth(w http.ResponseWriter, r *http.Request) {
+    s.pausesMu.RLock()
+    defer s.pausesMu.RUnlock()
+    t := s.currentBlockTemplate()
+    reply := map[string]interface{}{
+        "sick":     s.isSick(),
+        "upstream": s.upstreamName(),
+        "upstreams": s.upstreamsHealth(),
+        "pauses":   s.pauses,
+    }
+    if t != nil {
+        reply["height"] = t.Height
+    }
+    if s.pool != nil {
+        reply["pool"] = s.pool.state()
+    }
+    writeAdminReply(w, reply)
+}
+
+func (s *ProxyServer) adminBans(w http.ResponseWriter, r *http.Request) {
+    writeAdminReply(w, map[string]interface{}{
+        "ips":    s.policy.BannedIPs(),
+        "logins": s.policy.BannedLogins(),
+    })
+}
+
+func (s *ProxyServer) adminOffenders(w http.ResponseWriter, r *http.Request) {
+    writeAdminReply(w, map[string]interface{}{
+        "offenders": s.policy.Offenders(),
+    })
+}
+
+func (s *ProxyServer) adminForgive(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    if !s.policy.ForgiveOffender(vars["kind"], vars["id"]) {
+        w.WriteHeader(http.StatusNotFound)
+        return
+    }
+    writeAdminReply(w, map[string]interface{}{"kind": vars["kind"], "id": vars["id"], "level": 0})
+}
+
+func (s *ProxyServer) adminBanIP(w http.ResponseWriter, r *http.Request) {
+    parsed := net.ParseIP(mux.Vars(r)["ip"])
+    if parsed == nil {
+        w.WriteHeader(http.StatusBadRequest)
+        return
+    }
+    // Sessions keep IPs in canonical form
+    ip := parsed.String()
+    if r.Method == "DELETE" {
+        if !s.policy.UnbanIP(ip) {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+        writeAdminReply(w, map[string]interface{}{"ip": ip, "banned": false})
+        return
+    }
+    s.policy.BanIP(ip)
+    s.eachSession(func(cs *Session) {
+        if cs.ip == ip {
+            cs.conn.Close()
+        }
+    })
+    writeAdminReply(w, map[string]interface{}{"ip": ip, "banned": true})
+}
+
+func (s *ProxyServer) adminBanLogin(w http.ResponseWriter, r *http.Request) {
+    login := mux.Vars(r)["login"]
+    if !util.IsValidHexAddress(login) {
+        w.WriteHeader(http.StatusBadRequest)
+        return
+    }
+    var err error
+    if r.Method == "DELETE" {
+        err = s.policy.UnbanLogin(login)
+    } else {
+        err = s.policy.BanLogin(login)
+    }
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to update blacklist in backend: %v", err)
+        return
+    }
+    if r.Method == "DELETE" {
+        log.Infof("Admin unbanned login %v", login)
+        writeAdminReply(w, map[string]interface{}{"login": login, "banned": false})
+        return
+    }
+    log.Infof("Admin banned login %v", login)
+    s.eachSession(func(cs *Session) {
+        if cs.login == login {
+            cs.conn.Close()
+        }
+    })
+    writeAdminReply(w, map[string]interface{}{"login": login, "banned": true})
+}
+
+func (s *ProxyServer) adminWhitelist(w http.ResponseWriter, r *http.Request) {
+    writeAdminReply(w, map[string]interface{}{
+        "enabled": s.policy.WhitelistOnly(),
+        "logins":  s.policy.AllowedLogins(),
+    })
+}
+
+func (s *ProxyServer) adminWhitelistLogin(w http.ResponseWriter, r *http.Request) {
+    login := mux.Vars(r)["login"]
+    if !util.IsValidHexAddress(login) {
+        w.WriteHeader(http.StatusBadRequest)
+        return
+    }
+    var err error
+    if r.Method == "DELETE" {
+        err = s.policy.DisallowLogin(login)
+    } else {
+        err = s.policy.AllowLogin(login)
+    }
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to update login whitelist in backend: %v", err)
+        return
+    }
+    if r.Method == "PUT" {
+        log.Infof("Admin whitelisted login %v", login)
+        writeAdminReply(w, map[string]interface{}{"login": login, "whitelisted": true})
+        return
+    }
+    // Connected workers of removed login are dropped on whitelist only pools
+    log.Infof("Admin removed login %v from whitelist", login)
+    if s.policy.WhitelistOnly() {
+        s.eachSession(func(cs *Session) {
+            if cs.login == login {
+                cs.conn.Close()
+            }
+        })
+    }
+    writeAdminReply(w, map[string]interface{}{"login": login, "whitelisted": false})
+}
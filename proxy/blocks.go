@@ -1,12 +1,17 @@
 package proxy
 
 import (
-    "log"
+    "math"
     "math/big"
+    "strings"
     "sync"
+    "sync/atomic"
+    "time"
 
     "github.com/ethereum/go-ethereum/common"
+    "github.com/NotoriousPyro/open-metaverse-pool/pow"
     "github.com/NotoriousPyro/open-metaverse-pool/rpc"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
 )
 
 type BlockTemplate struct {
@@ -16,8 +21,21 @@ type BlockTemplate struct {
     Target                    string
     Difficulty                *big.Int
     Height                    uint64
+    // Lowest share difficulty accepted for this template
+    MinDifficulty             int64
+    // Port difficulties jobs of this template are sent with, by stratum index,
+    // later profile switches and reloads apply from next template
+    PortDifficulty            []portTarget
     GetPendingBlockCache      *rpc.GetBlockReply
     nonces                    map[string]bool
+    // Node which issued the work, solutions are submitted there
+    upstream                  *rpc.RPCClient
+    // Upstream pool which issued the work in pool mode, nil for node work
+    pool                      *poolClient
+    // Verifies shares by chain rules of upstream
+    hasher                    pow.Verifier
+    // Orders templates by block for job history, height of node work
+    round                     uint64
 }
 
 type Block struct {
@@ -35,36 +53,60 @@ func (b Block) MixDigest() common.Hash   { return b.mixDigest }
 func (b Block) NumberU64() uint64        { return b.number }
 
 func (s *ProxyServer) fetchBlockTemplate() {
-    rpc := s.rpc()
+    // Upstream pool pushes its work, there is no node to poll
+    if s.pool != nil {
+        return
+    }
+    s.fetchMu.Lock()
+    defer s.fetchMu.Unlock()
+    rpc := s.nextRpc()
     t := s.currentBlockTemplate()
+    atomic.StoreInt64(&s.lastFetch, util.MakeTimestamp())
     
-    pendingReply, height, diff, err := s.fetchPendingBlock()
+    pendingReply, height, diff, err := s.fetchPendingBlock(rpc)
     if err != nil {
-        log.Printf("Error while refreshing pending block on %s: %s", rpc.Name, err)
+        log.Errorf("Error while refreshing pending block on %s: %s", rpc.Name, err)
         return
     }
     
     reply, err := rpc.GetWork()
     if err != nil {
-        log.Printf("Error while refreshing block template on %s: %s", rpc.Name, err)
+        log.Errorf("Error while refreshing block template on %s: %s", rpc.Name, err)
         return
     }
     
     if t != nil && t.Header == reply[0] {
         return
     }
+    // Other nodes have their own work for the same block, switching to it would only churn jobs
+    if t != nil && t.upstream != rpc && height <= t.Height && !t.upstream.Sick() {
+        return
+    }
     
+    hasher, params := s.upstreamHasher(rpc.Name)
+    if seed := common.BytesToHash(pow.SeedHash(params, height)).Hex(); !strings.EqualFold(seed[2:], strings.TrimPrefix(reply[1], "0x")) {
+        log.Errorf("Seed hash %s of %s at height %d doesn't match %s expected by algo settings of upstream, shares will be rejected",
+            reply[1], rpc.Name, height, seed)
+    }
+
     newTemplate := BlockTemplate{
         Header:                  reply[0],
         Seed:                    reply[1],
         Target:                  reply[2],
         Height:                  height,
         Difficulty:              diff,
+        MinDifficulty:           s.difficultyFloor(diff),
+        PortDifficulty:          s.portTargets(),
         GetPendingBlockCache:    pendingReply,
+        upstream:                rpc,
+        hasher:                  hasher,
+        round:                   height,
     }
+    s.logDifficultyFloor(t, &newTemplate)
     
     s.blockTemplate.Store(&newTemplate)
-    log.Printf("New block to mine on %s at height %d / %s", rpc.Name, height, reply[0])
+    s.rememberBlockTemplate(&newTemplate)
+    log.Infof("New block to mine on %s at height %d / %s", rpc.Name, height, reply[0])
     
     for i, setting := range s.config.Proxy.Stratum {
         if setting.Enabled {
@@ -73,17 +115,123 @@ func (s *ProxyServer) fetchBlockTemplate() {
      }
 }
 
-func (s *ProxyServer) fetchPendingBlock() (*rpc.GetBlockReply, uint64, *big.Int, error) {
-    rpc := s.rpc()
+// Network difficulty divided by difficultyFloorDivisor, 0 if floor is disabled
+func (s *ProxyServer) difficultyFloor(netDiff *big.Int) int64 {
+    divisor := s.config.Proxy.DifficultyFloorDivisor
+    if divisor <= 0 || netDiff == nil {
+        return 0
+    }
+    floor := new(big.Int).Div(netDiff, big.NewInt(divisor))
+    if !floor.IsInt64() {
+        return math.MaxInt64
+    }
+    return floor.Int64()
+}
+
+func (s *ProxyServer) logDifficultyFloor(prev, next *BlockTemplate) {
+    var prevFloor int64
+    if prev != nil {
+        prevFloor = prev.MinDifficulty
+    }
+    for i, port := range next.PortDifficulty {
+        difficulty := port.difficulty
+        name := s.config.Proxy.Stratum[i].Name
+        if next.MinDifficulty > difficulty && prevFloor <= difficulty {
+            log.Warnf("Stratum %s difficulty %v is below network floor, raised to %v", name, difficulty, next.MinDifficulty)
+        } else if next.MinDifficulty <= difficulty && prevFloor > difficulty {
+            log.Infof("Stratum %s difficulty back to configured %v", name, difficulty)
+        }
+    }
+}
+
+// Keeps current template and jobHistory previous refreshes of current block, newest first.
+// Templates of earlier blocks are dropped, with stale grace those of previous block are kept.
+func (s *ProxyServer) rememberBlockTemplate(t *BlockTemplate) {
+    s.templatesMu.Lock()
+    defer s.templatesMu.Unlock()
+    if len(s.templates) == 0 || t.round > s.templates[0].round {
+        s.blockChangedAt = util.MakeTimestamp()
+    }
+    s.templates = append([]*BlockTemplate{t}, s.templates...)
+    minRound := t.round
+    if s.staleGrace > 0 && minRound > 0 {
+        minRound--
+    }
+    kept := s.templates[:0]
+    for _, v := range s.templates {
+        if v.round >= minRound {
+            kept = append(kept, v)
+        }
+    }
+    s.templates = kept
+    keep := s.config.Proxy.JobHistory + 1
+    if s.staleGrace > 0 && keep < 2 {
+        keep = 2
+    }
+    if len(s.templates) > keep {
+        s.templates = s.templates[:keep]
+    }
+}
+
+// Returns nil if job is unknown or too old. Only jobs of current block are accepted, with stale
+// grace also jobs of the previous block until grace runs out, such jobs are returned as late.
+func (s *ProxyServer) findBlockTemplate(header string) (*BlockTemplate, bool) {
+    s.templatesMu.RLock()
+    defer s.templatesMu.RUnlock()
+    if len(s.templates) == 0 {
+        return nil, false
+    }
+    current := s.templates[0]
+    var prevRound uint64
+    for _, t := range s.templates {
+        if t.round < current.round && prevRound == 0 {
+            prevRound = t.round
+        }
+        if !strings.EqualFold(t.Header, header) {
+            continue
+        }
+        if t.round >= current.round {
+            return t, false
+        }
+        if s.staleGrace == 0 || t.round != prevRound || util.MakeTimestamp()-s.blockChangedAt > int64(s.staleGrace/time.Millisecond) {
+            return nil, false
+        }
+        return t, true
+    }
+    return nil, false
+}
+
+// Share difficulty credited for late share of previous block
+func (s *ProxyServer) staleCredit(shareDiff int64) int64 {
+    weight := s.config.Proxy.StaleWeight
+    if weight <= 0 || weight >= 1 {
+        return shareDiff
+    }
+    return int64(float64(shareDiff) * weight)
+}
+
+// Refreshes block template unless upstream was polled within minIntv
+func (s *ProxyServer) refreshBlockTemplate(minIntv time.Duration) {
+    now := util.MakeTimestamp()
+    last := atomic.LoadInt64(&s.lastFetch)
+    if now-last < int64(minIntv/time.Millisecond) {
+        return
+    }
+    if atomic.CompareAndSwapInt64(&s.lastFetch, last, now) {
+        s.fetchBlockTemplate()
+    }
+}
+
+func (s *ProxyServer) fetchPendingBlock(rpc *rpc.RPCClient) (*rpc.GetBlockReply, uint64, *big.Int, error) {
     reply, err := rpc.GetPendingBlock()
     if err != nil {
-        log.Printf("Error while refreshing pending block on %s: %s", rpc.Name, err)
+        log.Errorf("Error while refreshing pending block on %s: %s", rpc.Name, err)
         return nil, 0, nil, err
     }
     
     blockDiff, success := new(big.Int).SetString(reply.Difficulty, 10)
     if !success {
-        log.Println("Can't parse pending block difficulty")
+        log.Error("Can't parse pending block difficulty")
         return nil, 0, nil, err
     }
     
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+    "encoding/json"
+    "errors"
+    "runtime"
+)
+
+const (
+    defaultSessionQueue = 16
+    // Sessions handed to a broadcast worker at once
+    broadcastChunk = 256
+)
+
+var errQueueFull = errors.New("outbound queue is full")
+
+// Fixed set of goroutines running job broadcasts of all stratums
+func (s *ProxyServer) startBroadcastWorkers(n int) {
+    if n <= 0 {
+        n = runtime.NumCPU()
+    }
+    s.broadcasts = make(chan func(), n)
+    for i := 0; i < n; i++ {
+        go func() {
+            for task := range s.broadcasts {
+                task()
+            }
+        }()
+    }
+    log.Infof("Running with %v broadcast workers", n)
+}
+
+func (s *ProxyServer) sessionQueueSize() int {
+    if s.config.Proxy.SessionQueue > 0 {
+        return s.config.Proxy.SessionQueue
+    }
+    return defaultSessionQueue
+}
+
+func encodeJob(job []string) ([]byte, error) {
+    // FIXME: Temporarily add ID for Claymore compliance
+    message := JSONPushMessage{Version: "2.0", Result: job, Id: 0}
+    data, err := json.Marshal(&message)
+    if err != nil {
+        return nil, err
+    }
+    return append(data, '\n'), nil
+}
+
+// Never blocks, a session whose queue is full is not reading and must be dropped
+func (cs *Session) enqueue(msg []byte) bool {
+    select {
+    case cs.queue <- msg:
+        return true
+    default:
+        return false
+    }
+}
+
+// Writes queued messages until session ends, a slow client blocks only this goroutine
+func (s *ProxyServer) writeQueued(cs *Session) {
+    stratumConfig := s.config.Proxy.Stratum[cs.s_id]
+    for {
+        select {
+        case msg := <-cs.queue:
+            cs.Lock()
+            _, err := cs.conn.Write(msg)
+            cs.Unlock()
+            if err != nil {
+                log.Errorf("Job transmit error from %s to %v@%v: %v", stratumConfig.Name, cs.login, cs.ip, err)
+                cs.conn.Close()
+                return
+            }
+            s.setDeadline(cs.conn, cs.s_id)
+        case <-cs.done:
+            return
+        }
+    }
+}
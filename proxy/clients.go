@@ -0,0 +1,61 @@
+package proxy
+
+import (
+    "strings"
+    "time"
+)
+
+// Longest agent string kept, rest is cut off
+const maxAgentLength = 64
+
+// Mining software and protocol dialect reported at login. Agent is the optional "agent"
+// request field or third login param, dialect is inferred from login method and worker.
+func clientOf(req *StratumReq, params []string) (string, string) {
+    agent := req.Agent
+    if len(agent) == 0 && len(params) > 2 {
+        agent = params[2]
+    }
+    agent = sanitizeAgent(agent)
+    if len(agent) == 0 {
+        agent = "unknown"
+    }
+    dialect := "ethproxy"
+    switch {
+    case req.Worker == "eth1.0":
+        // Claymore sends this instead of worker name
+        dialect = "claymore"
+    case req.Method == "eth_login":
+        dialect = "login"
+    }
+    return agent, dialect
+}
+
+// Keeps printable ASCII except separators of backend fields
+func sanitizeAgent(agent string) string {
+    clean := strings.Map(func(r rune) rune {
+        if r < 0x20 || r > 0x7e || r == ':' {
+            return -1
+        }
+        return r
+    }, strings.TrimSpace(agent))
+    if len(clean) > maxAgentLength {
+        clean = clean[:maxAgentLength]
+    }
+    return strings.ToLower(clean)
+}
+
+// Logged in sessions by "dialect:agent"
+func (s *ProxyServer) clientCounts() map[string]int64 {
+    counts := make(map[string]int64)
+    s.eachSession(func(cs *Session) {
+        if len(cs.dialect) > 0 {
+            counts[cs.dialect+":"+cs.agent]++
+        }
+    })
+    return counts
+}
+
+// Counts of node which stopped reporting disappear after a few missed updates
+func clientStatsExpiry(intv time.Duration) time.Duration {
+    return 3 * intv
+}
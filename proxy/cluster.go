@@ -0,0 +1,70 @@
+package proxy
+
+import (
+    "os"
+    "sync"
+    "time"
+)
+
+type ClusterConfig struct {
+    Enabled        bool     `json:"enabled"`
+    // Unique per instance, proxy name and hostname when empty
+    NodeId         string   `json:"nodeId"`
+    Region         string   `json:"region"`
+    // Hashrate of this instance reported to API is averaged over this window
+    HashrateWindow string   `json:"hashrateWindow"`
+}
+
+// Instances sharing one backend need distinct node ids, or they overwrite each other's state
+func nodeId(cfg *Proxy) string {
+    if !cfg.Cluster.Enabled {
+        return cfg.Name
+    }
+    if len(cfg.Cluster.NodeId) > 0 {
+        return cfg.Cluster.NodeId
+    }
+    host, err := os.Hostname()
+    if err != nil {
+        log.Fatalf("Set cluster nodeId, failed to get hostname: %v", err)
+    }
+    return cfg.Name + "-" + host
+}
+
+// Accepted share difficulty of this instance in buckets of stateUpdateInterval
+type localHashrate struct {
+    sync.Mutex
+    current        int64
+    samples        []int64
+    size           int
+    interval       time.Duration
+}
+
+func newLocalHashrate(window, interval time.Duration) *localHashrate {
+    size := int(window / interval)
+    if size < 1 {
+        size = 1
+    }
+    return &localHashrate{size: size, interval: interval}
+}
+
+func (h *localHashrate) add(diff int64) {
+    h.Lock()
+    h.current += diff
+    h.Unlock()
+}
+
+// Closes current bucket and returns hashrate over buckets collected so far
+func (h *localHashrate) roll() int64 {
+    h.Lock()
+    defer h.Unlock()
+    h.samples = append(h.samples, h.current)
+    h.current = 0
+    if len(h.samples) > h.size {
+        h.samples = h.samples[len(h.samples)-h.size:]
+    }
+    var sum int64
+    for _, v := range h.samples {
+        sum += v
+    }
+    return sum / int64(time.Duration(len(h.samples))*h.interval/time.Second)
+}
@@ -1,7 +1,14 @@
 package proxy
 
 import (
+    "encoding/json"
+    "fmt"
+    "strings"
+
     "github.com/NotoriousPyro/open-metaverse-pool/api"
+    "github.com/NotoriousPyro/open-metaverse-pool/events"
+    "github.com/NotoriousPyro/open-metaverse-pool/logging"
+    "github.com/NotoriousPyro/open-metaverse-pool/notify"
     "github.com/NotoriousPyro/open-metaverse-pool/payouts"
     "github.com/NotoriousPyro/open-metaverse-pool/policy"
     "github.com/NotoriousPyro/open-metaverse-pool/storage"
@@ -15,14 +22,32 @@ type Config struct {
     Api                       api.ApiConfig    `json:"api"`
     Upstream                  []Upstream       `json:"upstream"`
     UpstreamCheckInterval     string           `json:"upstreamCheckInterval"`
+    // failover: first healthy upstream in list order, roundRobin: work polled from healthy ones in turn
+    UpstreamStrategy          string           `json:"upstreamStrategy"`
+    // Upstream more blocks than this behind the best one is unhealthy, 0 disables
+    UpstreamMaxLag            int64            `json:"upstreamMaxLag"`
+    // Upstream slower than this to serve work is unhealthy, empty disables
+    UpstreamMaxLatency        string           `json:"upstreamMaxLatency"`
+    // Take work from upstream stratum pools instead of nodes
+    Pool                      PoolConfig       `json:"pool"`
 
     Threads                   int              `json:"threads"`
+    // Start without running preflight checks
+    SkipPreflight             bool             `json:"skipPreflight"`
+    Log                       logging.Config   `json:"log"`
 
     Coin                      string              `json:"coin"`
     Redis                     storage.Config      `json:"redis"`
+    // Where round shares, blocks, balances and payments are kept
+    Ledger                    storage.LedgerConfig `json:"ledger"`
+    // Share, block and payment events for external pipelines
+    Events                    events.Config        `json:"events"`
     
     BlockUnlocker             payouts.UnlockerConfig       `json:"unlocker"`
     Payouts                   payouts.PayoutsConfig        `json:"payouts"`
+    Notifier                  notify.NotifierConfig        `json:"notifier"`
+
+    Control                   ControlConfig                `json:"control"`
 
     NewrelicName              string    `json:"newrelicName"`
     NewrelicKey               string    `json:"newrelicKey"`
@@ -30,6 +55,15 @@ type Config struct {
     NewrelicEnabled           bool      `json:"newrelicEnabled"`
 }
 
+// Pool actions triggered by publishing to backend channels
+type ControlConfig struct {
+    Enabled        bool                `json:"enabled"`
+    // Publish {"action": "...", "message": "..."} here
+    Channel        string              `json:"channel"`
+    // Backend key => action run on any keyspace event of that key
+    Keys           map[string]string   `json:"keys"`
+}
+
 type Proxy struct {
     Enabled                 bool        `json:"enabled"`
     Name                    string      `json:"name"`
@@ -41,26 +75,101 @@ type Proxy struct {
     BlockRefreshInterval    string      `json:"blockRefreshInterval"`
     StateUpdateInterval     string      `json:"stateUpdateInterval"`
     HashrateExpiration      string      `json:"hashrateExpiration"`
+    // Previous refreshes of current block template still accepted for shares
+    JobHistory              int         `json:"jobHistory"`
+    // Shares for previous block accepted this long after block change, empty rejects them as stale
+    StaleGrace              string      `json:"staleGrace"`
+    // Weight such shares are credited with, 0 means full
+    StaleWeight             float64     `json:"staleWeight"`
+    // Recent shares kept in memory for duplicate detection
+    ShareCacheSize          int         `json:"shareCacheSize"`
+    // Last shares kept in backend for PPLNS rewards, 0 disables
+    PPLNSWindow             int64       `json:"pplnsWindow"`
+    // Share verification backend: go, cgo or empty for the fastest compiled in
+    Hasher                  string      `json:"hasher"`
+    // Share verification workers and spot checking of low difficulty shares
+    Verify                  VerifyConfig `json:"verify"`
+    // Goroutines sending new jobs to sessions, 0 means number of CPUs
+    BroadcastWorkers        int         `json:"broadcastWorkers"`
+    // Jobs queued per session, miner which falls this far behind is disconnected
+    SessionQueue            int         `json:"sessionQueue"`
+    // Request and bandwidth limits of every stratum connection
+    SessionLimits           SessionLimits   `json:"sessionLimits"`
 
     Policy                  policy.Config   `json:"policy"`
 
     MaxFails                int64           `json:"maxFails"`
     HealthCheck             bool            `json:"healthCheck"`
 
+    // What to do when login+worker connects again: keep, dropOld or reject
+    DuplicateLogin          string          `json:"duplicateLogin"`
+    // Several instances in one or more regions sharing backend
+    Cluster                 ClusterConfig   `json:"cluster"`
+    // Rules worker names are normalized by
+    Worker                  WorkerConfig    `json:"worker"`
+
+    // Time given to miners to leave before sessions are closed on shutdown
+    DrainTimeout            string          `json:"drainTimeout"`
+    // Sent with reconnect notification to connected miners on shutdown
+    ShutdownMessage         string          `json:"shutdownMessage"`
+
+    // Share difficulty is never lower than network difficulty / divisor, 0 disables
+    DifficultyFloorDivisor  int64           `json:"difficultyFloorDivisor"`
+
+    Admin                   AdminConfig     `json:"admin"`
+    // Profiling and runtime state, never expose publicly
+    Debug                   DebugConfig     `json:"debug"`
+
     Stratum                 []Stratum       `json:"stratum"`
 }
 
 type Stratum struct {
     Name           string      `json:"name"`
     Enabled        bool        `json:"enabled"`
-    Listen         string      `json:"listen"`
+    // One address or list of them, e.g. ["0.0.0.0:3002", "[::]:3002"]
+    Listen         ListenAddrs `json:"listen"`
     Timeout        string      `json:"timeout"`
     MaxConn        int         `json:"maxConn"`
     Difficulty     int64       `json:"difficulty"`
+    // Blocks found on this port are credited to the finder only
+    Solo                bool      `json:"solo"`
+    // Fetch fresh work from upstream on eth_getWork polls
+    FreshWork           bool      `json:"freshWork"`
+    FreshWorkInterval   string    `json:"freshWorkInterval"`
+    // Difficulty replaced by profile active at time of day in timezone, UTC by default
+    Schedule            []DifficultyProfile `json:"schedule"`
+    Timezone            string    `json:"timezone"`
+}
+
+// Addresses of one stratum endpoint, read from a string or list of strings
+type ListenAddrs []string
+
+func (l *ListenAddrs) UnmarshalJSON(data []byte) error {
+    var addr string
+    if err := json.Unmarshal(data, &addr); err == nil {
+        *l = ListenAddrs{addr}
+        return nil
+    }
+    var addrs []string
+    if err := json.Unmarshal(data, &addrs); err != nil {
+        return fmt.Errorf("listen must be address or list of addresses: %v", err)
+    }
+    *l = addrs
+    return nil
+}
+
+func (l ListenAddrs) String() string {
+    return strings.Join(l, ",")
 }
 
 type Upstream struct {
     Name           string      `json:"name"`
     Url            string      `json:"url"`
     Timeout        string      `json:"timeout"`
+    // ethash or etchash, empty is ethash
+    Algo           string      `json:"algo"`
+    // Overrides 30000 blocks of algo, for other Ethash variants
+    EpochLength    uint64      `json:"epochLength"`
+    // Overrides ETC mainnet height where etchash doubles epoch length
+    Ecip1099Block  uint64      `json:"ecip1099Block"`
 }
@@ -0,0 +1,23 @@
+package proxy
+
+import (
+)
+
+// Polls upstream for work now instead of waiting for block refresh timer
+func (s *ProxyServer) RefreshBlockTemplate() {
+    s.fetchBlockTemplate()
+}
+
+// Shows message to every connected miner which supports client.show_message
+func (s *ProxyServer) BroadcastMessage(message string) {
+    n := 0
+    s.eachSession(func(cs *Session) {
+        err := cs.pushMessage("client.show_message", []string{message})
+        if err != nil {
+            log.Errorf("Failed to send message to %v@%v: %v", cs.login, cs.ip, err)
+            return
+        }
+        n++
+    })
+    log.Infof("Broadcasted message to %v miners", n)
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+    "encoding/json"
+    "expvar"
+    "net/http"
+    "net/http/pprof"
+    "runtime"
+    runtimepprof "runtime/pprof"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+type DebugConfig struct {
+    Enabled        bool     `json:"enabled"`
+    Listen         string   `json:"listen"`
+    // Sent as "Authorization: Bearer <token>", keep listen on loopback when empty
+    Token          string   `json:"token"`
+}
+
+type DebugSession struct {
+    Id             uint64   `json:"id"`
+    Stratum        string   `json:"stratum"`
+    Ip             string   `json:"ip"`
+    Login          string   `json:"login"`
+    Worker         string   `json:"worker"`
+    ConnectedAt    int64    `json:"connectedAt"`
+    // Jobs waiting to be written, a session stuck at queueSize is not reading
+    Queued         int      `json:"queued"`
+    QueueSize      int      `json:"queueSize"`
+}
+
+// Serves pprof, expvar, goroutine stacks and session queues on its own listener
+func (s *ProxyServer) startDebug() {
+    cfg := &s.config.Proxy.Debug
+    if len(cfg.Token) == 0 {
+        log.Warnf("Debug endpoints on %v are not protected by token", cfg.Listen)
+    }
+    mux := http.NewServeMux()
+    mux.HandleFunc("/debug/pprof/", pprof.Index)
+    mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+    mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+    mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+    mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+    mux.Handle("/debug/vars", expvar.Handler())
+    mux.HandleFunc("/debug/goroutines", debugGoroutines)
+    mux.HandleFunc("/debug/sessions", s.debugSessions)
+
+    if expvar.Get("proxy") == nil {
+        expvar.Publish("proxy", expvar.Func(s.debugVars))
+    }
+    s.debugServer = &http.Server{Addr: cfg.Listen, Handler: util.BearerAuth(cfg.Token, mux)}
+
+    go func() {
+        log.Infof("Starting debug endpoints on %v", cfg.Listen)
+        err := s.debugServer.ListenAndServe()
+        if err != nil && err != http.ErrServerClosed {
+            log.Fatalf("Failed to start debug endpoints: %v", err)
+        }
+    }()
+}
+
+// Runtime state published as "proxy" in /debug/vars
+func (s *ProxyServer) debugVars() interface{} {
+    stalled := 0
+    s.eachSession(func(cs *Session) {
+        if cs.queue != nil && len(cs.queue) == cap(cs.queue) {
+            stalled++
+        }
+    })
+    return map[string]interface{}{
+        "goroutines":       runtime.NumGoroutine(),
+        "sessions":         s.sessionsCount(),
+        "stalledSessions":  stalled,
+        "broadcastBacklog": len(s.broadcasts),
+        "upstream":         s.upstreamName(),
+        "sick":             s.isSick(),
+        "verify":           s.verifier.stats(),
+    }
+}
+
+// Stacks of all goroutines in panic format
+func debugGoroutines(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+    runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// Connected sessions with depth of their outbound queues
+func (s *ProxyServer) debugSessions(w http.ResponseWriter, r *http.Request) {
+    sessions := []DebugSession{}
+    s.eachSession(func(cs *Session) {
+        sessions = append(sessions, DebugSession{
+            Id:          cs.id,
+            Stratum:     s.config.Proxy.Stratum[cs.s_id].Name,
+            Ip:          cs.ip,
+            Login:       cs.login,
+            Worker:      cs.worker,
+            ConnectedAt: cs.connectedAt,
+            Queued:      len(cs.queue),
+            QueueSize:   cap(cs.queue),
+        })
+    })
+    w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+    w.WriteHeader(http.StatusOK)
+    err := json.NewEncoder(w).Encode(sessions)
+    if err != nil {
+        log.Error("Error serializing debug response: ", err)
+    }
+}
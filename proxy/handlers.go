@@ -1,17 +1,18 @@
 package proxy
 
 import (
-    "log"
     "regexp"
     
+    "github.com/NotoriousPyro/open-metaverse-pool/events"
+    "github.com/NotoriousPyro/open-metaverse-pool/policy"
     "github.com/NotoriousPyro/open-metaverse-pool/rpc"
     "github.com/NotoriousPyro/open-metaverse-pool/util"
 )
 
 var (
+    errPenaltyBan = &ErrorReply{Code: -1, Message: "Banned for high rate of invalid or stale shares"}
     noncePattern = regexp.MustCompile("^0x[0-9a-f]{16}$")
     hashPattern = regexp.MustCompile("^0x[0-9a-f]{64}$")
-    workerPattern = regexp.MustCompile("^[0-9a-zA-Z-_]{1,8}$")
 )
 
 func (s *ProxyServer) handleLoginRPC(cs *Session, params []string, id string) (bool, *ErrorReply) {
@@ -26,23 +27,48 @@ func (s *ProxyServer) handleLoginRPC(cs *Session, params []string, id string) (b
         s.policy.ApplyMalformedPolicy(cs.ip)
     }
     
-    address, err := s.rpc().ValidateAddress(login)
-    
-    if !address.Valid() || err != nil || address == nil {
-        return false, &ErrorReply{Code: 0, Message: "Invalid login."}
-        s.policy.ApplyMalformedPolicy(cs.ip)
+    // Without node in pool mode only login format is checked
+    if s.pool == nil {
+        address, err := s.rpc().ValidateAddress(login)
+        
+        if !address.Valid() || err != nil || address == nil {
+            return false, &ErrorReply{Code: 0, Message: "Invalid login."}
+            s.policy.ApplyMalformedPolicy(cs.ip)
+        }
     }
     
     if !s.policy.ApplyLoginPolicy(login, cs.ip) {
         return false, &ErrorReply{Code: -1, Message: "You are blacklisted"}
     }
     
-    cs.login = login
-    s.registerSession(cs)
+    if !s.policy.ApplyLoginPenaltyPolicy(login) {
+        log.Warnf("Rejected login serving penalty ban from %s : %s", cs.ip, login)
+        return false, errPenaltyBan
+    }
+    
+    if !s.policy.ApplyWhitelistPolicy(login) {
+        log.Warnf("Rejected login not in whitelist from %s : %s", cs.ip, login)
+        return false, &ErrorReply{Code: -1, Message: "Address is not whitelisted"}
+    }
+    
+    id = s.workerNames.normalize(id)
+    if !s.registerSession(cs, login, id) {
+        log.Warnf("Rejected duplicate login from %s : %s.%s", cs.ip, login, id)
+        return false, &ErrorReply{Code: -1, Message: "Worker is already connected"}
+    }
     
     stratumConfig := s.config.Proxy.Stratum[cs.s_id]
+
+    if len(params) > 1 {
+        if rig := parseRigDirectives(params[1]); rig != nil {
+            err := s.backend.WriteWorkerRig(login, id, rig.Watts, rig.Algo, rig.Driver, s.hashrateExpiration)
+            if err != nil {
+                log.Errorf("Failed to write rig info of %s.%s to backend: %v", login, id, err)
+            }
+        }
+    }
     
-    log.Printf("Stratum miner connected on %s from %s : %s", stratumConfig.Name, cs.ip, login)
+    log.Infof("Stratum miner connected on %s from %s : %s", stratumConfig.Name, cs.ip, login)
     
     return true, nil
 }
@@ -52,7 +78,7 @@ func (s *ProxyServer) handleGetWorkRPC(cs *Session) ([]string, *ErrorReply) {
     if t == nil || len(t.Header) == 0 || s.isSick() {
         return nil, &ErrorReply{Code: 0, Message: "Work not ready"}
     }
-    diff := s.stratum[cs.s_id].diff
+    _, diff := s.sessionDifficulty(cs, t)
     return []string{t.Header, t.Seed, diff}, nil
 }
 
@@ -70,49 +96,116 @@ func (s *ProxyServer) handleTCPSubmitRPC(cs *Session, id string, params []string
 
 func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []string) (bool, *ErrorReply) {
     stratumConfig := s.config.Proxy.Stratum[cs.s_id]
-    if !workerPattern.MatchString(id) {
-        id = "0"
+    if p := s.pausedOn(cs.s_id); p != nil {
+        log.Warnf("Share rejected while paused on %s from %s : %s", stratumConfig.Name, cs.ip, login)
+        s.publishShare(cs, login, id, nil, "paused")
+        s.submitPausedSolution(cs, login, params)
+        return false, &ErrorReply{Code: 26, Message: pauseMessage(p)}
     }
+    id = s.workerNames.normalize(id)
     if len(params) != 3 {
         s.policy.ApplyMalformedPolicy(cs.ip)
-        log.Printf("Malformed params on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
+        log.Warnf("Malformed params on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
+        s.publishShare(cs, login, id, nil, "malformed")
         return false, &ErrorReply{Code: -1, Message: "Invalid params"}
     }
 
     if !noncePattern.MatchString(params[0]) || !hashPattern.MatchString(params[1]) || !hashPattern.MatchString(params[2]) {
         s.policy.ApplyMalformedPolicy(cs.ip)
-        log.Printf("Malformed PoW result on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
+        log.Warnf("Malformed PoW result on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
+        s.publishShare(cs, login, id, nil, "malformed")
         return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
     }
-    t := s.currentBlockTemplate()
-    exist, valid, stale := s.processShare(login, id, cs.ip, t, params, cs.s_id)
+    t, late := s.findBlockTemplate(params[1])
+    if t == nil {
+        s.policy.ApplySharePolicy(cs.ip, false)
+        log.Warnf("Stale share on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
+        s.publishShare(cs, login, id, nil, "stale")
+        return false, s.penalize(cs, login, policy.ShareStale, &ErrorReply{Code: 21, Message: "Stale share"})
+    }
+
+    if s.shares != nil && s.shares.seen(shareKey(params[1], params[0], login)) {
+        s.policy.ApplyDuplicatePolicy(cs.ip)
+        s.policy.ApplySharePolicy(cs.ip, false)
+        log.Warnf("Duplicate share on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
+        s.publishShare(cs, login, id, t, "duplicate")
+        return false, s.penalize(cs, login, policy.ShareInvalid, &ErrorReply{Code: 22, Message: "Duplicate share"})
+    }
+
+    if !s.beginShare() {
+        return false, &ErrorReply{Code: -1, Message: "Proxy is shutting down"}
+    }
+    exist, valid, stale, forged := s.processShare(cs, login, id, t, params, late)
+    s.sharesWg.Done()
     ok := s.policy.ApplySharePolicy(cs.ip, !exist && valid)
     
     if exist && valid {
-        log.Printf("Duplicate share on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
-        return false, &ErrorReply{Code: 22, Message: "Duplicate share"}
+        s.policy.ApplyDuplicatePolicy(cs.ip)
+        log.Warnf("Duplicate share on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
+        s.publishShare(cs, login, id, t, "duplicate")
+        return false, s.penalize(cs, login, policy.ShareInvalid, &ErrorReply{Code: 22, Message: "Duplicate share"})
     }
     
     if stale {
-        log.Printf("Stale share on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
-        return false, nil
+        log.Warnf("Stale share on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
+        s.publishShare(cs, login, id, t, "stale")
+        return false, s.penalize(cs, login, policy.ShareStale, &ErrorReply{Code: 21, Message: "Stale share"})
     }
     
     if !valid {
-        log.Printf("Invalid share on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
+        log.Warnf("Invalid share on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
+        s.publishShare(cs, login, id, t, "invalid")
+        kind := policy.ShareInvalid
+        if forged {
+            kind = policy.ShareForged
+        }
+        if !s.policy.ApplyPenaltyPolicy(login, cs.ip, kind) {
+            return false, errPenaltyBan
+        }
         if !ok {
             return false, &ErrorReply{Code: 23, Message: "Invalid share"}
         }
         return false, nil
     }
-    log.Printf("Valid share on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
+    if late {
+        log.Debugf("Late share for previous block on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
+    } else {
+        log.Debugf("Valid share on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
+    }
+    shareDiff, _ := s.sessionDifficulty(cs, t)
+    s.hashrate.add(shareDiff)
+    s.publishShare(cs, login, id, t, "")
     
+    if !s.policy.ApplyPenaltyPolicy(login, cs.ip, policy.ShareValid) {
+        return true, errPenaltyBan
+    }
     if !ok {
         return true, &ErrorReply{Code: -1, Message: "High rate of invalid or stale shares"}
     }
     return true, nil
 }
 
+// Counts rejected share towards penalties, reply is replaced when login or IP got banned for it
+func (s *ProxyServer) penalize(cs *Session, login string, kind policy.ShareKind, reply *ErrorReply) *ErrorReply {
+    if !s.policy.ApplyPenaltyPolicy(login, cs.ip, kind) {
+        return errPenaltyBan
+    }
+    return reply
+}
+
+// Empty reason means accepted share
+func (s *ProxyServer) publishShare(cs *Session, login, id string, t *BlockTemplate, reason string) {
+    if s.publisher == nil {
+        return
+    }
+    e := &events.ShareEvent{Login: login, Worker: id, Ip: cs.ip, Port: s.config.Proxy.Stratum[cs.s_id].Name, Accepted: len(reason) == 0, Reason: reason}
+    e.Difficulty, _ = s.sessionDifficulty(cs, t)
+    if t != nil {
+        e.Height = t.Height
+    }
+    s.publisher.Share(e)
+}
+
 func (s *ProxyServer) handleGetBlockByNumberRPC() *rpc.GetBlockReply {
     t := s.currentBlockTemplate()
     var reply *rpc.GetBlockReply
@@ -124,7 +217,7 @@ func (s *ProxyServer) handleGetBlockByNumberRPC() *rpc.GetBlockReply {
 
 func (s *ProxyServer) handleUnknownRPC(cs *Session, m string) *ErrorReply {
     stratumConfig := s.config.Proxy.Stratum[cs.s_id]
-    log.Printf("Unknown request method on %s from %s : %s", stratumConfig.Name, cs.ip, m)
+    log.Warnf("Unknown request method on %s from %s : %s", stratumConfig.Name, cs.ip, m)
     s.policy.ApplyMalformedPolicy(cs.ip)
     return &ErrorReply{Code: -3, Message: "Method not found"}
 }
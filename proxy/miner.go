@@ -1,29 +1,28 @@
 package proxy
 
 import (
-    "log"
     "math/big"
     "strconv"
     "strings"
 
-    "github.com/ethereum/ethash"
     "github.com/ethereum/go-ethereum/common"
-)
 
-var hasher = ethash.New()
+    "github.com/NotoriousPyro/open-metaverse-pool/events"
+)
 
-// returns exist, valid, stale as boolean
-func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, params []string, s_id int) (bool, bool, bool) {
-    stratumConfig := s.config.Proxy.Stratum[s_id]
+// returns exist, valid, stale and forged as boolean, late share of previous block is credited at stale weight only
+func (s *ProxyServer) processShare(cs *Session, login, id string, t *BlockTemplate, params []string, late bool) (bool, bool, bool, bool) {
     nonceHex := params[0]
     hashNoNonce := params[1]
     mixDigest := params[2]
     nonce, _ := strconv.ParseUint(strings.Replace(nonceHex, "0x", "", -1), 16, 64)
-    shareDiff := stratumConfig.Difficulty
+    shareDiff, _ := s.sessionDifficulty(cs, t)
+    stratumConfig := s.config.Proxy.Stratum[cs.s_id]
+    ip := cs.ip
     
     if !strings.EqualFold(t.Header, hashNoNonce) {
         // Stale Share
-        return false, false, true
+        return false, false, true, false
     }
     
     share := Block{
@@ -42,44 +41,73 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
         mixDigest:   common.HexToHash(mixDigest),
     }
     
-    if !hasher.Verify(share) {
+    // Network has moved past the block of a late share, it can't be submitted
+    valid, solution, forged := s.verifier.verify(t.hasher, share, block, !late)
+    if forged {
+        log.Warnf("Forged share on %s from %s : %s %v", stratumConfig.Name, ip, login, params)
+    }
+    if !valid {
         // Invalid Share
-        return false, false, false
+        return false, false, false, forged
     }
-    
-    if hasher.Verify(block) {
-        ok, err := s.rpc().SubmitWork(params)
+    // In pool mode block difficulty is upstream share difficulty, such shares are
+    // forwarded upstream and credited locally as ordinary shares
+    if solution && t.pool != nil {
+        if err := t.pool.submit(params); err != nil {
+            log.Errorf("Share of %v at height %v not forwarded: %v", login, t.Height, err)
+        }
+        solution = false
+    }
+    if solution {
+        ok, err := t.upstream.SubmitWork(params)
         if err != nil {
-            log.Printf("Block submission failure at height %v for %v: %v", t.Height, t.Header, err)
+            log.Errorf("Block submission failure at height %v for %v: %v", t.Height, t.Header, err)
         } else if !ok {
-            log.Printf("Block rejected at height %v for %v", t.Height, t.Header)
+            log.Warnf("Block rejected at height %v for %v", t.Height, t.Header)
             // Rejected Block
-            return false, false, false
+            return false, false, false, false
         } else {
             s.fetchBlockTemplate()
-            exist, err := s.backend.WriteBlock(login, id, params, shareDiff, t.Difficulty.Int64(), t.Height, s.hashrateExpiration)
+            var exist bool
+            if stratumConfig.Solo {
+                exist, err = s.ledger.WriteSoloBlock(login, id, params, shareDiff, t.Difficulty.Int64(), t.Height, s.hashrateExpiration, stratumConfig.Name)
+            } else {
+                exist, err = s.ledger.WriteBlock(login, id, params, shareDiff, t.Difficulty.Int64(), t.Height, s.hashrateExpiration, s.config.Proxy.PPLNSWindow, stratumConfig.Name)
+            }
             if exist {
                 // Duplicate Block
-                return true, true, false
+                return true, true, false, false
             }
             if err != nil {
-                log.Println("Failed to insert block candidate into backend:", err)
+                log.Error("Failed to insert block candidate into backend:", err)
             } else {
                 // Valid Block
-                log.Printf("Inserted block %v to backend", t.Height)
+                log.Infof("Inserted block %v to backend", t.Height)
             }
-            log.Printf("Block found by miner %v@%v at height %d", login, ip, t.Height)
+            log.Infof("Block found by miner %v@%v at height %d on %s", login, ip, t.Height, stratumConfig.Name)
+            s.publisher.Block(&events.BlockEvent{Login: login, Worker: id, Port: stratumConfig.Name, Height: t.Height, Nonce: nonceHex,
+                Header: hashNoNonce, Difficulty: t.Difficulty.Int64(), ShareDiff: shareDiff, Solo: stratumConfig.Solo})
         }
     } else {
-        exist, err := s.backend.WriteShare(login, id, params, shareDiff, t.Height, s.hashrateExpiration)
+        credit := shareDiff
+        if late {
+            credit = s.staleCredit(shareDiff)
+        }
+        var exist bool
+        var err error
+        if stratumConfig.Solo {
+            exist, err = s.ledger.WriteSoloShare(login, id, params, credit, t.Height, s.hashrateExpiration)
+        } else {
+            exist, err = s.ledger.WriteShare(login, id, params, credit, t.Height, s.hashrateExpiration, s.config.Proxy.PPLNSWindow)
+        }
         if exist {
             // Duplicate Share
-            return true, true, false
+            return true, true, false, false
         }
         if err != nil {
-            log.Println("Failed to insert share data into backend:", err)
+            log.Error("Failed to insert share data into backend:", err)
         }
     }
     // Valid Share
-    return false, true, false
+    return false, true, false, false
 }
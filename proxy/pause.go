@@ -0,0 +1,149 @@
+package proxy
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/gorilla/mux"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/pow"
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+// Pause key of all ports, others are stratum names
+const pauseAll = "*"
+
+// Reads pauses from backend, so toggles made on other instances apply too
+func (s *ProxyServer) loadPauses() {
+    pauses, err := s.backend.GetPauses()
+    if err != nil {
+        log.Errorf("Failed to get share acceptance pauses from backend: %v", err)
+        return
+    }
+    s.pausesMu.Lock()
+    s.pauses = pauses
+    s.pausesMu.Unlock()
+}
+
+// Returns pause of the whole pool or of port s_id
+func (s *ProxyServer) pausedOn(s_id int) *storage.Pause {
+    s.pausesMu.RLock()
+    defer s.pausesMu.RUnlock()
+    if p, ok := s.pauses[pauseAll]; ok {
+        return p
+    }
+    return s.pauses[s.config.Proxy.Stratum[s_id].Name]
+}
+
+// Share rejected while paused is still submitted to node if it solves block,
+// so network work isn't thrown away, block is not credited to anyone
+func (s *ProxyServer) submitPausedSolution(cs *Session, login string, params []string) {
+    if len(params) != 3 || !noncePattern.MatchString(params[0]) || !hashPattern.MatchString(params[1]) || !hashPattern.MatchString(params[2]) {
+        return
+    }
+    t, late := s.findBlockTemplate(params[1])
+    if t == nil || late || !strings.EqualFold(t.Header, params[1]) {
+        return
+    }
+    nonce, _ := strconv.ParseUint(strings.Replace(params[0], "0x", "", -1), 16, 64)
+    block := Block{
+        number:      t.Height,
+        hashNoNonce: common.HexToHash(params[1]),
+        difficulty:  t.Difficulty,
+        nonce:       nonce,
+        mixDigest:   common.HexToHash(params[2]),
+    }
+    if !pow.MeetsTarget(block) {
+        return
+    }
+    if valid, solution, _ := s.verifier.verify(t.hasher, block, block, true); !valid || !solution {
+        return
+    }
+    if t.pool != nil {
+        if err := t.pool.submit(params); err != nil {
+            log.Errorf("Share of %v at height %v not forwarded while paused: %v", login, t.Height, err)
+        }
+        return
+    }
+    ok, err := t.upstream.SubmitWork(params)
+    if err != nil {
+        log.Errorf("Block submission failure at height %v for %v: %v", t.Height, t.Header, err)
+    } else if !ok {
+        log.Warnf("Block rejected at height %v for %v", t.Height, t.Header)
+    } else {
+        s.fetchBlockTemplate()
+        log.Warnf("Block found by miner %v@%v at height %d while paused, submitted but not credited", login, cs.ip, t.Height)
+    }
+}
+
+// Tells miners on affected ports, connections are kept
+func (s *ProxyServer) announcePause(name, message string) {
+    n := 0
+    s.eachSession(func(cs *Session) {
+        if name != pauseAll && s.config.Proxy.Stratum[cs.s_id].Name != name {
+            return
+        }
+        if err := cs.pushMessage("client.show_message", []string{message}); err == nil {
+            n++
+        }
+    })
+    log.Infof("Told %v miners: %v", n, message)
+}
+
+func (s *ProxyServer) adminPauses(w http.ResponseWriter, r *http.Request) {
+    s.pausesMu.RLock()
+    defer s.pausesMu.RUnlock()
+    writeAdminReply(w, map[string]interface{}{"pauses": s.pauses})
+}
+
+// PUT {"reason": "..."} stops accepting shares, DELETE resumes
+func (s *ProxyServer) adminPause(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["name"]
+    if len(name) == 0 {
+        name = pauseAll
+    } else if s.stratumIndex(name) < 0 {
+        w.WriteHeader(http.StatusNotFound)
+        return
+    }
+    target := "all ports"
+    if name != pauseAll {
+        target = "port " + name
+    }
+
+    var err error
+    var req struct {
+        Reason string `json:"reason"`
+    }
+    if r.Method == "DELETE" {
+        err = s.backend.ClearPause(name)
+    } else {
+        json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req)
+        err = s.backend.SetPause(name, req.Reason, util.MakeTimestamp()/1000)
+    }
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Errorf("Failed to write share acceptance pause to backend: %v", err)
+        return
+    }
+    s.loadPauses()
+
+    if r.Method == "DELETE" {
+        log.Infof("Admin resumed share acceptance on %v", target)
+        s.announcePause(name, "Share acceptance resumed")
+    } else {
+        log.Infof("Admin paused share acceptance on %v", target)
+        s.announcePause(name, pauseMessage(&storage.Pause{Reason: req.Reason}))
+    }
+    writeAdminReply(w, map[string]interface{}{"name": name, "paused": r.Method != "DELETE"})
+}
+
+func pauseMessage(p *storage.Pause) string {
+    if p == nil || len(p.Reason) == 0 {
+        return "Share acceptance paused"
+    }
+    return "Share acceptance paused: " + p.Reason
+}
@@ -0,0 +1,342 @@
+package proxy
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/ethereum/go-ethereum/common"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/pow"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+// Work taken from upstream stratum pools instead of nodes
+type PoolConfig struct {
+    Enabled        bool            `json:"enabled"`
+    // Tried in list order, first one is preferred after every disconnect
+    Upstreams      []PoolUpstream  `json:"upstreams"`
+    // Upstream silent for this long is dropped, 2m when empty
+    Timeout        string          `json:"timeout"`
+    // Pause before starting over when no upstream accepts connection, 5s when empty
+    RetryInterval  string          `json:"retryInterval"`
+}
+
+type PoolUpstream struct {
+    Name           string      `json:"name"`
+    // host:port of eth-proxy stratum
+    Url            string      `json:"url"`
+    // Account of this proxy on upstream pool
+    Login          string      `json:"login"`
+    Password       string      `json:"password"`
+    Worker         string      `json:"worker"`
+    // Chain rules, same as for node upstreams
+    Algo           string      `json:"algo"`
+    EpochLength    uint64      `json:"epochLength"`
+    Ecip1099Block  uint64      `json:"ecip1099Block"`
+}
+
+const (
+    // Shares meeting upstream target waiting to be forwarded
+    poolSubmitQueue = 1024
+    // Work of chains with more epochs than this is not recognized
+    poolMaxEpoch = 4096
+    poolLoginId = 1
+    poolGetWorkId = 2
+)
+
+var errPoolQueueFull = errors.New("upstream pool submit queue is full")
+
+// One connection to upstream pool shared by all local miners. Jobs pushed by upstream
+// become block templates, shares meeting upstream target are forwarded.
+type poolClient struct {
+    proxy          *ProxyServer
+    upstreams      []PoolUpstream
+    timeout        time.Duration
+    retry          time.Duration
+    current        int32
+    connected      int32
+    submits        chan []string
+    requestSeq     int64
+    accepted       int64
+    rejected       int64
+    seedMu         sync.Mutex
+    seed           string
+    seedParams     pow.Params
+    seedHeight     uint64
+    round          uint64
+}
+
+type poolMessage struct {
+    Id             json.RawMessage  `json:"id"`
+    Result         json.RawMessage  `json:"result"`
+    Error          json.RawMessage  `json:"error"`
+}
+
+type poolRequest struct {
+    Id             int64       `json:"id"`
+    Version        string      `json:"jsonrpc"`
+    Method         string      `json:"method"`
+    Params         []string    `json:"params"`
+    Worker         string      `json:"worker,omitempty"`
+}
+
+// Health of upstream pool connection
+type PoolState struct {
+    Name           string   `json:"name"`
+    Connected      bool     `json:"connected"`
+    Accepted       int64    `json:"accepted"`
+    Rejected       int64    `json:"rejected"`
+}
+
+func newPoolClient(s *ProxyServer, cfg *PoolConfig) (*poolClient, error) {
+    if len(cfg.Upstreams) == 0 {
+        return nil, errors.New("Pool mode requires at least one upstream pool")
+    }
+    c := &poolClient{proxy: s, upstreams: cfg.Upstreams, timeout: 2 * time.Minute, retry: 5 * time.Second,
+        submits: make(chan []string, poolSubmitQueue), requestSeq: poolGetWorkId}
+    if len(cfg.Timeout) > 0 {
+        c.timeout = util.MustParseDuration(cfg.Timeout)
+    }
+    if len(cfg.RetryInterval) > 0 {
+        c.retry = util.MustParseDuration(cfg.RetryInterval)
+    }
+    for _, v := range cfg.Upstreams {
+        if len(v.Name) == 0 || len(v.Url) == 0 || len(v.Login) == 0 {
+            return nil, errors.New("Upstream pool requires name, url and login")
+        }
+        err := s.addHasher(&Upstream{Name: v.Name, Algo: v.Algo, EpochLength: v.EpochLength, Ecip1099Block: v.Ecip1099Block})
+        if err != nil {
+            return nil, fmt.Errorf("Upstream pool %s: %v", v.Name, err)
+        }
+    }
+    return c, nil
+}
+
+// Keeps connection to first upstream pool which works, starting over from the preferred one
+func (c *poolClient) run() {
+    for {
+        for i, v := range c.upstreams {
+            atomic.StoreInt32(&c.current, int32(i))
+            err := c.session(&v)
+            atomic.StoreInt32(&c.connected, 0)
+            log.Warnf("Upstream pool %s disconnected: %v", v.Name, err)
+            if c.proxy.isShuttingDown() {
+                return
+            }
+        }
+        time.Sleep(c.retry)
+    }
+}
+
+func (c *poolClient) name() string {
+    return c.upstreams[atomic.LoadInt32(&c.current)].Name
+}
+
+func (c *poolClient) isConnected() bool {
+    return atomic.LoadInt32(&c.connected) == 1
+}
+
+func (c *poolClient) state() *PoolState {
+    return &PoolState{
+        Name:      c.name(),
+        Connected: c.isConnected(),
+        Accepted:  atomic.LoadInt64(&c.accepted),
+        Rejected:  atomic.LoadInt64(&c.rejected),
+    }
+}
+
+// Queues share for upstream, never blocks share handling
+func (c *poolClient) submit(params []string) error {
+    select {
+    case c.submits <- params:
+        return nil
+    default:
+        return errPoolQueueFull
+    }
+}
+
+// Runs one connection until it fails
+func (c *poolClient) session(v *PoolUpstream) error {
+    conn, err := net.DialTimeout("tcp", v.Url, c.timeout)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    log.Infof("Connected to upstream pool %s at %s", v.Name, v.Url)
+    // Shares for work of previous connection would be rejected
+    for len(c.submits) > 0 {
+        <-c.submits
+    }
+
+    var mu sync.Mutex
+    enc := json.NewEncoder(conn)
+    send := func(req *poolRequest) error {
+        mu.Lock()
+        defer mu.Unlock()
+        req.Version = "2.0"
+        req.Worker = v.Worker
+        conn.SetWriteDeadline(time.Now().Add(c.timeout))
+        return enc.Encode(req)
+    }
+    err = send(&poolRequest{Id: poolLoginId, Method: "eth_submitLogin", Params: []string{v.Login, v.Password}})
+    if err != nil {
+        return err
+    }
+    err = send(&poolRequest{Id: poolGetWorkId, Method: "eth_getWork", Params: []string{}})
+    if err != nil {
+        return err
+    }
+
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        for {
+            select {
+            case params := <-c.submits:
+                id := atomic.AddInt64(&c.requestSeq, 1)
+                if err := send(&poolRequest{Id: id, Method: "eth_submitWork", Params: params}); err != nil {
+                    log.Errorf("Failed to forward share to upstream pool %s: %v", v.Name, err)
+                    conn.Close()
+                    return
+                }
+            case <-done:
+                return
+            }
+        }
+    }()
+
+    reader := bufio.NewReaderSize(conn, MaxReqSize)
+    for {
+        conn.SetReadDeadline(time.Now().Add(c.timeout))
+        data, isPrefix, err := reader.ReadLine()
+        if err != nil {
+            return err
+        }
+        if isPrefix {
+            return errors.New("message too long")
+        }
+        var msg poolMessage
+        if err := json.Unmarshal(data, &msg); err != nil {
+            return fmt.Errorf("malformed message: %v", err)
+        }
+        id, _ := strconv.ParseInt(string(msg.Id), 10, 64)
+        if err := c.handleMessage(v, id, &msg); err != nil {
+            return err
+        }
+    }
+}
+
+func (c *poolClient) handleMessage(v *PoolUpstream, id int64, msg *poolMessage) error {
+    failed := len(msg.Error) > 0 && string(msg.Error) != "null"
+    switch {
+    case id == poolLoginId:
+        var ok bool
+        json.Unmarshal(msg.Result, &ok)
+        if failed || !ok {
+            return fmt.Errorf("login rejected: %s", msg.Error)
+        }
+        atomic.StoreInt32(&c.connected, 1)
+        log.Infof("Logged in to upstream pool %s as %s", v.Name, v.Login)
+    case id == 0 || id == poolGetWorkId:
+        var job []string
+        if failed || json.Unmarshal(msg.Result, &job) != nil || len(job) < 3 {
+            log.Warnf("Unusable work from upstream pool %s: %s", v.Name, msg.Error)
+            return nil
+        }
+        c.setWork(v, job)
+    default:
+        var ok bool
+        json.Unmarshal(msg.Result, &ok)
+        if failed || !ok {
+            atomic.AddInt64(&c.rejected, 1)
+            log.Warnf("Share rejected by upstream pool %s: %s", v.Name, msg.Error)
+        } else {
+            atomic.AddInt64(&c.accepted, 1)
+        }
+    }
+    return nil
+}
+
+// Turns upstream job into block template, difficulty of the template is upstream share difficulty
+func (c *poolClient) setWork(v *PoolUpstream, job []string) {
+    s := c.proxy
+    t := s.currentBlockTemplate()
+    if t != nil && t.Header == job[0] {
+        return
+    }
+    hasher, params := s.upstreamHasher(v.Name)
+    height, exact, ok := c.height(params, job)
+    if !ok {
+        log.Errorf("Seed hash %s of upstream pool %s doesn't match algo settings, work ignored", job[1], v.Name)
+        return
+    }
+    diff := util.TargetHexToDiff(job[2])
+    if diff.Sign() <= 0 {
+        log.Errorf("Invalid target %s from upstream pool %s", job[2], v.Name)
+        return
+    }
+
+    newTemplate := BlockTemplate{
+        Header:         job[0],
+        Seed:           job[1],
+        Target:         job[2],
+        Height:         height,
+        Difficulty:     diff,
+        MinDifficulty:  s.difficultyFloor(diff),
+        PortDifficulty: s.portTargets(),
+        pool:           c,
+        hasher:         hasher,
+        round:          c.nextRound(height, exact),
+    }
+    s.logDifficultyFloor(t, &newTemplate)
+
+    s.blockTemplate.Store(&newTemplate)
+    s.rememberBlockTemplate(&newTemplate)
+    log.Infof("New job from upstream pool %s at height %d / %s, difficulty %v", v.Name, height, job[0], diff)
+
+    for i, setting := range s.config.Proxy.Stratum {
+        if setting.Enabled {
+            go s.broadcastNewJobs(i)
+        }
+    }
+}
+
+// Height sent as fourth job item, otherwise start of epoch of seed hash, which is not exact
+func (c *poolClient) height(params pow.Params, job []string) (uint64, bool, bool) {
+    if len(job) > 3 {
+        if height, err := strconv.ParseUint(strings.TrimPrefix(job[3], "0x"), 16, 64); err == nil {
+            return height, true, true
+        }
+    }
+    c.seedMu.Lock()
+    defer c.seedMu.Unlock()
+    if c.seed == job[1] && c.seedParams == params {
+        return c.seedHeight, false, true
+    }
+    height, ok := pow.SeedHeight(params, common.FromHex(job[1]), poolMaxEpoch)
+    if ok {
+        c.seed, c.seedParams, c.seedHeight = job[1], params, height
+    }
+    return height, false, ok
+}
+
+// Exact height orders jobs like node work. Without it refreshes of a block can't be told from
+// new blocks, so every new job starts a new round and only the latest one is mined.
+func (c *poolClient) nextRound(height uint64, exact bool) uint64 {
+    c.seedMu.Lock()
+    defer c.seedMu.Unlock()
+    if exact && height >= c.round {
+        c.round = height
+    } else {
+        c.round++
+    }
+    return c.round
+}
@@ -11,6 +11,8 @@ type JSONRpcReq struct {
 type StratumReq struct {
     JSONRpcReq
     Worker    string            `json:"worker"`
+    // Mining software, sent by some clients with login
+    Agent     string            `json:"agent"`
 }
 
 type JSONPushMessage struct {
@@ -19,6 +21,13 @@ type JSONPushMessage struct {
     Result    interface{}       `json:"result"`
 }
 
+type JSONPushNotification struct {
+    Id        int64             `json:"id"`
+    Version   string            `json:"jsonrpc"`
+    Method    string            `json:"method"`
+    Params    interface{}       `json:"params"`
+}
+
 type JSONRpcResp struct {
     Id         json.RawMessage  `json:"id"`
     Version    string           `json:"jsonrpc"`
@@ -3,7 +3,6 @@ package proxy
 import (
     "encoding/json"
     "io"
-    "log"
     "net"
     "net/http"
     "sync"
@@ -12,98 +11,251 @@ import (
 
     "github.com/gorilla/mux"
 
+    "github.com/NotoriousPyro/open-metaverse-pool/events"
+    "github.com/NotoriousPyro/open-metaverse-pool/logging"
     "github.com/NotoriousPyro/open-metaverse-pool/policy"
+    "github.com/NotoriousPyro/open-metaverse-pool/pow"
     "github.com/NotoriousPyro/open-metaverse-pool/rpc"
     "github.com/NotoriousPyro/open-metaverse-pool/storage"
     "github.com/NotoriousPyro/open-metaverse-pool/util"
 )
 
+var log = logging.New("proxy")
+
 type StratumServer struct {
     sessionsMu    sync.RWMutex
     sessions      map[*Session]struct{}
+
+    // Settings which can be changed on config reload
+    configMu      sync.RWMutex
+    listeners     []*net.TCPListener
     timeout       time.Duration
+    difficulty    int64
     diff          string
+    freshWorkIntv time.Duration
+    // Difficulty outside of scheduled profiles
+    baseDifficulty int64
+    schedule      []scheduleEntry
+    location      *time.Location
+    profile       string
 }
 
 type ProxyServer struct {
     config                  *Config
     blockTemplate           atomic.Value
+    // Serializes template fetches, replies of concurrent ones could arrive out of order
+    fetchMu                 sync.Mutex
+    templatesMu             sync.RWMutex
+    templates               []*BlockTemplate
+    // When current block height was first seen, guarded by templatesMu
+    blockChangedAt          int64
+    staleGrace              time.Duration
+    shares                  *shareCache
+    verifier                *shareVerifier
     upstream                int32
+    upstreamsMu             sync.RWMutex
     upstreams               []*rpc.RPCClient
+    upstreamStates          []*upstreamState
+    // Indexes of upstreams which passed last health check
+    healthyUpstreams        []int32
+    roundRobin              uint32
     backend                 *storage.RedisClient
+    ledger                  storage.Ledger
+    publisher               *events.Publisher
+    workerNames             *workerNamer
+    nodeId                  string
+    hashrate                *localHashrate
+    // Verifiers by chain rules and rules of each upstream, guarded by upstreamsMu
+    hashers                 map[pow.Params]pow.Verifier
+    upstreamParams          map[string]pow.Params
+    pausesMu                sync.RWMutex
+    pauses                  map[string]*storage.Pause
     policy                  *policy.PolicyServer
     hashrateExpiration      time.Duration
     failsCount              int64
+    lastFetch               int64
     stratum                 []*StratumServer
+    workersMu               sync.Mutex
+    workers                 map[string]*Session
+    httpServer              *http.Server
+    shuttingDown            int32
+    // Shares in flight, no new ones start once sharesClosed is set
+    sharesMu                sync.Mutex
+    sharesClosed            bool
+    sharesWg                sync.WaitGroup
+    sessionSeq              uint64
+    adminServer             *http.Server
+    // Set in pool mode, replaces node upstreams
+    pool                    *poolClient
+    debugServer             *http.Server
+    broadcasts              chan func()
 }
 
 type Session struct {
+    id          uint64
     s_id        int
     ip          string
     enc         *json.Encoder
+    connectedAt int64
+    // Set by admin, 0 means port difficulty
+    difficulty  int64
+    // Jobs waiting to be written, nil for HTTP sessions
+    queue       chan []byte
+    // Closed when read loop exits
+    done        chan struct{}
+    // Request rate of TCP sessions, nil when unlimited
+    limiter     *sessionLimiter
 
     sync.Mutex
     conn        *net.TCPConn
     login       string
+    worker      string
+    // Mining software and protocol dialect reported at login
+    agent       string
+    dialect     string
 }
 
-func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
+func NewProxy(cfg *Config, backend *storage.RedisClient, ledger storage.Ledger, publisher *events.Publisher) *ProxyServer {
     if len(cfg.Proxy.Name) == 0 {
         log.Fatal("You must set instance name")
     }
     policy := policy.Start(&cfg.Proxy.Policy, backend)
 
-    proxy := &ProxyServer{config: cfg, backend: backend, policy: policy}
-    proxy.upstreams = make([]*rpc.RPCClient, len(cfg.Upstream))
-    
-    for i, v := range cfg.Upstream {
-        proxy.upstreams[i] = rpc.NewRPCClient(v.Name, v.Url, cfg.Account, cfg.Password, v.Timeout)
-        log.Printf("Upstream: %s => %s", v.Name, v.Url)
+    proxy := &ProxyServer{config: cfg, backend: backend, ledger: ledger, publisher: publisher, policy: policy, workers: make(map[string]*Session)}
+    workerNames, err := newWorkerNamer(&cfg.Proxy.Worker)
+    if err != nil {
+        log.Fatal(err)
+    }
+    proxy.workerNames = workerNames
+    proxy.hashers = make(map[pow.Params]pow.Verifier)
+    proxy.upstreamParams = make(map[string]pow.Params)
+    proxy.startBroadcastWorkers(cfg.Proxy.BroadcastWorkers)
+    proxy.verifier = newShareVerifier(&cfg.Proxy.Verify)
+    if cfg.Proxy.ShareCacheSize > 0 {
+        proxy.shares = newShareCache(cfg.Proxy.ShareCacheSize)
+    }
+    switch cfg.Proxy.DuplicateLogin {
+    case "", "keep", "dropOld", "reject":
+    default:
+        log.Fatalf("Invalid duplicateLogin value: %v", cfg.Proxy.DuplicateLogin)
+    }
+    if len(cfg.Proxy.StaleGrace) > 0 {
+        proxy.staleGrace = util.MustParseDuration(cfg.Proxy.StaleGrace)
+        if cfg.Proxy.StaleWeight < 0 || cfg.Proxy.StaleWeight > 1 {
+            log.Fatalf("Invalid staleWeight %v, must be within 0 and 1", cfg.Proxy.StaleWeight)
+        }
+        log.Infof("Accepting shares for previous block within %v after block change", proxy.staleGrace)
+    }
+    if cfg.Pool.Enabled {
+        proxy.pool, err = newPoolClient(proxy, &cfg.Pool)
+        if err != nil {
+            log.Fatal(err)
+        }
+        log.Infof("Running in pool mode, default upstream pool: %s => %s", cfg.Pool.Upstreams[0].Name, cfg.Pool.Upstreams[0].Url)
+    } else {
+        proxy.upstreams = make([]*rpc.RPCClient, len(cfg.Upstream))
+        for i, v := range cfg.Upstream {
+            if err := proxy.addHasher(&v); err != nil {
+                log.Fatalf("Upstream %s: %v", v.Name, err)
+            }
+            proxy.upstreams[i] = rpc.NewRPCClient(v.Name, v.Url, cfg.Account, cfg.Password, v.Timeout)
+            log.Infof("Upstream: %s => %s", v.Name, v.Url)
+        }
+        log.Infof("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
     }
-    log.Printf("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
 
     proxy.stratum = make([]*StratumServer, len(cfg.Proxy.Stratum))
-    log.Printf("Total StratumServer count: %d", len(cfg.Proxy.Stratum))
+    log.Infof("Total StratumServer count: %d", len(cfg.Proxy.Stratum))
     for i, st := range cfg.Proxy.Stratum {
-        stratumserver := StratumServer{sessions: make(map[*Session]struct{}), diff: util.GetTargetHex(st.Difficulty)}
+        stratumserver := StratumServer{sessions: make(map[*Session]struct{})}
+        if err := stratumserver.configure(&st); err != nil {
+            log.Fatal(err)
+        }
         proxy.stratum[i] = &stratumserver
         if st.Enabled {
             go proxy.ListenTCP(i)
         }
     }
+    proxy.startScheduler()
+    proxy.loadPauses()
     
-    proxy.rpc().SetAddress(cfg.Proxy.Address)
+    proxy.httpServer = &http.Server{
+        Addr:           cfg.Proxy.Listen,
+        MaxHeaderBytes: cfg.Proxy.LimitHeadersSize,
+    }
 
-    proxy.fetchBlockTemplate()
+    if cfg.Proxy.Admin.Enabled {
+        proxy.startAdmin()
+    }
+    if cfg.Proxy.Debug.Enabled {
+        proxy.startDebug()
+    }
 
     proxy.hashrateExpiration = util.MustParseDuration(cfg.Proxy.HashrateExpiration)
 
-    refreshIntv := util.MustParseDuration(cfg.Proxy.BlockRefreshInterval)
-    refreshTimer := time.NewTimer(refreshIntv)
-    log.Printf("Set block refresh every %v", refreshIntv)
-
-    checkIntv := util.MustParseDuration(cfg.UpstreamCheckInterval)
-    checkTimer := time.NewTimer(checkIntv)
+    if proxy.pool != nil {
+        go proxy.pool.run()
+    } else {
+        proxy.rpc().SetAddress(cfg.Proxy.Address)
+        proxy.fetchBlockTemplate()
+        proxy.pollUpstreams()
+    }
 
     stateUpdateIntv := util.MustParseDuration(cfg.Proxy.StateUpdateInterval)
     stateUpdateTimer := time.NewTimer(stateUpdateIntv)
 
+    proxy.nodeId = nodeId(&cfg.Proxy)
+    hashrateWindow := 10 * time.Minute
+    if len(cfg.Proxy.Cluster.HashrateWindow) > 0 {
+        hashrateWindow = util.MustParseDuration(cfg.Proxy.Cluster.HashrateWindow)
+    }
+    proxy.hashrate = newLocalHashrate(hashrateWindow, stateUpdateIntv)
+    if cfg.Proxy.Cluster.Enabled {
+        log.Infof("Running in cluster as node %v in region %v", proxy.nodeId, cfg.Proxy.Cluster.Region)
+    }
+
     go func() {
         for {
             select {
-            case <-refreshTimer.C:
-                proxy.fetchBlockTemplate()
-                refreshTimer.Reset(refreshIntv)
+            case <-stateUpdateTimer.C:
+                proxy.loadPauses()
+                t := proxy.currentBlockTemplate()
+                if t != nil {
+                    err := backend.WriteNodeState(proxy.nodeId, cfg.Proxy.Cluster.Region, t.Height, t.Difficulty, proxy.hashrate.roll())
+                    if err != nil {
+                        log.Errorf("Failed to write node state to backend: %v", err)
+                        proxy.markSick()
+                    } else {
+                        proxy.markOk()
+                    }
+                }
+                err := backend.WriteClientStats(proxy.nodeId, proxy.clientCounts(), clientStatsExpiry(stateUpdateIntv))
+                if err != nil {
+                    log.Errorf("Failed to write client stats to backend: %v", err)
+                }
+                stateUpdateTimer.Reset(stateUpdateIntv)
             }
         }
     }()
 
+    return proxy
+}
+
+// Polls node upstreams for work and checks their health
+func (s *ProxyServer) pollUpstreams() {
+    refreshIntv := util.MustParseDuration(s.config.Proxy.BlockRefreshInterval)
+    refreshTimer := time.NewTimer(refreshIntv)
+    log.Infof("Set block refresh every %v", refreshIntv)
+
+    checkIntv := util.MustParseDuration(s.config.UpstreamCheckInterval)
+    checkTimer := time.NewTimer(checkIntv)
+
     go func() {
         for {
             select {
-            case <-checkTimer.C:
-                proxy.checkUpstreams()
-                checkTimer.Reset(checkIntv)
+            case <-refreshTimer.C:
+                s.fetchBlockTemplate()
+                refreshTimer.Reset(refreshIntv)
             }
         }
     }()
@@ -111,63 +263,41 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
     go func() {
         for {
             select {
-            case <-stateUpdateTimer.C:
-                t := proxy.currentBlockTemplate()
-                if t != nil {
-                    err := backend.WriteNodeState(cfg.Proxy.Name, t.Height, t.Difficulty)
-                    if err != nil {
-                        log.Printf("Failed to write node state to backend: %v", err)
-                        proxy.markSick()
-                    } else {
-                        proxy.markOk()
-                    }
-                }
-                stateUpdateTimer.Reset(stateUpdateIntv)
+            case <-checkTimer.C:
+                s.checkUpstreams()
+                checkTimer.Reset(checkIntv)
             }
         }
     }()
-
-    return proxy
 }
 
 func (s *ProxyServer) Start() {
-    log.Printf("Starting proxy on %v", s.config.Proxy.Listen)
+    log.Infof("Starting proxy on %v", s.config.Proxy.Listen)
     r := mux.NewRouter()
-    r.Handle("/{login:M[A-Z0-9]{1}[0-9a-zA-Z]{32}}}/{id:[0-9a-zA-Z-_]{1,8}}", s)
+    r.Handle("/{login:M[A-Z0-9]{1}[0-9a-zA-Z]{32}}}/{id}", s)
     r.Handle("/{login:M[A-Z0-9]{1}[0-9a-zA-Z]{32}}", s)
-    srv := &http.Server{
-        Addr:           s.config.Proxy.Listen,
-        Handler:        r,
-        MaxHeaderBytes: s.config.Proxy.LimitHeadersSize,
-    }
-    err := srv.ListenAndServe()
-    if err != nil {
+    s.httpServer.Handler = r
+    err := s.httpServer.ListenAndServe()
+    if err != nil && err != http.ErrServerClosed {
         log.Fatalf("Failed to start proxy: %v", err)
     }
 }
 
+// Name of upstream node or pool work comes from
+func (s *ProxyServer) upstreamName() string {
+    if s.pool != nil {
+        return s.pool.name()
+    }
+    return s.rpc().Name
+}
+
 func (s *ProxyServer) rpc() *rpc.RPCClient {
+    s.upstreamsMu.RLock()
+    defer s.upstreamsMu.RUnlock()
     i := atomic.LoadInt32(&s.upstream)
     return s.upstreams[i]
 }
 
-func (s *ProxyServer) checkUpstreams() {
-    candidate := int32(0)
-    backup := false
-
-    for i, v := range s.upstreams {
-        if v.Check() && !backup {
-            candidate = int32(i)
-            backup = true
-        }
-    }
-
-    if s.upstream != candidate {
-        log.Printf("Switching to %v upstream", s.upstreams[candidate].Name)
-        atomic.StoreInt32(&s.upstream, candidate)
-    }
-}
-
 func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     if r.Method != "POST" {
         s.writeError(w, 405, "rpc: POST method required, received "+r.Method)
@@ -192,7 +322,7 @@ func (s *ProxyServer) remoteAddr(r *http.Request) string {
 
 func (s *ProxyServer) handleClient(w http.ResponseWriter, r *http.Request, ip string) {
     if r.ContentLength > s.config.Proxy.LimitBodySize {
-        log.Printf("Socket flood from %s", ip)
+        log.Warnf("Socket flood from %s", ip)
         s.policy.ApplyMalformedPolicy(ip)
         http.Error(w, "Request too large", http.StatusExpectationFailed)
         return
@@ -207,7 +337,7 @@ func (s *ProxyServer) handleClient(w http.ResponseWriter, r *http.Request, ip st
         if err := dec.Decode(&req); err == io.EOF {
             break
         } else if err != nil {
-            log.Printf("Malformed request from %v: %v", ip, err)
+            log.Warnf("Malformed request from %v: %v", ip, err)
             s.policy.ApplyMalformedPolicy(ip)
             return
         }
@@ -217,7 +347,7 @@ func (s *ProxyServer) handleClient(w http.ResponseWriter, r *http.Request, ip st
 
 func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcReq) {
     if req.Id == nil {
-        log.Printf("Missing RPC id from %s", cs.ip)
+        log.Warnf("Missing RPC id from %s", cs.ip)
         s.policy.ApplyMalformedPolicy(cs.ip)
         return
     }
@@ -245,7 +375,7 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
             var params []string
             err := json.Unmarshal(req.Params, &params)
             if err != nil {
-                log.Printf("Unable to parse params from %v", cs.ip)
+                log.Errorf("Unable to parse params from %v", cs.ip)
                 s.policy.ApplyMalformedPolicy(cs.ip)
                 break
             }
@@ -301,6 +431,10 @@ func (s *ProxyServer) markSick() {
 }
 
 func (s *ProxyServer) isSick() bool {
+    // No work can be forwarded without upstream pool
+    if s.pool != nil && !s.pool.isConnected() {
+        return true
+    }
     x := atomic.LoadInt64(&s.failsCount)
     if s.config.Proxy.HealthCheck && x >= s.config.Proxy.MaxFails {
         return true
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+    "time"
+)
+
+type SessionLimits struct {
+    // Requests per second a session may send, 0 disables
+    MessageRate    float64  `json:"messageRate"`
+    // Requests allowed at once on top of the rate
+    MessageBurst   int      `json:"messageBurst"`
+    // Bytes per second read from a session, 0 disables
+    ByteRate       int64    `json:"byteRate"`
+    // Requests other than login allowed before login, 0 disables
+    MaxUnauthorized int     `json:"maxUnauthorized"`
+    // Session throttled this many requests in a row is dropped and counted as malformed
+    MaxThrottled   int      `json:"maxThrottled"`
+}
+
+// Token bucket, only used from read loop of its session
+type tokenBucket struct {
+    rate           float64
+    burst          float64
+    tokens         float64
+    last           time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+    if burst < 1 {
+        burst = 1
+    }
+    return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Takes n tokens, returns how long caller has to wait to stay within rate
+func (b *tokenBucket) take(n float64) time.Duration {
+    now := time.Now()
+    b.tokens += now.Sub(b.last).Seconds() * b.rate
+    b.last = now
+    if b.tokens > b.burst {
+        b.tokens = b.burst
+    }
+    b.tokens -= n
+    if b.tokens >= 0 {
+        return 0
+    }
+    return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type sessionLimiter struct {
+    messages       *tokenBucket
+    bytes          *tokenBucket
+    throttled      int
+    unauthorized   int
+}
+
+// Returns nil when no limit is configured
+func newSessionLimiter(cfg *SessionLimits) *sessionLimiter {
+    if cfg.MessageRate <= 0 && cfg.ByteRate <= 0 && cfg.MaxUnauthorized <= 0 {
+        return nil
+    }
+    l := &sessionLimiter{}
+    if cfg.MessageRate > 0 {
+        l.messages = newTokenBucket(cfg.MessageRate, float64(cfg.MessageBurst))
+    }
+    if cfg.ByteRate > 0 {
+        // Largest request must always fit
+        l.bytes = newTokenBucket(float64(cfg.ByteRate), MaxReqSize)
+    }
+    return l
+}
+
+// Delays reading of a session over its rate, so a flood slows down its sender instead of the pool.
+// Returns false when session kept exceeding rate and must be dropped.
+func (s *ProxyServer) throttle(cs *Session, size int) bool {
+    l := cs.limiter
+    if l == nil {
+        return true
+    }
+    var wait time.Duration
+    if l.messages != nil {
+        wait = l.messages.take(1)
+    }
+    if l.bytes != nil {
+        if w := l.bytes.take(float64(size)); w > wait {
+            wait = w
+        }
+    }
+    if wait == 0 {
+        l.throttled = 0
+        return true
+    }
+    l.throttled++
+    maxThrottled := s.config.Proxy.SessionLimits.MaxThrottled
+    if maxThrottled > 0 && l.throttled >= maxThrottled {
+        return false
+    }
+    time.Sleep(wait)
+    return true
+}
+
+// Counts requests sent before login, returns false when session sent too many
+func (s *ProxyServer) authorizeRequest(cs *Session, method string) bool {
+    l := cs.limiter
+    if l == nil || method == "eth_submitLogin" || method == "eth_login" {
+        return true
+    }
+    maxUnauthorized := s.config.Proxy.SessionLimits.MaxUnauthorized
+    if maxUnauthorized <= 0 {
+        return true
+    }
+    // Login is set from the same read loop
+    if len(cs.login) > 0 {
+        return true
+    }
+    l.unauthorized++
+    return l.unauthorized <= maxUnauthorized
+}
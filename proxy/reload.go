@@ -0,0 +1,63 @@
+package proxy
+
+import (
+    "github.com/NotoriousPyro/open-metaverse-pool/rpc"
+)
+
+// Applies changed policy limits, stratum parameters and new upstreams
+// without dropping connected sessions. Listeners are not restarted,
+// so new stratum entries and changed listen addresses require restart.
+func (s *ProxyServer) Reload(cfg *Config) {
+    s.policy.Reload(&cfg.Proxy.Policy)
+
+    for _, st := range cfg.Proxy.Stratum {
+        i := s.stratumIndex(st.Name)
+        if i < 0 {
+            log.Warnf("Stratum %s is not running, restart is required to start it", st.Name)
+            continue
+        }
+        if err := s.stratum[i].configure(&st); err != nil {
+            log.Errorf("Stratum %s not reconfigured: %v", st.Name, err)
+            continue
+        }
+        log.Infof("Stratum %s reconfigured (Difficulty: %d, Timeout: %s)", st.Name, st.Difficulty, st.Timeout)
+    }
+
+    s.upstreamsMu.Lock()
+    for _, v := range cfg.Upstream {
+        // Node upstreams are not used in pool mode
+        if s.pool != nil {
+            break
+        }
+        if s.hasUpstream(v.Name) {
+            continue
+        }
+        if err := s.addHasher(&v); err != nil {
+            log.Errorf("Upstream %s not added: %v", v.Name, err)
+            continue
+        }
+        s.upstreams = append(s.upstreams, rpc.NewRPCClient(v.Name, v.Url, cfg.Account, cfg.Password, v.Timeout))
+        log.Infof("Upstream: %s => %s", v.Name, v.Url)
+    }
+    s.upstreamsMu.Unlock()
+    // New difficulty is sent with jobs of next template
+}
+
+func (s *ProxyServer) stratumIndex(name string) int {
+    for i, st := range s.config.Proxy.Stratum {
+        if st.Name == name {
+            return i
+        }
+    }
+    return -1
+}
+
+// Must be called with upstreamsMu held
+func (s *ProxyServer) hasUpstream(name string) bool {
+    for _, v := range s.upstreams {
+        if v.Name == name {
+            return true
+        }
+    }
+    return false
+}
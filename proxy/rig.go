@@ -0,0 +1,50 @@
+package proxy
+
+import (
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+var directivePattern = regexp.MustCompile("^[0-9a-zA-Z._-]{1,32}$")
+
+// Rig metadata passed as "watts=850;algo=v2;driver=470.57" in password field
+type RigInfo struct {
+    Watts      int64
+    Algo       string
+    Driver     string
+}
+
+// Returns nil if password has no known directives, so plain passwords and emails are ignored
+func parseRigDirectives(password string) *RigInfo {
+    var info RigInfo
+    found := false
+    fields := strings.FieldsFunc(password, func(r rune) bool {
+        return r == ';' || r == ',' || r == ' '
+    })
+    for _, field := range fields {
+        kv := strings.SplitN(field, "=", 2)
+        if len(kv) != 2 || !directivePattern.MatchString(kv[1]) {
+            continue
+        }
+        switch strings.ToLower(kv[0]) {
+        case "watts", "w":
+            watts, err := strconv.ParseInt(kv[1], 10, 64)
+            if err != nil || watts <= 0 {
+                continue
+            }
+            info.Watts = watts
+        case "algo":
+            info.Algo = kv[1]
+        case "driver":
+            info.Driver = kv[1]
+        default:
+            continue
+        }
+        found = true
+    }
+    if !found {
+        return nil
+    }
+    return &info
+}
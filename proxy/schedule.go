@@ -0,0 +1,122 @@
+package proxy
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+type DifficultyProfile struct {
+    Name           string      `json:"name"`
+    // Daily window as HH:MM, may wrap past midnight
+    From           string      `json:"from"`
+    To             string      `json:"to"`
+    Difficulty     int64       `json:"difficulty"`
+}
+
+type scheduleEntry struct {
+    name           string
+    from           int
+    to             int
+    difficulty     int64
+}
+
+// Window is [from, to) in minutes of day
+func (e *scheduleEntry) active(minute int) bool {
+    if e.from <= e.to {
+        return minute >= e.from && minute < e.to
+    }
+    return minute >= e.from || minute < e.to
+}
+
+func parseClock(s string) (int, error) {
+    t, err := time.Parse("15:04", s)
+    if err != nil {
+        return 0, fmt.Errorf("Invalid time of day %v, expected HH:MM", s)
+    }
+    return t.Hour()*60 + t.Minute(), nil
+}
+
+// Also validates schedule of config being reloaded
+func parseSchedule(cfg *Stratum) ([]scheduleEntry, *time.Location, error) {
+    location := time.UTC
+    if len(cfg.Timezone) > 0 {
+        var err error
+        location, err = time.LoadLocation(cfg.Timezone)
+        if err != nil {
+            return nil, nil, fmt.Errorf("Invalid timezone of stratum %s: %v", cfg.Name, err)
+        }
+    }
+    schedule := make([]scheduleEntry, len(cfg.Schedule))
+    for i, p := range cfg.Schedule {
+        if p.Difficulty <= 0 {
+            return nil, nil, fmt.Errorf("Difficulty profile %s of stratum %s must have positive difficulty", p.Name, cfg.Name)
+        }
+        from, err := parseClock(p.From)
+        if err != nil {
+            return nil, nil, fmt.Errorf("Difficulty profile %s of stratum %s: %v", p.Name, cfg.Name, err)
+        }
+        to, err := parseClock(p.To)
+        if err != nil {
+            return nil, nil, fmt.Errorf("Difficulty profile %s of stratum %s: %v", p.Name, cfg.Name, err)
+        }
+        schedule[i] = scheduleEntry{name: p.Name, from: from, to: to, difficulty: p.Difficulty}
+    }
+    return schedule, location, nil
+}
+
+func ValidateSchedule(cfg *Stratum) error {
+    _, _, err := parseSchedule(cfg)
+    return err
+}
+
+// First matching profile wins, port difficulty applies outside of all of them.
+// Returns true if difficulty changed, must be called with configMu held.
+func (st *StratumServer) applySchedule(now time.Time) bool {
+    local := now.In(st.location)
+    minute := local.Hour()*60 + local.Minute()
+    profile, difficulty := "", st.baseDifficulty
+    for _, e := range st.schedule {
+        if e.active(minute) {
+            profile, difficulty = e.name, e.difficulty
+            break
+        }
+    }
+    if profile == st.profile && difficulty == st.difficulty {
+        return false
+    }
+    st.profile = profile
+    st.difficulty = difficulty
+    st.diff = util.GetTargetHex(difficulty)
+    return true
+}
+
+// Checks difficulty profiles every minute, new difficulty is sent with jobs of next template
+// since shares of jobs already sent are judged by difficulty they were issued with
+func (s *ProxyServer) startScheduler() {
+    timer := time.NewTimer(time.Minute)
+    go func() {
+        for {
+            select {
+            case <-timer.C:
+                now := time.Now()
+                for i, st := range s.stratum {
+                    st.configMu.Lock()
+                    changed := st.applySchedule(now)
+                    profile, difficulty := st.profile, st.difficulty
+                    st.configMu.Unlock()
+                    if !changed || !s.config.Proxy.Stratum[i].Enabled {
+                        continue
+                    }
+                    if len(profile) == 0 {
+                        profile = "default"
+                    }
+                    name := s.config.Proxy.Stratum[i].Name
+                    log.Infof("Stratum %s switched to difficulty profile %s, difficulty %d from next job", name, profile, difficulty)
+                }
+                timer.Reset(time.Minute)
+            }
+        }
+    }()
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+    "container/list"
+    "strings"
+    "sync"
+)
+
+// LRU of recently submitted (job, nonce, login) triples
+type shareCache struct {
+    sync.Mutex
+    size    int
+    ll      *list.List
+    items   map[string]*list.Element
+}
+
+func newShareCache(size int) *shareCache {
+    return &shareCache{size: size, ll: list.New(), items: make(map[string]*list.Element, size)}
+}
+
+func shareKey(header, nonce, login string) string {
+    return strings.ToLower(header) + ":" + strings.ToLower(nonce) + ":" + login
+}
+
+// Registers share and reports whether it was already submitted
+func (c *shareCache) seen(key string) bool {
+    c.Lock()
+    defer c.Unlock()
+
+    if e, ok := c.items[key]; ok {
+        c.ll.MoveToFront(e)
+        return true
+    }
+    c.items[key] = c.ll.PushFront(key)
+    if c.ll.Len() > c.size {
+        oldest := c.ll.Back()
+        c.ll.Remove(oldest)
+        delete(c.items, oldest.Value.(string))
+    }
+    return false
+}
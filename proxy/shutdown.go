@@ -0,0 +1,117 @@
+package proxy
+
+import (
+    "context"
+    "sync/atomic"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+// Stops accepting miners, lets connected ones finish in-flight work and leave
+// within drainTimeout, then closes the rest once share writes are flushed.
+func (s *ProxyServer) Shutdown() {
+    if !atomic.CompareAndSwapInt32(&s.shuttingDown, 0, 1) {
+        return
+    }
+    var drainTimeout time.Duration
+    if len(s.config.Proxy.DrainTimeout) > 0 {
+        drainTimeout = util.MustParseDuration(s.config.Proxy.DrainTimeout)
+    }
+    log.Infof("Shutting down proxy, draining sessions for %v", drainTimeout)
+
+    for _, stratum := range s.stratum {
+        stratum.closeListener()
+    }
+
+    // HTTP requests and sessions share one drain window
+    deadline := time.Now().Add(drainTimeout)
+    ctx, cancel := context.WithDeadline(context.Background(), deadline)
+    defer cancel()
+    err := s.httpServer.Shutdown(ctx)
+    if err != nil {
+        log.Errorf("HTTP proxy did not finish requests in time: %v", err)
+    }
+    if s.adminServer != nil {
+        s.adminServer.Close()
+    }
+    if s.debugServer != nil {
+        s.debugServer.Close()
+    }
+
+    if len(s.config.Proxy.ShutdownMessage) > 0 {
+        s.eachSession(func(cs *Session) {
+            err := cs.pushMessage("client.reconnect", []string{s.config.Proxy.ShutdownMessage})
+            if err != nil {
+                log.Errorf("Failed to notify %v@%v about shutdown: %v", cs.login, cs.ip, err)
+            }
+        })
+    }
+
+    for s.sessionsCount() > 0 && time.Now().Before(deadline) {
+        time.Sleep(100 * time.Millisecond)
+    }
+
+    n := s.sessionsCount()
+    s.eachSession(func(cs *Session) {
+        cs.conn.Close()
+    })
+    if n > 0 {
+        log.Warnf("Closed %v sessions which did not leave in time", n)
+    }
+
+    s.sharesMu.Lock()
+    s.sharesClosed = true
+    s.sharesMu.Unlock()
+    s.sharesWg.Wait()
+    // Buffered shares are kept on failure, give backend a few chances before they are lost
+    for i := 1; i <= 3; i++ {
+        err := s.backend.FlushShares()
+        if err == nil {
+            break
+        }
+        log.Errorf("Failed to flush buffered shares to backend, attempt %v: %v", i, err)
+        time.Sleep(time.Second)
+    }
+    log.Info("Proxy shutdown complete")
+}
+
+// Counts share as in flight, false once shutdown waits for shares in flight
+func (s *ProxyServer) beginShare() bool {
+    s.sharesMu.Lock()
+    defer s.sharesMu.Unlock()
+    if s.sharesClosed {
+        return false
+    }
+    s.sharesWg.Add(1)
+    return true
+}
+
+func (s *ProxyServer) isShuttingDown() bool {
+    return atomic.LoadInt32(&s.shuttingDown) > 0
+}
+
+func (s *ProxyServer) sessionsCount() int {
+    total := 0
+    for _, stratum := range s.stratum {
+        stratum.sessionsMu.RLock()
+        total += len(stratum.sessions)
+        stratum.sessionsMu.RUnlock()
+    }
+    return total
+}
+
+// Calls fn for every session outside of sessions lock
+func (s *ProxyServer) eachSession(fn func(cs *Session)) {
+    var sessions []*Session
+    for _, stratum := range s.stratum {
+        stratum.sessionsMu.RLock()
+        for cs, _ := range stratum.sessions {
+            sessions = append(sessions, cs)
+        }
+        stratum.sessionsMu.RUnlock()
+    }
+    for _, cs := range sessions {
+        fn(cs)
+    }
+}
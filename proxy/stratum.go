@@ -5,8 +5,9 @@ import (
     "encoding/json"
     "errors"
     "io"
-    "log"
     "net"
+    "sync"
+    "sync/atomic"
     "time"
 
     "github.com/NotoriousPyro/open-metaverse-pool/util"
@@ -18,26 +19,57 @@ const (
 
 func (s *ProxyServer) ListenTCP(s_id int) {
     stratumConfig := s.config.Proxy.Stratum[s_id]
-    timeout := util.MustParseDuration(stratumConfig.Timeout)
-    s.stratum[s_id].timeout = timeout
+    if len(stratumConfig.Listen) == 0 {
+        log.Fatalf("Stratum %s has no listen address", stratumConfig.Name)
+    }
 
-    addr, err := net.ResolveTCPAddr("tcp", stratumConfig.Listen)
-    if err != nil {
-        log.Fatalf("Error: %v", err)
+    listeners := make([]*net.TCPListener, 0, len(stratumConfig.Listen))
+    for _, v := range stratumConfig.Listen {
+        server, err := listenStratum(v, len(stratumConfig.Listen) > 1)
+        if err != nil {
+            log.Fatalf("Error: %v", err)
+        }
+        listeners = append(listeners, server)
+    }
+    s.stratum[s_id].setListeners(listeners)
+
+    log.Infof("Stratum %s listening on %s (Difficulty: %d)", stratumConfig.Name, stratumConfig.Listen, stratumConfig.Difficulty)
+    // Connection limit is shared by all addresses of the endpoint
+    var accept = make(chan int, stratumConfig.MaxConn)
+    var wg sync.WaitGroup
+    for _, server := range listeners {
+        wg.Add(1)
+        go func(server *net.TCPListener) {
+            defer wg.Done()
+            defer server.Close()
+            s.acceptTCP(s_id, server, accept)
+        }(server)
     }
-    server, err := net.ListenTCP("tcp", addr)
+    wg.Wait()
+}
+
+// Binds IPv6 addresses as IPv6 only when endpoint has several addresses,
+// so "[::]" doesn't take the port of "0.0.0.0" on dual-stack hosts
+func listenStratum(listen string, multi bool) (*net.TCPListener, error) {
+    addr, err := net.ResolveTCPAddr("tcp", listen)
     if err != nil {
-        log.Fatalf("Error: %v", err)
+        return nil, err
     }
-    defer server.Close()
-    
-    log.Printf("Stratum %s listening on %s (Difficulty: %d)", stratumConfig.Name, stratumConfig.Listen, stratumConfig.Difficulty)
-    var accept = make(chan int, stratumConfig.MaxConn)
-    n := 0
+    network := "tcp"
+    if multi && addr.IP != nil && addr.IP.To4() == nil {
+        network = "tcp6"
+    }
+    return net.ListenTCP(network, addr)
+}
 
+func (s *ProxyServer) acceptTCP(s_id int, server *net.TCPListener, accept chan int) {
+    n := 0
     for {
         conn, err := server.AcceptTCP()
         if err != nil {
+            if s.isShuttingDown() {
+                return
+            }
             continue
         }
         conn.SetKeepAlive(true)
@@ -49,11 +81,13 @@ func (s *ProxyServer) ListenTCP(s_id int) {
             continue
         }
         n += 1
-        cs := &Session{s_id: s_id, conn: conn, ip: ip}
+        cs := &Session{id: atomic.AddUint64(&s.sessionSeq, 1), s_id: s_id, conn: conn, ip: ip, connectedAt: util.MakeTimestamp(),
+            queue: make(chan []byte, s.sessionQueueSize()), done: make(chan struct{}),
+            limiter: newSessionLimiter(&s.config.Proxy.SessionLimits)}
 
         accept <- n
         go func(cs *Session) {
-            err = s.handleTCPClient(cs)
+            err := s.handleTCPClient(cs)
             if err != nil {
                 s.removeSession(cs)
                 conn.Close()
@@ -65,32 +99,44 @@ func (s *ProxyServer) ListenTCP(s_id int) {
 
 func (s *ProxyServer) handleTCPClient(cs *Session) error {
     cs.enc = json.NewEncoder(cs.conn)
+    go s.writeQueued(cs)
+    defer close(cs.done)
     connbuff := bufio.NewReaderSize(cs.conn, MaxReqSize)
     s.setDeadline(cs.conn, cs.s_id)
     stratumConfig := s.config.Proxy.Stratum[cs.s_id]
     for {
         data, isPrefix, err := connbuff.ReadLine()
         if isPrefix {
-            log.Printf("Socket flood detected on %s from %s", stratumConfig.Name, cs.ip)
+            log.Warnf("Socket flood detected on %s from %s", stratumConfig.Name, cs.ip)
             s.policy.BanClient(cs.ip)
             return err
         } else if err == io.EOF {
-            log.Printf("Client on %s disconnected: %s ", stratumConfig.Name, cs.ip)
+            log.Debugf("Client on %s disconnected: %s ", stratumConfig.Name, cs.ip)
             s.removeSession(cs)
             break
         } else if err != nil {
-            log.Printf("Error reading from socket on %s: %v", stratumConfig.Name, err)
+            log.Errorf("Error reading from socket on %s: %v", stratumConfig.Name, err)
             return err
         }
 
         if len(data) > 1 {
+            if !s.throttle(cs, len(data)) {
+                log.Warnf("Request rate exceeded on %s from %s", stratumConfig.Name, cs.ip)
+                s.policy.ApplyMalformedPolicy(cs.ip)
+                return errors.New("request rate exceeded")
+            }
             var req StratumReq
             err = json.Unmarshal(data, &req)
             if err != nil {
                 s.policy.ApplyMalformedPolicy(cs.ip)
-                log.Printf("Malformed stratum request on %s from %s: %v", stratumConfig.Name, cs.ip, err)
+                log.Warnf("Malformed stratum request on %s from %s: %v", stratumConfig.Name, cs.ip, err)
                 return err
             }
+            if !s.authorizeRequest(cs, req.Method) {
+                log.Warnf("Too many requests before login on %s from %s", stratumConfig.Name, cs.ip)
+                s.policy.ApplyMalformedPolicy(cs.ip)
+                return errors.New("too many requests before login")
+            }
             s.setDeadline(cs.conn, cs.s_id)
             err = cs.handleTCPMessage(s, &req)
             if err != nil {
@@ -109,15 +155,20 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
             var params []string
             err := json.Unmarshal(req.Params, &params)
             if err != nil {
-                log.Println("Malformed stratum request params on %s from %s", stratumConfig.Name, cs.ip)
+                log.Warnf("Malformed stratum request params on %s from %s", stratumConfig.Name, cs.ip)
                 return err
             }
+            // Set before session is registered, like login
+            cs.agent, cs.dialect = clientOf(req, params)
             reply, errReply := s.handleLoginRPC(cs, params, req.Worker)
             if errReply != nil {
                 return cs.sendTCPError(req.Id, errReply)
             }
             return cs.sendTCPResult(req.Id, reply)
         case "eth_getWork":
+            if intv := s.stratum[cs.s_id].freshWorkInterval(); intv > 0 {
+                s.refreshBlockTemplate(intv)
+            }
             reply, errReply := s.handleGetWorkRPC(cs)
             if errReply != nil {
                 return cs.sendTCPError(req.Id, errReply)
@@ -127,11 +178,14 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
             var params []string
             err := json.Unmarshal(req.Params, &params)
             if err != nil {
-                log.Println("Malformed stratum request params on %s from %s", stratumConfig.Name, cs.ip)
+                log.Warnf("Malformed stratum request params on %s from %s", stratumConfig.Name, cs.ip)
                 return err
             }
             reply, errReply := s.handleTCPSubmitRPC(cs, req.Worker, params)
-            if errReply != nil {
+            if errReply != nil && (errReply.Code == 21 || errReply.Code == 26) {
+                // Stale shares are expected around block change and pauses are not miner's fault, keep miner connected
+                return cs.sendTCPReject(req.Id, errReply)
+            } else if errReply != nil {
                 return cs.sendTCPError(req.Id, errReply)
             }
             return cs.sendTCPResult(req.Id, &reply)
@@ -151,12 +205,16 @@ func (cs *Session) sendTCPResult(id json.RawMessage, result interface{}) error {
     return cs.enc.Encode(&message)
 }
 
-func (cs *Session) pushNewJob(result interface{}) error {
-    cs.Lock()
-    defer cs.Unlock()
-    // FIXME: Temporarily add ID for Claymore compliance
-    message := JSONPushMessage{Version: "2.0", Result: result, Id: 0}
-    return cs.enc.Encode(&message)
+// Queued behind jobs already sent to session
+func (cs *Session) pushNewJob(job []string) error {
+    msg, err := encodeJob(job)
+    if err != nil {
+        return err
+    }
+    if !cs.enqueue(msg) {
+        return errQueueFull
+    }
+    return nil
 }
 
 func (cs *Session) sendTCPError(id json.RawMessage, reply *ErrorReply) error {
@@ -171,24 +229,189 @@ func (cs *Session) sendTCPError(id json.RawMessage, reply *ErrorReply) error {
     return errors.New(reply.Message)
 }
 
+// Replies with error without closing connection
+func (cs *Session) sendTCPReject(id json.RawMessage, reply *ErrorReply) error {
+    cs.Lock()
+    defer cs.Unlock()
+
+    message := JSONRpcResp{Id: id, Version: "2.0", Error: reply}
+    return cs.enc.Encode(&message)
+}
+
 func (self *ProxyServer) setDeadline(conn *net.TCPConn, s_id int) {
-    conn.SetDeadline(time.Now().Add(self.stratum[s_id].timeout))
+    conn.SetDeadline(time.Now().Add(self.stratum[s_id].currentTimeout()))
+}
+
+func (st *StratumServer) setListeners(l []*net.TCPListener) {
+    st.configMu.Lock()
+    defer st.configMu.Unlock()
+    st.listeners = l
 }
 
-func (s *ProxyServer) registerSession(cs *Session) {
+func (st *StratumServer) closeListener() {
+    st.configMu.Lock()
+    defer st.configMu.Unlock()
+    for _, l := range st.listeners {
+        l.Close()
+    }
+}
+
+func (st *StratumServer) configure(cfg *Stratum) error {
+    schedule, location, err := parseSchedule(cfg)
+    if err != nil {
+        return err
+    }
+    timeout := util.MustParseDuration(cfg.Timeout)
+    var freshWorkIntv time.Duration
+    if cfg.FreshWork {
+        freshWorkIntv = util.MustParseDuration(cfg.FreshWorkInterval)
+        log.Infof("Stratum %s fetches fresh work on poll, at most every %v", cfg.Name, freshWorkIntv)
+    }
+    st.configMu.Lock()
+    defer st.configMu.Unlock()
+    st.timeout = timeout
+    st.baseDifficulty = cfg.Difficulty
+    st.schedule = schedule
+    st.location = location
+    st.freshWorkIntv = freshWorkIntv
+    // Force difficulty to be set even if profile stays the same
+    st.profile, st.difficulty = "", 0
+    st.applySchedule(time.Now())
+    if len(st.profile) > 0 {
+        log.Infof("Stratum %s uses difficulty profile %s, difficulty %d", cfg.Name, st.profile, st.difficulty)
+    }
+    return nil
+}
+
+type portTarget struct {
+    difficulty     int64
+    diff           string
+}
+
+// Current difficulty of every port, snapshot for new template
+func (s *ProxyServer) portTargets() []portTarget {
+    targets := make([]portTarget, len(s.stratum))
+    for i, st := range s.stratum {
+        st.configMu.RLock()
+        targets[i] = portTarget{difficulty: st.difficulty, diff: st.diff}
+        st.configMu.RUnlock()
+    }
+    return targets
+}
+
+// Returns share difficulty for jobs of template t on port s_id and its target hex.
+// Port difficulty is the one template was issued with, raised to network derived floor of the template.
+func (s *ProxyServer) shareDifficulty(s_id int, t *BlockTemplate) (int64, string) {
+    var target portTarget
+    if t != nil && s_id < len(t.PortDifficulty) {
+        target = t.PortDifficulty[s_id]
+    } else {
+        st := s.stratum[s_id]
+        st.configMu.RLock()
+        target = portTarget{difficulty: st.difficulty, diff: st.diff}
+        st.configMu.RUnlock()
+    }
+    if t != nil && t.MinDifficulty > target.difficulty {
+        return t.MinDifficulty, util.GetTargetHex(t.MinDifficulty)
+    }
+    return target.difficulty, target.diff
+}
+
+// Difficulty override set by admin takes precedence over port difficulty, network floor still applies
+func (s *ProxyServer) sessionDifficulty(cs *Session, t *BlockTemplate) (int64, string) {
+    d := atomic.LoadInt64(&cs.difficulty)
+    if d <= 0 {
+        return s.shareDifficulty(cs.s_id, t)
+    }
+    if t != nil && t.MinDifficulty > d {
+        d = t.MinDifficulty
+    }
+    return d, util.GetTargetHex(d)
+}
+
+func (st *StratumServer) currentTimeout() time.Duration {
+    st.configMu.RLock()
+    defer st.configMu.RUnlock()
+    return st.timeout
+}
+
+func (st *StratumServer) freshWorkInterval() time.Duration {
+    st.configMu.RLock()
+    defer st.configMu.RUnlock()
+    return st.freshWorkIntv
+}
+
+func (cs *Session) pushMessage(method string, params interface{}) error {
+    cs.Lock()
+    defer cs.Unlock()
+
+    message := JSONPushNotification{Version: "2.0", Method: method, Params: params, Id: 0}
+    return cs.enc.Encode(&message)
+}
+
+// Asks miner to reconnect and closes connection, read loop will remove the session
+func (cs *Session) dropWithReconnect(reason string) {
+    err := cs.pushMessage("client.reconnect", []string{reason})
+    if err != nil {
+        log.Errorf("Failed to send reconnect to %v@%v: %v", cs.login, cs.ip, err)
+    }
+    cs.conn.Close()
+}
+
+func (s *ProxyServer) registerSession(cs *Session, login, worker string) bool {
+    if !s.registerWorker(cs, login, worker) {
+        return false
+    }
     stratum := s.stratum[cs.s_id]
     stratum.sessionsMu.Lock()
     defer stratum.sessionsMu.Unlock()
     stratum.sessions[cs] = struct{}{}
+    return true
 }
 
 func (s *ProxyServer) removeSession(cs *Session) {
+    s.removeWorker(cs)
     stratum := s.stratum[cs.s_id]
     stratum.sessionsMu.Lock()
     defer stratum.sessionsMu.Unlock()
     delete(stratum.sessions, cs)
 }
 
+// Applies duplicateLogin policy, returns false if session must be rejected
+func (s *ProxyServer) registerWorker(cs *Session, login, worker string) bool {
+    key := login + "." + worker
+    s.workersMu.Lock()
+    defer s.workersMu.Unlock()
+
+    prev, ok := s.workers[key]
+    if ok && prev != cs {
+        switch s.config.Proxy.DuplicateLogin {
+        case "reject":
+            return false
+        case "dropOld":
+            log.Warnf("Dropping previous session of %s from %s, new one from %s", key, prev.ip, cs.ip)
+            go prev.dropWithReconnect("Worker connected from another session")
+        }
+    }
+    // Session logging in again as another worker frees the old one
+    if old := cs.login + "." + cs.worker; len(cs.login) > 0 && old != key && s.workers[old] == cs {
+        delete(s.workers, old)
+    }
+    cs.login, cs.worker = login, worker
+    s.workers[key] = cs
+    return true
+}
+
+func (s *ProxyServer) removeWorker(cs *Session) {
+    key := cs.login + "." + cs.worker
+    s.workersMu.Lock()
+    defer s.workersMu.Unlock()
+
+    if s.workers[key] == cs {
+        delete(s.workers, key)
+    }
+}
+
 func (s *ProxyServer) broadcastNewJobs(s_id int) {
     proxyConfig := s.config.Proxy
     stratumConfig := proxyConfig.Stratum[s_id]
@@ -197,33 +420,50 @@ func (s *ProxyServer) broadcastNewJobs(s_id int) {
         return
     }
     stratum := s.stratum[s_id]
-    reply := []string{t.Header, t.Seed, stratum.diff}
+    difficulty, diff := s.shareDifficulty(s_id, t)
+    reply := []string{t.Header, t.Seed, diff}
 
     stratum.sessionsMu.RLock()
-    defer stratum.sessionsMu.RUnlock()
+    sessions := make([]*Session, 0, len(stratum.sessions))
+    for cs := range stratum.sessions {
+        sessions = append(sessions, cs)
+    }
+    stratum.sessionsMu.RUnlock()
 
-    count := len(stratum.sessions)
-    log.Printf("Broadcasting new job to %v miners on %s", count, stratumConfig.Name)
-    s.backend.WriteStratumState(proxyConfig.Name, stratumConfig.Name, stratumConfig.Listen, count, stratumConfig.Difficulty)
-    
-    start := time.Now()
-    bcast := make(chan int, 1024)
-    n := 0
+    count := len(sessions)
+    log.Debugf("Broadcasting new job to %v miners on %s", count, stratumConfig.Name)
+    s.backend.WriteStratumState(s.nodeId, stratumConfig.Name, stratumConfig.Listen.String(), count, difficulty)
 
-    for m, _ := range stratum.sessions {
-        n++
-        bcast <- n
+    job, err := encodeJob(reply)
+    if err != nil {
+        log.Errorf("Failed to encode job on %s: %v", stratumConfig.Name, err)
+        return
+    }
+    start := time.Now()
+    var wg sync.WaitGroup
 
-        go func(cs *Session) {
-            err := cs.pushNewJob(&reply)
-            <-bcast
-            if err != nil {
-                log.Printf("Job transmit error from %s to %v@%v: %v", stratumConfig.Name, cs.login, cs.ip, err)
-                s.removeSession(cs)
-            } else {
-                s.setDeadline(cs.conn, cs.s_id)
+    for i := 0; i < count; i += broadcastChunk {
+        end := i + broadcastChunk
+        if end > count {
+            end = count
+        }
+        chunk := sessions[i:end]
+        wg.Add(1)
+        s.broadcasts <- func() {
+            defer wg.Done()
+            for _, cs := range chunk {
+                msg := job
+                if atomic.LoadInt64(&cs.difficulty) > 0 {
+                    _, diff := s.sessionDifficulty(cs, t)
+                    msg, _ = encodeJob([]string{t.Header, t.Seed, diff})
+                }
+                if !cs.enqueue(msg) {
+                    log.Warnf("Dropping stalled session on %s of %v@%v, %v", stratumConfig.Name, cs.login, cs.ip, errQueueFull)
+                    cs.conn.Close()
+                }
             }
-        }(m)
+        }
     }
-    log.Printf("Jobs broadcast on %s finished in %s", stratumConfig.Name, time.Since(start))
+    wg.Wait()
+    log.Debugf("Jobs broadcast on %s finished in %s", stratumConfig.Name, time.Since(start))
 }
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/pow"
+    "github.com/NotoriousPyro/open-metaverse-pool/rpc"
+)
+
+// Result of last health probe of an upstream
+type upstreamState struct {
+    Name           string   `json:"name"`
+    Healthy        bool     `json:"healthy"`
+    Height         uint64   `json:"height"`
+    // Milliseconds
+    Latency        int64    `json:"latency"`
+    Reason         string   `json:"reason,omitempty"`
+}
+
+// Probes all upstreams at once, so a stalled node does not delay the others.
+// Node is unhealthy when it fails, is sick, lags best height by more than upstreamMaxLag
+// or responds slower than upstreamMaxLatency. First healthy one in list order is preferred,
+// so a primary which catches back up is promoted again.
+func (s *ProxyServer) checkUpstreams() {
+    s.upstreamsMu.RLock()
+    upstreams := append([]*rpc.RPCClient{}, s.upstreams...)
+    s.upstreamsMu.RUnlock()
+
+    states := make([]*upstreamState, len(upstreams))
+    errs := make([]error, len(upstreams))
+    var wg sync.WaitGroup
+    for i, v := range upstreams {
+        wg.Add(1)
+        go func(i int, v *rpc.RPCClient) {
+            defer wg.Done()
+            height, latency, err := v.Probe()
+            states[i] = &upstreamState{Name: v.Name, Height: height, Latency: int64(latency / time.Millisecond)}
+            errs[i] = err
+        }(i, v)
+    }
+    wg.Wait()
+
+    var best uint64
+    for _, st := range states {
+        if st.Height > best {
+            best = st.Height
+        }
+    }
+    var maxLatency time.Duration
+    if len(s.config.UpstreamMaxLatency) > 0 {
+        maxLatency, _ = time.ParseDuration(s.config.UpstreamMaxLatency)
+    }
+
+    candidate := int32(0)
+    found := false
+    healthy := make([]int32, 0, len(states))
+    for i, st := range states {
+        switch {
+        case errs[i] != nil:
+            st.Reason = errs[i].Error()
+        case upstreams[i].Sick():
+            st.Reason = "sick"
+        case s.config.UpstreamMaxLag > 0 && best-st.Height > uint64(s.config.UpstreamMaxLag):
+            st.Reason = fmt.Sprintf("%v blocks behind", best-st.Height)
+        case maxLatency > 0 && time.Duration(st.Latency)*time.Millisecond > maxLatency:
+            st.Reason = fmt.Sprintf("latency %vms", st.Latency)
+        default:
+            st.Healthy = true
+            healthy = append(healthy, int32(i))
+            if !found {
+                candidate = int32(i)
+                found = true
+            }
+        }
+    }
+
+    s.upstreamsMu.Lock()
+    prev := s.upstreamStates
+    s.upstreamStates = states
+    s.healthyUpstreams = healthy
+    s.upstreamsMu.Unlock()
+
+    for i, st := range states {
+        if i >= len(prev) || prev[i] == nil || prev[i].Healthy == st.Healthy {
+            continue
+        }
+        if st.Healthy {
+            log.Infof("Upstream %v caught up at height %v, back in rotation", st.Name, st.Height)
+        } else {
+            log.Warnf("Upstream %v is unhealthy: %v", st.Name, st.Reason)
+        }
+    }
+
+    if atomic.LoadInt32(&s.upstream) != candidate {
+        log.Warnf("Switching to %v upstream", upstreams[candidate].Name)
+        atomic.StoreInt32(&s.upstream, candidate)
+    }
+}
+
+// Upstream to poll for work, with roundRobin strategy rotates over healthy ones
+func (s *ProxyServer) nextRpc() *rpc.RPCClient {
+    if s.config.UpstreamStrategy != "roundRobin" {
+        return s.rpc()
+    }
+    s.upstreamsMu.RLock()
+    defer s.upstreamsMu.RUnlock()
+    if len(s.healthyUpstreams) == 0 {
+        return s.upstreams[atomic.LoadInt32(&s.upstream)]
+    }
+    n := atomic.AddUint32(&s.roundRobin, 1)
+    return s.upstreams[s.healthyUpstreams[n%uint32(len(s.healthyUpstreams))]]
+}
+
+func (s *ProxyServer) upstreamsHealth() []*upstreamState {
+    s.upstreamsMu.RLock()
+    defer s.upstreamsMu.RUnlock()
+    return s.upstreamStates
+}
+
+// Sets up share verification for chain rules of upstream, upstreams with same rules share caches.
+// Must be called with upstreamsMu held or before proxy starts.
+func (s *ProxyServer) addHasher(v *Upstream) error {
+    params, err := pow.NewParams(v.Algo, v.EpochLength, v.Ecip1099Block)
+    if err != nil {
+        return err
+    }
+    if _, ok := s.hashers[params]; !ok {
+        hasher, name, err := pow.New(s.config.Proxy.Hasher, params)
+        if err != nil {
+            return err
+        }
+        s.hashers[params] = hasher
+        log.Infof("Using %v hashing backend for %v, epoch length %v", name, algoName(v.Algo), params.EpochLength)
+    }
+    s.upstreamParams[v.Name] = params
+    return nil
+}
+
+// Verifier and chain rules of upstream
+func (s *ProxyServer) upstreamHasher(name string) (pow.Verifier, pow.Params) {
+    s.upstreamsMu.RLock()
+    defer s.upstreamsMu.RUnlock()
+    params := s.upstreamParams[name]
+    return s.hashers[params], params
+}
+
+func algoName(algo string) string {
+    if len(algo) == 0 {
+        return "ethash"
+    }
+    return algo
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+    "math/rand"
+    "runtime"
+    "sync/atomic"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/pow"
+)
+
+type VerifyConfig struct {
+    // Goroutines computing proof of work, 0 means GOMAXPROCS
+    Workers        int      `json:"workers"`
+    // Shares waiting for a worker, sessions submitting beyond it wait
+    Queue          int      `json:"queue"`
+    // Shares below this difficulty are fully verified at spotCheckRate only, 0 verifies all
+    SpotCheckBelow int64    `json:"spotCheckBelow"`
+    // Fraction of such shares fully verified, between 0 and 1
+    SpotCheckRate  float64  `json:"spotCheckRate"`
+}
+
+type verifyJob struct {
+    hasher         pow.Verifier
+    share          Block
+    reply          chan bool
+}
+
+// Runs proof of work on a bounded number of goroutines, so thousands of sessions
+// submitting at once don't fight over CPU and caches
+type shareVerifier struct {
+    jobs           chan verifyJob
+    spotBelow      int64
+    spotRate       float64
+    full           int64
+    skipped        int64
+    rejected       int64
+    forged         int64
+}
+
+func newShareVerifier(cfg *VerifyConfig) *shareVerifier {
+    workers := cfg.Workers
+    if workers <= 0 {
+        workers = runtime.GOMAXPROCS(0)
+    }
+    queue := cfg.Queue
+    if queue <= 0 {
+        queue = workers * 64
+    }
+    if cfg.SpotCheckBelow > 0 && (cfg.SpotCheckRate < 0 || cfg.SpotCheckRate > 1) {
+        log.Fatalf("Spot check rate must be between 0 and 1, got %v", cfg.SpotCheckRate)
+    }
+    v := &shareVerifier{jobs: make(chan verifyJob, queue), spotBelow: cfg.SpotCheckBelow, spotRate: cfg.SpotCheckRate}
+    for i := 0; i < workers; i++ {
+        go func() {
+            for job := range v.jobs {
+                job.reply <- job.hasher.Verify(job.share)
+            }
+        }()
+    }
+    if v.spotBelow > 0 {
+        log.Infof("Verifying shares on %v workers, %v of shares below difficulty %v", workers, v.spotRate, v.spotBelow)
+    } else {
+        log.Infof("Verifying shares on %v workers", workers)
+    }
+    return v
+}
+
+// Returns whether share is valid, whether it also solves block and whether it is forged.
+// Shares whose claimed mix digest doesn't meet their target are rejected without hashing,
+// block candidates are always verified in full. A spot checked share which meets its target
+// by claimed digest but fails verification counts as forged, faulty hardware can send one too,
+// so it is judged by penalty threshold rather than punished at once.
+func (v *shareVerifier) verify(hasher pow.Verifier, share, block Block, checkBlock bool) (bool, bool, bool) {
+    if !pow.MeetsTarget(share) {
+        atomic.AddInt64(&v.rejected, 1)
+        return false, false, false
+    }
+    solution := checkBlock && pow.MeetsTarget(block)
+    spotChecked := v.spotBelow > 0 && share.difficulty.Int64() < v.spotBelow
+    if !solution && spotChecked && rand.Float64() >= v.spotRate {
+        atomic.AddInt64(&v.skipped, 1)
+        return true, false, false
+    }
+    atomic.AddInt64(&v.full, 1)
+    reply := make(chan bool, 1)
+    v.jobs <- verifyJob{hasher: hasher, share: share, reply: reply}
+    // Correct digest makes the quick block check hold as well
+    if !<-reply {
+        if spotChecked {
+            atomic.AddInt64(&v.forged, 1)
+        }
+        return false, false, spotChecked
+    }
+    return true, solution, false
+}
+
+// Counters published in debug vars
+func (v *shareVerifier) stats() map[string]int64 {
+    return map[string]int64{
+        "full":     atomic.LoadInt64(&v.full),
+        "skipped":  atomic.LoadInt64(&v.skipped),
+        "rejected": atomic.LoadInt64(&v.rejected),
+        "forged":   atomic.LoadInt64(&v.forged),
+        "queued":   int64(len(v.jobs)),
+    }
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+    "fmt"
+    "regexp"
+    "strings"
+)
+
+type WorkerConfig struct {
+    // Longer names are cut, 8 when 0
+    MaxLength      int      `json:"maxLength"`
+    // Regexp character class of allowed characters, others are dropped. 0-9a-zA-Z_- when empty
+    Charset        string   `json:"charset"`
+    // Used when worker is missing or nothing is left of it, 0 when empty
+    Default        string   `json:"default"`
+    // Drops everything from "@" on, for miners sending email as worker
+    StripEmail     bool     `json:"stripEmail"`
+}
+
+// Worker names become part of backend keys and API paths, so they are normalized on login and submit
+type workerNamer struct {
+    invalid        *regexp.Regexp
+    maxLength      int
+    def            string
+    stripEmail     bool
+}
+
+func newWorkerNamer(cfg *WorkerConfig) (*workerNamer, error) {
+    charset := cfg.Charset
+    if len(charset) == 0 {
+        charset = "0-9a-zA-Z_-"
+    }
+    invalid, err := regexp.Compile("[^" + charset + "]")
+    if err != nil {
+        return nil, fmt.Errorf("Invalid worker charset %v: %v", charset, err)
+    }
+    n := &workerNamer{invalid: invalid, maxLength: cfg.MaxLength, def: cfg.Default, stripEmail: cfg.StripEmail}
+    if n.maxLength <= 0 {
+        n.maxLength = 8
+    }
+    if len(n.def) == 0 {
+        n.def = "0"
+    }
+    if invalid.MatchString(n.def) || len([]rune(n.def)) > n.maxLength {
+        return nil, fmt.Errorf("Default worker %v doesn't fit charset and maxLength", n.def)
+    }
+    return n, nil
+}
+
+func (n *workerNamer) normalize(id string) string {
+    if n.stripEmail {
+        if i := strings.Index(id, "@"); i >= 0 {
+            id = id[:i]
+        }
+    }
+    id = n.invalid.ReplaceAllString(id, "")
+    if runes := []rune(id); len(runes) > n.maxLength {
+        id = string(runes[:n.maxLength])
+    }
+    if len(id) == 0 {
+        return n.def
+    }
+    return id
+}
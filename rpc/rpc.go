@@ -5,7 +5,9 @@ import (
     "encoding/json"
     "errors"
     "net/http"
+    "strconv"
     "sync"
+    "time"
 
     "github.com/NotoriousPyro/open-metaverse-pool/util"
 )
@@ -179,6 +181,56 @@ func (r *RPCClient) SendTransaction(from, to, value string) (string, error) {
     return reply.Hash, err
 }
 
+// Pays all recipients in one transaction, change goes back to change address
+func (r *RPCClient) SendMore(recipients []string, amounts []int64, change string) (string, error) {
+    params := []string{r.Account, r.Password}
+    for i, to := range recipients {
+        params = append(params, "-r", to+":"+strconv.FormatInt(amounts[i], 10))
+    }
+    params = append(params, "-m", change)
+    rpcResp, err := r.doPost(r.Url, "sendmore", params)
+    if err != nil {
+        return "", err
+    }
+    var reply MVSTx
+    err = json.Unmarshal(*rpcResp.Result, &reply)
+    return reply.Hash, err
+}
+
+// Builds unsigned transaction spending UTXOs of sender, fee 0 leaves default of node
+func (r *RPCClient) CreateRawTx(sender string, recipients []string, amounts []int64, change string, fee int64) (string, error) {
+    params := []string{"-t", "0", "-s", sender}
+    for i, to := range recipients {
+        params = append(params, "-r", to+":"+strconv.FormatInt(amounts[i], 10))
+    }
+    params = append(params, "-m", change)
+    if fee > 0 {
+        params = append(params, "-f", strconv.FormatInt(fee, 10))
+    }
+    rpcResp, err := r.doPost(r.Url, "createrawtx", params)
+    if err != nil {
+        return "", err
+    }
+    var reply string
+    err = json.Unmarshal(*rpcResp.Result, &reply)
+    return reply, err
+}
+
+// Broadcasts signed transaction, returns its hash
+func (r *RPCClient) SendRawTx(tx string) (string, error) {
+    rpcResp, err := r.doPost(r.Url, "sendrawtx", []string{tx})
+    if err != nil {
+        return "", err
+    }
+    var hash string
+    if err = json.Unmarshal(*rpcResp.Result, &hash); err == nil {
+        return hash, nil
+    }
+    var reply MVSTx
+    err = json.Unmarshal(*rpcResp.Result, &reply)
+    return reply.Hash, err
+}
+
 func (r *RPCClient) GetTransaction(hash string) (*GetBlockReply, error) {
     rpcResp, err := r.doPost(r.Url, "gettx", []string{hash})
     if err != nil {
@@ -189,6 +241,17 @@ func (r *RPCClient) GetTransaction(hash string) (*GetBlockReply, error) {
     return reply, err
 }
 
+// Returns serialized transaction as hex
+func (r *RPCClient) GetRawTx(hash string) (string, error) {
+    rpcResp, err := r.doPost(r.Url, "gettx", []string{"--json=false", hash})
+    if err != nil {
+        return "", err
+    }
+    var reply string
+    err = json.Unmarshal(*rpcResp.Result, &reply)
+    return reply, err
+}
+
 func (r *RPCClient) GetBalance(address string) (*GetBalanceReply, error) {
     rpcResp, err := r.doPost(r.Url, "fetch-balance", []string{address})
     if err != nil {
@@ -200,6 +263,22 @@ func (r *RPCClient) GetBalance(address string) (*GetBalanceReply, error) {
     return reply, err
 }
 
+func (r *RPCClient) VerifyMessage(address, signature, message string) (bool, error) {
+    rpcResp, err := r.doPost(r.Url, "verifymessage", []string{address, signature, message})
+    if err != nil {
+        return false, err
+    }
+    var reply bool
+    err = json.Unmarshal(*rpcResp.Result, &reply)
+    return reply, err
+}
+
+// Fails if account is locked or credentials are wrong
+func (r *RPCClient) CheckAccount() error {
+    _, err := r.doPost(r.Url, "getbalance", []string{r.Account, r.Password})
+    return err
+}
+
 func (r *RPCClient) GetPeerCount() (int, error) {
     rpcResp, err := r.doPost(r.Url, "getpeerinfo", []string{})
     if err != nil {
@@ -245,6 +324,21 @@ func (r *RPCClient) Check() bool {
     return !r.Sick()
 }
 
+// Node must serve work, returns its height and getwork response time
+func (r *RPCClient) Probe() (uint64, time.Duration, error) {
+    start := time.Now()
+    if _, err := r.GetWork(); err != nil {
+        return 0, 0, err
+    }
+    latency := time.Since(start)
+    height, err := r.GetHeight()
+    if err != nil {
+        return 0, latency, err
+    }
+    r.markAlive()
+    return height, latency, nil
+}
+
 func (r *RPCClient) Sick() bool {
     r.RLock()
     defer r.RUnlock()
@@ -0,0 +1,124 @@
+package storage
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "gopkg.in/redis.v3"
+)
+
+const clusterDialTimeout = 5 * time.Second
+
+// Returned on write to connection of a node which stopped mastering pool slot,
+// nothing is sent and client drops the connection
+var errMasterMoved = &net.OpError{Op: "write", Net: "tcp", Err: errors.New("Cluster master moved")}
+
+// Pool needs MULTI across its keys, so in cluster mode the prefix becomes a hash tag
+// and all keys live in one slot. Connections go to whichever node masters that slot,
+// it is looked up again on every dial so pool reconnects to new master after failover.
+func newClusterClient(cfg *Config, prefix string) *RedisClient {
+    if !strings.HasPrefix(prefix, "{") {
+        prefix = "{" + prefix + "}"
+    }
+    seeds := cfg.Cluster.Addrs
+    password := cfg.Password
+    var gen uint64
+    client := redis.NewClient(&redis.Options{
+        Dialer: func() (net.Conn, error) {
+            addr, err := clusterMaster(seeds, password, prefix)
+            if err != nil {
+                return nil, err
+            }
+            conn, err := net.DialTimeout("tcp", addr, clusterDialTimeout)
+            if err != nil {
+                return nil, err
+            }
+            return &clusterConn{Conn: conn, gen: atomic.LoadUint64(&gen), current: &gen}, nil
+        },
+        Password: password,
+        PoolSize: cfg.PoolSize,
+    })
+    return &RedisClient{client: client, prefix: prefix}
+}
+
+// Connection of the pool, client keeps connections across server errors, so once
+// any of them is redirected by MOVED or refused by READONLY all connections dialed
+// before are failed on next write and dialed again to current master
+type clusterConn struct {
+    net.Conn
+    gen            uint64
+    current        *uint64
+}
+
+func (c *clusterConn) Read(p []byte) (int, error) {
+    n, err := c.Conn.Read(p)
+    if n > 0 && masterMoved(p[:n]) {
+        atomic.CompareAndSwapUint64(c.current, c.gen, c.gen+1)
+    }
+    return n, err
+}
+
+func (c *clusterConn) Write(p []byte) (int, error) {
+    if atomic.LoadUint64(c.current) != c.gen {
+        return 0, errMasterMoved
+    }
+    return c.Conn.Write(p)
+}
+
+// Error replies start a line
+func masterMoved(reply []byte) bool {
+    for _, prefix := range []string{"-MOVED ", "-READONLY "} {
+        if bytes.HasPrefix(reply, []byte(prefix)) || bytes.Contains(reply, []byte("\r\n"+prefix)) {
+            return true
+        }
+    }
+    return false
+}
+
+// Asks seed nodes in turn for master of the slot holding key
+func clusterMaster(seeds []string, password, key string) (string, error) {
+    var lastErr error
+    for _, seed := range seeds {
+        addr, err := slotMaster(seed, password, key)
+        if err == nil {
+            return addr, nil
+        }
+        lastErr = err
+    }
+    if lastErr == nil {
+        lastErr = fmt.Errorf("No cluster nodes configured")
+    }
+    return "", lastErr
+}
+
+func slotMaster(seed, password, key string) (string, error) {
+    client := redis.NewClient(&redis.Options{
+        Addr:        seed,
+        Password:    password,
+        PoolSize:    1,
+        DialTimeout: clusterDialTimeout,
+        ReadTimeout: clusterDialTimeout,
+    })
+    defer client.Close()
+
+    slot, err := client.ClusterKeySlot(key).Result()
+    if err != nil {
+        return "", err
+    }
+    slots, err := client.ClusterSlots().Result()
+    if err != nil {
+        return "", err
+    }
+    for _, s := range slots {
+        // First address is the master
+        if int64(s.Start) <= slot && slot <= int64(s.End) && len(s.Addrs) > 0 {
+            return s.Addrs[0], nil
+        }
+    }
+    return "", fmt.Errorf("Slot %v is not served by cluster", slot)
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+    "fmt"
+    "time"
+)
+
+type LedgerConfig struct {
+    // redis (default) or postgres
+    Driver     string   `json:"driver"`
+    // PostgreSQL connection string
+    Url        string   `json:"url"`
+    MaxConns   int      `json:"maxConns"`
+}
+
+// Financial records: round shares, blocks, balances and payments.
+// Stats, settings and pool state are always kept in Redis.
+type Ledger interface {
+    Check() (string, error)
+
+    WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration, pplns int64) (bool, error)
+    WriteSoloShare(login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error)
+    WriteBlock(login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration, pplns int64, port string) (bool, error)
+    WriteSoloBlock(login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration, port string) (bool, error)
+
+    GetCandidates(maxHeight int64) ([]*BlockData, error)
+    GetImmatureBlocks(maxHeight int64) ([]*BlockData, error)
+    GetRoundShares(height int64, nonce string) (map[string]int64, error)
+    GetPPLNSShares(nonce string) (map[string]int64, error)
+    WritePendingOrphans(blocks []*BlockData) error
+    WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error
+    WriteMaturedBlock(block *BlockData, roundRewards map[string]int64, disputable bool) error
+    WriteOrphan(block *BlockData) error
+
+    ReleaseDisputableCredits(maxTs int64) (int, error)
+    HoldBlock(height int64, hash, reason string) (bool, error)
+    ReleaseHold(height int64, hash string) (bool, error)
+    GetHolds(login string) ([]map[string]interface{}, error)
+
+    GetPayees() ([]string, error)
+    GetBalance(login string) (int64, error)
+    GetClosingBalance(login string) (int64, int64, error)
+    // Shares of current round or of a block not matured yet
+    HasRoundShares(login string) (bool, error)
+    LockPayouts(login string, amount int64) error
+    UnlockPayouts() error
+    IsPayoutsLocked() (bool, error)
+    GetPayoutsLock() (*PayoutsLock, error)
+    SetPayoutsTx(txHash string) error
+    GetPendingPayments() []*PendingPayment
+    UpdateBalance(login string, amount int64) error
+    RollbackBalance(login string, amount int64) error
+    WritePayment(login, txHash string, amount int64) error
+    // Writes every payment of tx and releases payouts lock in one transaction
+    WriteBatchPayments(txHash string, payments []*PendingPayment) error
+
+    GetLedgerStats(maxBlocks, maxPayments int64) (map[string]interface{}, error)
+    GetMinerLedgerStats(login string, maxPayments int64) (map[string]interface{}, error)
+    CollectLuckStats(windows []int) (map[string]interface{}, error)
+}
+
+// Redis driver returns backend itself
+func NewLedger(cfg *LedgerConfig, backend *RedisClient) (Ledger, error) {
+    switch cfg.Driver {
+    case "", "redis":
+        return backend, nil
+    case "postgres":
+        return NewPostgresClient(cfg, backend)
+    }
+    return nil, fmt.Errorf("Unknown ledger driver %v", cfg.Driver)
+}
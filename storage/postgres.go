@@ -0,0 +1,820 @@
+package storage
+
+import (
+    "database/sql"
+    "fmt"
+    "math/big"
+    "time"
+
+    _ "github.com/lib/pq"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+// Current round shares are kept under height 0 until block is found.
+// Blocks keep their row through candidate, immature and matured states,
+// credits are bound to the row so height corrections need no rename.
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS round_shares (
+    height         BIGINT NOT NULL,
+    nonce          TEXT NOT NULL,
+    login          TEXT NOT NULL,
+    shares         BIGINT NOT NULL,
+    PRIMARY KEY (height, nonce, login)
+);
+CREATE TABLE IF NOT EXISTS window_shares (
+    id             BIGSERIAL PRIMARY KEY,
+    login          TEXT NOT NULL,
+    diff           BIGINT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS pplns_shares (
+    nonce          TEXT NOT NULL,
+    login          TEXT NOT NULL,
+    shares         BIGINT NOT NULL,
+    PRIMARY KEY (nonce, login)
+);
+CREATE TABLE IF NOT EXISTS blocks (
+    id             BIGSERIAL PRIMARY KEY,
+    state          TEXT NOT NULL,
+    height         BIGINT NOT NULL,
+    nonce          TEXT NOT NULL,
+    pow_hash       TEXT NOT NULL DEFAULT '',
+    mix_digest     TEXT NOT NULL DEFAULT '',
+    hash           TEXT NOT NULL DEFAULT '',
+    ts             BIGINT NOT NULL,
+    difficulty     BIGINT NOT NULL,
+    total_shares   BIGINT NOT NULL,
+    uncle_height   BIGINT NOT NULL DEFAULT 0,
+    orphan         BOOLEAN NOT NULL DEFAULT FALSE,
+    reward         NUMERIC NOT NULL DEFAULT 0,
+    port           TEXT NOT NULL DEFAULT '',
+    finder         TEXT NOT NULL DEFAULT '',
+    credit_state   TEXT NOT NULL DEFAULT '',
+    credited_at    BIGINT NOT NULL DEFAULT 0,
+    held_at        BIGINT NOT NULL DEFAULT 0,
+    hold_reason    TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS blocks_state_height ON blocks (state, height);
+CREATE INDEX IF NOT EXISTS blocks_credit_state ON blocks (credit_state, credited_at);
+CREATE TABLE IF NOT EXISTS credits (
+    block_id       BIGINT NOT NULL REFERENCES blocks (id),
+    login          TEXT NOT NULL,
+    amount         BIGINT NOT NULL,
+    matured        BOOLEAN NOT NULL,
+    PRIMARY KEY (block_id, matured, login)
+);
+CREATE TABLE IF NOT EXISTS balances (
+    login          TEXT PRIMARY KEY,
+    balance        BIGINT NOT NULL DEFAULT 0,
+    immature       BIGINT NOT NULL DEFAULT 0,
+    disputable     BIGINT NOT NULL DEFAULT 0,
+    held           BIGINT NOT NULL DEFAULT 0,
+    pending        BIGINT NOT NULL DEFAULT 0,
+    paid           BIGINT NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS payments (
+    id             BIGSERIAL PRIMARY KEY,
+    ts             BIGINT NOT NULL,
+    login          TEXT NOT NULL,
+    amount         BIGINT NOT NULL,
+    tx_hash        TEXT NOT NULL DEFAULT '',
+    pending        BOOLEAN NOT NULL
+);
+CREATE INDEX IF NOT EXISTS payments_login ON payments (login, ts);
+CREATE TABLE IF NOT EXISTS payouts_lock (
+    id             INT PRIMARY KEY CHECK (id = 1),
+    login          TEXT NOT NULL,
+    amount         BIGINT NOT NULL
+);
+ALTER TABLE payouts_lock ADD COLUMN IF NOT EXISTS sending BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE payouts_lock ADD COLUMN IF NOT EXISTS tx_hash TEXT NOT NULL DEFAULT '';
+`
+
+const blockColumns = "id, state, height, nonce, pow_hash, mix_digest, hash, ts, difficulty, total_shares, uncle_height, orphan, reward, port, finder"
+
+// Keeps ledger in PostgreSQL, duplicate share check and hashrate stats stay in Redis
+type PostgresClient struct {
+    db       *sql.DB
+    redis    *RedisClient
+}
+
+func NewPostgresClient(cfg *LedgerConfig, backend *RedisClient) (*PostgresClient, error) {
+    db, err := sql.Open("postgres", cfg.Url)
+    if err != nil {
+        return nil, err
+    }
+    if cfg.MaxConns > 0 {
+        db.SetMaxOpenConns(cfg.MaxConns)
+    }
+    if _, err := db.Exec(postgresSchema); err != nil {
+        db.Close()
+        return nil, err
+    }
+    return &PostgresClient{db: db, redis: backend}, nil
+}
+
+func (p *PostgresClient) Check() (string, error) {
+    var version string
+    err := p.db.QueryRow("SHOW server_version").Scan(&version)
+    return "PostgreSQL " + version, err
+}
+
+func (p *PostgresClient) inTx(fn func(tx *sql.Tx) error) error {
+    tx, err := p.db.Begin()
+    if err != nil {
+        return err
+    }
+    if err := fn(tx); err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
+
+func (p *PostgresClient) WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration, pplns int64) (bool, error) {
+    exist, err := p.redis.WriteShareStats(login, id, params, diff, height, window, false, false)
+    if err != nil || exist {
+        return exist, err
+    }
+    return false, p.inTx(func(tx *sql.Tx) error {
+        if err := writeRoundShare(tx, login, diff); err != nil {
+            return err
+        }
+        return writeWindowShare(tx, login, diff, pplns)
+    })
+}
+
+func (p *PostgresClient) WriteSoloShare(login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
+    return p.redis.WriteShareStats(login, id, params, diff, height, window, true, false)
+}
+
+func (p *PostgresClient) WriteSoloBlock(login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration, port string) (bool, error) {
+    exist, err := p.redis.WriteShareStats(login, id, params, diff, height, window, true, true)
+    if err != nil || exist {
+        return exist, err
+    }
+    ts := util.MakeTimestamp() / 1000
+    _, err = p.db.Exec(`INSERT INTO blocks (state, height, nonce, pow_hash, mix_digest, ts, difficulty, total_shares, port, finder)
+        VALUES ('candidate', $1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+        int64(height), params[0], params[1], params[2], ts, roundDiff, diff, port, login)
+    return false, err
+}
+
+func (p *PostgresClient) WriteBlock(login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration, pplns int64, port string) (bool, error) {
+    exist, err := p.redis.WriteShareStats(login, id, params, diff, height, window, false, true)
+    if err != nil || exist {
+        return exist, err
+    }
+    ts := util.MakeTimestamp() / 1000
+    nonce := params[0]
+
+    return false, p.inTx(func(tx *sql.Tx) error {
+        if err := writeRoundShare(tx, login, diff); err != nil {
+            return err
+        }
+        _, err := tx.Exec("UPDATE round_shares SET height = $1, nonce = $2 WHERE height = 0 AND nonce = ''", int64(height), nonce)
+        if err != nil {
+            return err
+        }
+        var totalShares int64
+        err = tx.QueryRow("SELECT COALESCE(SUM(shares), 0) FROM round_shares WHERE height = $1 AND nonce = $2", int64(height), nonce).Scan(&totalShares)
+        if err != nil {
+            return err
+        }
+        if pplns > 0 {
+            if err := writeWindowShare(tx, login, diff, pplns); err != nil {
+                return err
+            }
+            // Snapshot of PPLNS window at the moment block was found, summed by login
+            _, err = tx.Exec(`INSERT INTO pplns_shares (nonce, login, shares)
+                SELECT $1::text, login, SUM(diff) FROM (SELECT login, diff FROM window_shares ORDER BY id DESC LIMIT $2) w
+                GROUP BY login ON CONFLICT DO NOTHING`, nonce, pplns)
+            if err != nil {
+                return err
+            }
+        }
+        _, err = tx.Exec(`INSERT INTO blocks (state, height, nonce, pow_hash, mix_digest, ts, difficulty, total_shares, port)
+            VALUES ('candidate', $1, $2, $3, $4, $5, $6, $7, $8)`,
+            int64(height), nonce, params[1], params[2], ts, roundDiff, totalShares, port)
+        return err
+    })
+}
+
+func writeRoundShare(tx *sql.Tx, login string, diff int64) error {
+    _, err := tx.Exec(`INSERT INTO round_shares (height, nonce, login, shares) VALUES (0, '', $1, $2)
+        ON CONFLICT (height, nonce, login) DO UPDATE SET shares = round_shares.shares + EXCLUDED.shares`, login, diff)
+    return err
+}
+
+// Rolling window of last pplns shares
+func writeWindowShare(tx *sql.Tx, login string, diff, pplns int64) error {
+    if pplns <= 0 {
+        return nil
+    }
+    _, err := tx.Exec("INSERT INTO window_shares (login, diff) VALUES ($1, $2)", login, diff)
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec("DELETE FROM window_shares WHERE id <= (SELECT id FROM window_shares ORDER BY id DESC OFFSET $1 LIMIT 1)", pplns)
+    return err
+}
+
+func (p *PostgresClient) GetCandidates(maxHeight int64) ([]*BlockData, error) {
+    return p.queryBlocks("SELECT "+blockColumns+" FROM blocks WHERE state = 'candidate' AND height <= $1 ORDER BY height", maxHeight)
+}
+
+func (p *PostgresClient) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
+    return p.queryBlocks("SELECT "+blockColumns+" FROM blocks WHERE state = 'immature' AND height <= $1 ORDER BY height", maxHeight)
+}
+
+func (p *PostgresClient) queryBlocks(query string, args ...interface{}) ([]*BlockData, error) {
+    rows, err := p.db.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var result []*BlockData
+    for rows.Next() {
+        block := BlockData{}
+        var state string
+        err := rows.Scan(&block.rowId, &state, &block.Height, &block.Nonce, &block.PowHash, &block.MixDigest, &block.Hash,
+            &block.Timestamp, &block.Difficulty, &block.TotalShares, &block.UncleHeight, &block.Orphan,
+            &block.RewardString, &block.Port, &block.Finder)
+        if err != nil {
+            return nil, err
+        }
+        block.RoundHeight = block.Height
+        block.Uncle = block.UncleHeight > 0
+        // Candidates have no reward yet
+        if state == "candidate" {
+            block.RewardString = ""
+        } else {
+            block.ImmatureReward = block.RewardString
+        }
+        result = append(result, &block)
+    }
+    return result, rows.Err()
+}
+
+func (p *PostgresClient) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
+    return p.queryShares("SELECT login, shares FROM round_shares WHERE height = $1 AND nonce = $2", height, nonce)
+}
+
+func (p *PostgresClient) GetPPLNSShares(nonce string) (map[string]int64, error) {
+    return p.queryShares("SELECT login, shares FROM pplns_shares WHERE nonce = $1", nonce)
+}
+
+func (p *PostgresClient) queryShares(query string, args ...interface{}) (map[string]int64, error) {
+    rows, err := p.db.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    result := make(map[string]int64)
+    for rows.Next() {
+        var login string
+        var n int64
+        if err := rows.Scan(&login, &n); err != nil {
+            return nil, err
+        }
+        result[login] = n
+    }
+    return result, rows.Err()
+}
+
+func (p *PostgresClient) WritePendingOrphans(blocks []*BlockData) error {
+    return p.inTx(func(tx *sql.Tx) error {
+        for _, block := range blocks {
+            if err := writeImmatureBlock(tx, block); err != nil {
+                return err
+            }
+            // Orphans are never credited, round shares are kept only as a fallback
+            if _, err := tx.Exec("DELETE FROM pplns_shares WHERE nonce = $1", block.Nonce); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+func (p *PostgresClient) WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error {
+    return p.inTx(func(tx *sql.Tx) error {
+        if err := writeImmatureBlock(tx, block); err != nil {
+            return err
+        }
+        for login, amount := range roundRewards {
+            if err := addBalance(tx, login, "immature", amount); err != nil {
+                return err
+            }
+            _, err := tx.Exec("INSERT INTO credits (block_id, login, amount, matured) VALUES ($1, $2, $3, FALSE) ON CONFLICT DO NOTHING",
+                block.rowId, login, amount)
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// With disputable set credits are kept aside from balances until released by ReleaseDisputableCredits
+func (p *PostgresClient) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64, disputable bool) error {
+    ts := util.MakeTimestamp() / 1000
+    creditState, column := "balance", "balance"
+    if disputable {
+        creditState, column = "disputable", "disputable"
+    }
+    return p.inTx(func(tx *sql.Tx) error {
+        if err := removeImmatureCredits(tx, block); err != nil {
+            return err
+        }
+        if err := writeMaturedBlock(tx, block, creditState, ts); err != nil {
+            return err
+        }
+        for login, amount := range roundRewards {
+            if err := addBalance(tx, login, column, amount); err != nil {
+                return err
+            }
+            _, err := tx.Exec("INSERT INTO credits (block_id, login, amount, matured) VALUES ($1, $2, $3, TRUE) ON CONFLICT DO NOTHING",
+                block.rowId, login, amount)
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+func (p *PostgresClient) WriteOrphan(block *BlockData) error {
+    return p.inTx(func(tx *sql.Tx) error {
+        if err := removeImmatureCredits(tx, block); err != nil {
+            return err
+        }
+        return writeMaturedBlock(tx, block, "", 0)
+    })
+}
+
+func writeImmatureBlock(tx *sql.Tx, block *BlockData) error {
+    // Solo blocks have no round shares to move
+    if block.Height != block.RoundHeight && !block.IsSolo() {
+        _, err := tx.Exec("UPDATE round_shares SET height = $1 WHERE height = $2 AND nonce = $3", block.Height, block.RoundHeight, block.Nonce)
+        if err != nil {
+            return err
+        }
+    }
+    _, err := tx.Exec(`UPDATE blocks SET state = 'immature', height = $2, hash = $3, ts = $4, difficulty = $5,
+        total_shares = $6, uncle_height = $7, orphan = $8, reward = $9 WHERE id = $1`,
+        block.rowId, block.Height, block.Hash, block.Timestamp, block.Difficulty, block.TotalShares,
+        block.UncleHeight, block.Orphan, rewardString(block.Reward))
+    return err
+}
+
+func writeMaturedBlock(tx *sql.Tx, block *BlockData, creditState string, ts int64) error {
+    _, err := tx.Exec("DELETE FROM round_shares WHERE height = $1 AND nonce = $2", block.RoundHeight, block.Nonce)
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec("DELETE FROM pplns_shares WHERE nonce = $1", block.Nonce)
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec(`UPDATE blocks SET state = 'matured', height = $2, hash = $3, ts = $4, difficulty = $5,
+        total_shares = $6, uncle_height = $7, orphan = $8, reward = $9, credit_state = $10, credited_at = $11 WHERE id = $1`,
+        block.rowId, block.Height, block.Hash, block.Timestamp, block.Difficulty, block.TotalShares,
+        block.UncleHeight, block.Orphan, rewardString(block.Reward), creditState, ts)
+    return err
+}
+
+// Must decrement immatures using existing credits
+func removeImmatureCredits(tx *sql.Tx, block *BlockData) error {
+    _, err := tx.Exec(`UPDATE balances b SET immature = b.immature - c.amount FROM credits c
+        WHERE c.block_id = $1 AND NOT c.matured AND c.login = b.login`, block.rowId)
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec("DELETE FROM credits WHERE block_id = $1 AND NOT matured", block.rowId)
+    return err
+}
+
+// Column is one of the fixed balance columns, never user input
+func addBalance(tx *sql.Tx, login, column string, amount int64) error {
+    query := fmt.Sprintf(`INSERT INTO balances (login, %[1]s) VALUES ($1, $2)
+        ON CONFLICT (login) DO UPDATE SET %[1]s = balances.%[1]s + EXCLUDED.%[1]s`, column)
+    _, err := tx.Exec(query, login, amount)
+    return err
+}
+
+func moveCredits(tx *sql.Tx, blockId int64, from, to string) error {
+    query := fmt.Sprintf(`UPDATE balances b SET %[1]s = b.%[1]s - c.amount, %[2]s = b.%[2]s + c.amount FROM credits c
+        WHERE c.block_id = $1 AND c.matured AND c.login = b.login`, from, to)
+    _, err := tx.Exec(query, blockId)
+    return err
+}
+
+func rewardString(reward *big.Int) string {
+    if reward == nil {
+        return "0"
+    }
+    return reward.String()
+}
+
+// Moves credits of a block still within dispute window from disputable to held
+func (p *PostgresClient) HoldBlock(height int64, hash, reason string) (bool, error) {
+    ts := util.MakeTimestamp() / 1000
+    return p.switchCredits(`UPDATE blocks SET credit_state = 'held', held_at = $3, hold_reason = $4
+        WHERE state = 'matured' AND height = $1 AND hash = $2 AND credit_state = 'disputable' RETURNING id`,
+        "disputable", "held", height, hash, ts, reason)
+}
+
+// Returns held credits back to disputable, they are released with the next unlocker run
+func (p *PostgresClient) ReleaseHold(height int64, hash string) (bool, error) {
+    return p.switchCredits(`UPDATE blocks SET credit_state = 'disputable', held_at = 0, hold_reason = ''
+        WHERE state = 'matured' AND height = $1 AND hash = $2 AND credit_state = 'held' RETURNING id`,
+        "held", "disputable", height, hash)
+}
+
+func (p *PostgresClient) switchCredits(query, from, to string, args ...interface{}) (bool, error) {
+    found := false
+    err := p.inTx(func(tx *sql.Tx) error {
+        var blockId int64
+        err := tx.QueryRow(query, args...).Scan(&blockId)
+        if err == sql.ErrNoRows {
+            return nil
+        } else if err != nil {
+            return err
+        }
+        found = true
+        return moveCredits(tx, blockId, from, to)
+    })
+    return found && err == nil, err
+}
+
+// Credits not held and matured before maxTs become payable
+func (p *PostgresClient) ReleaseDisputableCredits(maxTs int64) (int, error) {
+    rows, err := p.db.Query("SELECT id FROM blocks WHERE credit_state = 'disputable' AND credited_at <= $1", maxTs)
+    if err != nil {
+        return 0, err
+    }
+    var ids []int64
+    for rows.Next() {
+        var id int64
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        ids = append(ids, id)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+
+    released := 0
+    for _, id := range ids {
+        ok, err := p.switchCredits("UPDATE blocks SET credit_state = 'balance' WHERE id = $1 AND credit_state = 'disputable' RETURNING id",
+            "disputable", "balance", id)
+        if err != nil {
+            return released, err
+        }
+        if ok {
+            released++
+        }
+    }
+    return released, nil
+}
+
+// Returns all held blocks, if login is set only blocks crediting that login
+func (p *PostgresClient) GetHolds(login string) ([]map[string]interface{}, error) {
+    rows, err := p.db.Query("SELECT id, height, hash, held_at, hold_reason FROM blocks WHERE credit_state = 'held' ORDER BY height")
+    if err != nil {
+        return nil, err
+    }
+    var ids []int64
+    var holds []map[string]interface{}
+    for rows.Next() {
+        var id, height, ts int64
+        var hash, reason string
+        if err := rows.Scan(&id, &height, &hash, &ts, &reason); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        ids = append(ids, id)
+        holds = append(holds, map[string]interface{}{"height": height, "hash": hash, "timestamp": ts, "reason": reason})
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+
+    result := make([]map[string]interface{}, 0, len(holds))
+    for i, hold := range holds {
+        if len(login) > 0 {
+            var amount int64
+            err := p.db.QueryRow("SELECT amount FROM credits WHERE block_id = $1 AND matured AND login = $2", ids[i], login).Scan(&amount)
+            if err == sql.ErrNoRows {
+                continue
+            } else if err != nil {
+                return nil, err
+            }
+            hold["amount"] = amount
+        } else {
+            credits, err := p.queryShares("SELECT login, amount FROM credits WHERE block_id = $1 AND matured", ids[i])
+            if err != nil {
+                return nil, err
+            }
+            m := make(map[string]interface{})
+            for k, v := range credits {
+                m[k] = v
+            }
+            hold["credits"] = m
+        }
+        result = append(result, hold)
+    }
+    return result, nil
+}
+
+func (p *PostgresClient) GetPayees() ([]string, error) {
+    rows, err := p.db.Query("SELECT login FROM balances WHERE balance > 0")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var result []string
+    for rows.Next() {
+        var login string
+        if err := rows.Scan(&login); err != nil {
+            return nil, err
+        }
+        result = append(result, login)
+    }
+    return result, rows.Err()
+}
+
+func (p *PostgresClient) GetBalance(login string) (int64, error) {
+    var balance int64
+    err := p.db.QueryRow("SELECT balance FROM balances WHERE login = $1", login).Scan(&balance)
+    if err == sql.ErrNoRows {
+        return 0, nil
+    }
+    return balance, err
+}
+
+func (p *PostgresClient) GetClosingBalance(login string) (int64, int64, error) {
+    var balance, locked int64
+    err := p.db.QueryRow("SELECT balance, immature + disputable + held + pending FROM balances WHERE login = $1", login).Scan(&balance, &locked)
+    if err == sql.ErrNoRows {
+        return 0, 0, nil
+    }
+    return balance, locked, err
+}
+
+// Rows of matured and orphaned rounds are deleted, any row left is still to be credited
+func (p *PostgresClient) HasRoundShares(login string) (bool, error) {
+    var ok bool
+    err := p.db.QueryRow("SELECT EXISTS (SELECT 1 FROM round_shares WHERE login = $1)", login).Scan(&ok)
+    return ok, err
+}
+
+func (p *PostgresClient) LockPayouts(login string, amount int64) error {
+    res, err := p.db.Exec("INSERT INTO payouts_lock (id, login, amount) VALUES (1, $1, $2) ON CONFLICT DO NOTHING", login, amount)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return fmt.Errorf("Unable to acquire payouts lock")
+    }
+    return nil
+}
+
+func (p *PostgresClient) UnlockPayouts() error {
+    _, err := p.db.Exec("DELETE FROM payouts_lock")
+    return err
+}
+
+func (p *PostgresClient) IsPayoutsLocked() (bool, error) {
+    var locked bool
+    err := p.db.QueryRow("SELECT EXISTS (SELECT 1 FROM payouts_lock)").Scan(&locked)
+    return locked, err
+}
+
+func (p *PostgresClient) GetPayoutsLock() (*PayoutsLock, error) {
+    lock := &PayoutsLock{}
+    err := p.db.QueryRow("SELECT login, amount, sending, tx_hash FROM payouts_lock").Scan(&lock.Login, &lock.Amount, &lock.Sending, &lock.Tx)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return lock, nil
+}
+
+func (p *PostgresClient) SetPayoutsTx(txHash string) error {
+    _, err := p.db.Exec("UPDATE payouts_lock SET sending = TRUE, tx_hash = $1", txHash)
+    return err
+}
+
+func (p *PostgresClient) GetPendingPayments() []*PendingPayment {
+    var result []*PendingPayment
+    rows, err := p.db.Query("SELECT ts, amount, login FROM payments WHERE pending ORDER BY ts DESC")
+    if err != nil {
+        return result
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        payment := PendingPayment{}
+        if err := rows.Scan(&payment.Timestamp, &payment.Amount, &payment.Address); err != nil {
+            break
+        }
+        result = append(result, &payment)
+    }
+    return result
+}
+
+// Deduct miner's balance for payment
+func (p *PostgresClient) UpdateBalance(login string, amount int64) error {
+    ts := util.MakeTimestamp() / 1000
+    return p.inTx(func(tx *sql.Tx) error {
+        _, err := tx.Exec("UPDATE balances SET balance = balance - $2, pending = pending + $2 WHERE login = $1", login, amount)
+        if err != nil {
+            return err
+        }
+        _, err = tx.Exec("INSERT INTO payments (ts, login, amount, pending) VALUES ($1, $2, $3, TRUE)", ts, login, amount)
+        return err
+    })
+}
+
+func (p *PostgresClient) RollbackBalance(login string, amount int64) error {
+    return p.inTx(func(tx *sql.Tx) error {
+        _, err := tx.Exec("UPDATE balances SET balance = balance + $2, pending = pending - $2 WHERE login = $1", login, amount)
+        if err != nil {
+            return err
+        }
+        _, err = tx.Exec(`DELETE FROM payments WHERE id =
+            (SELECT id FROM payments WHERE pending AND login = $1 AND amount = $2 ORDER BY id LIMIT 1)`, login, amount)
+        return err
+    })
+}
+
+func (p *PostgresClient) WritePayment(login, txHash string, amount int64) error {
+    return p.WriteBatchPayments(txHash, []*PendingPayment{{Address: login, Amount: amount}})
+}
+
+func (p *PostgresClient) WriteBatchPayments(txHash string, payments []*PendingPayment) error {
+    ts := util.MakeTimestamp() / 1000
+    return p.inTx(func(tx *sql.Tx) error {
+        for _, pm := range payments {
+            _, err := tx.Exec("UPDATE balances SET pending = pending - $2, paid = paid + $2 WHERE login = $1", pm.Address, pm.Amount)
+            if err != nil {
+                return err
+            }
+            _, err = tx.Exec(`UPDATE payments SET pending = FALSE, tx_hash = $3, ts = $4 WHERE id =
+                (SELECT id FROM payments WHERE pending AND login = $1 AND amount = $2 ORDER BY id LIMIT 1)`, pm.Address, pm.Amount, txHash, ts)
+            if err != nil {
+                return err
+            }
+        }
+        _, err := tx.Exec("DELETE FROM payouts_lock")
+        return err
+    })
+}
+
+// Blocks and payments of the pool
+func (p *PostgresClient) GetLedgerStats(maxBlocks, maxPayments int64) (map[string]interface{}, error) {
+    stats := make(map[string]interface{})
+
+    var err error
+    stats["candidates"], err = p.queryBlocks("SELECT " + blockColumns + " FROM blocks WHERE state = 'candidate' ORDER BY height DESC")
+    if err != nil {
+        return nil, err
+    }
+    stats["immature"], err = p.queryBlocks("SELECT " + blockColumns + " FROM blocks WHERE state = 'immature' ORDER BY height DESC")
+    if err != nil {
+        return nil, err
+    }
+    stats["matured"], err = p.queryBlocks("SELECT "+blockColumns+" FROM blocks WHERE state = 'matured' ORDER BY height DESC LIMIT $1", limit(maxBlocks))
+    if err != nil {
+        return nil, err
+    }
+
+    totals := map[string]int64{}
+    rows, err := p.db.Query("SELECT state, COUNT(*) FROM blocks GROUP BY state")
+    if err != nil {
+        return nil, err
+    }
+    for rows.Next() {
+        var state string
+        var n int64
+        if err := rows.Scan(&state, &n); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        totals[state] = n
+    }
+    rows.Close()
+    stats["candidatesTotal"] = totals["candidate"]
+    stats["immatureTotal"] = totals["immature"]
+    stats["maturedTotal"] = totals["matured"]
+
+    stats["payments"], err = p.queryPayments("SELECT ts, tx_hash, login, amount FROM payments WHERE NOT pending ORDER BY ts DESC LIMIT $1", true, limit(maxPayments))
+    if err != nil {
+        return nil, err
+    }
+    var paymentsTotal int64
+    err = p.db.QueryRow("SELECT COUNT(*) FROM payments WHERE NOT pending").Scan(&paymentsTotal)
+    if err != nil {
+        return nil, err
+    }
+    stats["paymentsTotal"] = paymentsTotal
+    return stats, nil
+}
+
+// Balances, payments, current round shares and holds of login
+func (p *PostgresClient) GetMinerLedgerStats(login string, maxPayments int64) (map[string]interface{}, error) {
+    stats := make(map[string]interface{})
+
+    var values [6]int64
+    err := p.db.QueryRow("SELECT balance, immature, disputable, held, pending, paid FROM balances WHERE login = $1", login).
+        Scan(&values[0], &values[1], &values[2], &values[3], &values[4], &values[5])
+    if err != nil && err != sql.ErrNoRows {
+        return nil, err
+    }
+    balances := make(map[string]int64)
+    if err == nil {
+        for i, field := range balanceFields {
+            balances[field] = values[i]
+        }
+    }
+    stats["balances"] = balances
+
+    stats["payments"], err = p.queryPayments("SELECT ts, tx_hash, login, amount FROM payments WHERE NOT pending AND login = $1 ORDER BY ts DESC LIMIT $2", false, login, limit(maxPayments))
+    if err != nil {
+        return nil, err
+    }
+    var paymentsTotal, roundShares int64
+    err = p.db.QueryRow("SELECT COUNT(*) FROM payments WHERE NOT pending AND login = $1", login).Scan(&paymentsTotal)
+    if err != nil {
+        return nil, err
+    }
+    stats["paymentsTotal"] = paymentsTotal
+    err = p.db.QueryRow("SELECT shares FROM round_shares WHERE height = 0 AND nonce = '' AND login = $1", login).Scan(&roundShares)
+    if err != nil && err != sql.ErrNoRows {
+        return nil, err
+    }
+    stats["roundShares"] = roundShares
+
+    holds, err := p.GetHolds(login)
+    if err != nil {
+        return nil, err
+    }
+    stats["holds"] = holds
+    return stats, nil
+}
+
+// Whole payments rows carry address, individual ones only tx and amount
+func (p *PostgresClient) queryPayments(query string, withAddress bool, args ...interface{}) ([]map[string]interface{}, error) {
+    rows, err := p.db.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var result []map[string]interface{}
+    for rows.Next() {
+        var ts, amount int64
+        var txHash, login string
+        if err := rows.Scan(&ts, &txHash, &login, &amount); err != nil {
+            return nil, err
+        }
+        tx := map[string]interface{}{"timestamp": ts, "tx": txHash, "amount": amount}
+        if withAddress {
+            tx["address"] = login
+        }
+        result = append(result, tx)
+    }
+    return result, rows.Err()
+}
+
+func (p *PostgresClient) CollectLuckStats(windows []int) (map[string]interface{}, error) {
+    max := int64(windows[len(windows)-1])
+    immature, err := p.queryBlocks("SELECT " + blockColumns + " FROM blocks WHERE state = 'immature' ORDER BY height DESC")
+    if err != nil {
+        return nil, err
+    }
+    matured, err := p.queryBlocks("SELECT "+blockColumns+" FROM blocks WHERE state = 'matured' ORDER BY height DESC LIMIT $1", limit(max))
+    if err != nil {
+        return nil, err
+    }
+    return luckStats(append(immature, matured...), windows), nil
+}
+
+// LIMIT NULL means no limit, like -1 stop of Redis ranges
+func limit(n int64) interface{} {
+    if n <= 0 {
+        return nil
+    }
+    return n
+}
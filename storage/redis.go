@@ -1,8 +1,10 @@
 package storage
 
 import (
+    "errors"
     "fmt"
     "math/big"
+    "net"
     "strconv"
     "strings"
     "time"
@@ -13,15 +15,34 @@ import (
 )
 
 type Config struct {
-    Endpoint   string   `json:"endpoint"`
-    Password   string   `json:"password"`
-    Database   int64    `json:"database"`
-    PoolSize   int      `json:"poolSize"`
+    Endpoint   string           `json:"endpoint"`
+    Password   string           `json:"password"`
+    Database   int64            `json:"database"`
+    PoolSize   int              `json:"poolSize"`
+    // Endpoint is ignored when either of these is enabled
+    Sentinel   SentinelConfig   `json:"sentinel"`
+    Cluster    ClusterConfig    `json:"cluster"`
+    // Batches share writes of stratum
+    WriteBehind WriteBehindConfig `json:"writeBehind"`
+}
+
+type SentinelConfig struct {
+    Enabled    bool     `json:"enabled"`
+    MasterName string   `json:"masterName"`
+    Addrs      []string `json:"addrs"`
+}
+
+type ClusterConfig struct {
+    Enabled    bool     `json:"enabled"`
+    // Seed nodes used to find master of the pool's slot
+    Addrs      []string `json:"addrs"`
 }
 
 type RedisClient struct {
     client   *redis.Client
     prefix   string
+    // Nil unless writeBehind is enabled
+    buffer   *shareBuffer
 }
 
 type BlockData struct {
@@ -41,8 +62,15 @@ type BlockData struct {
     ImmatureReward string     `json:"-"`
     RewardString   string     `json:"reward"`
     RoundHeight    int64      `json:"-"`
+    ShareDump      string     `json:"shareDump,omitempty"`
+    // Stratum the block was found on
+    Port           string     `json:"port,omitempty"`
+    // Set for solo blocks only, whole reward goes to this login
+    Finder         string     `json:"finder,omitempty"`
     candidateKey   string
     immatureKey    string
+    // Row of PostgreSQL ledger
+    rowId          int64
 }
 
 func (b *BlockData) RewardInShannon() int64 {
@@ -62,8 +90,12 @@ func (b *BlockData) RoundKey() string {
     return join(b.RoundHeight, b.Hash)
 }
 
+func (b *BlockData) IsSolo() bool {
+    return len(b.Finder) > 0
+}
+
 func (b *BlockData) key() string {
-    return join(b.UncleHeight, b.Orphan, b.Nonce, b.serializeHash(), b.Timestamp, b.Difficulty, b.TotalShares, b.Reward)
+    return join(b.UncleHeight, b.Orphan, b.Nonce, b.serializeHash(), b.Timestamp, b.Difficulty, b.TotalShares, b.Reward, b.Port, b.Finder)
 }
 
 type Miner struct {
@@ -73,12 +105,55 @@ type Miner struct {
     startedAt   int64
 }
 
+// Account closure workflow: pending until paid out, paid until deleted after retention
+type Closure struct {
+    Login       string  `json:"login"`
+    State       string  `json:"state"`
+    RequestedAt int64   `json:"requestedAt"`
+    PaidAt      int64   `json:"paidAt,omitempty"`
+    DeletedAt   int64   `json:"deletedAt,omitempty"`
+    // Balance left below closure dust at final payout
+    Dust        int64   `json:"dust,omitempty"`
+}
+
+type HashrateSample struct {
+    Timestamp   int64   `json:"ts"`
+    Hashrate    int64   `json:"hr"`
+}
+
 type Worker struct {
     Miner
     TotalHR     int64   `json:"hr2"`
+    // Reported by rig in password directives
+    Watts       int64   `json:"watts,omitempty"`
+    Algo        string  `json:"algo,omitempty"`
+    Driver      string  `json:"driver,omitempty"`
+    // Current hashrate per watt
+    Efficiency  float64 `json:"efficiency,omitempty"`
 }
 
 func NewRedisClient(cfg *Config, prefix string) *RedisClient {
+    r := newRedisClient(cfg, prefix)
+    if cfg.WriteBehind.Enabled {
+        r.startShareBuffer(&cfg.WriteBehind)
+    }
+    return r
+}
+
+func newRedisClient(cfg *Config, prefix string) *RedisClient {
+    if cfg.Sentinel.Enabled {
+        client := redis.NewFailoverClient(&redis.FailoverOptions{
+            MasterName:    cfg.Sentinel.MasterName,
+            SentinelAddrs: cfg.Sentinel.Addrs,
+            Password:      cfg.Password,
+            DB:            cfg.Database,
+            PoolSize:      cfg.PoolSize,
+        })
+        return &RedisClient{client: client, prefix: prefix}
+    }
+    if cfg.Cluster.Enabled {
+        return newClusterClient(cfg, prefix)
+    }
     client := redis.NewClient(&redis.Options{
         Addr:     cfg.Endpoint,
         Password: cfg.Password,
@@ -88,6 +163,12 @@ func NewRedisClient(cfg *Config, prefix string) *RedisClient {
     return &RedisClient{client: client, prefix: prefix}
 }
 
+// Connects to a read-only replica sharing the same key prefix.
+// Only read queries must be issued through the returned client.
+func (r *RedisClient) NewReplicaClient(cfg *Config) *RedisClient {
+    return NewRedisClient(cfg, r.prefix)
+}
+
 func (r *RedisClient) Client() *redis.Client {
     return r.client
 }
@@ -96,6 +177,25 @@ func (r *RedisClient) Check() (string, error) {
     return r.client.Ping().Result()
 }
 
+func (r *RedisClient) Subscribe(channels ...string) (*redis.PubSub, error) {
+    return r.client.Subscribe(channels...)
+}
+
+// Channel of keyspace notifications for key, requires notify-keyspace-events to be set on server
+func (r *RedisClient) KeyspaceChannel(db int64, key string) string {
+    return fmt.Sprintf("__keyspace@%d__:%s", db, r.formatKey(key))
+}
+
+// Writes and removes a probe key to make sure we are not connected to a read-only replica
+func (r *RedisClient) CheckWritable() error {
+    key := r.formatKey("preflight", util.MakeTimestamp())
+    err := r.client.Set(key, "1", time.Minute).Err()
+    if err != nil {
+        return err
+    }
+    return r.client.Del(key).Err()
+}
+
 func (r *RedisClient) BgSave() (string, error) {
     return r.client.BgSave().Result()
 }
@@ -109,6 +209,191 @@ func (r *RedisClient) GetBlacklist() ([]string, error) {
     return cmd.Val(), nil
 }
 
+func (r *RedisClient) AddToBlacklist(login string) error {
+    return r.client.SAdd(r.formatKey("blacklist"), login).Err()
+}
+
+func (r *RedisClient) RemoveFromBlacklist(login string) error {
+    return r.client.SRem(r.formatKey("blacklist"), login).Err()
+}
+
+// Logins allowed to mine on whitelist only pools
+func (r *RedisClient) GetLoginWhitelist() ([]string, error) {
+    cmd := r.client.SMembers(r.formatKey("logins", "whitelist"))
+    if cmd.Err() != nil {
+        return []string{}, cmd.Err()
+    }
+    return cmd.Val(), nil
+}
+
+func (r *RedisClient) AddToLoginWhitelist(login string) error {
+    return r.client.SAdd(r.formatKey("logins", "whitelist"), login).Err()
+}
+
+func (r *RedisClient) RemoveFromLoginWhitelist(login string) error {
+    return r.client.SRem(r.formatKey("logins", "whitelist"), login).Err()
+}
+
+// Counts offense of ip and its subnet within window, returns both counts
+func (r *RedisClient) WriteOffense(ip, subnet string, window time.Duration) (int64, int64, error) {
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    cmds, err := tx.Exec(func() error {
+        tx.Incr(r.formatKey("offenses", "ip", ip))
+        tx.Expire(r.formatKey("offenses", "ip", ip), window)
+        tx.Incr(r.formatKey("offenses", "subnet", subnet))
+        tx.Expire(r.formatKey("offenses", "subnet", subnet), window)
+        return nil
+    })
+    if err != nil {
+        return 0, 0, err
+    }
+    return cmds[0].(*redis.IntCmd).Val(), cmds[2].(*redis.IntCmd).Val(), nil
+}
+
+func (r *RedisClient) ClearOffenses(ip string) error {
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    _, err := tx.Exec(func() error {
+        tx.Del(r.formatKey("offenses", "ip", ip))
+        tx.HDel(r.formatKey("bans", "permanent"), ip)
+        tx.ZRem(r.formatKey("bans", "temporary"), ip)
+        tx.HDel(r.formatKey("bans", "tiers"), ip)
+        tx.Del(r.formatKey("policy", ip))
+        return nil
+    })
+    return err
+}
+
+// Temporary ban shared by all proxies, times are in milliseconds
+type IPBan struct {
+    Until    int64
+    Tier     int64
+}
+
+// Members are IPs scored by ban expiry, so expired bans are swept by score,
+// tiers are kept in a hash by IP
+func (r *RedisClient) AddBan(ip string, tier, until int64) error {
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    _, err := tx.Exec(func() error {
+        tx.ZAdd(r.formatKey("bans", "temporary"), redis.Z{Score: float64(until), Member: ip})
+        tx.HSet(r.formatKey("bans", "tiers"), ip, strconv.FormatInt(tier, 10))
+        return nil
+    })
+    return err
+}
+
+// Returns active temporary bans by IP
+func (r *RedisClient) GetBans() (map[string]IPBan, error) {
+    result := make(map[string]IPBan)
+    // Tiers are read first, so tier of a ban added meanwhile is never taken as stale
+    tiers := r.client.HGetAllMap(r.formatKey("bans", "tiers"))
+    if tiers.Err() != nil {
+        return result, tiers.Err()
+    }
+    now := strconv.FormatInt(util.MakeTimestamp(), 10)
+    r.client.ZRemRangeByScore(r.formatKey("bans", "temporary"), "-inf", now)
+    cmd := r.client.ZRangeWithScores(r.formatKey("bans", "temporary"), 0, -1)
+    if cmd.Err() != nil {
+        return result, cmd.Err()
+    }
+    for _, v := range cmd.Val() {
+        member := v.Member.(string)
+        if net.ParseIP(member) == nil {
+            // Written by older proxies as "ip:tier"
+            ip, tier := splitBanMember(member)
+            r.migrateBan(member, ip, tier, int64(v.Score))
+            result[ip] = IPBan{Until: int64(v.Score), Tier: tier}
+            continue
+        }
+        tier, _ := strconv.ParseInt(tiers.Val()[member], 10, 64)
+        result[member] = IPBan{Until: int64(v.Score), Tier: tier}
+    }
+    // Tiers of expired bans
+    var stale []string
+    for ip := range tiers.Val() {
+        if _, ok := result[ip]; !ok {
+            stale = append(stale, ip)
+        }
+    }
+    if len(stale) > 0 {
+        r.client.HDel(r.formatKey("bans", "tiers"), stale...)
+    }
+    return result, nil
+}
+
+func (r *RedisClient) migrateBan(member, ip string, tier, until int64) {
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    tx.Exec(func() error {
+        tx.ZRem(r.formatKey("bans", "temporary"), member)
+        tx.ZAdd(r.formatKey("bans", "temporary"), redis.Z{Score: float64(until), Member: ip})
+        tx.HSet(r.formatKey("bans", "tiers"), ip, strconv.FormatInt(tier, 10))
+        return nil
+    })
+}
+
+// IPv6 addresses contain colons, tier is always last
+func splitBanMember(member string) (string, int64) {
+    i := strings.LastIndex(member, ":")
+    if i < 0 {
+        return member, 0
+    }
+    tier, _ := strconv.ParseInt(member[i+1:], 10, 64)
+    return member[:i], tier
+}
+
+// Adds to policy counters of ip shared by all proxies and returns their totals.
+// Counters are dropped window after first write.
+func (r *RedisClient) IncrPolicyCounters(ip string, counts map[string]int64, window time.Duration) (map[string]int64, error) {
+    key := r.formatKey("policy", ip)
+    fields := make([]string, 0, len(counts))
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    cmds, err := tx.Exec(func() error {
+        for field, n := range counts {
+            fields = append(fields, field)
+            tx.HIncrBy(key, field, n)
+        }
+        tx.PTTL(key)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    result := make(map[string]int64)
+    for i, field := range fields {
+        result[field] = cmds[i].(*redis.IntCmd).Val()
+    }
+    if cmds[len(fields)].(*redis.DurationCmd).Val() < 0 {
+        r.client.PExpire(key, window)
+    }
+    return result, nil
+}
+
+func (r *RedisClient) AddPermanentBan(ip string, tier int64) error {
+    return r.client.HSet(r.formatKey("bans", "permanent"), ip, strconv.FormatInt(tier, 10)).Err()
+}
+
+// Returns permanently banned IPs with their tier
+func (r *RedisClient) GetPermanentBans() (map[string]int64, error) {
+    result := make(map[string]int64)
+    cmd := r.client.HGetAllMap(r.formatKey("bans", "permanent"))
+    if cmd.Err() != nil {
+        return result, cmd.Err()
+    }
+    for ip, v := range cmd.Val() {
+        result[ip], _ = strconv.ParseInt(v, 10, 64)
+    }
+    return result, nil
+}
+
 // Always returns list of IPs. If Redis fails it will return empty list.
 func (r *RedisClient) GetWhitelist() ([]string, error) {
     cmd := r.client.SMembers(r.formatKey("whitelist"))
@@ -157,7 +442,50 @@ func (r *RedisClient) GetStratumStates(nodeId string) ([]map[string]interface{},
     return v, nil
 }
 
-func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int) error {
+// Connected sessions of stratum node by "dialect:agent", replaced on every write
+// and expiring when node stops reporting
+func (r *RedisClient) WriteClientStats(nodeId string, counts map[string]int64, expire time.Duration) error {
+    key := r.formatKey("clients", nodeId)
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    _, err := tx.Exec(func() error {
+        tx.Del(key)
+        for field, n := range counts {
+            tx.HSet(key, field, strconv.FormatInt(n, 10))
+        }
+        tx.Expire(key, expire)
+        return nil
+    })
+    return err
+}
+
+// Client counts summed over nodes
+func (r *RedisClient) GetClientStats(nodeIds []string) (map[string]int64, error) {
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    cmds, err := tx.Exec(func() error {
+        for _, id := range nodeIds {
+            tx.HGetAllMap(r.formatKey("clients", id))
+        }
+        return nil
+    })
+    if err != nil && err != redis.Nil {
+        return nil, err
+    }
+    result := make(map[string]int64)
+    for _, cmd := range cmds {
+        for field, value := range cmd.(*redis.StringStringMapCmd).Val() {
+            n, _ := strconv.ParseInt(value, 10, 64)
+            result[field] += n
+        }
+    }
+    return result, nil
+}
+
+// Region and hashrate of instance are reported by cluster members, region is empty otherwise
+func (r *RedisClient) WriteNodeState(id, region string, height uint64, diff *big.Int, hashrate int64) error {
     tx := r.client.Multi()
     defer tx.Close()
 
@@ -168,6 +496,8 @@ func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int) er
         tx.HSet(r.formatKey("nodes"), join(id, "height"), strconv.FormatUint(height, 10))
         tx.HSet(r.formatKey("nodes"), join(id, "difficulty"), diff.String())
         tx.HSet(r.formatKey("nodes"), join(id, "lastBeat"), strconv.FormatInt(now, 10))
+        tx.HSet(r.formatKey("nodes"), join(id, "region"), region)
+        tx.HSet(r.formatKey("nodes"), join(id, "hashrate"), strconv.FormatInt(hashrate, 10))
         return nil
     })
     return err
@@ -199,13 +529,18 @@ func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 }
 
 func (r *RedisClient) checkPoWExist(height uint64, params []string) (bool, error) {
-    // Sweep PoW backlog for previous blocks, we have 3 templates back in RAM
-    r.client.ZRemRangeByScore(r.formatKey("pow"), "-inf", fmt.Sprint("(", height-8))
+    if r.buffer != nil {
+        // Swept on flush
+        r.buffer.setHeight(height)
+    } else {
+        r.sweepPoW(height)
+    }
     val, err := r.client.ZAdd(r.formatKey("pow"), redis.Z{Score: float64(height), Member: strings.Join(params, ":")}).Result()
     return val == 0, err
 }
 
-func (r *RedisClient) WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
+// pplns is the number of last shares kept in PPLNS window, 0 disables the window
+func (r *RedisClient) WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration, pplns int64) (bool, error) {
     exist, err := r.checkPoWExist(height, params)
     if err != nil {
         return false, err
@@ -214,6 +549,10 @@ func (r *RedisClient) WriteShare(login, id string, params []string, diff int64,
     if exist {
         return true, nil
     }
+    if r.buffer != nil {
+        r.buffer.add(login, id, diff, window, true, true, pplns, height)
+        return false, nil
+    }
     tx := r.client.Multi()
     defer tx.Close()
 
@@ -222,13 +561,115 @@ func (r *RedisClient) WriteShare(login, id string, params []string, diff int64,
 
     _, err = tx.Exec(func() error {
         r.writeShare(tx, ms, ts, login, id, diff, window)
+        r.writeWindowShare(tx, login, diff, pplns)
         tx.HIncrBy(r.formatKey("stats"), "roundShares", diff)
         return nil
     })
     return false, err
 }
 
-func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration) (bool, error) {
+// Share of solo port, not counted in pool round
+func (r *RedisClient) WriteSoloShare(login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
+    exist, err := r.checkPoWExist(height, params)
+    if err != nil {
+        return false, err
+    }
+    // Duplicate share, (nonce, powHash, mixDigest) pair exist
+    if exist {
+        return true, nil
+    }
+    if r.buffer != nil {
+        r.buffer.add(login, id, diff, window, false, false, 0, height)
+        return false, nil
+    }
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    ms := util.MakeTimestamp()
+    ts := ms / 1000
+
+    _, err = tx.Exec(func() error {
+        r.writeHashrate(tx, ms, ts, login, id, diff, window)
+        return nil
+    })
+    return false, err
+}
+
+// Duplicate check and stats of a share whose round is accounted by another ledger
+func (r *RedisClient) WriteShareStats(login, id string, params []string, diff int64, height uint64, window time.Duration, solo, block bool) (bool, error) {
+    exist, err := r.checkPoWExist(height, params)
+    if err != nil {
+        return false, err
+    }
+    // Duplicate share, (nonce, powHash, mixDigest) pair exist
+    if exist {
+        return true, nil
+    }
+    if r.buffer != nil {
+        if !block {
+            r.buffer.add(login, id, diff, window, false, !solo, 0, height)
+            return false, nil
+        }
+        r.flushBeforeBlock()
+    }
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    ms := util.MakeTimestamp()
+    ts := ms / 1000
+
+    _, err = tx.Exec(func() error {
+        r.writeHashrate(tx, ms, ts, login, id, diff, window)
+        if !block {
+            if !solo {
+                tx.HIncrBy(r.formatKey("stats"), "roundShares", diff)
+            }
+            return nil
+        }
+        tx.ZIncrBy(r.formatKey("finders"), 1, login)
+        tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
+        if solo {
+            tx.HIncrBy(r.formatKey("miners", login), "soloBlocksFound", 1)
+        } else {
+            tx.HSet(r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
+            tx.HDel(r.formatKey("stats"), "roundShares")
+        }
+        return nil
+    })
+    return false, err
+}
+
+// Block of solo port, pool round is left running and whole reward is credited to login
+func (r *RedisClient) WriteSoloBlock(login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration, port string) (bool, error) {
+    exist, err := r.checkPoWExist(height, params)
+    if err != nil {
+        return false, err
+    }
+    // Duplicate share, (nonce, powHash, mixDigest) pair exist
+    if exist {
+        return true, nil
+    }
+    r.flushBeforeBlock()
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    ms := util.MakeTimestamp()
+    ts := ms / 1000
+
+    _, err = tx.Exec(func() error {
+        r.writeHashrate(tx, ms, ts, login, id, diff, window)
+        tx.ZIncrBy(r.formatKey("finders"), 1, login)
+        tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
+        tx.HIncrBy(r.formatKey("miners", login), "soloBlocksFound", 1)
+        hashHex := strings.Join(params, ":")
+        s := join(hashHex, ts, roundDiff, diff, port, login)
+        tx.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
+        return nil
+    })
+    return false, err
+}
+
+func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration, pplns int64, port string) (bool, error) {
     exist, err := r.checkPoWExist(height, params)
     if err != nil {
         return false, err
@@ -237,6 +678,8 @@ func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundD
     if exist {
         return true, nil
     }
+    // Round must include buffered shares
+    r.flushBeforeBlock()
     tx := r.client.Multi()
     defer tx.Close()
 
@@ -251,11 +694,21 @@ func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundD
         tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
         tx.Rename(r.formatKey("shares", "roundCurrent"), r.formatRound(int64(height), params[0]))
         tx.HGetAllMap(r.formatRound(int64(height), params[0]))
+        if pplns > 0 {
+            r.writeWindowShare(tx, login, diff, pplns)
+            tx.LRange(r.formatKey("shares", "window"), 0, pplns-1)
+        }
         return nil
     })
     if err != nil {
         return false, err
     } else {
+        if pplns > 0 {
+            err = r.writePPLNSShares(params[0], cmds[len(cmds)-1].(*redis.StringSliceCmd).Val())
+            if err != nil {
+                return false, err
+            }
+        }
         sharesMap, _ := cmds[10].(*redis.StringStringMapCmd).Result()
         totalShares := int64(0)
         for _, v := range sharesMap {
@@ -263,7 +716,7 @@ func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundD
             totalShares += n
         }
         hashHex := strings.Join(params, ":")
-        s := join(hashHex, ts, roundDiff, totalShares)
+        s := join(hashHex, ts, roundDiff, totalShares, port, "")
         cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
         return false, cmd.Err()
     }
@@ -271,12 +724,64 @@ func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundD
 
 func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff int64, expire time.Duration) {
     tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
+    r.writeHashrate(tx, ms, ts, login, id, diff, expire)
+}
+
+func (r *RedisClient) writeHashrate(tx *redis.Multi, ms, ts int64, login, id string, diff int64, expire time.Duration) {
     tx.ZAdd(r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
     tx.ZAdd(r.formatKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms)})
     tx.Expire(r.formatKey("hashrate", login), expire) // Will delete hashrates for miners that gone
     tx.HSet(r.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
 }
 
+// Rolling window of last pplns shares, newest first
+func (r *RedisClient) writeWindowShare(tx *redis.Multi, login string, diff, pplns int64) {
+    if pplns <= 0 {
+        return
+    }
+    tx.LPush(r.formatKey("shares", "window"), join(login, diff))
+    tx.LTrim(r.formatKey("shares", "window"), 0, pplns-1)
+}
+
+// Snapshot of PPLNS window at the moment block was found, summed by login
+func (r *RedisClient) writePPLNSShares(nonce string, window []string) error {
+    shares := make(map[string]int64)
+    for _, v := range window {
+        fields := strings.Split(v, ":")
+        if len(fields) < 2 {
+            continue
+        }
+        diff, _ := strconv.ParseInt(fields[1], 10, 64)
+        shares[fields[0]] += diff
+    }
+    if len(shares) == 0 {
+        return nil
+    }
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    _, err := tx.Exec(func() error {
+        for login, diff := range shares {
+            tx.HSet(r.formatPPLNS(nonce), login, strconv.FormatInt(diff, 10))
+        }
+        return nil
+    })
+    return err
+}
+
+func (r *RedisClient) GetPPLNSShares(nonce string) (map[string]int64, error) {
+    result := make(map[string]int64)
+    sharesMap, err := r.client.HGetAllMap(r.formatPPLNS(nonce)).Result()
+    if err != nil {
+        return nil, err
+    }
+    for login, v := range sharesMap {
+        n, _ := strconv.ParseInt(v, 10, 64)
+        result[login] = n
+    }
+    return result, nil
+}
+
 func (r *RedisClient) formatKey(args ...interface{}) string {
     return join(r.prefix, join(args...))
 }
@@ -285,6 +790,11 @@ func (r *RedisClient) formatRound(height int64, nonce string) string {
     return r.formatKey("shares", "round"+strconv.FormatInt(height, 10), nonce)
 }
 
+// Keyed by nonce only so it survives candidate height correction without rename
+func (r *RedisClient) formatPPLNS(nonce string) string {
+    return r.formatKey("shares", "pplns", nonce)
+}
+
 func join(args ...interface{}) string {
     s := make([]string, len(args))
     for i, v := range args {
@@ -395,8 +905,7 @@ func (r *RedisClient) LockPayouts(login string, amount int64) error {
 }
 
 func (r *RedisClient) UnlockPayouts() error {
-    key := r.formatKey("payments", "lock")
-    _, err := r.client.Del(key).Result()
+    _, err := r.client.Del(r.formatKey("payments", "lock"), r.formatKey("payments", "lockTx")).Result()
     return err
 }
 
@@ -411,7 +920,44 @@ func (r *RedisClient) IsPayoutsLocked() (bool, error) {
     }
 }
 
-type PendingPayment struct {
+// Payout in progress, Sending is set once transaction is about to be sent
+// and Tx once node returned its hash
+type PayoutsLock struct {
+    Login     string
+    Amount    int64
+    Sending   bool
+    Tx        string
+}
+
+func (r *RedisClient) GetPayoutsLock() (*PayoutsLock, error) {
+    value, err := r.client.Get(r.formatKey("payments", "lock")).Result()
+    if err == redis.Nil {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    // "login:amount"
+    fields := strings.Split(value, ":")
+    lock := &PayoutsLock{Login: fields[0]}
+    if len(fields) > 1 {
+        lock.Amount, _ = strconv.ParseInt(fields[1], 10, 64)
+    }
+    lock.Tx, err = r.client.Get(r.formatKey("payments", "lockTx")).Result()
+    if err == redis.Nil {
+        return lock, nil
+    } else if err != nil {
+        return nil, err
+    }
+    lock.Sending = true
+    return lock, nil
+}
+
+// Empty hash marks transaction as being sent, so crash recovery won't roll it back
+func (r *RedisClient) SetPayoutsTx(txHash string) error {
+    return r.client.Set(r.formatKey("payments", "lockTx"), txHash, 0).Err()
+}
+
+type PendingPayment struct {
     Timestamp int64  `json:"timestamp"`
     Amount    int64  `json:"amount"`
     Address   string `json:"login"`
@@ -466,20 +1012,29 @@ func (r *RedisClient) RollbackBalance(login string, amount int64) error {
 }
 
 func (r *RedisClient) WritePayment(login, txHash string, amount int64) error {
+    return r.WriteBatchPayments(txHash, []*PendingPayment{{Address: login, Amount: amount}})
+}
+
+// Writes all payments of one tx and releases payouts lock atomically,
+// so lock is never released with part of the batch still pending
+func (r *RedisClient) WriteBatchPayments(txHash string, payments []*PendingPayment) error {
     tx := r.client.Multi()
     defer tx.Close()
 
     ts := util.MakeTimestamp() / 1000
 
     _, err := tx.Exec(func() error {
-        tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
-        tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
-        tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
-        tx.HIncrBy(r.formatKey("finances"), "paid", amount)
-        tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
-        tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
-        tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
-        tx.Del(r.formatKey("payments", "lock"))
+        for _, p := range payments {
+            login, amount := p.Address, p.Amount
+            tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
+            tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
+            tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
+            tx.HIncrBy(r.formatKey("finances"), "paid", amount)
+            tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
+            tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
+            tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+        }
+        tx.Del(r.formatKey("payments", "lock"), r.formatKey("payments", "lockTx"))
         return nil
     })
     return err
@@ -503,7 +1058,8 @@ func (r *RedisClient) WriteImmatureBlock(block *BlockData, roundRewards map[stri
     return err
 }
 
-func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64) error {
+// With disputable set credits are kept aside from balances until released by ReleaseDisputableCredits
+func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64, disputable bool) error {
     creditKey := r.formatKey("credits", "immature", block.RoundHeight, block.Hash)
     tx, err := r.client.Watch(creditKey)
     // Must decrement immatures using existing log entry
@@ -533,9 +1089,16 @@ func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[strin
         for login, amount := range roundRewards {
             total += amount
             // NOTICE: Maybe expire round reward entry in 604800 (a week)?
-            tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
+            if disputable {
+                tx.HIncrBy(r.formatKey("miners", login), "disputable", amount)
+            } else {
+                tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
+            }
             tx.HSetNX(r.formatKey("credits", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
         }
+        if disputable {
+            tx.ZAdd(r.formatKey("credits", "disputable"), redis.Z{Score: float64(ts), Member: join(block.Height, block.Hash)})
+        }
         tx.Del(creditKey)
         tx.HIncrBy(r.formatKey("finances"), "balance", total)
         tx.HIncrBy(r.formatKey("finances"), "immature", (totalImmature * -1))
@@ -558,6 +1121,7 @@ func (r *RedisClient) WriteOrphan(block *BlockData) error {
     defer tx.Close()
 
     _, err = tx.Exec(func() error {
+        // Drops round shares and PPLNS snapshot too
         r.writeMaturedBlock(tx, block)
 
         // Decrement immature balances
@@ -581,6 +1145,8 @@ func (r *RedisClient) WritePendingOrphans(blocks []*BlockData) error {
     _, err := tx.Exec(func() error {
         for _, block := range blocks {
             r.writeImmatureBlock(tx, block)
+            // Orphans are never credited, round shares are kept only as a fallback
+            tx.Del(r.formatPPLNS(block.Nonce))
         }
         return nil
     })
@@ -589,7 +1155,8 @@ func (r *RedisClient) WritePendingOrphans(blocks []*BlockData) error {
 
 func (r *RedisClient) writeImmatureBlock(tx *redis.Multi, block *BlockData) {
     // Redis 2.8.x returns "ERR source and destination objects are the same"
-    if block.Height != block.RoundHeight {
+    // Solo blocks have no round shares to rename
+    if block.Height != block.RoundHeight && !block.IsSolo() {
         tx.Rename(r.formatRound(block.RoundHeight, block.Nonce), r.formatRound(block.Height, block.Nonce))
     }
     tx.ZRem(r.formatKey("blocks", "candidates"), block.candidateKey)
@@ -598,22 +1165,525 @@ func (r *RedisClient) writeImmatureBlock(tx *redis.Multi, block *BlockData) {
 
 func (r *RedisClient) writeMaturedBlock(tx *redis.Multi, block *BlockData) {
     tx.Del(r.formatRound(block.RoundHeight, block.Nonce))
+    tx.Del(r.formatPPLNS(block.Nonce))
     tx.ZRem(r.formatKey("blocks", "immature"), block.immatureKey)
     tx.ZAdd(r.formatKey("blocks", "matured"), redis.Z{Score: float64(block.Height), Member: block.key()})
 }
 
+// Moves credits of a block still within dispute window from disputable to held
+func (r *RedisClient) HoldBlock(height int64, hash, reason string) (bool, error) {
+    block := join(height, hash)
+    ts := util.MakeTimestamp() / 1000
+    check := func(tx *redis.Multi) (bool, error) {
+        err := tx.ZScore(r.formatKey("credits", "disputable"), block).Err()
+        if err == redis.Nil {
+            return false, nil
+        } else if err != nil {
+            return false, err
+        }
+        held, err := tx.HExists(r.formatKey("holds"), block).Result()
+        return !held, err
+    }
+    return r.switchCredits(height, hash, "disputable", "held", check, func(tx *redis.Multi) {
+        tx.HSet(r.formatKey("holds"), block, join(ts, reason))
+    })
+}
+
+// Returns held credits back to disputable, they are released with the next unlocker run
+func (r *RedisClient) ReleaseHold(height int64, hash string) (bool, error) {
+    block := join(height, hash)
+    check := func(tx *redis.Multi) (bool, error) {
+        return tx.HExists(r.formatKey("holds"), block).Result()
+    }
+    return r.switchCredits(height, hash, "held", "disputable", check, func(tx *redis.Multi) {
+        tx.HDel(r.formatKey("holds"), block)
+    })
+}
+
+// Credits not held and matured before maxTs become payable
+func (r *RedisClient) ReleaseDisputableCredits(maxTs int64) (int, error) {
+    opt := redis.ZRangeByScore{Min: "-inf", Max: strconv.FormatInt(maxTs, 10)}
+    blocks, err := r.client.ZRangeByScore(r.formatKey("credits", "disputable"), opt).Result()
+    if err != nil {
+        return 0, err
+    }
+    released := 0
+    for _, block := range blocks {
+        height, hash := parseBlockKey(block)
+        check := func(tx *redis.Multi) (bool, error) {
+            err := tx.ZScore(r.formatKey("credits", "disputable"), block).Err()
+            if err == redis.Nil {
+                return false, nil
+            } else if err != nil {
+                return false, err
+            }
+            held, err := tx.HExists(r.formatKey("holds"), block).Result()
+            return !held, err
+        }
+        ok, err := r.switchCredits(height, hash, "disputable", "balance", check, func(tx *redis.Multi) {
+            tx.ZRem(r.formatKey("credits", "disputable"), block)
+        })
+        if err != nil {
+            return released, err
+        }
+        if ok {
+            released++
+        }
+    }
+    return released, nil
+}
+
+// Moves credits of block between miner fields together with change of its dispute state,
+// in one transaction watching that state. check returns false when block is not in state
+// the move starts from. Retried a few times when state changes meanwhile.
+func (r *RedisClient) switchCredits(height int64, hash, from, to string, check func(tx *redis.Multi) (bool, error), change func(tx *redis.Multi)) (bool, error) {
+    creditKey := r.formatKey("credits", height, hash)
+    for attempt := 0; attempt < 3; attempt++ {
+        tx, err := r.client.Watch(r.formatKey("holds"), r.formatKey("credits", "disputable"), creditKey)
+        if err != nil {
+            return false, err
+        }
+        ok, err := check(tx)
+        if err != nil || !ok {
+            tx.Close()
+            return false, err
+        }
+        credits, err := tx.HGetAllMap(creditKey).Result()
+        if err != nil {
+            tx.Close()
+            return false, err
+        }
+        _, err = tx.Exec(func() error {
+            change(tx)
+            for login, amountString := range credits {
+                amount, _ := strconv.ParseInt(amountString, 10, 64)
+                tx.HIncrBy(r.formatKey("miners", login), from, (amount * -1))
+                tx.HIncrBy(r.formatKey("miners", login), to, amount)
+            }
+            return nil
+        })
+        tx.Close()
+        if err == redis.TxFailedErr {
+            continue
+        }
+        return err == nil, err
+    }
+    return false, fmt.Errorf("Dispute state of block %v/%v keeps changing, try again", height, hash)
+}
+
+// Returns all held blocks, if login is set only blocks crediting that login
+func (r *RedisClient) GetHolds(login string) ([]map[string]interface{}, error) {
+    holds, err := r.client.HGetAllMap(r.formatKey("holds")).Result()
+    if err != nil {
+        return nil, err
+    }
+    result := make([]map[string]interface{}, 0, len(holds))
+    for block, value := range holds {
+        height, hash := parseBlockKey(block)
+        fields := strings.SplitN(value, ":", 2)
+        hold := map[string]interface{}{"height": height, "hash": hash}
+        hold["timestamp"], _ = strconv.ParseInt(fields[0], 10, 64)
+        if len(fields) > 1 {
+            hold["reason"] = fields[1]
+        }
+        creditKey := r.formatKey("credits", height, hash)
+        if len(login) > 0 {
+            amount, err := r.client.HGet(creditKey, login).Int64()
+            if err == redis.Nil {
+                continue
+            } else if err != nil {
+                return nil, err
+            }
+            hold["amount"] = amount
+        } else {
+            credits, err := r.client.HGetAllMap(creditKey).Result()
+            if err != nil {
+                return nil, err
+            }
+            hold["credits"] = convertStringMap(credits)
+        }
+        result = append(result, hold)
+    }
+    return result, nil
+}
+
+func parseBlockKey(key string) (int64, string) {
+    fields := strings.SplitN(key, ":", 2)
+    height, _ := strconv.ParseInt(fields[0], 10, 64)
+    if len(fields) < 2 {
+        return height, ""
+    }
+    return height, fields[1]
+}
+
+func (r *RedisClient) WriteShareDump(height int64, hash string, data []byte, expire time.Duration) error {
+    return r.client.Set(r.formatKey("sharedumps", height, hash), string(data), expire).Err()
+}
+
+func (r *RedisClient) GetShareDump(height int64, hash string) ([]byte, error) {
+    cmd := r.client.Get(r.formatKey("sharedumps", height, hash))
+    if cmd.Err() == redis.Nil {
+        return nil, nil
+    } else if cmd.Err() != nil {
+        return nil, cmd.Err()
+    }
+    return cmd.Bytes()
+}
+
 func (r *RedisClient) IsMinerExists(login string) (bool, error) {
     return r.client.Exists(r.formatKey("miners", login)).Result()
 }
 
-func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string]interface{}, error) {
+// Stores personal payout threshold, ts must be newer than of previously stored one
+func (r *RedisClient) SetMinerThreshold(login string, threshold, ts int64) (bool, error) {
+    key := r.formatKey("miners", login)
+    return r.writeIfNewer(key, "thresholdTs", ts, func(tx *redis.Multi) {
+        tx.HMSet(key, "threshold", strconv.FormatInt(threshold, 10), "thresholdTs", strconv.FormatInt(ts, 10))
+    })
+}
+
+// Runs change in one transaction watching key if ts is newer than tsField of key,
+// so of concurrent signed requests only the newest is applied. Retried a few times
+// when key changes meanwhile.
+func (r *RedisClient) writeIfNewer(key, tsField string, ts int64, change func(tx *redis.Multi)) (bool, error) {
+    for attempt := 0; attempt < 3; attempt++ {
+        tx, err := r.client.Watch(key)
+        if err != nil {
+            return false, err
+        }
+        last, err := tx.HGet(key, tsField).Int64()
+        if err != nil && err != redis.Nil {
+            tx.Close()
+            return false, err
+        }
+        if last >= ts {
+            tx.Close()
+            return false, nil
+        }
+        _, err = tx.Exec(func() error {
+            change(tx)
+            return nil
+        })
+        tx.Close()
+        if err == redis.TxFailedErr {
+            continue
+        }
+        return err == nil, err
+    }
+    return false, fmt.Errorf("Key %v keeps changing, try again", key)
+}
+
+// Returns 0 if miner did not set personal threshold
+func (r *RedisClient) GetMinerThreshold(login string) (int64, error) {
+    threshold, err := r.client.HGet(r.formatKey("miners", login), "threshold").Int64()
+    if err == redis.Nil {
+        return 0, nil
+    }
+    return threshold, err
+}
+
+// Share acceptance stopped by admin
+type Pause struct {
+    Since       int64   `json:"since"`
+    Reason      string  `json:"reason"`
+}
+
+type WorkerState struct {
+    State       string
+    LastShare   int64
+}
+
+// Stores notification targets by kind, ts must be newer than of previously stored ones.
+// Login without targets is unsubscribed, ts is kept so the request can't be replayed.
+func (r *RedisClient) SetNotifications(login string, targets map[string]string, ts int64) (bool, error) {
+    key := r.formatKey("notify", login)
+    return r.writeIfNewer(key, "ts", ts, func(tx *redis.Multi) {
+        tx.Del(key)
+        tx.HSet(key, "ts", strconv.FormatInt(ts, 10))
+        if len(targets) == 0 {
+            tx.SRem(r.formatKey("notify", "logins"), login)
+            tx.Del(r.formatKey("notify", "state", login))
+            return
+        }
+        for kind, target := range targets {
+            tx.HSet(key, kind, target)
+        }
+        tx.SAdd(r.formatKey("notify", "logins"), login)
+    })
+}
+
+func (r *RedisClient) GetNotifications(login string) (map[string]string, error) {
+    targets, err := r.client.HGetAllMap(r.formatKey("notify", login)).Result()
+    if err != nil {
+        return nil, err
+    }
+    delete(targets, "ts")
+    return targets, nil
+}
+
+func (r *RedisClient) GetNotifyLogins() ([]string, error) {
+    return r.client.SMembers(r.formatKey("notify", "logins")).Result()
+}
+
+// Last share timestamp in seconds by worker within hashrate stats
+func (r *RedisClient) GetWorkersLastShare(login string) (map[string]int64, error) {
+    result := make(map[string]int64)
+    shares, err := r.client.ZRangeWithScores(r.formatKey("hashrate", login), 0, -1).Result()
+    if err != nil {
+        return result, err
+    }
+    for _, v := range shares {
+        parts := strings.Split(v.Member.(string), ":")
+        if len(parts) < 2 {
+            continue
+        }
+        if ts := int64(v.Score); ts > result[parts[1]] {
+            result[parts[1]] = ts
+        }
+    }
+    return result, nil
+}
+
+func (r *RedisClient) GetWorkerStates(login string) (map[string]WorkerState, error) {
+    result := make(map[string]WorkerState)
+    v, err := r.client.HGetAllMap(r.formatKey("notify", "state", login)).Result()
+    if err != nil {
+        return result, err
+    }
+    for worker, value := range v {
+        parts := strings.Split(value, ":")
+        lastShare, _ := strconv.ParseInt(parts[1], 10, 64)
+        result[worker] = WorkerState{State: parts[0], LastShare: lastShare}
+    }
+    return result, nil
+}
+
+func (r *RedisClient) SetWorkerState(login, worker, state string, lastShare int64) error {
+    return r.client.HSet(r.formatKey("notify", "state", login), worker, join(state, lastShare)).Err()
+}
+
+func (r *RedisClient) SetPause(name, reason string, ts int64) error {
+    return r.client.HSet(r.formatKey("pause"), name, join(ts, reason)).Err()
+}
+
+func (r *RedisClient) ClearPause(name string) error {
+    return r.client.HDel(r.formatKey("pause"), name).Err()
+}
+
+// Pauses by stratum name, "*" pauses all ports
+func (r *RedisClient) GetPauses() (map[string]*Pause, error) {
+    result := make(map[string]*Pause)
+    v, err := r.client.HGetAllMap(r.formatKey("pause")).Result()
+    if err != nil {
+        return result, err
+    }
+    for name, value := range v {
+        parts := strings.SplitN(value, ":", 2)
+        since, _ := strconv.ParseInt(parts[0], 10, 64)
+        result[name] = &Pause{Since: since}
+        if len(parts) > 1 {
+            result[name].Reason = parts[1]
+        }
+    }
+    return result, nil
+}
+
+// Returns false if closure of login is already in progress or ts of signed request
+// is not newer than of the previous closure, so the request can't be replayed
+func (r *RedisClient) RequestClosure(login string, ts int64) (bool, error) {
+    key := r.formatKey("closures")
+    for attempt := 0; attempt < 3; attempt++ {
+        tx, err := r.client.Watch(key)
+        if err != nil {
+            return false, err
+        }
+        v, err := tx.HGet(key, login).Result()
+        if err != nil && err != redis.Nil {
+            tx.Close()
+            return false, err
+        }
+        if err == nil {
+            c := parseClosure(login, v)
+            if c.State != "deleted" || c.RequestedAt >= ts {
+                tx.Close()
+                return false, nil
+            }
+        }
+        _, err = tx.Exec(func() error {
+            tx.HSet(key, login, join("pending", ts, 0, 0))
+            return nil
+        })
+        tx.Close()
+        if err == redis.TxFailedErr {
+            continue
+        }
+        return err == nil, err
+    }
+    return false, fmt.Errorf("Closures keep changing, try again")
+}
+
+// Returns nil if login never requested closure
+func (r *RedisClient) GetClosure(login string) (*Closure, error) {
+    v, err := r.client.HGet(r.formatKey("closures"), login).Result()
+    if err == redis.Nil {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    return parseClosure(login, v), nil
+}
+
+func (r *RedisClient) GetClosures(state string) ([]*Closure, error) {
+    result := []*Closure{}
+    v, err := r.client.HGetAllMap(r.formatKey("closures")).Result()
+    if err != nil {
+        return result, err
+    }
+    for login, value := range v {
+        c := parseClosure(login, value)
+        if c.State == state {
+            result = append(result, c)
+        }
+    }
+    return result, nil
+}
+
+func parseClosure(login, value string) *Closure {
+    fields := strings.Split(value, ":")
+    c := &Closure{Login: login, State: fields[0]}
+    c.RequestedAt, _ = strconv.ParseInt(fields[1], 10, 64)
+    c.PaidAt, _ = strconv.ParseInt(fields[2], 10, 64)
+    c.DeletedAt, _ = strconv.ParseInt(fields[3], 10, 64)
+    if len(fields) > 4 {
+        c.Dust, _ = strconv.ParseInt(fields[4], 10, 64)
+    }
+    return c
+}
+
+// Returns payable balance and sum of credits not payable yet
+// Fields of miner hash kept by ledger
+var balanceFields = []string{"balance", "immature", "disputable", "held", "pending", "paid"}
+
+func (r *RedisClient) GetClosingBalance(login string) (int64, int64, error) {
+    v, err := r.client.HMGet(r.formatKey("miners", login), balanceFields...).Result()
+    if err != nil {
+        return 0, 0, err
+    }
+    var values [6]int64
+    for i, s := range v {
+        if s != nil {
+            values[i], _ = strconv.ParseInt(s.(string), 10, 64)
+        }
+    }
+    return values[0], values[1] + values[2] + values[3] + values[4], nil
+}
+
+func (r *RedisClient) MarkClosurePaid(c *Closure, dust, ts int64) error {
+    return r.client.HSet(r.formatKey("closures"), c.Login, join("paid", c.RequestedAt, ts, 0, dust)).Err()
+}
+
+// Puts paid closure back to pending, so payouts settle credits of login again
+func (r *RedisClient) ReopenClosure(c *Closure) error {
+    return r.client.HSet(r.formatKey("closures"), c.Login, join("pending", c.RequestedAt, 0, 0)).Err()
+}
+
+var ErrClosureUnsettled = errors.New("Account has unsettled shares or credits")
+
+// Returns true if login has shares in current round or in a round of block candidate
+func (r *RedisClient) HasRoundShares(login string) (bool, error) {
+    return r.hasRoundShares(r.client, login)
+}
+
+type hashReader interface {
+    HExists(key, field string) *redis.BoolCmd
+    ZRangeWithScores(key string, start, stop int64) *redis.ZSliceCmd
+}
+
+func (r *RedisClient) hasRoundShares(c hashReader, login string) (bool, error) {
+    ok, err := c.HExists(r.formatKey("shares", "roundCurrent"), login).Result()
+    if err != nil || ok {
+        return ok, err
+    }
+    cmd := c.ZRangeWithScores(r.formatKey("blocks", "candidates"), 0, -1)
+    if cmd.Err() != nil {
+        return false, cmd.Err()
+    }
+    for _, block := range convertCandidateResults(cmd) {
+        ok, err := c.HExists(r.formatRound(block.Height, block.Nonce), login).Result()
+        if err != nil || ok {
+            return ok, err
+        }
+    }
+    return false, nil
+}
+
+// Drops stats, workers, history, proofs and notification targets of login, payment records
+// and block credits are kept for bookkeeping.
+// Returns ErrClosureUnsettled if login got shares or credits since final payout,
+// new rounds and credits are watched until data is gone.
+func (r *RedisClient) DeleteMinerData(c *Closure, ts int64) error {
+    minerKey := r.formatKey("miners", c.Login)
+    tx, err := r.client.Watch(minerKey, r.formatKey("shares", "roundCurrent"), r.formatKey("blocks", "candidates"))
+    if err != nil {
+        return err
+    }
+    defer tx.Close()
+
+    unsettled, err := r.hasRoundShares(tx, c.Login)
+    if err != nil {
+        return err
+    }
+    // Balances are only found here with ledger kept in Redis
+    v, err := tx.HMGet(minerKey, balanceFields...).Result()
+    if err != nil {
+        return err
+    }
+    var values [6]int64
+    for i, s := range v {
+        if s != nil {
+            values[i], _ = strconv.ParseInt(s.(string), 10, 64)
+        }
+    }
+    if unsettled || values[0] > c.Dust || values[1]+values[2]+values[3]+values[4] > 0 {
+        return ErrClosureUnsettled
+    }
+
+    _, err = tx.Exec(func() error {
+        tx.Del(minerKey)
+        tx.Del(r.formatKey("hashrate", c.Login))
+        tx.Del(r.formatKey("rigs", c.Login))
+        tx.Del(r.historyKey(c.Login))
+        tx.Del(join(r.historyKey(c.Login), "1h"))
+        tx.SRem(r.formatKey("history", "logins"), c.Login)
+        tx.Del(r.formatKey("notify", c.Login))
+        tx.Del(r.formatKey("notify", "state", c.Login))
+        tx.SRem(r.formatKey("notify", "logins"), c.Login)
+        tx.Del(r.formatKey("proofs", c.Login))
+        tx.HSet(r.formatKey("closures"), c.Login, join("deleted", c.RequestedAt, c.PaidAt, ts))
+        return nil
+    })
+    return err
+}
+
+func (r *RedisClient) GetMinerStats(login string) (map[string]interface{}, error) {
+    stats := make(map[string]interface{})
+    result, err := r.client.HGetAllMap(r.formatKey("miners", login)).Result()
+    if err != nil && err != redis.Nil {
+        return nil, err
+    }
+    stats["stats"] = convertStringMap(result)
+    return stats, nil
+}
+
+// Balances, payments, current round shares and holds of login
+func (r *RedisClient) GetMinerLedgerStats(login string, maxPayments int64) (map[string]interface{}, error) {
     stats := make(map[string]interface{})
 
     tx := r.client.Multi()
     defer tx.Close()
 
     cmds, err := tx.Exec(func() error {
-        tx.HGetAllMap(r.formatKey("miners", login))
+        tx.HMGet(r.formatKey("miners", login), balanceFields...)
         tx.ZRevRangeWithScores(r.formatKey("payments", login), 0, maxPayments-1)
         tx.ZCard(r.formatKey("payments", login))
         tx.HGet(r.formatKey("shares", "roundCurrent"), login)
@@ -623,8 +1693,13 @@ func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string
     if err != nil && err != redis.Nil {
         return nil, err
     } else {
-        result, _ := cmds[0].(*redis.StringStringMapCmd).Result()
-        stats["stats"] = convertStringMap(result)
+        balances := make(map[string]int64)
+        for i, v := range cmds[0].(*redis.SliceCmd).Val() {
+            if v != nil {
+                balances[balanceFields[i]], _ = strconv.ParseInt(v.(string), 10, 64)
+            }
+        }
+        stats["balances"] = balances
         payments := convertPaymentsResults(cmds[1].(*redis.ZSliceCmd))
         stats["payments"] = payments
         stats["paymentsTotal"] = cmds[2].(*redis.IntCmd).Val()
@@ -632,6 +1707,12 @@ func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string
         stats["roundShares"] = roundShares
     }
 
+    holds, err := r.GetHolds(login)
+    if err != nil {
+        return nil, err
+    }
+    stats["holds"] = holds
+
     return stats, nil
 }
 
@@ -648,6 +1729,45 @@ func convertStringMap(m map[string]string) map[string]interface{} {
     return result
 }
 
+// Returns number of shares and their summed difficulty submitted by login within [from, to]
+func (r *RedisClient) GetMinerShares(login string, from, to int64) (int64, int64, error) {
+    option := redis.ZRangeByScore{Min: strconv.FormatInt(from, 10), Max: strconv.FormatInt(to, 10)}
+    cmd := r.client.ZRangeByScoreWithScores(r.formatKey("hashrate", login), option)
+    if cmd.Err() != nil {
+        return 0, 0, cmd.Err()
+    }
+    var shares, total int64
+    for _, v := range cmd.Val() {
+        // "diff:id:ms"
+        parts := strings.Split(v.Member.(string), ":")
+        diff, _ := strconv.ParseInt(parts[0], 10, 64)
+        total += diff
+        shares++
+    }
+    return shares, total, nil
+}
+
+func (r *RedisClient) WriteHashrateProof(login string, ts int64, proof string, keep int64, expire time.Duration) error {
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    _, err := tx.Exec(func() error {
+        tx.ZAdd(r.formatKey("proofs", login), redis.Z{Score: float64(ts), Member: proof})
+        tx.ZRemRangeByRank(r.formatKey("proofs", login), 0, -(keep + 1))
+        tx.Expire(r.formatKey("proofs", login), expire)
+        return nil
+    })
+    return err
+}
+
+func (r *RedisClient) GetHashrateProofs(login string, max int64) ([]string, error) {
+    cmd := r.client.ZRevRange(r.formatKey("proofs", login), 0, max-1)
+    if cmd.Err() != nil {
+        return nil, cmd.Err()
+    }
+    return cmd.Val(), nil
+}
+
 // WARNING: Must run it periodically to flush out of window hashrate entries
 func (r *RedisClient) FlushStaleStats(window, largeWindow time.Duration) (int64, error) {
     now := util.MakeTimestamp() / 1000
@@ -686,7 +1806,7 @@ func (r *RedisClient) FlushStaleStats(window, largeWindow time.Duration) (int64,
     return total, nil
 }
 
-func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error) {
+func (r *RedisClient) CollectStats(smallWindow time.Duration) (map[string]interface{}, error) {
     window := int64(smallWindow / time.Second)
     stats := make(map[string]interface{})
 
@@ -696,9 +1816,33 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
     now := util.MakeTimestamp() / 1000
 
     cmds, err := tx.Exec(func() error {
-        tx.ZRemRangeByScore(r.formatKey("hashrate"), "-inf", fmt.Sprint("(", now-window))
-        tx.ZRangeWithScores(r.formatKey("hashrate"), 0, -1)
+        tx.ZRangeByScoreWithScores(r.formatKey("hashrate"), redis.ZRangeByScore{Min: strconv.FormatInt(now-window, 10), Max: "+inf"})
         tx.HGetAllMap(r.formatKey("stats"))
+        return nil
+    })
+
+    if err != nil {
+        return nil, err
+    }
+
+    result, _ := cmds[1].(*redis.StringStringMapCmd).Result()
+    stats["stats"] = convertStringMap(result)
+
+    totalHashrate, miners := convertMinersStats(window, cmds[0].(*redis.ZSliceCmd))
+    stats["miners"] = miners
+    stats["minersTotal"] = len(miners)
+    stats["hashrate"] = totalHashrate
+    return stats, nil
+}
+
+// Blocks and payments of the pool
+func (r *RedisClient) GetLedgerStats(maxBlocks, maxPayments int64) (map[string]interface{}, error) {
+    stats := make(map[string]interface{})
+
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    cmds, err := tx.Exec(func() error {
         tx.ZRevRangeWithScores(r.formatKey("blocks", "candidates"), 0, -1)
         tx.ZRevRangeWithScores(r.formatKey("blocks", "immature"), 0, -1)
         tx.ZRevRangeWithScores(r.formatKey("blocks", "matured"), 0, maxBlocks-1)
@@ -714,31 +1858,150 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
         return nil, err
     }
 
-    result, _ := cmds[2].(*redis.StringStringMapCmd).Result()
-    stats["stats"] = convertStringMap(result)
-    candidates := convertCandidateResults(cmds[3].(*redis.ZSliceCmd))
+    candidates := convertCandidateResults(cmds[0].(*redis.ZSliceCmd))
     stats["candidates"] = candidates
-    stats["candidatesTotal"] = cmds[6].(*redis.IntCmd).Val()
+    stats["candidatesTotal"] = cmds[3].(*redis.IntCmd).Val()
 
-    immature := convertBlockResults(cmds[4].(*redis.ZSliceCmd))
+    immature := convertBlockResults(cmds[1].(*redis.ZSliceCmd))
     stats["immature"] = immature
-    stats["immatureTotal"] = cmds[7].(*redis.IntCmd).Val()
+    stats["immatureTotal"] = cmds[4].(*redis.IntCmd).Val()
 
-    matured := convertBlockResults(cmds[5].(*redis.ZSliceCmd))
+    matured := convertBlockResults(cmds[2].(*redis.ZSliceCmd))
     stats["matured"] = matured
-    stats["maturedTotal"] = cmds[8].(*redis.IntCmd).Val()
+    stats["maturedTotal"] = cmds[5].(*redis.IntCmd).Val()
 
-    payments := convertPaymentsResults(cmds[10].(*redis.ZSliceCmd))
+    payments := convertPaymentsResults(cmds[7].(*redis.ZSliceCmd))
     stats["payments"] = payments
-    stats["paymentsTotal"] = cmds[9].(*redis.IntCmd).Val()
-
-    totalHashrate, miners := convertMinersStats(window, cmds[1].(*redis.ZSliceCmd))
-    stats["miners"] = miners
-    stats["minersTotal"] = len(miners)
-    stats["hashrate"] = totalHashrate
+    stats["paymentsTotal"] = cmds[6].(*redis.IntCmd).Val()
     return stats, nil
 }
 
+// Empty login is the pool-wide series
+func (r *RedisClient) historyKey(login string) string {
+    if len(login) == 0 {
+        return r.formatKey("history", "pool")
+    }
+    return r.formatKey("history", "miners", login)
+}
+
+// Writes pool and per-login hashrate sampled at ts in seconds
+func (r *RedisClient) WriteHashrateSamples(ts, total int64, miners map[string]Miner) error {
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    _, err := tx.Exec(func() error {
+        tx.ZAdd(r.historyKey(""), redis.Z{Score: float64(ts), Member: join(ts, total)})
+        for login, miner := range miners {
+            tx.ZAdd(r.historyKey(login), redis.Z{Score: float64(ts), Member: join(ts, miner.HR)})
+            tx.SAdd(r.formatKey("history", "logins"), login)
+        }
+        return nil
+    })
+    return err
+}
+
+// Returns hourly rollups followed by raw samples since from in seconds
+func (r *RedisClient) GetHashrateSamples(login string, from int64) ([]HashrateSample, error) {
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    opt := redis.ZRangeByScore{Min: strconv.FormatInt(from, 10), Max: "+inf"}
+    cmds, err := tx.Exec(func() error {
+        tx.ZRangeByScore(join(r.historyKey(login), "1h"), opt)
+        tx.ZRangeByScore(r.historyKey(login), opt)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    samples := []HashrateSample{}
+    for _, cmd := range cmds {
+        for _, v := range cmd.(*redis.StringSliceCmd).Val() {
+            parts := strings.Split(v, ":")
+            ts, _ := strconv.ParseInt(parts[0], 10, 64)
+            hr, _ := strconv.ParseInt(parts[1], 10, 64)
+            samples = append(samples, HashrateSample{Timestamp: ts, Hashrate: hr})
+        }
+    }
+    return samples, nil
+}
+
+// Averages raw samples older than retention into hourly rollups, drops rollups older than rollupRetention
+func (r *RedisClient) CompactHashrateHistory(retention, rollupRetention time.Duration) (int64, error) {
+    now := util.MakeTimestamp() / 1000
+    // Only whole hours are compacted so a rollup is never written twice
+    cutoff := (now - int64(retention/time.Second)) / 3600 * 3600
+    rollupCutoff := now - int64(rollupRetention/time.Second)
+
+    logins, err := r.client.SMembers(r.formatKey("history", "logins")).Result()
+    if err != nil {
+        return 0, err
+    }
+    total := int64(0)
+    for _, login := range append([]string{""}, logins...) {
+        n, err := r.compactHistory(login, cutoff, rollupCutoff)
+        if err != nil {
+            return total, err
+        }
+        total += n
+    }
+    return total, nil
+}
+
+func (r *RedisClient) compactHistory(login string, cutoff, rollupCutoff int64) (int64, error) {
+    key := r.historyKey(login)
+    raw, err := r.client.ZRangeByScore(key, redis.ZRangeByScore{Min: "-inf", Max: fmt.Sprint("(", cutoff)}).Result()
+    if err != nil {
+        return 0, err
+    }
+    sums := make(map[int64]int64)
+    counts := make(map[int64]int64)
+    for _, v := range raw {
+        parts := strings.Split(v, ":")
+        ts, _ := strconv.ParseInt(parts[0], 10, 64)
+        hr, _ := strconv.ParseInt(parts[1], 10, 64)
+        hour := ts / 3600 * 3600
+        sums[hour] += hr
+        counts[hour]++
+    }
+
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    cmds, err := tx.Exec(func() error {
+        for hour, sum := range sums {
+            tx.ZAdd(join(key, "1h"), redis.Z{Score: float64(hour), Member: join(hour, sum/counts[hour])})
+        }
+        tx.ZRemRangeByScore(key, "-inf", fmt.Sprint("(", cutoff))
+        tx.ZRemRangeByScore(join(key, "1h"), "-inf", fmt.Sprint("(", rollupCutoff))
+        tx.ZCard(key)
+        tx.ZCard(join(key, "1h"))
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+    // Forget logins with nothing left to chart
+    n := len(cmds)
+    if len(login) > 0 && cmds[n-2].(*redis.IntCmd).Val() == 0 && cmds[n-1].(*redis.IntCmd).Val() == 0 {
+        r.client.SRem(r.formatKey("history", "logins"), login)
+    }
+    return int64(len(raw)), nil
+}
+
+// Values are validated by proxy and never contain colons
+func (r *RedisClient) WriteWorkerRig(login, id string, watts int64, algo, driver string, expire time.Duration) error {
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    _, err := tx.Exec(func() error {
+        tx.HSet(r.formatKey("rigs", login), id, join(watts, algo, driver))
+        tx.Expire(r.formatKey("rigs", login), expire)
+        return nil
+    })
+    return err
+}
+
 func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login string) (map[string]interface{}, error) {
     smallWindow := int64(sWindow / time.Second)
     largeWindow := int64(lWindow / time.Second)
@@ -750,20 +2013,21 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
     now := util.MakeTimestamp() / 1000
 
     cmds, err := tx.Exec(func() error {
-        tx.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", fmt.Sprint("(", now-largeWindow))
-        tx.ZRangeWithScores(r.formatKey("hashrate", login), 0, -1)
+        tx.ZRangeByScoreWithScores(r.formatKey("hashrate", login), redis.ZRangeByScore{Min: strconv.FormatInt(now-largeWindow, 10), Max: "+inf"})
+        tx.HGetAllMap(r.formatKey("rigs", login))
         return nil
     })
 
     if err != nil {
         return nil, err
     }
+    rigs, _ := cmds[1].(*redis.StringStringMapCmd).Result()
 
     totalHashrate := int64(0)
     currentHashrate := int64(0)
     online := int64(0)
     offline := int64(0)
-    workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd))
+    workers := convertWorkersStats(smallWindow, cmds[0].(*redis.ZSliceCmd))
 
     for id, worker := range workers {
         timeOnline := now - worker.startedAt
@@ -790,6 +2054,18 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
             online++
         }
 
+        if rig, ok := rigs[id]; ok {
+            fields := strings.Split(rig, ":")
+            if len(fields) == 3 {
+                worker.Watts, _ = strconv.ParseInt(fields[0], 10, 64)
+                worker.Algo = fields[1]
+                worker.Driver = fields[2]
+            }
+            if worker.Watts > 0 {
+                worker.Efficiency = float64(worker.HR) / float64(worker.Watts)
+            }
+        }
+
         currentHashrate += worker.HR
         totalHashrate += worker.TotalHR
         workers[id] = worker
@@ -804,8 +2080,6 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 }
 
 func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, error) {
-    stats := make(map[string]interface{})
-
     tx := r.client.Multi()
     defer tx.Close()
 
@@ -817,9 +2091,15 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
         return nil
     })
     if err != nil {
-        return stats, err
+        return nil, err
     }
     blocks := convertBlockResults(cmds[0].(*redis.ZSliceCmd), cmds[1].(*redis.ZSliceCmd))
+    return luckStats(blocks, windows), nil
+}
+
+// Blocks are newest first, one row per window until blocks run out
+func luckStats(blocks []*BlockData, windows []int) map[string]interface{} {
+    stats := make(map[string]interface{})
 
     calcLuck := func(max int) (int, float64, float64, float64) {
         var total int
@@ -854,13 +2134,13 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
             break
         }
     }
-    return stats, nil
+    return stats
 }
 
 func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
     var result []*BlockData
     for _, v := range raw.Val() {
-        // "nonce:powHash:mixDigest:timestamp:diff:totalShares"
+        // "nonce:powHash:mixDigest:timestamp:diff:totalShares:port:finder"
         block := BlockData{}
         block.Height = int64(v.Score)
         block.RoundHeight = block.Height
@@ -871,6 +2151,10 @@ func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
         block.Timestamp, _ = strconv.ParseInt(fields[3], 10, 64)
         block.Difficulty, _ = strconv.ParseInt(fields[4], 10, 64)
         block.TotalShares, _ = strconv.ParseInt(fields[5], 10, 64)
+        if len(fields) > 7 {
+            block.Port = fields[6]
+            block.Finder = fields[7]
+        }
         block.candidateKey = v.Member.(string)
         result = append(result, &block)
     }
@@ -881,7 +2165,7 @@ func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
     var result []*BlockData
     for _, row := range rows {
         for _, v := range row.Val() {
-            // "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:rewardInWei"
+            // "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:rewardInWei:port:finder"
             block := BlockData{}
             block.Height = int64(v.Score)
             block.RoundHeight = block.Height
@@ -896,6 +2180,10 @@ func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
             block.TotalShares, _ = strconv.ParseInt(fields[6], 10, 64)
             block.RewardString = fields[7]
             block.ImmatureReward = fields[7]
+            if len(fields) > 9 {
+                block.Port = fields[8]
+                block.Finder = fields[9]
+            }
             block.immatureKey = v.Member.(string)
             result = append(result, &block)
         }
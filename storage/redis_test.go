@@ -0,0 +1,86 @@
+package storage
+
+import (
+    "os"
+    "strconv"
+    "testing"
+
+    "gopkg.in/redis.v3"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+// Uses database 10 of REDIS_TEST_ENDPOINT, 127.0.0.1:6379 by default, which is flushed
+func testRedis(t *testing.T) *RedisClient {
+    endpoint := os.Getenv("REDIS_TEST_ENDPOINT")
+    if len(endpoint) == 0 {
+        endpoint = "127.0.0.1:6379"
+    }
+    r := NewRedisClient(&Config{Endpoint: endpoint, Database: 10}, "test")
+    if _, err := r.Check(); err != nil {
+        t.Skipf("Redis at %v is not available: %v", endpoint, err)
+    }
+    if err := r.client.FlushDb().Err(); err != nil {
+        t.Fatal(err)
+    }
+    return r
+}
+
+func TestSwitchCredits(t *testing.T) {
+    r := testRedis(t)
+    const (
+        height = int64(100)
+        hash   = "0x1234"
+        login  = "MTi43eWRhDPgH1Khv4Vrm5pkrWxhw6sE8X"
+    )
+    ts := util.MakeTimestamp() / 1000
+    r.client.HSet(r.formatKey("credits", height, hash), login, "500")
+    r.client.ZAdd(r.formatKey("credits", "disputable"), redis.Z{Score: float64(ts), Member: join(height, hash)})
+    r.client.HIncrBy(r.formatKey("miners", login), "disputable", 500)
+
+    hold := func() (bool, error) { return r.HoldBlock(height, hash, "dispute") }
+    release := func() (bool, error) { return r.ReleaseHold(height, hash) }
+    mature := func() (bool, error) {
+        n, err := r.ReleaseDisputableCredits(ts + 1)
+        return n == 1, err
+    }
+    steps := []struct {
+        name       string
+        op         func() (bool, error)
+        ok         bool
+        disputable int64
+        held       int64
+        balance    int64
+    }{
+        {"hold", hold, true, 0, 500, 0},
+        {"hold again", hold, false, 0, 500, 0},
+        {"release held", mature, false, 0, 500, 0},
+        {"unhold", release, true, 500, 0, 0},
+        {"unhold again", release, false, 500, 0, 0},
+        {"release", mature, true, 0, 0, 500},
+        {"release again", mature, false, 0, 0, 500},
+        {"hold released", hold, false, 0, 0, 500},
+    }
+    for _, s := range steps {
+        ok, err := s.op()
+        if err != nil {
+            t.Fatalf("%v: %v", s.name, err)
+        }
+        if ok != s.ok {
+            t.Errorf("%v: switched %v, want %v", s.name, ok, s.ok)
+        }
+        miner, err := r.client.HGetAllMap(r.formatKey("miners", login)).Result()
+        if err != nil {
+            t.Fatal(err)
+        }
+        for field, want := range map[string]int64{"disputable": s.disputable, "held": s.held, "balance": s.balance} {
+            if got, _ := strconv.ParseInt(miner[field], 10, 64); got != want {
+                t.Errorf("%v: %v %v, want %v", s.name, field, got, want)
+            }
+        }
+        held, _ := r.client.HExists(r.formatKey("holds"), join(height, hash)).Result()
+        if held != (s.held > 0) {
+            t.Errorf("%v: block held %v", s.name, held)
+        }
+    }
+}
@@ -0,0 +1,223 @@
+package storage
+
+import (
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/logging"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+var log = logging.New("storage")
+
+type WriteBehindConfig struct {
+    Enabled        bool     `json:"enabled"`
+    // Buffered shares reach backend at most this long after they were submitted
+    FlushInterval  string   `json:"flushInterval"`
+    // Flush early once this many shares are buffered
+    MaxShares      int      `json:"maxShares"`
+}
+
+// Shares of one worker since last flush, written as a single hashrate sample
+type workerShares struct {
+    login          string
+    id             string
+    diff           int64
+    ms             int64
+    expire         time.Duration
+}
+
+type shareBatch struct {
+    workers        map[string]*workerShares
+    // Round shares per login
+    round          map[string]int64
+    roundShares    int64
+    // PPLNS window entries, oldest first
+    window         []string
+    pplns          int64
+    height         uint64
+    count          int
+}
+
+func newShareBatch() *shareBatch {
+    return &shareBatch{workers: make(map[string]*workerShares), round: make(map[string]int64)}
+}
+
+// Puts b in front of newer shares in n
+func (b *shareBatch) merge(n *shareBatch) {
+    for key, w := range n.workers {
+        if prev, ok := b.workers[key]; ok {
+            prev.diff += w.diff
+            prev.ms = w.ms
+            prev.expire = w.expire
+        } else {
+            b.workers[key] = w
+        }
+    }
+    for login, diff := range n.round {
+        b.round[login] += diff
+    }
+    b.roundShares += n.roundShares
+    b.window = append(b.window, n.window...)
+    if n.pplns > 0 {
+        b.pplns = n.pplns
+    }
+    if n.height > b.height {
+        b.height = n.height
+    }
+    b.count += n.count
+}
+
+// Write-behind buffer of share increments, so a share costs one round trip for duplicate check
+// and the rest is written in one transaction per flushInterval
+type shareBuffer struct {
+    sync.Mutex
+    batch          *shareBatch
+    maxShares      int
+    kick           chan struct{}
+    // Flushes are serialized so batches land in submission order
+    flushMu        sync.Mutex
+}
+
+func (r *RedisClient) startShareBuffer(cfg *WriteBehindConfig) {
+    intv := time.Second
+    if len(cfg.FlushInterval) > 0 {
+        intv = util.MustParseDuration(cfg.FlushInterval)
+    }
+    maxShares := cfg.MaxShares
+    if maxShares <= 0 {
+        maxShares = 10000
+    }
+    r.buffer = &shareBuffer{batch: newShareBatch(), maxShares: maxShares, kick: make(chan struct{}, 1)}
+    log.Infof("Buffering share writes, flush every %v or %v shares", intv, maxShares)
+
+    go func() {
+        ticker := time.NewTicker(intv)
+        for {
+            select {
+            case <-ticker.C:
+            case <-r.buffer.kick:
+            }
+            if err := r.FlushShares(); err != nil {
+                log.Errorf("Failed to flush buffered shares to backend: %v", err)
+            }
+        }
+    }()
+}
+
+// round adds share to login's round shares and stats, stats alone when ledger keeps rounds elsewhere
+func (b *shareBuffer) add(login, id string, diff int64, expire time.Duration, round, stats bool, pplns int64, height uint64) {
+    b.Lock()
+    defer b.Unlock()
+
+    batch := b.batch
+    key := join(login, id)
+    w, ok := batch.workers[key]
+    if !ok {
+        w = &workerShares{login: login, id: id}
+        batch.workers[key] = w
+    }
+    w.diff += diff
+    w.ms = util.MakeTimestamp()
+    w.expire = expire
+    if round {
+        batch.round[login] += diff
+    }
+    if stats {
+        batch.roundShares += diff
+    }
+    if pplns > 0 {
+        batch.window = append(batch.window, join(login, diff))
+        batch.pplns = pplns
+    }
+    if height > batch.height {
+        batch.height = height
+    }
+    batch.count++
+    if batch.count >= b.maxShares {
+        select {
+        case b.kick <- struct{}{}:
+        default:
+        }
+    }
+}
+
+func (b *shareBuffer) setHeight(height uint64) {
+    b.Lock()
+    if height > b.batch.height {
+        b.batch.height = height
+    }
+    b.Unlock()
+}
+
+func (b *shareBuffer) take() *shareBatch {
+    b.Lock()
+    defer b.Unlock()
+    batch := b.batch
+    b.batch = newShareBatch()
+    return batch
+}
+
+// Failed batch is kept for next flush
+func (b *shareBuffer) restore(batch *shareBatch) {
+    b.Lock()
+    defer b.Unlock()
+    batch.merge(b.batch)
+    b.batch = batch
+}
+
+// Writes buffered shares to backend, called on interval, before blocks and on shutdown
+func (r *RedisClient) FlushShares() error {
+    if r.buffer == nil {
+        return nil
+    }
+    r.buffer.flushMu.Lock()
+    defer r.buffer.flushMu.Unlock()
+
+    batch := r.buffer.take()
+    if batch.count == 0 {
+        if batch.height > 0 {
+            r.sweepPoW(batch.height)
+        }
+        return nil
+    }
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    _, err := tx.Exec(func() error {
+        for _, w := range batch.workers {
+            r.writeHashrate(tx, w.ms, w.ms/1000, w.login, w.id, w.diff, w.expire)
+        }
+        for login, diff := range batch.round {
+            tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
+        }
+        if batch.roundShares > 0 {
+            tx.HIncrBy(r.formatKey("stats"), "roundShares", batch.roundShares)
+        }
+        for _, s := range batch.window {
+            tx.LPush(r.formatKey("shares", "window"), s)
+        }
+        if len(batch.window) > 0 {
+            tx.LTrim(r.formatKey("shares", "window"), 0, batch.pplns-1)
+        }
+        return nil
+    })
+    if err != nil {
+        r.buffer.restore(batch)
+        return err
+    }
+    r.sweepPoW(batch.height)
+    return nil
+}
+
+func (r *RedisClient) flushBeforeBlock() {
+    if err := r.FlushShares(); err != nil {
+        log.Errorf("Failed to flush buffered shares before block, they go to next round: %v", err)
+    }
+}
+
+func (r *RedisClient) sweepPoW(height uint64) {
+    // Sweep PoW backlog for previous blocks, we have 3 templates back in RAM
+    r.client.ZRemRangeByScore(r.formatKey("pow"), "-inf", "("+strconv.FormatUint(height-8, 10))
+}
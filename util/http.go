@@ -0,0 +1,20 @@
+package util
+
+import (
+    "crypto/subtle"
+    "net/http"
+)
+
+// Passes requests carrying "Authorization: Bearer <token>", all requests when token is empty.
+// Responses are never cached.
+func BearerAuth(token string, next http.Handler) http.Handler {
+    expected := []byte("Bearer " + token)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if len(token) > 0 && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+            w.WriteHeader(http.StatusUnauthorized)
+            return
+        }
+        w.Header().Set("Cache-Control", "no-cache")
+        next.ServeHTTP(w, r)
+    })
+}